@@ -0,0 +1,545 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"DevMaan707/streamer/auth"
+	"DevMaan707/streamer/db"
+	"DevMaan707/streamer/services"
+	"DevMaan707/streamer/utils"
+)
+
+// SessionCookie is the name of the cookie holding the session token.
+const SessionCookie = "starflix_session"
+
+// RequireAuth only lets requests through that carry a valid API token as a
+// bearer token or a valid session cookie, and stores the token or session
+// and its user in the request context. Requests authenticated already, by
+// the server's rate limiter, are let through as they are.
+func RequireAuth(svc *services.AuthService) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if services.CurrentSession(r.Context()) != nil || services.CurrentAPIToken(r.Context()) != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			authed, err := Authenticate(svc, r)
+			if err != nil {
+				if !errors.Is(err, services.ErrUnauthenticated) {
+					slog.ErrorContext(r.Context(), "Failed to authenticate request", "error", err)
+					WriteError(w, http.StatusInternalServerError, "Failed to authenticate")
+					return
+				}
+				w.Header().Set("WWW-Authenticate", `Bearer realm="starflix"`)
+				WriteError(w, http.StatusUnauthorized, "Unauthorized")
+				return
+			}
+			next.ServeHTTP(w, authed)
+		})
+	}
+}
+
+// Authenticate resolves the bearer token or, without one, the session
+// cookie of r and returns r with the token or session and its user stored
+// in the context. It returns services.ErrUnauthenticated if the credentials
+// are missing or invalid.
+func Authenticate(svc *services.AuthService, r *http.Request) (*http.Request, error) {
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		t, user, err := svc.AuthenticateAPIToken(r.Context(), bearer)
+		if err != nil {
+			return nil, err
+		}
+		return r.WithContext(services.WithAPIToken(r.Context(), t, user)), nil
+	}
+	sess, user, err := authenticateCookie(svc, r)
+	if err != nil {
+		return nil, err
+	}
+	return r.WithContext(services.WithSession(r.Context(), sess, user)), nil
+}
+
+// RequireAuthOrSignedURL is RequireAuth for the stream and cover routes,
+// which also take signed URLs instead of a session or API token. It checks
+// the signature and runs a signed request as the user the URL names, so
+// their role's permissions apply; the video service checks the signature
+// again before opening the file.
+func RequireAuthOrSignedURL(svc *services.AuthService, videoSvc *services.VideoService) func(http.Handler) http.Handler {
+	authed := RequireAuth(svc)
+	return func(next http.Handler) http.Handler {
+		withAuth := authed(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			q := r.URL.Query()
+			if !auth.IsSigned(q) {
+				withAuth.ServeHTTP(w, r)
+				return
+			}
+			grant, err := videoSvc.VerifySignedURL(r)
+			if err != nil {
+				WriteError(w, http.StatusForbidden, "Invalid or expired link")
+				return
+			}
+			user, err := svc.SignedURLUser(r.Context(), grant.UserID)
+			if err != nil {
+				if !errors.Is(err, services.ErrUnauthenticated) {
+					slog.ErrorContext(r.Context(), "Failed to authenticate request", "error", err)
+					WriteError(w, http.StatusInternalServerError, "Failed to authenticate")
+					return
+				}
+				WriteError(w, http.StatusForbidden, "Invalid or expired link")
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(services.WithSignedURLUser(r.Context(), user)))
+		})
+	}
+}
+
+// authenticateCookie resolves the session cookie of r to its session and
+// user.
+func authenticateCookie(svc *services.AuthService, r *http.Request) (*db.Session, *db.User, error) {
+	var token string
+	if c, err := r.Cookie(SessionCookie); err == nil {
+		token = c.Value
+	}
+	return svc.Authenticate(r.Context(), token)
+}
+
+// requireSession rejects requests authenticated with an API token, for
+// endpoints that manage the account itself.
+func requireSession(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if services.CurrentSession(r.Context()) == nil {
+			WriteError(w, http.StatusForbidden, "This endpoint requires logging in, API tokens can't use it")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// authorize checks that the logged-in user's role grants perm, writing an
+// error response and returning false if not. Denials are recorded in the
+// audit trail. It must run inside RequireAuth.
+func authorize(svc *services.AuthService, w http.ResponseWriter, r *http.Request, perm auth.Permission) bool {
+	if err := svc.Authorize(r.Context(), perm, r.Method+" "+r.URL.Path); err != nil {
+		writeServiceError(w, r, err, "authorize")
+		return false
+	}
+	return true
+}
+
+// requirePermission is authorize for handlers that need perm for every
+// method.
+func requirePermission(svc *services.AuthService, perm auth.Permission, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if authorize(svc, w, r, perm) {
+			next(w, r)
+		}
+	}
+}
+
+type credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type sessionResponse struct {
+	User     *db.User     `json:"user"`
+	Session  *db.Session  `json:"session,omitempty"`
+	APIToken *db.APIToken `json:"api_token,omitempty"`
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, token string, expires time.Time, secure bool) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   secure || r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// baseURL returns the scheme and host the client reached the server at,
+// for absolute URLs handed to other devices and players.
+func baseURL(r *http.Request, secure bool) string {
+	scheme := "http"
+	if secure || r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+func clearSessionCookie(w http.ResponseWriter, r *http.Request, secure bool) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   secure || r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func loginHandler(svc *services.AuthService, secureCookies bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		var req credentials
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+			WriteError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+		token, sess, user, err := svc.Login(r.Context(), req.Username, req.Password, r.UserAgent(), utils.ClientIP(r.Context()))
+		if err != nil {
+			var delay *services.LoginDelayError
+			switch {
+			case errors.Is(err, services.ErrInvalidCredentials):
+				slog.WarnContext(r.Context(), "Failed login", "username", req.Username)
+			case errors.As(err, &delay):
+				slog.WarnContext(r.Context(), "Login refused while delayed", "username", req.Username, "wait", delay.Wait)
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Wait.Seconds()))))
+			}
+			writeServiceError(w, r, err, "log in")
+			return
+		}
+		slog.InfoContext(r.Context(), "User logged in", "user", user.Username)
+		setSessionCookie(w, r, token, sess.ExpiresAt, secureCookies)
+		writeJSON(w, r, http.StatusOK, sessionResponse{User: user, Session: sess})
+	}
+}
+
+func logoutHandler(svc *services.AuthService, secureCookies bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		if err := svc.Logout(r.Context(), services.CurrentSession(r.Context())); err != nil && !errors.Is(err, db.ErrNotFound) {
+			writeServiceError(w, r, err, "log out")
+			return
+		}
+		clearSessionCookie(w, r, secureCookies)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type loginAttemptsResponse struct {
+	*services.LoginLock
+	Attempts []db.LoginAttempt `json:"attempts"`
+}
+
+// loginAttemptsHandler serves GET /api/auth/login-attempts, the failed
+// logins to the user's account in the last 30 days and whether it is
+// locked out.
+func loginAttemptsHandler(svc *services.AuthService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		user := services.CurrentUser(r.Context())
+		lock, err := svc.LoginLock(r.Context(), user)
+		if err != nil {
+			writeServiceError(w, r, err, "list failed logins")
+			return
+		}
+		attempts, err := svc.LoginAttempts(r.Context(), user)
+		if err != nil {
+			writeServiceError(w, r, err, "list failed logins")
+			return
+		}
+		writeJSON(w, r, http.StatusOK, loginAttemptsResponse{LoginLock: lock, Attempts: attempts})
+	}
+}
+
+func meHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, sessionResponse{
+		User:     services.CurrentUser(r.Context()),
+		Session:  services.CurrentSession(r.Context()),
+		APIToken: services.CurrentAPIToken(r.Context()),
+	})
+}
+
+type sessionListEntry struct {
+	db.Session
+	Current bool `json:"current"`
+}
+
+func sessionsHandler(svc *services.AuthService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := services.CurrentUser(r.Context())
+		current := services.CurrentSession(r.Context())
+
+		idStr := strings.TrimPrefix(r.URL.Path, "/api/auth/sessions")
+		idStr = strings.TrimPrefix(idStr, "/")
+		if idStr == "" {
+			if r.Method != http.MethodGet {
+				WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+				return
+			}
+			sessions, err := svc.ListSessions(r.Context(), user.ID)
+			if err != nil {
+				writeServiceError(w, r, err, "list sessions")
+				return
+			}
+			entries := make([]sessionListEntry, len(sessions))
+			for i, sess := range sessions {
+				entries[i] = sessionListEntry{Session: sess, Current: sess.ID == current.ID}
+			}
+			writeJSON(w, r, http.StatusOK, entries)
+			return
+		}
+
+		if r.Method != http.MethodDelete {
+			WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, "Invalid session ID")
+			return
+		}
+		if err := svc.RevokeSession(r.Context(), user.ID, id); err != nil {
+			writeServiceError(w, r, err, "revoke session")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type passwordChange struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+func changePasswordHandler(svc *services.AuthService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		var req passwordChange
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+			WriteError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+		user := services.CurrentUser(r.Context())
+		err := svc.ChangePassword(r.Context(), user, services.CurrentSession(r.Context()), req.CurrentPassword, req.NewPassword)
+		if err != nil {
+			if errors.Is(err, services.ErrInvalidCredentials) {
+				WriteError(w, http.StatusForbidden, "Current password is wrong")
+				return
+			}
+			writeServiceError(w, r, err, "change password")
+			return
+		}
+		slog.InfoContext(r.Context(), "Password changed", "user", user.Username)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type newUserRequest struct {
+	Username string    `json:"username"`
+	Password string    `json:"password"`
+	Role     auth.Role `json:"role"`
+}
+
+func usersHandler(svc *services.AuthService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			users, err := svc.ListUsers(r.Context())
+			if err != nil {
+				writeServiceError(w, r, err, "list users")
+				return
+			}
+			writeJSON(w, r, http.StatusOK, users)
+		case http.MethodPost:
+			req := newUserRequest{Role: auth.RoleViewer}
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+				WriteError(w, http.StatusBadRequest, "Invalid request body")
+				return
+			}
+			user, err := svc.CreateUser(r.Context(), req.Username, req.Password, req.Role)
+			if err != nil {
+				writeServiceError(w, r, err, "create user")
+				return
+			}
+			svc.Audit(r.Context(), "create_user", user.Username, services.AuditSuccess, "role "+user.Role)
+			writeJSON(w, r, http.StatusCreated, user)
+		default:
+			WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	}
+}
+
+type roleRequest struct {
+	Role auth.Role `json:"role"`
+}
+
+// userHandler serves PUT /api/users/{id}/role and POST
+// /api/users/{id}/unlock, which ends a lockout after failed logins.
+func userHandler(svc *services.AuthService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		idStr, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/users/"), "/")
+		if action != "role" && action != "unlock" {
+			WriteError(w, http.StatusNotFound, "Not found")
+			return
+		}
+		if (action == "role" && r.Method != http.MethodPut) || (action == "unlock" && r.Method != http.MethodPost) {
+			WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, "Invalid user ID")
+			return
+		}
+		if action == "unlock" {
+			user, err := svc.UnlockAccount(r.Context(), id)
+			if err != nil {
+				writeServiceError(w, r, err, "unlock account")
+				return
+			}
+			svc.Audit(r.Context(), "unlock_account", user.Username, services.AuditSuccess, "")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		var req roleRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+			WriteError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+		user, err := svc.SetRole(r.Context(), id, req.Role)
+		if err != nil {
+			writeServiceError(w, r, err, "set role")
+			return
+		}
+		svc.Audit(r.Context(), "set_role", user.Username, services.AuditSuccess, "role "+user.Role)
+		writeJSON(w, r, http.StatusOK, user)
+	}
+}
+
+type inviteRequest struct {
+	Role auth.Role `json:"role"`
+}
+
+type inviteResponse struct {
+	Token     string    `json:"token"`
+	URL       string    `json:"url"`
+	Role      string    `json:"role"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func inviteHandler(svc *services.AuthService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		// The body is optional; invites are for viewers by default.
+		req := inviteRequest{Role: auth.RoleViewer}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			WriteError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+		token, inv, err := svc.CreateInvite(r.Context(), services.CurrentUser(r.Context()).ID, req.Role)
+		if err != nil {
+			writeServiceError(w, r, err, "create invite")
+			return
+		}
+		svc.Audit(r.Context(), "create_invite", "", services.AuditSuccess, "role "+inv.Role)
+		writeJSON(w, r, http.StatusCreated, inviteResponse{
+			Token:     token,
+			URL:       "/login.html?invite=" + token,
+			Role:      inv.Role,
+			ExpiresAt: inv.ExpiresAt,
+		})
+	}
+}
+
+// auditHandler serves GET /api/admin/audit, newest first, filtered by the
+// user_id, action and outcome query parameters and paged with limit and
+// before.
+func auditHandler(svc *services.AuthService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		q := r.URL.Query()
+		f := db.AuditFilter{
+			Action:  q.Get("action"),
+			Outcome: q.Get("outcome"),
+			Limit:   100,
+		}
+		for name, dst := range map[string]*int{"user_id": &f.UserID, "before": &f.BeforeID, "limit": &f.Limit} {
+			if v := q.Get(name); v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil || n < 0 {
+					WriteError(w, http.StatusBadRequest, "Invalid "+name)
+					return
+				}
+				*dst = n
+			}
+		}
+		if f.Limit == 0 || f.Limit > 1000 {
+			f.Limit = 1000
+		}
+		events, err := svc.ListAuditEvents(r.Context(), f)
+		if err != nil {
+			writeServiceError(w, r, err, "list audit events")
+			return
+		}
+		if events == nil {
+			events = []db.AuditEvent{}
+		}
+		writeJSON(w, r, http.StatusOK, events)
+	}
+}
+
+type registration struct {
+	Invite   string `json:"invite"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func registerHandler(svc *services.AuthService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		var req registration
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+			WriteError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+		user, err := svc.Register(r.Context(), req.Invite, req.Username, req.Password)
+		if errors.Is(err, db.ErrNotFound) {
+			WriteError(w, http.StatusForbidden, "Invite is invalid, used or expired")
+			return
+		}
+		if err != nil {
+			writeServiceError(w, r, err, "register")
+			return
+		}
+		slog.InfoContext(r.Context(), "User registered with invite", "user", user.Username)
+		writeJSON(w, r, http.StatusCreated, user)
+	}
+}
@@ -0,0 +1,230 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"DevMaan707/streamer/db"
+	"DevMaan707/streamer/services"
+	"DevMaan707/streamer/utils"
+)
+
+// deviceCodeGrant is the grant_type devices poll the token endpoint with.
+const deviceCodeGrant = "urn:ietf:params:oauth:grant-type:device_code"
+
+type deviceCodeResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+type deviceTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	Scope       string `json:"scope"`
+}
+
+// oauthError is the error body of the device endpoints, in the OAuth 2.0
+// format device clients expect rather than errorResponse.
+type oauthError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+func writeOAuthError(w http.ResponseWriter, r *http.Request, status int, code, description string) {
+	writeJSON(w, r, status, oauthError{Error: code, ErrorDescription: description})
+}
+
+// deviceCodeHandler serves POST /api/device/code, where a device starts
+// linking. It takes the form fields client_id, the name the device goes by,
+// and scope, a space-separated list.
+func deviceCodeHandler(svc *services.AuthService, secureCookies bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, 1<<16)
+		if err := r.ParseForm(); err != nil {
+			writeOAuthError(w, r, http.StatusBadRequest, "invalid_request", "Invalid form body")
+			return
+		}
+		da, err := svc.StartDeviceAuthorization(r.Context(), r.PostForm.Get("client_id"), strings.Fields(r.PostForm.Get("scope")), utils.ClientIP(r.Context()))
+		switch {
+		case errors.Is(err, services.ErrRateLimited):
+			w.Header().Set("Retry-After", strconv.Itoa(int(services.DeviceCodeTTL/time.Second)))
+			writeOAuthError(w, r, http.StatusTooManyRequests, "slow_down", err.Error())
+			return
+		case errors.Is(err, services.ErrInvalidInput):
+			writeOAuthError(w, r, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		case err != nil:
+			slog.ErrorContext(r.Context(), "Failed to start device authorization", "error", err)
+			writeOAuthError(w, r, http.StatusInternalServerError, "server_error", "")
+			return
+		}
+
+		verify := baseURL(r, secureCookies) + "/link"
+		writeJSON(w, r, http.StatusOK, deviceCodeResponse{
+			DeviceCode:              da.DeviceCode,
+			UserCode:                da.UserCode,
+			VerificationURI:         verify,
+			VerificationURIComplete: verify + "?code=" + url.QueryEscape(da.UserCode),
+			ExpiresIn:               int(da.ExpiresIn / time.Second),
+			Interval:                int(da.Interval / time.Second),
+		})
+	}
+}
+
+// deviceTokenHandler serves POST /api/device/token, which a device polls
+// until the user has approved or denied it.
+func deviceTokenHandler(svc *services.AuthService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, 1<<16)
+		if err := r.ParseForm(); err != nil {
+			writeOAuthError(w, r, http.StatusBadRequest, "invalid_request", "Invalid form body")
+			return
+		}
+		if r.PostForm.Get("grant_type") != deviceCodeGrant {
+			writeOAuthError(w, r, http.StatusBadRequest, "unsupported_grant_type", "")
+			return
+		}
+		token, t, err := svc.PollDeviceToken(r.Context(), r.PostForm.Get("device_code"))
+		if err != nil {
+			for _, known := range []error{services.ErrAuthorizationPending, services.ErrSlowDown, services.ErrAccessDenied, services.ErrExpiredToken} {
+				if errors.Is(err, known) {
+					writeOAuthError(w, r, http.StatusBadRequest, known.Error(), "")
+					return
+				}
+			}
+			if errors.Is(err, services.ErrInvalidInput) {
+				writeOAuthError(w, r, http.StatusBadRequest, "invalid_grant", err.Error())
+				return
+			}
+			slog.ErrorContext(r.Context(), "Failed to issue device token", "error", err)
+			writeOAuthError(w, r, http.StatusInternalServerError, "server_error", "")
+			return
+		}
+		writeJSON(w, r, http.StatusOK, deviceTokenResponse{
+			AccessToken: token,
+			TokenType:   "Bearer",
+			ExpiresIn:   int(time.Until(t.ExpiresAt) / time.Second),
+			Scope:       strings.Join(t.Scopes, " "),
+		})
+	}
+}
+
+type pendingDevice struct {
+	UserCode   string    `json:"user_code"`
+	ClientName string    `json:"client_name"`
+	Scopes     []string  `json:"scopes"`
+	ClientIP   string    `json:"client_ip"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+func newPendingDevice(dc *db.DeviceCode) pendingDevice {
+	return pendingDevice{
+		UserCode:   services.FormatUserCode(dc.UserCode),
+		ClientName: dc.ClientName,
+		Scopes:     dc.Scopes,
+		ClientIP:   dc.ClientIP,
+		ExpiresAt:  dc.ExpiresAt,
+	}
+}
+
+type approveDeviceRequest struct {
+	UserCode string `json:"user_code"`
+	Approve  bool   `json:"approve"`
+}
+
+// deviceVerifyHandler serves GET /api/device/verify?user_code=, showing the
+// logged-in user which device a code belongs to before they approve it.
+func deviceVerifyHandler(svc *services.AuthService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		dc, err := svc.LookupDeviceCode(r.Context(), services.CurrentUser(r.Context()), r.URL.Query().Get("user_code"))
+		if err != nil {
+			writeServiceError(w, r, err, "look up device code")
+			return
+		}
+		writeJSON(w, r, http.StatusOK, newPendingDevice(dc))
+	}
+}
+
+// deviceApproveHandler serves POST /api/device/approve, where the
+// logged-in user approves or denies a device.
+func deviceApproveHandler(svc *services.AuthService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		var req approveDeviceRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+			WriteError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+		dc, err := svc.ResolveDeviceCode(r.Context(), services.CurrentUser(r.Context()), req.UserCode, req.Approve)
+		if err != nil {
+			writeServiceError(w, r, err, "resolve device code")
+			return
+		}
+		writeJSON(w, r, http.StatusOK, newPendingDevice(dc))
+	}
+}
+
+// devicesHandler serves GET /api/devices and DELETE /api/devices/{id} for
+// the logged-in user's linked devices.
+func devicesHandler(svc *services.AuthService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := services.CurrentUser(r.Context())
+
+		idStr := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/devices"), "/")
+		if idStr != "" {
+			if r.Method != http.MethodDelete {
+				WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+				return
+			}
+			id, err := strconv.Atoi(idStr)
+			if err != nil {
+				WriteError(w, http.StatusBadRequest, "Invalid device ID")
+				return
+			}
+			if err := svc.UnlinkDevice(r.Context(), user.ID, id); err != nil {
+				writeServiceError(w, r, err, "unlink device")
+				return
+			}
+			svc.Audit(r.Context(), "unlink_device", idStr, services.AuditSuccess, "")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		devices, err := svc.ListDevices(r.Context(), user.ID)
+		if err != nil {
+			writeServiceError(w, r, err, "list devices")
+			return
+		}
+		writeJSON(w, r, http.StatusOK, devices)
+	}
+}
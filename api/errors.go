@@ -0,0 +1,65 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"DevMaan707/streamer/db"
+	"DevMaan707/streamer/services"
+)
+
+// errorResponse is the body of every API error.
+type errorResponse struct {
+	Error  string `json:"error"`
+	Status int    `json:"status"`
+}
+
+// WriteError sends an API error as JSON.
+func WriteError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: message, Status: status})
+}
+
+// serviceErrorStatus maps service errors to HTTP status codes, returning 0
+// for unexpected errors.
+func serviceErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrInvalidInput):
+		return http.StatusBadRequest
+	case errors.Is(err, services.ErrInvalidCredentials), errors.Is(err, services.ErrUnauthenticated):
+		return http.StatusUnauthorized
+	case errors.Is(err, services.ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, db.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, db.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, services.ErrRateLimited):
+		return http.StatusTooManyRequests
+	}
+	return 0
+}
+
+// writeServiceError sends err with its status code if it is an expected
+// service error, and logs it and hides the details otherwise.
+func writeServiceError(w http.ResponseWriter, r *http.Request, err error, action string) {
+	if status := serviceErrorStatus(err); status != 0 {
+		WriteError(w, status, err.Error())
+		return
+	}
+	slog.ErrorContext(r.Context(), "Failed to "+action, "error", err)
+	WriteError(w, http.StatusInternalServerError, "Failed to "+action)
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := encodeJSON(r.Context(), w, v); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode response", "error", err)
+	}
+}
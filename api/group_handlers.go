@@ -0,0 +1,158 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"DevMaan707/streamer/auth"
+	"DevMaan707/streamer/db"
+	"DevMaan707/streamer/services"
+)
+
+type newGroupRequest struct {
+	Name string `json:"name"`
+}
+
+// groupsHandler serves GET /api/groups, which lists every group for admins
+// and the user's own groups for everyone else, and for admins POST
+// /api/groups, DELETE /api/groups/{id} and PUT and DELETE
+// /api/groups/{id}/members/{username}.
+func groupsHandler(svc *services.GroupService, authSvc *services.AuthService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rest := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/groups"), "/")
+		if rest == "" {
+			switch r.Method {
+			case http.MethodGet:
+				groups, err := svc.ListGroups(r.Context(), services.CurrentUser(r.Context()))
+				if err != nil {
+					writeServiceError(w, r, err, "list groups")
+					return
+				}
+				writeJSON(w, r, http.StatusOK, groups)
+			case http.MethodPost:
+				if !authorize(authSvc, w, r, auth.PermAdmin) {
+					return
+				}
+				var req newGroupRequest
+				if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+					WriteError(w, http.StatusBadRequest, "Invalid request body")
+					return
+				}
+				group, err := svc.CreateGroup(r.Context(), req.Name)
+				if err != nil {
+					writeServiceError(w, r, err, "create group")
+					return
+				}
+				authSvc.Audit(r.Context(), "create_group", group.Name, services.AuditSuccess, "")
+				writeJSON(w, r, http.StatusCreated, group)
+			default:
+				WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			}
+			return
+		}
+
+		if !authorize(authSvc, w, r, auth.PermAdmin) {
+			return
+		}
+		idStr, member, hasMember := strings.Cut(rest, "/members/")
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			WriteError(w, http.StatusNotFound, "Group not found")
+			return
+		}
+		if !hasMember {
+			if r.Method != http.MethodDelete {
+				WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+				return
+			}
+			if err := svc.DeleteGroup(r.Context(), id); err != nil {
+				writeServiceError(w, r, err, "delete group")
+				return
+			}
+			authSvc.Audit(r.Context(), "delete_group", idStr, services.AuditSuccess, "")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPut:
+			err = svc.AddMember(r.Context(), id, member)
+		case http.MethodDelete:
+			err = svc.RemoveMember(r.Context(), id, member)
+		default:
+			WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		if err != nil {
+			writeServiceError(w, r, err, "change group members")
+			return
+		}
+		action := "add_group_member"
+		if r.Method == http.MethodDelete {
+			action = "remove_group_member"
+		}
+		authSvc.Audit(r.Context(), action, idStr, services.AuditSuccess, member)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// preferencesHandler serves GET and PUT /api/auth/preferences, the
+// logged-in user's defaults for new uploads.
+func preferencesHandler(svc *services.GroupService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := services.CurrentUser(r.Context())
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var req db.Preferences
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+				WriteError(w, http.StatusBadRequest, "Invalid request body")
+				return
+			}
+			if err := svc.SetPreferences(r.Context(), user, req); err != nil {
+				writeServiceError(w, r, err, "save preferences")
+				return
+			}
+		default:
+			WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		prefs, err := svc.Preferences(r.Context(), user)
+		if err != nil {
+			writeServiceError(w, r, err, "load preferences")
+			return
+		}
+		writeJSON(w, r, http.StatusOK, prefs)
+	}
+}
+
+type visibilityRequest struct {
+	Visibility string `json:"visibility"`
+	GroupID    int    `json:"group_id"`
+}
+
+// videoVisibilityHandler serves PUT /api/videos/{id}/visibility, which
+// the video's owner and admins use to change who can see it.
+func videoVisibilityHandler(svc *services.VideoService, authSvc *services.AuthService, id int, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if !authorize(authSvc, w, r, auth.PermUpload) {
+		return
+	}
+	var req visibilityRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		WriteError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	video, err := svc.SetVisibility(r.Context(), id, req.Visibility, req.GroupID)
+	if err != nil {
+		writeServiceError(w, r, err, "change visibility")
+		return
+	}
+	authSvc.Audit(r.Context(), "set_visibility", strconv.Itoa(id), services.AuditSuccess, video.Visibility)
+	writeJSON(w, r, http.StatusOK, video)
+}
@@ -0,0 +1,156 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"DevMaan707/streamer/services"
+	"DevMaan707/streamer/utils"
+)
+
+// oidcCookie holds the state of a single sign-on login between the redirect
+// to the identity provider and the callback.
+const oidcCookie = "starflix_oidc"
+
+// oidcLoginTimeout is how long the user has to log in at the identity
+// provider.
+const oidcLoginTimeout = 600
+
+type oidcInfo struct {
+	Name     string `json:"name"`
+	LoginURL string `json:"login_url"`
+	LinkURL  string `json:"link_url"`
+}
+
+// oidcInfoHandler serves GET /api/auth/oidc, which tells the login page
+// whether to offer single sign-on.
+func oidcInfoHandler(svc *services.OIDCService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		writeJSON(w, r, http.StatusOK, oidcInfo{
+			Name:     svc.Name(),
+			LoginURL: "/api/auth/oidc/login",
+			LinkURL:  "/api/auth/oidc/login?link=1",
+		})
+	}
+}
+
+// oidcLoginHandler serves GET /api/auth/oidc/login, redirecting the browser
+// to the identity provider. With ?link=1 a logged-in user links their
+// provider account instead of logging in.
+func oidcLoginHandler(svc *services.OIDCService, authSvc *services.AuthService, secureCookies bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		link := r.URL.Query().Get("link") == "1"
+		if link {
+			if _, _, err := authenticateCookie(authSvc, r); err != nil {
+				writeServiceError(w, r, err, "authenticate")
+				return
+			}
+		}
+		redirect, login, err := svc.BeginLogin(r.Context(), link)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to start single sign-on", "error", err)
+			WriteError(w, http.StatusBadGateway, "The identity provider is unavailable")
+			return
+		}
+		value, err := json.Marshal(login)
+		if err != nil {
+			writeServiceError(w, r, err, "start single sign-on")
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     oidcCookie,
+			Value:    base64.RawURLEncoding.EncodeToString(value),
+			Path:     "/api/auth/oidc",
+			MaxAge:   oidcLoginTimeout,
+			HttpOnly: true,
+			Secure:   secureCookies || r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(w, r, redirect, http.StatusFound)
+	}
+}
+
+// oidcCallbackHandler serves GET /api/auth/oidc/callback, where the
+// identity provider sends the browser back. It ends on a redirect to the
+// app, or to the login page with an error message.
+func oidcCallbackHandler(svc *services.OIDCService, authSvc *services.AuthService, secureCookies bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		fail := func(err error, action string) {
+			message := "Single sign-on failed"
+			if serviceErrorStatus(err) != 0 {
+				slog.WarnContext(r.Context(), "Single sign-on refused", "error", err)
+				message = err.Error()
+			} else {
+				slog.ErrorContext(r.Context(), "Failed to "+action, "error", err)
+			}
+			http.Redirect(w, r, "/login.html?error="+url.QueryEscape(message), http.StatusFound)
+		}
+
+		q := r.URL.Query()
+		if e := q.Get("error"); e != "" {
+			slog.WarnContext(r.Context(), "Identity provider returned an error", "error", e, "description", q.Get("error_description"))
+			http.Redirect(w, r, "/login.html?error="+url.QueryEscape("Single sign-on was cancelled or refused"), http.StatusFound)
+			return
+		}
+
+		var login *services.OIDCLogin
+		if c, err := r.Cookie(oidcCookie); err == nil {
+			if value, err := base64.RawURLEncoding.DecodeString(c.Value); err == nil {
+				json.Unmarshal(value, &login)
+			}
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     oidcCookie,
+			Value:    "",
+			Path:     "/api/auth/oidc",
+			MaxAge:   -1,
+			HttpOnly: true,
+			Secure:   secureCookies || r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		tokens, err := svc.Exchange(r.Context(), login, q.Get("state"), q.Get("code"))
+		if err != nil {
+			fail(err, "complete single sign-on")
+			return
+		}
+
+		if login.Link {
+			sess, user, err := authenticateCookie(authSvc, r)
+			if err != nil {
+				fail(err, "authenticate")
+				return
+			}
+			if err := svc.Link(services.WithSession(r.Context(), sess, user), user, tokens); err != nil {
+				fail(err, "link identity")
+				return
+			}
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		token, sess, user, err := svc.Login(r.Context(), tokens, r.UserAgent(), utils.ClientIP(r.Context()))
+		if err != nil {
+			fail(err, "log in with single sign-on")
+			return
+		}
+		slog.InfoContext(r.Context(), "User logged in with single sign-on", "user", user.Username)
+		setSessionCookie(w, r, token, sess.ExpiresAt, secureCookies)
+		http.Redirect(w, r, "/", http.StatusFound)
+	}
+}
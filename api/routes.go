@@ -3,16 +3,69 @@ package api
 import (
 	"net/http"
 
+	"DevMaan707/streamer/auth"
 	"DevMaan707/streamer/services"
 )
 
-func RegisterRoutes(mux *http.ServeMux, videoSvc *services.VideoService, uploadSvc *services.UploadService) {
+// RegisterRoutes adds the API, stream and cover routes to mux. Everything
+// except logging in, registering with an invite, the endpoints a device
+// calls while being linked and those behind share links requires a session
+// or an API token, or for streams and covers a signed URL; handlers check
+// the permissions of the user's role, and the token's scopes, on top of
+// that. oidcSvc is nil unless single sign-on is enabled.
+func RegisterRoutes(mux *http.ServeMux, videoSvc *services.VideoService, uploadSvc *services.UploadService, shareSvc *services.ShareService, groupSvc *services.GroupService, authSvc *services.AuthService, oidcSvc *services.OIDCService, secureCookies bool) {
+	authed := RequireAuth(authSvc)
+	handle := func(pattern string, h http.HandlerFunc) {
+		mux.Handle(pattern, authed(h))
+	}
+	view := func(h http.HandlerFunc) http.HandlerFunc {
+		return requirePermission(authSvc, auth.PermView, h)
+	}
 
-	mux.HandleFunc("/api/videos", videoListHandler(videoSvc))
-	mux.HandleFunc("/api/videos/genre/", videoListByGenreHandler(videoSvc))
-	mux.HandleFunc("/api/genres", genreListHandler(videoSvc))
-	mux.HandleFunc("/videos/", videoStreamHandler(videoSvc))
-	mux.HandleFunc("/covers/", coverImageHandler(videoSvc))
+	handle("/api/videos", view(videoListHandler(videoSvc)))
+	handle("/api/videos/", videoHandler(videoSvc, shareSvc, authSvc, secureCookies))
+	handle("/api/videos/genre/", view(videoListByGenreHandler(videoSvc)))
+	handle("/api/videos/search", view(videoSearchHandler(videoSvc)))
+	handle("/api/genres", genreListHandler(videoSvc, authSvc))
+	handle("/api/genres/", genreHandler(videoSvc, authSvc))
+	signedOrAuthed := RequireAuthOrSignedURL(authSvc, videoSvc)
+	mux.Handle("/videos/", signedOrAuthed(view(videoStreamHandler(videoSvc))))
+	mux.Handle("/covers/", signedOrAuthed(view(coverImageHandler(videoSvc))))
 
-	mux.HandleFunc("/api/upload", uploadHandler(uploadSvc))
+	handle("/api/upload", uploadHandler(uploadSvc, authSvc))
+
+	handle("/api/shares", requirePermission(authSvc, auth.PermShare, sharesHandler(shareSvc, authSvc)))
+	handle("/api/shares/", requirePermission(authSvc, auth.PermShare, sharesHandler(shareSvc, authSvc)))
+	mux.HandleFunc("/api/shared/", sharedHandler(shareSvc, secureCookies))
+
+	handle("/api/groups", view(groupsHandler(groupSvc, authSvc)))
+	handle("/api/groups/", view(groupsHandler(groupSvc, authSvc)))
+
+	mux.HandleFunc("/api/auth/login", loginHandler(authSvc, secureCookies))
+	mux.HandleFunc("/api/auth/register", registerHandler(authSvc))
+	if oidcSvc != nil {
+		mux.HandleFunc("/api/auth/oidc", oidcInfoHandler(oidcSvc))
+		mux.HandleFunc("/api/auth/oidc/login", oidcLoginHandler(oidcSvc, authSvc, secureCookies))
+		mux.HandleFunc("/api/auth/oidc/callback", oidcCallbackHandler(oidcSvc, authSvc, secureCookies))
+	}
+	handle("/api/auth/logout", requireSession(logoutHandler(authSvc, secureCookies)))
+	handle("/api/auth/me", meHandler)
+	handle("/api/auth/password", requireSession(changePasswordHandler(authSvc)))
+	handle("/api/auth/preferences", requireSession(preferencesHandler(groupSvc)))
+	handle("/api/auth/login-attempts", loginAttemptsHandler(authSvc))
+	handle("/api/auth/sessions", requireSession(sessionsHandler(authSvc)))
+	handle("/api/auth/sessions/", requireSession(sessionsHandler(authSvc)))
+	handle("/api/tokens", requireSession(tokensHandler(authSvc)))
+	handle("/api/tokens/", requireSession(tokensHandler(authSvc)))
+	mux.HandleFunc("/api/device/code", deviceCodeHandler(authSvc, secureCookies))
+	mux.HandleFunc("/api/device/token", deviceTokenHandler(authSvc))
+	handle("/api/device/verify", requireSession(deviceVerifyHandler(authSvc)))
+	handle("/api/device/approve", requireSession(deviceApproveHandler(authSvc)))
+	handle("/api/devices", requireSession(devicesHandler(authSvc)))
+	handle("/api/devices/", requireSession(devicesHandler(authSvc)))
+
+	handle("/api/users", requirePermission(authSvc, auth.PermAdmin, usersHandler(authSvc)))
+	handle("/api/users/", requirePermission(authSvc, auth.PermAdmin, userHandler(authSvc)))
+	handle("/api/invites", requirePermission(authSvc, auth.PermAdmin, inviteHandler(authSvc)))
+	handle("/api/admin/audit", requirePermission(authSvc, auth.PermAdmin, auditHandler(authSvc)))
 }
@@ -0,0 +1,295 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"DevMaan707/streamer/auth"
+	"DevMaan707/streamer/db"
+	"DevMaan707/streamer/services"
+	"DevMaan707/streamer/utils"
+)
+
+// shareCookie holds the key of an unlocked password-protected share. It is
+// scoped to the share's API path, so each share has its own.
+const shareCookie = "starflix_share"
+
+// sharePlayCookie holds the play key of the latest counted play of a
+// share, which lets its player seek. It is scoped to the share's video.
+const sharePlayCookie = "starflix_share_play"
+
+type newShareRequest struct {
+	// ExpiresIn is a duration such as "72h"; empty means the default.
+	ExpiresIn string `json:"expires_in"`
+	MaxPlays  int    `json:"max_plays"`
+	Password  string `json:"password"`
+}
+
+type shareEntry struct {
+	db.Share
+	HasPassword bool `json:"has_password"`
+}
+
+type newShareResponse struct {
+	shareEntry
+	// Token and URL are only ever shown in this response.
+	Token string `json:"token"`
+	URL   string `json:"url"`
+}
+
+func newShareEntries(shares []db.Share) []shareEntry {
+	entries := make([]shareEntry, 0, len(shares))
+	for _, sh := range shares {
+		entries = append(entries, shareEntry{Share: sh, HasPassword: sh.PasswordHash != ""})
+	}
+	return entries
+}
+
+// videoSharesHandler serves GET and POST /api/videos/{id}/shares, the
+// logged-in user's share links for a video.
+func videoSharesHandler(svc *services.ShareService, authSvc *services.AuthService, secureCookies bool, videoID int, w http.ResponseWriter, r *http.Request) {
+	if !authorize(authSvc, w, r, auth.PermShare) {
+		return
+	}
+	user := services.CurrentUser(r.Context())
+	switch r.Method {
+	case http.MethodGet:
+		shares, err := svc.ListShares(r.Context(), user.ID, videoID)
+		if err != nil {
+			writeServiceError(w, r, err, "list shares")
+			return
+		}
+		writeJSON(w, r, http.StatusOK, newShareEntries(shares))
+	case http.MethodPost:
+		var req newShareRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil && err != io.EOF {
+			WriteError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+		var ttl time.Duration
+		if req.ExpiresIn != "" {
+			var err error
+			if ttl, err = time.ParseDuration(req.ExpiresIn); err != nil || ttl <= 0 {
+				WriteError(w, http.StatusBadRequest, "Invalid expires_in duration")
+				return
+			}
+		}
+		token, sh, err := svc.CreateShare(r.Context(), user, videoID, services.ShareOptions{
+			TTL:      ttl,
+			MaxPlays: req.MaxPlays,
+			Password: req.Password,
+		})
+		if err != nil {
+			writeServiceError(w, r, err, "create share")
+			return
+		}
+		authSvc.Audit(r.Context(), "create_share", strconv.Itoa(videoID), services.AuditSuccess, sh.VideoTitle)
+		writeJSON(w, r, http.StatusCreated, newShareResponse{
+			shareEntry: shareEntry{Share: *sh, HasPassword: sh.PasswordHash != ""},
+			Token:      token,
+			URL:        baseURL(r, secureCookies) + "/s/" + token,
+		})
+	default:
+		WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// sharesHandler serves GET /api/shares and DELETE /api/shares/{id} for the
+// logged-in user's share links of all videos.
+func sharesHandler(svc *services.ShareService, authSvc *services.AuthService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := services.CurrentUser(r.Context())
+
+		idStr := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/shares"), "/")
+		if idStr != "" {
+			if r.Method != http.MethodDelete {
+				WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+				return
+			}
+			id, err := strconv.Atoi(idStr)
+			if err != nil {
+				WriteError(w, http.StatusBadRequest, "Invalid share ID")
+				return
+			}
+			if err := svc.RevokeShare(r.Context(), user.ID, id); err != nil {
+				writeServiceError(w, r, err, "revoke share")
+				return
+			}
+			authSvc.Audit(r.Context(), "revoke_share", idStr, services.AuditSuccess, "")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		shares, err := svc.ListShares(r.Context(), user.ID, 0)
+		if err != nil {
+			writeServiceError(w, r, err, "list shares")
+			return
+		}
+		writeJSON(w, r, http.StatusOK, newShareEntries(shares))
+	}
+}
+
+type sharedVideo struct {
+	Title         string    `json:"title"`
+	Description   string    `json:"description"`
+	NeedsPassword bool      `json:"needs_password"`
+	Unlocked      bool      `json:"unlocked"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	// PlaysLeft is null for shares without a limit.
+	PlaysLeft *int   `json:"plays_left"`
+	VideoURL  string `json:"video_url"`
+	CoverURL  string `json:"cover_url,omitempty"`
+}
+
+type unlockShareRequest struct {
+	Password string `json:"password"`
+}
+
+// sharedHandler serves the endpoints behind the share player page, which
+// need no account: GET /api/shared/{token} describes the video, POST
+// /api/shared/{token}/unlock takes the password, and GET
+// /api/shared/{token}/video and /cover serve the files.
+func sharedHandler(svc *services.ShareService, secureCookies bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/shared/"), "/")
+		sh, err := svc.OpenShare(r.Context(), token)
+		if err != nil {
+			writeServiceError(w, r, err, "open share")
+			return
+		}
+		base := "/api/shared/" + token
+		var key string
+		if c, err := r.Cookie(shareCookie); err == nil {
+			key = c.Value
+		}
+		unlocked := svc.Unlocked(sh, key)
+
+		switch action {
+		case "":
+			if r.Method != http.MethodGet {
+				WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+				return
+			}
+			info := sharedVideo{
+				Title:         sh.VideoTitle,
+				NeedsPassword: sh.PasswordHash != "",
+				Unlocked:      unlocked,
+				ExpiresAt:     sh.ExpiresAt,
+				VideoURL:      base + "/video",
+			}
+			if sh.MaxPlays > 0 {
+				left := max(sh.MaxPlays-sh.Plays, 0)
+				info.PlaysLeft = &left
+			}
+			// Everything but the title stays hidden until the password is
+			// entered.
+			if unlocked {
+				video, err := svc.Video(r.Context(), sh)
+				if err != nil {
+					writeServiceError(w, r, err, "open share")
+					return
+				}
+				info.Description = video.Description
+				if video.CoverImage != "" {
+					info.CoverURL = base + "/cover"
+				}
+			}
+			writeJSON(w, r, http.StatusOK, info)
+		case "unlock":
+			if r.Method != http.MethodPost {
+				WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+				return
+			}
+			var req unlockShareRequest
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+				WriteError(w, http.StatusBadRequest, "Invalid request body")
+				return
+			}
+			key, err := svc.Unlock(sh, req.Password)
+			if errors.Is(err, services.ErrWrongSharePassword) {
+				slog.WarnContext(r.Context(), "Wrong share password", "share", sh.ID)
+				WriteError(w, http.StatusUnauthorized, err.Error())
+				return
+			}
+			if err != nil {
+				writeServiceError(w, r, err, "unlock share")
+				return
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     shareCookie,
+				Value:    key,
+				Path:     base,
+				Expires:  sh.ExpiresAt,
+				HttpOnly: true,
+				Secure:   secureCookies || r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+			w.WriteHeader(http.StatusNoContent)
+		case "video", "cover":
+			if r.Method != http.MethodGet {
+				WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+				return
+			}
+			if !unlocked {
+				WriteError(w, http.StatusUnauthorized, services.ErrShareLocked.Error())
+				return
+			}
+			if action == "video" {
+				var playKey string
+				if c, err := r.Cookie(sharePlayCookie); err == nil {
+					playKey = c.Value
+				}
+				playKey, err = svc.Play(r.Context(), r, sh, playKey)
+				if err == nil {
+					if playKey != "" {
+						http.SetCookie(w, &http.Cookie{
+							Name:     sharePlayCookie,
+							Value:    playKey,
+							Path:     base + "/video",
+							MaxAge:   int(services.SharePlayTTL.Seconds()),
+							HttpOnly: true,
+							Secure:   secureCookies || r.TLS != nil,
+							SameSite: http.SameSiteLaxMode,
+						})
+					}
+					err = svc.StreamShare(w, r, sh)
+				}
+			} else {
+				err = svc.ServeShareCover(w, r, sh)
+			}
+			if err != nil {
+				writeShareFileError(w, r, err)
+			}
+		default:
+			WriteError(w, http.StatusNotFound, "Not found")
+		}
+	}
+}
+
+// writeShareFileError answers a failed shared stream or cover request the
+// way the stream and cover handlers do.
+func writeShareFileError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case r.Context().Err() != nil:
+		// The response is already partly written.
+	case errors.Is(err, services.ErrSharePlaysUsed):
+		WriteError(w, http.StatusGone, err.Error())
+	case errors.Is(err, services.ErrSharePlayNotStarted):
+		WriteError(w, http.StatusForbidden, err.Error())
+	case errors.Is(err, db.ErrNotFound), err == utils.ErrNotFound:
+		WriteError(w, http.StatusNotFound, "Not found")
+	default:
+		slog.ErrorContext(r.Context(), "Failed to serve shared video", "error", err)
+		WriteError(w, http.StatusInternalServerError, "Error serving video")
+	}
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"DevMaan707/streamer/db"
+	"DevMaan707/streamer/services"
+)
+
+type newTokenRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// ExpiresIn is a duration such as "720h"; empty means the default.
+	ExpiresIn string `json:"expires_in"`
+}
+
+type newTokenResponse struct {
+	db.APIToken
+	// Token is only ever shown in this response.
+	Token string `json:"token"`
+}
+
+// tokensHandler serves GET and POST /api/tokens and DELETE
+// /api/tokens/{id} for the logged-in user's own tokens.
+func tokensHandler(svc *services.AuthService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := services.CurrentUser(r.Context())
+
+		idStr := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/tokens"), "/")
+		if idStr != "" {
+			if r.Method != http.MethodDelete {
+				WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+				return
+			}
+			id, err := strconv.Atoi(idStr)
+			if err != nil {
+				WriteError(w, http.StatusBadRequest, "Invalid token ID")
+				return
+			}
+			if err := svc.RevokeAPIToken(r.Context(), user.ID, id); err != nil {
+				writeServiceError(w, r, err, "revoke API token")
+				return
+			}
+			svc.Audit(r.Context(), "revoke_api_token", idStr, services.AuditSuccess, "")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			tokens, err := svc.ListAPITokens(r.Context(), user.ID)
+			if err != nil {
+				writeServiceError(w, r, err, "list API tokens")
+				return
+			}
+			if tokens == nil {
+				tokens = []db.APIToken{}
+			}
+			writeJSON(w, r, http.StatusOK, tokens)
+		case http.MethodPost:
+			var req newTokenRequest
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+				WriteError(w, http.StatusBadRequest, "Invalid request body")
+				return
+			}
+			var ttl time.Duration
+			if req.ExpiresIn != "" {
+				var err error
+				if ttl, err = time.ParseDuration(req.ExpiresIn); err != nil || ttl <= 0 {
+					WriteError(w, http.StatusBadRequest, "Invalid expires_in duration")
+					return
+				}
+			}
+			token, t, err := svc.CreateAPIToken(r.Context(), user, req.Name, req.Scopes, ttl)
+			if err != nil {
+				writeServiceError(w, r, err, "create API token")
+				return
+			}
+			svc.Audit(r.Context(), "create_api_token", t.Name, services.AuditSuccess, strings.Join(t.Scopes, ","))
+			writeJSON(w, r, http.StatusCreated, newTokenResponse{APIToken: *t, Token: token})
+		default:
+			WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	}
+}
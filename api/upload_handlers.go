@@ -3,9 +3,10 @@ package api
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 
+	"DevMaan707/streamer/auth"
 	"DevMaan707/streamer/services"
 )
 
@@ -15,36 +16,35 @@ type uploadResponse struct {
 	File    string `json:"file,omitempty"`
 }
 
-func uploadHandler(svc *services.UploadService) http.HandlerFunc {
+func uploadHandler(svc *services.UploadService, authSvc *services.AuthService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Println("Upload request received")
-
 		if r.Method != http.MethodPost {
-			log.Println("Method not allowed:", r.Method)
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		if !authorize(authSvc, w, r, auth.PermUpload) {
 			return
 		}
 
-		log.Println("Attempting to handle upload")
 		filename, err := svc.HandleUpload(r)
 		w.Header().Set("Content-Type", "application/json")
 		resp := uploadResponse{}
 
 		if err != nil {
-			log.Printf("Upload failed: %v", err)
+			slog.WarnContext(r.Context(), "Upload failed", "error", err)
 			resp.Success = false
 			resp.Message = fmt.Sprintf("Upload failed: %v", err)
 			w.WriteHeader(http.StatusBadRequest)
 		} else {
-			log.Printf("Upload successful: %s", filename)
+			authSvc.Audit(r.Context(), "upload", filename, services.AuditSuccess, "")
 			resp.Success = true
 			resp.Message = "Upload successful"
 			resp.File = filename
 			w.WriteHeader(http.StatusOK)
 		}
 		if err := json.NewEncoder(w).Encode(resp); err != nil {
-			log.Printf("Failed to encode response: %v", err)
-			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed to encode response", "error", err)
+			WriteError(w, http.StatusInternalServerError, "Failed to encode response")
 		}
 	}
 }
@@ -1,80 +1,236 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
+	"DevMaan707/streamer/auth"
+	"DevMaan707/streamer/db"
 	"DevMaan707/streamer/services"
+	"DevMaan707/streamer/tracing"
 	"DevMaan707/streamer/utils"
 )
 
 func videoListHandler(svc *services.VideoService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
 			return
 		}
-		videos, err := svc.ListVideos()
+		videos, err := svc.ListVideos(r.Context())
 		if err != nil {
-			log.Printf("Error listing videos: %v", err)
-			http.Error(w, fmt.Sprintf("Failed to list videos: %v", err), http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed to list videos", "error", err)
+			WriteError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to list videos: %v", err))
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
 		w.Header().Set("Cache-Control", "no-cache")
 
-		if err := json.NewEncoder(w).Encode(videos); err != nil {
-			log.Printf("Error encoding video response: %v", err)
-			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		if err := encodeJSON(r.Context(), w, videos); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to encode video response", "error", err)
+			WriteError(w, http.StatusInternalServerError, "Failed to encode response")
 		}
 	}
 }
 func videoListByGenreHandler(svc *services.VideoService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
 			return
 		}
 		genre := strings.TrimPrefix(r.URL.Path, "/api/videos/genre/")
 		if genre == "" {
-			http.Error(w, "Genre required", http.StatusBadRequest)
+			WriteError(w, http.StatusBadRequest, "Genre required")
 			return
 		}
 
-		videos, err := svc.ListVideosByGenre(genre)
+		videos, err := svc.ListVideosByGenre(r.Context(), genre)
 		if err != nil {
-			http.Error(w, "Failed to list videos", http.StatusInternalServerError)
+			WriteError(w, http.StatusInternalServerError, "Failed to list videos")
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		w.Header().Set("Cache-Control", "no-cache")
 
-		if err := json.NewEncoder(w).Encode(videos); err != nil {
-			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		if err := encodeJSON(r.Context(), w, videos); err != nil {
+			WriteError(w, http.StatusInternalServerError, "Failed to encode response")
 		}
 	}
 }
 
-func genreListHandler(svc *services.VideoService) http.HandlerFunc {
+func videoSearchHandler(svc *services.VideoService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
 			return
 		}
-		genres, err := svc.GetGenres()
+		term := strings.TrimSpace(r.URL.Query().Get("q"))
+		if term == "" {
+			WriteError(w, http.StatusBadRequest, "Search query required")
+			return
+		}
+
+		videos, err := svc.SearchVideos(r.Context(), term)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to search videos", "error", err)
+			WriteError(w, http.StatusInternalServerError, "Failed to search videos")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+
+		if err := encodeJSON(r.Context(), w, videos); err != nil {
+			WriteError(w, http.StatusInternalServerError, "Failed to encode response")
+		}
+	}
+}
+
+func genreListHandler(svc *services.VideoService, authSvc *services.AuthService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			if !authorize(authSvc, w, r, auth.PermView) {
+				return
+			}
+		case http.MethodPost:
+			createGenre(svc, authSvc, w, r)
+			return
+		default:
+			WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		genres, err := svc.GetGenres(r.Context())
 		if err != nil {
-			http.Error(w, "Failed to list genres", http.StatusInternalServerError)
+			WriteError(w, http.StatusInternalServerError, "Failed to list genres")
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
 		w.Header().Set("Cache-Control", "no-cache")
 
-		if err := json.NewEncoder(w).Encode(genres); err != nil {
-			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		if err := encodeJSON(r.Context(), w, genres); err != nil {
+			WriteError(w, http.StatusInternalServerError, "Failed to encode response")
+		}
+	}
+}
+
+func createGenre(svc *services.VideoService, authSvc *services.AuthService, w http.ResponseWriter, r *http.Request) {
+	if !authorize(authSvc, w, r, auth.PermManageGenres) {
+		return
+	}
+	var req db.Genre
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		WriteError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	genre, err := svc.CreateGenre(r.Context(), req.Name)
+	if err != nil {
+		writeServiceError(w, r, err, "create genre")
+		return
+	}
+	authSvc.Audit(r.Context(), "create_genre", genre.Name, services.AuditSuccess, "")
+	writeJSON(w, r, http.StatusCreated, genre)
+}
+
+// genreHandler serves DELETE /api/genres/{id}.
+func genreHandler(svc *services.VideoService, authSvc *services.AuthService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/genres/"))
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, "Invalid genre ID")
+			return
+		}
+		if !authorize(authSvc, w, r, auth.PermManageGenres) {
+			return
+		}
+		if err := svc.DeleteGenre(r.Context(), id); err != nil {
+			writeServiceError(w, r, err, "delete genre")
+			return
+		}
+		authSvc.Audit(r.Context(), "delete_genre", strconv.Itoa(id), services.AuditSuccess, "")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// videoHandler serves GET, PUT (metadata edits) and DELETE on
+// /api/videos/{id}, POST /api/videos/{id}/signed-url, PUT
+// /api/videos/{id}/visibility and /api/videos/{id}/shares.
+func videoHandler(svc *services.VideoService, shareSvc *services.ShareService, authSvc *services.AuthService, secureCookies bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		idStr, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/videos/"), "/")
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			WriteError(w, http.StatusNotFound, "Video not found")
+			return
+		}
+		switch sub {
+		case "":
+		case "signed-url":
+			signedURLHandler(svc, authSvc, secureCookies, id, w, r)
+			return
+		case "visibility":
+			videoVisibilityHandler(svc, authSvc, id, w, r)
+			return
+		case "shares":
+			videoSharesHandler(shareSvc, authSvc, secureCookies, id, w, r)
+			return
+		default:
+			WriteError(w, http.StatusNotFound, "Not found")
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			if !authorize(authSvc, w, r, auth.PermView) {
+				return
+			}
+			video, err := svc.GetVideo(r.Context(), id)
+			if err != nil {
+				writeServiceError(w, r, err, "get video")
+				return
+			}
+			writeJSON(w, r, http.StatusOK, video)
+		case http.MethodPut:
+			if !authorize(authSvc, w, r, auth.PermEdit) {
+				return
+			}
+			var update services.VideoUpdate
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&update); err != nil {
+				WriteError(w, http.StatusBadRequest, "Invalid request body")
+				return
+			}
+			video, err := svc.UpdateVideo(r.Context(), id, update)
+			if err != nil {
+				writeServiceError(w, r, err, "update video")
+				return
+			}
+			authSvc.Audit(r.Context(), "edit_video", strconv.Itoa(id), services.AuditSuccess, video.Title)
+			writeJSON(w, r, http.StatusOK, video)
+		case http.MethodDelete:
+			if !authorize(authSvc, w, r, auth.PermDelete) {
+				return
+			}
+			video, err := svc.DeleteVideo(r.Context(), id)
+			if err != nil {
+				writeServiceError(w, r, err, "delete video")
+				return
+			}
+			authSvc.Audit(r.Context(), "delete_video", strconv.Itoa(id), services.AuditSuccess, video.Title)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
 		}
 	}
 }
@@ -82,22 +238,29 @@ func genreListHandler(svc *services.VideoService) http.HandlerFunc {
 func videoStreamHandler(svc *services.VideoService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
 			return
 		}
 		path := strings.TrimPrefix(r.URL.Path, "/videos/")
 		if path == "" {
-			http.Error(w, "Video path required", http.StatusBadRequest)
+			WriteError(w, http.StatusBadRequest, "Video path required")
 			return
 		}
 		err := svc.StreamVideo(w, r, path)
 		if err != nil {
-			if err == utils.ErrNotFound {
-				http.Error(w, "Video not found", http.StatusNotFound)
+			if r.Context().Err() != nil {
+				// The client went away or the server is shutting down;
+				// the response is already partly written.
+				return
+			}
+			if errors.Is(err, auth.ErrInvalidSignature) {
+				WriteError(w, http.StatusForbidden, "Invalid or expired link")
+			} else if err == utils.ErrNotFound {
+				WriteError(w, http.StatusNotFound, "Video not found")
 			} else if err == utils.ErrInvalidPath {
-				http.Error(w, "Invalid video path", http.StatusForbidden)
+				WriteError(w, http.StatusForbidden, "Invalid video path")
 			} else {
-				http.Error(w, "Error streaming video", http.StatusInternalServerError)
+				WriteError(w, http.StatusInternalServerError, "Error streaming video")
 			}
 		}
 	}
@@ -106,24 +269,83 @@ func videoStreamHandler(svc *services.VideoService) http.HandlerFunc {
 func coverImageHandler(svc *services.VideoService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
 			return
 		}
 
 		path := strings.TrimPrefix(r.URL.Path, "/covers/")
 		if path == "" {
-			http.Error(w, "Image path required", http.StatusBadRequest)
+			WriteError(w, http.StatusBadRequest, "Image path required")
 			return
 		}
 		err := svc.ServeCoverImage(w, r, path)
 		if err != nil {
-			if err == utils.ErrNotFound {
-				http.Error(w, "Image not found", http.StatusNotFound)
+			if errors.Is(err, auth.ErrInvalidSignature) {
+				WriteError(w, http.StatusForbidden, "Invalid or expired link")
+			} else if err == utils.ErrNotFound {
+				WriteError(w, http.StatusNotFound, "Image not found")
 			} else if err == utils.ErrInvalidPath {
-				http.Error(w, "Invalid image path", http.StatusForbidden)
+				WriteError(w, http.StatusForbidden, "Invalid image path")
 			} else {
-				http.Error(w, "Error serving image", http.StatusInternalServerError)
+				WriteError(w, http.StatusInternalServerError, "Error serving image")
 			}
 		}
 	}
 }
+
+type signedURLRequest struct {
+	// ExpiresIn is a duration such as "2h"; empty means the default.
+	ExpiresIn string `json:"expires_in"`
+	// BindIP limits the URLs to the address the request came from.
+	BindIP bool `json:"bind_ip"`
+}
+
+// signedURLHandler serves POST /api/videos/{id}/signed-url, which returns
+// stream and cover URLs that work without logging in, for players such as
+// VLC or a smart TV.
+func signedURLHandler(svc *services.VideoService, authSvc *services.AuthService, secureCookies bool, id int, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if !authorize(authSvc, w, r, auth.PermView) {
+		return
+	}
+	var req signedURLRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil && err != io.EOF {
+		WriteError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	var ttl time.Duration
+	if req.ExpiresIn != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.ExpiresIn); err != nil || ttl <= 0 {
+			WriteError(w, http.StatusBadRequest, "Invalid expires_in duration")
+			return
+		}
+	}
+	var ip string
+	if req.BindIP {
+		ip = utils.ClientIP(r.Context())
+	}
+	urls, err := svc.SignVideoURLs(r.Context(), id, services.CurrentUser(r.Context()), ttl, ip)
+	if err != nil {
+		writeServiceError(w, r, err, "sign URL")
+		return
+	}
+	base := baseURL(r, secureCookies)
+	urls.URL = base + urls.URL
+	if urls.CoverURL != "" {
+		urls.CoverURL = base + urls.CoverURL
+	}
+	authSvc.Audit(r.Context(), "sign_url", strconv.Itoa(id), services.AuditSuccess, ip)
+	writeJSON(w, r, http.StatusOK, urls)
+}
+
+// encodeJSON writes v as JSON in its own span, so slow encoding of large
+// listings shows up separately from the queries in a trace.
+func encodeJSON(ctx context.Context, w io.Writer, v interface{}) error {
+	_, span := tracing.Start(ctx, "json.Encode")
+	defer span.End()
+	return json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,350 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"DevMaan707/streamer/tracing"
+)
+
+// ErrTokenRejected is returned by OIDCProvider.Exchange and Refresh when the
+// identity provider refuses the code or refresh token, as opposed to being
+// unreachable.
+var ErrTokenRejected = errors.New("identity provider rejected the token")
+
+const (
+	// oidcTimeout bounds every request to the identity provider.
+	oidcTimeout = 10 * time.Second
+	// jwksMinRefresh limits how often an unknown key ID makes the signing
+	// keys be fetched again.
+	jwksMinRefresh = time.Minute
+	// clockSkew is tolerated between us and the identity provider when
+	// checking exp and iat.
+	clockSkew = time.Minute
+)
+
+// OIDCProvider is an OpenID Connect relying party for one issuer, using the
+// authorization code flow with PKCE. The issuer's discovery document and
+// signing keys are fetched on first use and cached.
+type OIDCProvider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	scopes       []string
+	client       *http.Client
+
+	mu          sync.Mutex
+	meta        *oidcMetadata
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+}
+
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// NewOIDCProvider returns a relying party registered with the issuer as
+// clientID. An empty clientSecret makes it a public client that relies on
+// PKCE alone.
+func NewOIDCProvider(issuer, clientID, clientSecret, redirectURL string, scopes []string) *OIDCProvider {
+	return &OIDCProvider{
+		issuer:       strings.TrimRight(issuer, "/"),
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		redirectURL:  redirectURL,
+		scopes:       scopes,
+		client:       &http.Client{Timeout: oidcTimeout},
+	}
+}
+
+// Issuer returns the issuer identifier, which together with the subject
+// claim identifies a user.
+func (p *OIDCProvider) Issuer() string {
+	return p.issuer
+}
+
+// NewPKCEVerifier returns a random PKCE code verifier.
+func NewPKCEVerifier() (string, error) {
+	return NewToken()
+}
+
+// AuthCodeURL returns the identity provider URL to send the browser to.
+// state and nonce are echoed back in the callback and the ID token, and
+// verifier is the PKCE code verifier later passed to Exchange.
+func (p *OIDCProvider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(meta.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid authorization endpoint: %w", err)
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.clientID)
+	q.Set("redirect_uri", p.redirectURL)
+	q.Set("scope", strings.Join(p.scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", s256Challenge(verifier))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// OIDCTokens is a token endpoint response. Claims holds the verified
+// claims of the ID token, which is optional in refresh responses.
+type OIDCTokens struct {
+	IDToken      string
+	RefreshToken string
+	Claims       Claims
+}
+
+// Exchange redeems an authorization code and verifies the ID token, which
+// must carry nonce.
+func (p *OIDCProvider) Exchange(ctx context.Context, code, verifier, nonce string) (*OIDCTokens, error) {
+	tokens, err := p.token(ctx, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURL},
+		"code_verifier": {verifier},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if tokens.IDToken == "" {
+		return nil, errors.New("token response has no ID token")
+	}
+	if tokens.Claims, err = p.VerifyIDToken(ctx, tokens.IDToken); err != nil {
+		return nil, err
+	}
+	if tokens.Claims.String("nonce") != nonce {
+		return nil, errors.New("ID token nonce doesn't match")
+	}
+	return tokens, nil
+}
+
+// Refresh uses a refresh token to check that the user's login at the
+// identity provider is still valid. The response may rotate the refresh
+// token and carry a new ID token, which is verified; a missing refresh
+// token in the response means the old one stays valid.
+func (p *OIDCProvider) Refresh(ctx context.Context, refreshToken string) (*OIDCTokens, error) {
+	tokens, err := p.token(ctx, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if tokens.RefreshToken == "" {
+		tokens.RefreshToken = refreshToken
+	}
+	if tokens.IDToken != "" {
+		if tokens.Claims, err = p.VerifyIDToken(ctx, tokens.IDToken); err != nil {
+			return nil, err
+		}
+	}
+	return tokens, nil
+}
+
+// token calls the token endpoint, authenticating with the client secret
+// if there is one.
+func (p *OIDCProvider) token(ctx context.Context, form url.Values) (*OIDCTokens, error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ctx, span := tracing.StartKind(ctx, "OIDC token "+form.Get("grant_type"), tracing.KindClient)
+	defer span.End()
+
+	if p.clientSecret == "" {
+		form.Set("client_id", p.clientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+	}
+	tracing.Inject(ctx, req.Header)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to call token endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		RefreshToken     string `json:"refresh_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil && resp.StatusCode == http.StatusOK {
+		return nil, fmt.Errorf("failed to decode token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("token endpoint returned %s: %s %s", resp.Status, body.Error, body.ErrorDescription)
+		span.RecordError(err)
+		// invalid_grant and friends come with 400 or 401; anything else
+		// is the provider having trouble.
+		if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized {
+			return nil, fmt.Errorf("%w: %v", ErrTokenRejected, err)
+		}
+		return nil, err
+	}
+	return &OIDCTokens{IDToken: body.IDToken, RefreshToken: body.RefreshToken}, nil
+}
+
+// VerifyIDToken checks an ID token's signature, issuer, audience and
+// expiry and returns its claims.
+func (p *OIDCProvider) VerifyIDToken(ctx context.Context, raw string) (Claims, error) {
+	header, claims, signed, sig, err := parseJWT(raw)
+	if err != nil {
+		return nil, err
+	}
+	key, err := p.signingKey(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWS(header.Alg, key, signed, sig); err != nil {
+		return nil, err
+	}
+
+	if iss := claims.String("iss"); iss != p.issuer {
+		return nil, fmt.Errorf("ID token issuer %q doesn't match %q", iss, p.issuer)
+	}
+	aud := claims.Strings("aud")
+	if !slices.Contains(aud, p.clientID) {
+		return nil, errors.New("ID token isn't meant for this client")
+	}
+	if azp := claims.String("azp"); azp != "" && azp != p.clientID {
+		return nil, errors.New("ID token was issued to another client")
+	}
+	now := time.Now()
+	exp, ok := claims.Time("exp")
+	if !ok || now.After(time.Unix(exp, 0).Add(clockSkew)) {
+		return nil, errors.New("ID token has expired")
+	}
+	if iat, ok := claims.Time("iat"); ok && time.Unix(iat, 0).After(now.Add(clockSkew)) {
+		return nil, errors.New("ID token is issued in the future")
+	}
+	if claims.String("sub") == "" {
+		return nil, errors.New("ID token has no subject")
+	}
+	return claims, nil
+}
+
+// metadata returns the issuer's discovery document, fetching it on first
+// use.
+func (p *OIDCProvider) metadata(ctx context.Context) (*oidcMetadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.meta != nil {
+		return p.meta, nil
+	}
+	var meta oidcMetadata
+	if err := p.getJSON(ctx, p.issuer+"/.well-known/openid-configuration", &meta); err != nil {
+		return nil, fmt.Errorf("failed to discover OIDC issuer: %w", err)
+	}
+	if strings.TrimRight(meta.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("discovery document is for issuer %q, not %q", meta.Issuer, p.issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, errors.New("discovery document lacks the authorization, token or JWKS endpoint")
+	}
+	p.meta = &meta
+	return p.meta, nil
+}
+
+// signingKey returns the issuer's key with the given ID. The key set is
+// fetched again when an unknown ID shows up, as providers rotate keys, but
+// at most once a minute.
+func (p *OIDCProvider) signingKey(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.lookupKey(kid); ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetched) < jwksMinRefresh {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := p.getJSON(ctx, meta.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("failed to fetch signing keys: %w", err)
+	}
+	p.keys = make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if key, err := k.publicKey(); err == nil {
+			p.keys[k.Kid] = key
+		}
+	}
+	p.keysFetched = time.Now()
+	if key, ok := p.lookupKey(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// lookupKey finds a cached key. A token without a key ID matches when the
+// issuer has only one key.
+func (p *OIDCProvider) lookupKey(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, ok := p.keys[kid]
+	return key, ok
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, url string, v interface{}) error {
+	ctx, span := tracing.StartKind(ctx, "OIDC GET", tracing.KindClient)
+	defer span.End()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	tracing.Inject(ctx, req.Header)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
@@ -0,0 +1,56 @@
+package auth
+
+import "fmt"
+
+// Role is what a user is allowed to do, granted as a fixed set of
+// permissions.
+type Role string
+
+const (
+	RoleAdmin    Role = "admin"
+	RoleEditor   Role = "editor"
+	RoleUploader Role = "uploader"
+	RoleViewer   Role = "viewer"
+)
+
+// Roles lists every role, most privileged first.
+var Roles = []Role{RoleAdmin, RoleEditor, RoleUploader, RoleViewer}
+
+// Permission is a single operation that can be allowed or denied.
+type Permission string
+
+const (
+	PermView         Permission = "view"
+	PermUpload       Permission = "upload"
+	PermEdit         Permission = "edit"
+	PermDelete       Permission = "delete"
+	PermManageGenres Permission = "manage_genres"
+	PermShare        Permission = "share"
+	PermAdmin        Permission = "admin"
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleAdmin:    {PermView, PermUpload, PermEdit, PermDelete, PermManageGenres, PermShare, PermAdmin},
+	RoleEditor:   {PermView, PermUpload, PermEdit, PermDelete, PermManageGenres, PermShare},
+	RoleUploader: {PermView, PermUpload, PermShare},
+	RoleViewer:   {PermView},
+}
+
+// ParseRole validates a role name.
+func ParseRole(s string) (Role, error) {
+	r := Role(s)
+	if _, ok := rolePermissions[r]; !ok {
+		return "", fmt.Errorf("unknown role %q, must be admin, editor, uploader or viewer", s)
+	}
+	return r, nil
+}
+
+// Can reports whether the role grants p. Unknown roles grant nothing.
+func (r Role) Can(p Permission) bool {
+	for _, granted := range rolePermissions[r] {
+		if granted == p {
+			return true
+		}
+	}
+	return false
+}
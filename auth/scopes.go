@@ -0,0 +1,51 @@
+package auth
+
+import "fmt"
+
+// Scope limits what an API token may do. A token never grants more than
+// its owner's role.
+type Scope string
+
+const (
+	ScopeVideosRead  Scope = "videos:read"
+	ScopeVideosWrite Scope = "videos:write"
+	ScopeUpload      Scope = "upload"
+	ScopeAdmin       Scope = "admin"
+)
+
+var scopePermissions = map[Scope][]Permission{
+	ScopeVideosRead:  {PermView},
+	ScopeVideosWrite: {PermEdit, PermDelete, PermManageGenres, PermShare},
+	ScopeUpload:      {PermUpload},
+	ScopeAdmin:       {PermAdmin},
+}
+
+// ParseScope validates a scope name.
+func ParseScope(s string) (Scope, error) {
+	sc := Scope(s)
+	if _, ok := scopePermissions[sc]; !ok {
+		return "", fmt.Errorf("unknown scope %q, must be videos:read, videos:write, upload or admin", s)
+	}
+	return sc, nil
+}
+
+// Allows reports whether the scope grants p.
+func (sc Scope) Allows(p Permission) bool {
+	for _, granted := range scopePermissions[sc] {
+		if granted == p {
+			return true
+		}
+	}
+	return false
+}
+
+// UsableBy reports whether the role has any of the permissions the scope
+// grants, i.e. whether a token with it would be of any use to the role.
+func (sc Scope) UsableBy(r Role) bool {
+	for _, p := range scopePermissions[sc] {
+		if r.Can(p) {
+			return true
+		}
+	}
+	return false
+}
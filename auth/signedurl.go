@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidSignature is returned for signed URLs that were tampered with,
+// have expired, are used from another address than they were bound to, or
+// were signed with a key that no longer exists.
+var ErrInvalidSignature = errors.New("invalid or expired link")
+
+// SigningKeys supplies the keys URLs are signed with. vault.Keyring
+// implements it, so the keys are rotated like the encryption keys.
+type SigningKeys interface {
+	ActiveKey() (uint32, []byte)
+	Key(id uint32) ([]byte, error)
+}
+
+// URLGrant is what a signed URL allows: fetching Path on behalf of UserID
+// until Expires, and only from IP if it is set.
+type URLGrant struct {
+	Path    string
+	UserID  int
+	IP      string
+	Expires time.Time
+}
+
+// URLSigner signs and verifies URLs with an HMAC-SHA256 in the query
+// string. The id of the key used is part of the URL, so links signed with
+// an older key keep working after a rotation as long as the key is kept.
+type URLSigner struct {
+	keys SigningKeys
+}
+
+func NewURLSigner(keys SigningKeys) *URLSigner {
+	return &URLSigner{keys: keys}
+}
+
+// IsSigned reports whether a query string carries a signature.
+func IsSigned(q url.Values) bool {
+	return q.Has("sig")
+}
+
+// Sign returns g.Path with the grant and its signature in the query
+// string.
+func (s *URLSigner) Sign(g URLGrant) string {
+	kid, key := s.keys.ActiveKey()
+	q := url.Values{}
+	q.Set("exp", strconv.FormatInt(g.Expires.Unix(), 10))
+	q.Set("uid", strconv.Itoa(g.UserID))
+	if g.IP != "" {
+		q.Set("ip", g.IP)
+	}
+	q.Set("kid", strconv.FormatUint(uint64(kid), 10))
+	q.Set("sig", base64.RawURLEncoding.EncodeToString(urlMAC(key, kid, g.Path, q)))
+	u := url.URL{Path: g.Path, RawQuery: q.Encode()}
+	return u.String()
+}
+
+// Verify checks the signature in q for a request for path from clientIP
+// and returns the grant it carries.
+func (s *URLSigner) Verify(path string, q url.Values, clientIP string, now time.Time) (URLGrant, error) {
+	var g URLGrant
+	kid, err := strconv.ParseUint(q.Get("kid"), 10, 32)
+	if err != nil {
+		return g, ErrInvalidSignature
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(q.Get("sig"))
+	if err != nil {
+		return g, ErrInvalidSignature
+	}
+	key, err := s.keys.Key(uint32(kid))
+	if err != nil {
+		return g, ErrInvalidSignature
+	}
+	if !hmac.Equal(sig, urlMAC(key, uint32(kid), path, q)) {
+		return g, ErrInvalidSignature
+	}
+
+	exp, err := strconv.ParseInt(q.Get("exp"), 10, 64)
+	if err != nil {
+		return g, ErrInvalidSignature
+	}
+	uid, err := strconv.Atoi(q.Get("uid"))
+	if err != nil {
+		return g, ErrInvalidSignature
+	}
+	g = URLGrant{Path: path, UserID: uid, IP: q.Get("ip"), Expires: time.Unix(exp, 0)}
+	if !now.Before(g.Expires) {
+		return g, ErrInvalidSignature
+	}
+	if g.IP != "" && g.IP != clientIP {
+		return g, ErrInvalidSignature
+	}
+	return g, nil
+}
+
+// urlMAC signs the key id, the path and the grant parameters of q. Other
+// query parameters, such as ones a player adds, are ignored.
+func urlMAC(key []byte, kid uint32, path string, q url.Values) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.Join([]string{
+		"v1",
+		strconv.FormatUint(uint64(kid), 10),
+		path,
+		q.Get("exp"),
+		q.Get("uid"),
+		q.Get("ip"),
+	}, "\n")))
+	return mac.Sum(nil)
+}
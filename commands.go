@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"DevMaan707/streamer/auth"
+	"DevMaan707/streamer/db"
+	"DevMaan707/streamer/logging"
+	"DevMaan707/streamer/services"
+	"DevMaan707/streamer/vault"
+)
+
+// runRotateKey adds a new active key to the key file. Servers re-encrypt
+// every stored file that still uses an older key in the background: a
+// running server after a SIGHUP, others when they next start. They keep
+// serving throughout, reading files with whichever key they use.
+func runRotateKey(args []string) {
+	cfg, err := loadConfig(flag.NewFlagSet("rotate-key", flag.ExitOnError), args)
+	if err != nil {
+		fatal("Configuration error", "error", err)
+	}
+	logging.Setup(cfg.Log)
+	if cfg.EncryptionKeyFile == "" {
+		fatal("rotate-key: no encryption key file configured")
+	}
+	keyring, err := vault.LoadKeyring(cfg.EncryptionKeyFile)
+	if err != nil {
+		fatal("Failed to load encryption keys", "error", err)
+	}
+	id, err := keyring.Rotate()
+	if err != nil {
+		fatal("Failed to rotate encryption key", "error", err)
+	}
+	slog.Info("New encryption key added; send SIGHUP to the server to use it and re-encrypt stored files in the background",
+		"key_id", id)
+}
+
+// runRotateSigningKey adds a new active key to the URL signing key file.
+// URLs signed with older keys stay valid until they expire, as long as the
+// keys are kept in the file. Running servers sign with the new key after a
+// SIGHUP.
+func runRotateSigningKey(args []string) {
+	cfg, err := loadConfig(flag.NewFlagSet("rotate-signing-key", flag.ExitOnError), args)
+	if err != nil {
+		fatal("Configuration error", "error", err)
+	}
+	logging.Setup(cfg.Log)
+	if cfg.Auth.URLSigningKeyFile == "" {
+		fatal("rotate-signing-key: no URL signing key file configured")
+	}
+	keyring, err := vault.LoadKeyring(cfg.Auth.URLSigningKeyFile)
+	if err != nil {
+		fatal("Failed to load URL signing keys", "error", err)
+	}
+	id, err := keyring.Rotate()
+	if err != nil {
+		fatal("Failed to rotate URL signing key", "error", err)
+	}
+	slog.Info("New URL signing key is now active", "key_id", id)
+}
+
+// runMigrate implements "migrate up|down|status" against the configured
+// database.
+func runMigrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	steps := fs.Int("steps", 1, "Number of migrations to roll back with down")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: streamer migrate [flags] up|down|status")
+		fs.PrintDefaults()
+	}
+	cfg, err := loadConfig(fs, args)
+	if err != nil {
+		fatal("Configuration error", "error", err)
+	}
+	logging.Setup(cfg.Log)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	connected, err := connectDatabase(cfg)
+	if err != nil {
+		fatal("Database initialization failed", "error", err)
+	}
+	if !connected {
+		fatal("migrate: the configured backend has no schema to migrate", "driver", cfg.Database.Driver)
+	}
+	defer db.DB.Close()
+
+	switch fs.Arg(0) {
+	case "up":
+		count, err := db.MigrateUp()
+		if err != nil {
+			fatal("Migration failed", "error", err)
+		}
+		fmt.Printf("Applied %d migrations\n", count)
+	case "down":
+		count, err := db.MigrateDown(*steps)
+		if err != nil {
+			fatal("Rollback failed", "error", err)
+		}
+		fmt.Printf("Rolled back %d migrations\n", count)
+	case "status":
+		states, err := db.MigrationStatus()
+		if err != nil {
+			fatal("Failed to read migration status", "error", err)
+		}
+		for _, s := range states {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%-30s %s\n", s.Version, s.Name, applied)
+		}
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+}
+
+// runUser implements "user add [-role ROLE] NAME", "user passwd NAME" and
+// "user unlock NAME". The password is read from the first line of standard
+// input.
+func runUser(args []string) {
+	fs := flag.NewFlagSet("user", flag.ExitOnError)
+	role := fs.String("role", string(auth.RoleViewer), "Role of the new user: admin, editor, uploader or viewer")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: streamer user [flags] add|passwd NAME < password")
+		fmt.Fprintln(fs.Output(), "       streamer user [flags] unlock NAME")
+		fs.PrintDefaults()
+	}
+	cfg, err := loadConfig(fs, args)
+	if err != nil {
+		fatal("Configuration error", "error", err)
+	}
+	logging.Setup(cfg.Log)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	action, username := fs.Arg(0), fs.Arg(1)
+	if action != "add" && action != "passwd" && action != "unlock" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if cfg.Database.Driver == "memory" {
+		fatal("user: the memory backend doesn't persist users", "driver", cfg.Database.Driver)
+	}
+
+	var password string
+	if action != "unlock" {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			fatal("user: failed to read password from standard input", "error", err)
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+
+	store, err := openStore(cfg)
+	if err != nil {
+		fatal("Database initialization failed", "error", err)
+	}
+	defer db.DB.Close()
+
+	authSvc := services.NewAuthService(store, store, store, cfg.Auth.SessionTTL, cfg.Auth.InviteTTL, services.LockoutPolicy{
+		Attempts:   cfg.Auth.LockoutAttempts,
+		IPAttempts: cfg.Auth.IPLockoutAttempts,
+		Duration:   cfg.Auth.LockoutDuration,
+	})
+	ctx := context.Background()
+	switch action {
+	case "add":
+		user, err := authSvc.CreateUser(ctx, username, password, auth.Role(*role))
+		if err != nil {
+			fatal("Failed to create user", "error", err)
+		}
+		fmt.Printf("Created user %s\n", user.Username)
+	case "passwd":
+		if err := authSvc.SetPassword(ctx, username, password); err != nil {
+			fatal("Failed to set password", "error", err)
+		}
+		fmt.Printf("Changed password of %s and ended their sessions\n", username)
+	case "unlock":
+		user, err := store.GetUserByUsername(ctx, strings.ToLower(username))
+		if err != nil {
+			fatal("Failed to find user", "error", err)
+		}
+		if _, err := authSvc.UnlockAccount(ctx, user.ID); err != nil {
+			fatal("Failed to unlock account", "error", err)
+		}
+		fmt.Printf("Unlocked %s\n", user.Username)
+	}
+}
@@ -1,21 +1,439 @@
 package config
 
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the effective server configuration. It is built by Load from,
+// in increasing precedence: the defaults in NewConfig, the TOML config
+// file, STREAMER_* environment variables and command-line flags.
 type Config struct {
-	Port          int
-	VideoDir      string
-	CoverImageDir string
-	MaxUploadSize int
+	// Port is used for the default listener when Listeners is empty.
+	Port          int    `toml:"port"`
+	VideoDir      string `toml:"video_dir"`
+	CoverImageDir string `toml:"cover_dir"`
+	// MaxUploadSize is in megabytes.
+	MaxUploadSize int `toml:"max_upload_mb"`
+	// CORSOrigins lists the origins allowed to call the API from a browser;
+	// "*" allows any origin.
+	CORSOrigins []string `toml:"cors_origins"`
+	// ShutdownTimeout is how long in-flight requests, streams included,
+	// may take to finish after a shutdown signal before they are cancelled.
+	ShutdownTimeout time.Duration `toml:"shutdown_timeout"`
+	// TrustedProxies lists the IPs and CIDR ranges of reverse proxies whose
+	// forwarding headers are believed. TrustedProxiesFile adds more ranges
+	// from a file with one per line, such as Cloudflare's published lists.
+	TrustedProxies     []string         `toml:"trusted_proxies"`
+	TrustedProxiesFile string           `toml:"trusted_proxies_file"`
+	Listeners          []ListenerConfig `toml:"listeners"`
+	TLS                TLSConfig        `toml:"tls"`
+	Database           DatabaseConfig   `toml:"database"`
+	Log                LogConfig        `toml:"log"`
+	Tracing            TracingConfig    `toml:"tracing"`
+	Auth               AuthConfig       `toml:"auth"`
+	RateLimit          RateLimitConfig  `toml:"rate_limit"`
+	// AdminToken is a bearer token accepted by /api/admin/status in place
+	// of an admin's session, for scripts and monitoring. Empty disables it.
+	AdminToken string `toml:"admin_token"`
+	// EncryptionKeyFile enables encryption at rest for uploaded videos and
+	// covers when set.
+	EncryptionKeyFile string `toml:"encryption_key_file"`
+}
+
+// ListenerConfig is one socket to serve on. Address is a URL:
+//
+//	http://127.0.0.1:9090       plain TCP
+//	https://:443                TCP with the [tls] certificate
+//	unix:///run/starflix.sock   unix socket
+//	systemd://public            socket inherited from systemd by its
+//	                            FileDescriptorName, or systemd://0 by index
+//
+// Routes selects what is served: "public" (the site and API), "admin" or
+// "all".
+type ListenerConfig struct {
+	Address string `toml:"address"`
+	Routes  string `toml:"routes"`
+	// SocketMode sets the permissions of a unix socket, in octal.
+	SocketMode string `toml:"socket_mode"`
+}
+
+// EffectiveListeners returns the configured listeners, or a single public
+// listener on Port if none are configured.
+func (c *Config) EffectiveListeners() []ListenerConfig {
+	if len(c.Listeners) > 0 {
+		return c.Listeners
+	}
+	scheme := "http"
+	if c.TLS.Enabled() {
+		scheme = "https"
+	}
+	return []ListenerConfig{{
+		Address: fmt.Sprintf("%s://:%d", scheme, c.Port),
+		Routes:  "public",
+	}}
+}
+
+// ListenAddress is a parsed ListenerConfig.Address.
+type ListenAddress struct {
+	// Network is "tcp", "unix" or "systemd".
+	Network string
+	// Address is the host:port, socket path or systemd socket name.
+	Address string
+	TLS     bool
+}
+
+func ParseListenAddress(addr string) (ListenAddress, error) {
+	scheme, rest, ok := strings.Cut(addr, "://")
+	if !ok {
+		// A bare host:port is plain HTTP.
+		scheme, rest = "http", addr
+	}
+	switch scheme {
+	case "http", "https":
+		if _, _, err := net.SplitHostPort(rest); err != nil {
+			return ListenAddress{}, fmt.Errorf("%q: %w", addr, err)
+		}
+		return ListenAddress{Network: "tcp", Address: rest, TLS: scheme == "https"}, nil
+	case "unix", "systemd":
+		if rest == "" {
+			return ListenAddress{}, fmt.Errorf("%q: missing %s socket", addr, scheme)
+		}
+		return ListenAddress{Network: scheme, Address: rest}, nil
+	default:
+		return ListenAddress{}, fmt.Errorf("%q: unsupported scheme %q", addr, scheme)
+	}
+}
+
+// TLSConfig enables HTTPS (and with it HTTP/2) when CertFile and KeyFile
+// are set. The certificate files are re-read when they change on disk.
+type TLSConfig struct {
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+	// RedirectPort, if set, serves plain HTTP on that port and redirects
+	// every request to HTTPS.
+	RedirectPort int `toml:"redirect_port"`
+	// ClientCAFile and ClientAuth enable client-certificate (mTLS)
+	// authentication. ClientAuth is "none", "optional" (verify a
+	// certificate if one is sent) or "require".
+	ClientCAFile string `toml:"client_ca_file"`
+	ClientAuth   string `toml:"client_auth"`
+}
+
+// Enabled reports whether the server should serve HTTPS.
+func (t *TLSConfig) Enabled() bool {
+	return t.CertFile != "" && t.KeyFile != ""
+}
+
+// LogConfig controls the application log and the optional access log.
+type LogConfig struct {
+	// Level is "debug", "info", "warn" or "error".
+	Level string `toml:"level"`
+	// Format is "text" or "json".
+	Format string `toml:"format"`
+	// AccessLog, if set, is a file that receives one line per request in
+	// Combined Log Format. It is rotated once it grows past AccessLogMaxMB,
+	// keeping AccessLogMaxBackups old files.
+	AccessLog           string `toml:"access_log"`
+	AccessLogMaxMB      int    `toml:"access_log_max_mb"`
+	AccessLogMaxBackups int    `toml:"access_log_max_backups"`
+}
+
+// AuthConfig controls user logins.
+type AuthConfig struct {
+	// SessionTTL is how long a login lasts.
+	SessionTTL time.Duration `toml:"session_ttl"`
+	// InviteTTL is how long an invite can be used to register.
+	InviteTTL time.Duration `toml:"invite_ttl"`
+	// SecureCookies marks session cookies Secure on plain HTTP requests
+	// too, for deployments behind a TLS-terminating proxy. Cookies set over
+	// HTTPS are always Secure.
+	SecureCookies bool `toml:"secure_cookies"`
+	// URLSigningKeyFile holds the keys that sign stream and cover URLs for
+	// players that can't log in, in the format of the encryption key file.
+	// It is created on first start; empty disables signed URLs.
+	URLSigningKeyFile string `toml:"url_signing_key_file"`
+	// SignedURLTTL is how long signed URLs last unless asked otherwise.
+	SignedURLTTL time.Duration `toml:"signed_url_ttl"`
+	// LockoutAttempts consecutive failed logins to an account, or
+	// IPLockoutAttempts from one client address, lock it out for
+	// LockoutDuration. Each failure before that makes the next attempt
+	// wait, from a second doubling up to 30 seconds. Failures are
+	// forgotten after LockoutDuration without any. 0 turns either off.
+	LockoutAttempts   int           `toml:"lockout_attempts"`
+	IPLockoutAttempts int           `toml:"ip_lockout_attempts"`
+	LockoutDuration   time.Duration `toml:"lockout_duration"`
+	OIDC              OIDCConfig    `toml:"oidc"`
+}
+
+// RateLimitConfig limits how many requests one client may make to each
+// class of routes. Clients are told apart by their account when they send
+// valid credentials and by IP address otherwise.
+type RateLimitConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Store is "memory", counting requests in each instance separately, or
+	// "postgres", counting them in the database so that instances sharing
+	// it share their limits.
+	Store string `toml:"store"`
+	// Auth covers logging in, registering and linking devices.
+	Auth Limit `toml:"auth"`
+	// Upload covers uploads.
+	Upload Limit `toml:"upload"`
+	// Listing covers listing, searching and looking up videos and genres.
+	Listing Limit `toml:"listing"`
+	// Stream covers starting playback; the range requests of a playing
+	// video after its first aren't counted.
+	Stream Limit `toml:"stream"`
+}
+
+// Limit allows Requests requests in every Window. A Limit with no Requests
+// is unlimited.
+type Limit struct {
+	Requests int           `toml:"requests"`
+	Window   time.Duration `toml:"window"`
+}
+
+// String formats the limit as requests/window, the form ParseLimit reads.
+func (l Limit) String() string {
+	if l.Requests == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("%d/%s", l.Requests, l.Window)
+}
+
+// ParseLimit reads a limit written as requests/window, such as 10/1m, or
+// 0 for no limit.
+func ParseLimit(v string) (Limit, error) {
+	if strings.TrimSpace(v) == "0" {
+		return Limit{}, nil
+	}
+	requests, window, ok := strings.Cut(v, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("%q is not a limit like 10/1m", v)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(requests))
+	if err != nil {
+		return Limit{}, fmt.Errorf("%q: invalid number of requests", v)
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(window))
+	if err != nil {
+		return Limit{}, fmt.Errorf("%q: invalid window", v)
+	}
+	return Limit{Requests: n, Window: d}, nil
+}
+
+// OIDCConfig enables single sign-on through an OpenID Connect identity
+// provider when Issuer is set.
+type OIDCConfig struct {
+	Issuer       string `toml:"issuer"`
+	ClientID     string `toml:"client_id"`
+	ClientSecret string `toml:"client_secret"`
+	// RedirectURL is this server's callback as registered with the
+	// provider, https://<host>/api/auth/oidc/callback.
+	RedirectURL string   `toml:"redirect_url"`
+	Scopes      []string `toml:"scopes"`
+	// Name labels the login button.
+	Name string `toml:"name"`
+	// UsernameClaim names the ID token claim used as the username of
+	// provisioned accounts. The part of an email address before the @ is
+	// used.
+	UsernameClaim string `toml:"username_claim"`
+	// RolesClaim names the claim, a string or a list of strings such as
+	// group names, that RoleMapping maps to roles.
+	RolesClaim string `toml:"roles_claim"`
+	// RoleMapping maps values of RolesClaim to roles; the most privileged
+	// match wins. With a mapping, roles are managed at the identity
+	// provider and updated on every login and refresh. Users matching
+	// nothing get DefaultRole, or are refused if it is empty.
+	RoleMapping map[string]string `toml:"role_mapping"`
+	DefaultRole string            `toml:"default_role"`
+	// AutoProvision creates accounts for unknown users on their first
+	// login. Without it, users must link their provider account to an
+	// existing account while logged in.
+	AutoProvision bool `toml:"auto_provision"`
+	// RefreshInterval is how often a single sign-on session is checked
+	// with the identity provider using its refresh token. A session whose
+	// refresh is rejected ends.
+	RefreshInterval time.Duration `toml:"refresh_interval"`
+}
+
+// Enabled reports whether single sign-on is configured.
+func (o *OIDCConfig) Enabled() bool {
+	return o.Issuer != ""
+}
+
+// TracingConfig controls request tracing.
+type TracingConfig struct {
+	// Exporter is "none", "stdout" (one JSON line per span) or "otlp".
+	Exporter string `toml:"exporter"`
+	// Endpoint is the base URL of an OTLP/HTTP collector; spans are posted
+	// to Endpoint/v1/traces.
+	Endpoint string `toml:"endpoint"`
+	// SampleRatio is the fraction of new traces that are recorded. Traces
+	// started by a caller keep the caller's decision.
+	SampleRatio float64 `toml:"sample_ratio"`
+	ServiceName string  `toml:"service_name"`
+}
+
+// DatabaseConfig describes the storage backend and, for PostgreSQL, how to
+// connect to it. URL, when set, is a complete DSN and takes the place of the
+// individual connection fields.
+type DatabaseConfig struct {
+	// Driver selects the storage backend: "postgres", "sqlite" or "memory".
+	Driver string `toml:"driver"`
+	// DataDir holds the SQLite database file.
+	DataDir string `toml:"data_dir"`
+
+	URL          string `toml:"url"`
+	Host         string `toml:"host"`
+	Port         int    `toml:"port"`
+	Name         string `toml:"name"`
+	User         string `toml:"user"`
+	Password     string `toml:"password"`
+	PasswordFile string `toml:"password_file"`
+	SSLMode      string `toml:"sslmode"`
+	SSLRootCert  string `toml:"sslrootcert"`
+	SSLCert      string `toml:"sslcert"`
+	SSLKey       string `toml:"sslkey"`
+
+	MaxOpenConns    int           `toml:"max_open_conns"`
+	MaxIdleConns    int           `toml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `toml:"conn_max_lifetime"`
+	// ConnectRetries is how many times a failed initial connection is
+	// retried, waiting ConnectBackoff and doubling it after each attempt.
+	ConnectRetries int           `toml:"connect_retries"`
+	ConnectBackoff time.Duration `toml:"connect_backoff"`
 }
 
 func NewConfig() *Config {
 	return &Config{
-		Port:          8080,
-		VideoDir:      "./videos",
-		CoverImageDir: "./covers",
-		MaxUploadSize: 4096,
+		Port:            5101,
+		VideoDir:        "./videos",
+		CoverImageDir:   "./covers",
+		MaxUploadSize:   1024,
+		CORSOrigins:     []string{"*"},
+		ShutdownTimeout: 30 * time.Second,
+		TLS: TLSConfig{
+			ClientAuth: "none",
+		},
+		Database: DatabaseConfig{
+			Driver:          "postgres",
+			DataDir:         "./data",
+			Host:            "localhost",
+			Port:            5432,
+			Name:            "streamflix",
+			SSLMode:         "disable",
+			MaxOpenConns:    25,
+			MaxIdleConns:    5,
+			ConnMaxLifetime: 5 * time.Minute,
+			ConnectRetries:  5,
+			ConnectBackoff:  time.Second,
+		},
+		Auth: AuthConfig{
+			SessionTTL:        30 * 24 * time.Hour,
+			InviteTTL:         7 * 24 * time.Hour,
+			SignedURLTTL:      6 * time.Hour,
+			LockoutAttempts:   5,
+			IPLockoutAttempts: 20,
+			LockoutDuration:   15 * time.Minute,
+			OIDC: OIDCConfig{
+				Scopes:          []string{"openid", "profile", "email"},
+				Name:            "single sign-on",
+				UsernameClaim:   "preferred_username",
+				RolesClaim:      "groups",
+				DefaultRole:     "viewer",
+				RefreshInterval: 15 * time.Minute,
+			},
+		},
+		RateLimit: RateLimitConfig{
+			Enabled: true,
+			Store:   "memory",
+			Auth:    Limit{Requests: 10, Window: time.Minute},
+			Upload:  Limit{Requests: 30, Window: time.Hour},
+			Listing: Limit{Requests: 300, Window: time.Minute},
+			Stream:  Limit{Requests: 60, Window: time.Minute},
+		},
+		Tracing: TracingConfig{
+			Exporter:    "none",
+			Endpoint:    "http://localhost:4318",
+			SampleRatio: 1,
+			ServiceName: "starflix",
+		},
+		Log: LogConfig{
+			Level:               "info",
+			Format:              "text",
+			AccessLogMaxMB:      100,
+			AccessLogMaxBackups: 5,
+		},
 	}
 }
 
 func (c *Config) MaxUploadSizeBytes() int64 {
 	return int64(c.MaxUploadSize) * 1024 * 1024
 }
+
+var logLevels = map[string]bool{
+	"debug": true,
+	"info":  true,
+	"warn":  true,
+	"error": true,
+}
+
+var sslModes = map[string]bool{
+	"disable":     true,
+	"require":     true,
+	"verify-ca":   true,
+	"verify-full": true,
+}
+
+// DSN builds the PostgreSQL connection string, reading the password from
+// PasswordFile if one is configured.
+func (d *DatabaseConfig) DSN() (string, error) {
+	if d.URL != "" {
+		return d.URL, nil
+	}
+	if !sslModes[d.SSLMode] {
+		return "", fmt.Errorf("unsupported sslmode %q", d.SSLMode)
+	}
+
+	password := d.Password
+	if d.PasswordFile != "" {
+		data, err := os.ReadFile(d.PasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read database password file: %w", err)
+		}
+		password = strings.TrimRight(string(data), "\r\n")
+	}
+
+	params := []struct{ key, value string }{
+		{"host", d.Host},
+		{"port", fmt.Sprint(d.Port)},
+		{"dbname", d.Name},
+		{"user", d.User},
+		{"password", password},
+		{"sslmode", d.SSLMode},
+		{"sslrootcert", d.SSLRootCert},
+		{"sslcert", d.SSLCert},
+		{"sslkey", d.SSLKey},
+	}
+	var parts []string
+	for _, p := range params {
+		if p.value != "" {
+			parts = append(parts, p.key+"="+quoteDSNValue(p.value))
+		}
+	}
+	return strings.Join(parts, " "), nil
+}
+
+var dsnEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+func quoteDSNValue(v string) string {
+	if v != "" && !strings.ContainsAny(v, ` '\`) {
+		return v
+	}
+	return "'" + dsnEscaper.Replace(v) + "'"
+}
@@ -0,0 +1,186 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LoadEnv overrides the configuration with any STREAMER_* environment
+// variables that are set. DATABASE_URL is honoured as well, as that is what
+// most container platforms provide, and so is OTEL_EXPORTER_OTLP_ENDPOINT.
+func (c *Config) LoadEnv() error {
+	d := &c.Database
+	stringVars := map[string]*string{
+		"STREAMER_VIDEO_DIR":            &c.VideoDir,
+		"STREAMER_COVER_DIR":            &c.CoverImageDir,
+		"STREAMER_ENCRYPTION_KEY_FILE":  &c.EncryptionKeyFile,
+		"STREAMER_URL_SIGNING_KEY_FILE": &c.Auth.URLSigningKeyFile,
+		"STREAMER_ADMIN_TOKEN":          &c.AdminToken,
+		"STREAMER_TRUSTED_PROXIES_FILE": &c.TrustedProxiesFile,
+		"STREAMER_TLS_CERT":             &c.TLS.CertFile,
+		"STREAMER_TLS_KEY":              &c.TLS.KeyFile,
+		"STREAMER_TLS_CLIENT_CA":        &c.TLS.ClientCAFile,
+		"STREAMER_TLS_CLIENT_AUTH":      &c.TLS.ClientAuth,
+		"STREAMER_LOG_LEVEL":            &c.Log.Level,
+		"STREAMER_LOG_FORMAT":           &c.Log.Format,
+		"STREAMER_ACCESS_LOG":           &c.Log.AccessLog,
+		"STREAMER_TRACING_EXPORTER":     &c.Tracing.Exporter,
+		"STREAMER_OTLP_ENDPOINT":        &c.Tracing.Endpoint,
+		"STREAMER_TRACING_SERVICE_NAME": &c.Tracing.ServiceName,
+		"STREAMER_RATE_LIMIT_STORE":     &c.RateLimit.Store,
+		"STREAMER_OIDC_ISSUER":          &c.Auth.OIDC.Issuer,
+		"STREAMER_OIDC_CLIENT_ID":       &c.Auth.OIDC.ClientID,
+		"STREAMER_OIDC_CLIENT_SECRET":   &c.Auth.OIDC.ClientSecret,
+		"STREAMER_OIDC_REDIRECT_URL":    &c.Auth.OIDC.RedirectURL,
+		"STREAMER_OIDC_NAME":            &c.Auth.OIDC.Name,
+		"STREAMER_OIDC_USERNAME_CLAIM":  &c.Auth.OIDC.UsernameClaim,
+		"STREAMER_OIDC_ROLES_CLAIM":     &c.Auth.OIDC.RolesClaim,
+		"STREAMER_OIDC_DEFAULT_ROLE":    &c.Auth.OIDC.DefaultRole,
+		"STREAMER_DB_DRIVER":            &d.Driver,
+		"STREAMER_DATA_DIR":             &d.DataDir,
+		"STREAMER_DB_HOST":              &d.Host,
+		"STREAMER_DB_NAME":              &d.Name,
+		"STREAMER_DB_USER":              &d.User,
+		"STREAMER_DB_PASSWORD":          &d.Password,
+		"STREAMER_DB_PASSWORD_FILE":     &d.PasswordFile,
+		"STREAMER_DB_SSLMODE":           &d.SSLMode,
+		"STREAMER_DB_SSLROOTCERT":       &d.SSLRootCert,
+		"STREAMER_DB_SSLCERT":           &d.SSLCert,
+		"STREAMER_DB_SSLKEY":            &d.SSLKey,
+	}
+	intVars := map[string]*int{
+		"STREAMER_PORT":                   &c.Port,
+		"STREAMER_MAX_UPLOAD_MB":          &c.MaxUploadSize,
+		"STREAMER_ACCESS_LOG_MAX_MB":      &c.Log.AccessLogMaxMB,
+		"STREAMER_ACCESS_LOG_MAX_BACKUPS": &c.Log.AccessLogMaxBackups,
+		"STREAMER_LOCKOUT_ATTEMPTS":       &c.Auth.LockoutAttempts,
+		"STREAMER_IP_LOCKOUT_ATTEMPTS":    &c.Auth.IPLockoutAttempts,
+		"STREAMER_DB_PORT":                &d.Port,
+		"STREAMER_DB_MAX_OPEN_CONNS":      &d.MaxOpenConns,
+		"STREAMER_DB_MAX_IDLE_CONNS":      &d.MaxIdleConns,
+		"STREAMER_DB_CONNECT_RETRIES":     &d.ConnectRetries,
+	}
+	durationVars := map[string]*time.Duration{
+		"STREAMER_SHUTDOWN_TIMEOUT":      &c.ShutdownTimeout,
+		"STREAMER_SESSION_TTL":           &c.Auth.SessionTTL,
+		"STREAMER_INVITE_TTL":            &c.Auth.InviteTTL,
+		"STREAMER_SIGNED_URL_TTL":        &c.Auth.SignedURLTTL,
+		"STREAMER_LOCKOUT_DURATION":      &c.Auth.LockoutDuration,
+		"STREAMER_OIDC_REFRESH_INTERVAL": &c.Auth.OIDC.RefreshInterval,
+		"STREAMER_DB_CONN_MAX_LIFETIME":  &d.ConnMaxLifetime,
+		"STREAMER_DB_CONNECT_BACKOFF":    &d.ConnectBackoff,
+	}
+
+	// DATABASE_URL is applied before STREAMER_DATABASE_URL so the more
+	// specific variable wins when both are set.
+	for _, name := range []string{"DATABASE_URL", "STREAMER_DATABASE_URL"} {
+		if v, ok := os.LookupEnv(name); ok {
+			d.URL = v
+		}
+	}
+	// Likewise OTEL_EXPORTER_OTLP_ENDPOINT, the standard OpenTelemetry
+	// variable, is overridden by STREAMER_OTLP_ENDPOINT below.
+	if v, ok := os.LookupEnv("OTEL_EXPORTER_OTLP_ENDPOINT"); ok {
+		c.Tracing.Endpoint = v
+	}
+	for name, dst := range stringVars {
+		if v, ok := os.LookupEnv(name); ok {
+			*dst = v
+		}
+	}
+	for name, dst := range intVars {
+		if v, ok := os.LookupEnv(name); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%s: invalid integer %q", name, v)
+			}
+			*dst = n
+		}
+	}
+	if v, ok := os.LookupEnv("STREAMER_TRACING_SAMPLE_RATIO"); ok {
+		ratio, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("STREAMER_TRACING_SAMPLE_RATIO: invalid number %q", v)
+		}
+		c.Tracing.SampleRatio = ratio
+	}
+	if v, ok := os.LookupEnv("STREAMER_SECURE_COOKIES"); ok {
+		secure, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("STREAMER_SECURE_COOKIES: invalid boolean %q", v)
+		}
+		c.Auth.SecureCookies = secure
+	}
+	if v, ok := os.LookupEnv("STREAMER_OIDC_AUTO_PROVISION"); ok {
+		provision, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("STREAMER_OIDC_AUTO_PROVISION: invalid boolean %q", v)
+		}
+		c.Auth.OIDC.AutoProvision = provision
+	}
+	if v, ok := os.LookupEnv("STREAMER_RATE_LIMIT"); ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("STREAMER_RATE_LIMIT: invalid boolean %q", v)
+		}
+		c.RateLimit.Enabled = enabled
+	}
+	limitVars := map[string]*Limit{
+		"STREAMER_RATE_LIMIT_AUTH":    &c.RateLimit.Auth,
+		"STREAMER_RATE_LIMIT_UPLOAD":  &c.RateLimit.Upload,
+		"STREAMER_RATE_LIMIT_LISTING": &c.RateLimit.Listing,
+		"STREAMER_RATE_LIMIT_STREAM":  &c.RateLimit.Stream,
+	}
+	for name, dst := range limitVars {
+		if v, ok := os.LookupEnv(name); ok {
+			limit, err := ParseLimit(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			*dst = limit
+		}
+	}
+	if v, ok := os.LookupEnv("STREAMER_OIDC_SCOPES"); ok {
+		c.Auth.OIDC.Scopes = splitList(v)
+	}
+	if v, ok := os.LookupEnv("STREAMER_OIDC_ROLE_MAPPING"); ok {
+		mapping, err := parseMapping(v)
+		if err != nil {
+			return fmt.Errorf("STREAMER_OIDC_ROLE_MAPPING: %w", err)
+		}
+		c.Auth.OIDC.RoleMapping = mapping
+	}
+	if v, ok := os.LookupEnv("STREAMER_LISTEN"); ok {
+		c.Listeners = parseListeners(v)
+	}
+	if v, ok := os.LookupEnv("STREAMER_TRUSTED_PROXIES"); ok {
+		c.TrustedProxies = splitList(v)
+	}
+	if v, ok := os.LookupEnv("STREAMER_CORS_ORIGINS"); ok {
+		c.CORSOrigins = splitList(v)
+	}
+	for name, dst := range durationVars {
+		if v, ok := os.LookupEnv(name); ok {
+			dur, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("%s: invalid duration %q", name, v)
+			}
+			*dst = dur
+		}
+	}
+	return nil
+}
+
+// splitList splits a comma-separated list, dropping empty entries.
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,463 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Load builds the configuration for a command. It registers -config and the
+// configuration flags on fs, next to any flags the caller has already
+// registered, and parses args. The config file is taken from -config or
+// STREAMER_CONFIG.
+func Load(fs *flag.FlagSet, args []string) (*Config, error) {
+	var path string
+	fs.StringVar(&path, "config", os.Getenv("STREAMER_CONFIG"), "Path to a TOML config file")
+	RegisterFlags(fs, NewConfig())
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := NewConfig()
+	if path != "" {
+		if err := cfg.LoadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.LoadEnv(); err != nil {
+		return nil, fmt.Errorf("invalid environment configuration: %w", err)
+	}
+
+	// Only flags given on the command line override the layers below, so
+	// they are replayed onto cfg rather than parsed into it directly.
+	overrides := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	RegisterFlags(overrides, cfg)
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		if overrides.Lookup(f.Name) != nil {
+			if err := overrides.Set(f.Name, f.Value.String()); err != nil {
+				flagErr = errors.Join(flagErr, fmt.Errorf("-%s: %w", f.Name, err))
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, flagErr
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// LoadFile merges a TOML config file into the configuration. Keys that don't
+// correspond to a setting are rejected so typos don't go unnoticed.
+func (c *Config) LoadFile(path string) error {
+	md, err := toml.DecodeFile(path, c)
+	if err != nil {
+		return fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, k := range undecoded {
+			keys[i] = k.String()
+		}
+		sort.Strings(keys)
+		return fmt.Errorf("config file %s: unknown settings: %s", path, strings.Join(keys, ", "))
+	}
+	return nil
+}
+
+// RegisterFlags registers a flag for every setting on fs, bound to c and
+// with c's values as defaults.
+func RegisterFlags(fs *flag.FlagSet, c *Config) {
+	fs.IntVar(&c.Port, "port", c.Port, "Port to serve on")
+	fs.StringVar(&c.VideoDir, "videos", c.VideoDir, "Directory containing video files")
+	fs.StringVar(&c.CoverImageDir, "covers", c.CoverImageDir, "Directory for video cover images")
+	fs.IntVar(&c.MaxUploadSize, "max-upload", c.MaxUploadSize, "Maximum upload size in MB")
+	fs.Var(listenersFlag{&c.Listeners}, "listen", "Comma-separated listeners as [routes=]address, e.g. public=unix:///run/starflix.sock,admin=http://127.0.0.1:9090 (default: one public listener on -port)")
+	fs.Var(listFlag{&c.TrustedProxies}, "trusted-proxies", "Comma-separated IPs or CIDR ranges of trusted reverse proxies")
+	fs.StringVar(&c.TrustedProxiesFile, "trusted-proxies-file", c.TrustedProxiesFile, "File with trusted proxy ranges, one per line (e.g. Cloudflare's ips-v4 and ips-v6)")
+	fs.Var(listFlag{&c.CORSOrigins}, "cors-origins", "Comma-separated origins allowed to call the API, * for any")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "How long to let in-flight requests and streams finish on shutdown")
+	fs.StringVar(&c.AdminToken, "admin-token", c.AdminToken, "Bearer token accepted by /api/admin/status besides admin sessions (disabled if empty; prefer STREAMER_ADMIN_TOKEN)")
+	fs.StringVar(&c.EncryptionKeyFile, "encryption-key", c.EncryptionKeyFile, "Key file for encrypting stored videos and covers (disabled if empty)")
+
+	fs.StringVar(&c.TLS.CertFile, "tls-cert", c.TLS.CertFile, "TLS certificate file; enables HTTPS and HTTP/2 together with -tls-key")
+	fs.StringVar(&c.TLS.KeyFile, "tls-key", c.TLS.KeyFile, "TLS private key file")
+	fs.IntVar(&c.TLS.RedirectPort, "tls-redirect-port", c.TLS.RedirectPort, "Port for a plain HTTP listener redirecting to HTTPS (disabled if 0)")
+	fs.StringVar(&c.TLS.ClientCAFile, "tls-client-ca", c.TLS.ClientCAFile, "CA certificates for verifying client certificates")
+	fs.StringVar(&c.TLS.ClientAuth, "tls-client-auth", c.TLS.ClientAuth, "Client certificate authentication: none, optional or require")
+
+	fs.StringVar(&c.Log.Level, "log-level", c.Log.Level, "Log level: debug, info, warn or error")
+	fs.StringVar(&c.Log.Format, "log-format", c.Log.Format, "Log format: text or json")
+	fs.StringVar(&c.Log.AccessLog, "access-log", c.Log.AccessLog, "File for a Combined Log Format access log (disabled if empty)")
+	fs.IntVar(&c.Log.AccessLogMaxMB, "access-log-max-mb", c.Log.AccessLogMaxMB, "Size in MB at which the access log is rotated")
+	fs.IntVar(&c.Log.AccessLogMaxBackups, "access-log-max-backups", c.Log.AccessLogMaxBackups, "Number of rotated access logs to keep")
+
+	fs.DurationVar(&c.Auth.SessionTTL, "session-ttl", c.Auth.SessionTTL, "How long a login lasts")
+	fs.DurationVar(&c.Auth.InviteTTL, "invite-ttl", c.Auth.InviteTTL, "How long an invite can be used to register")
+	fs.BoolVar(&c.Auth.SecureCookies, "secure-cookies", c.Auth.SecureCookies, "Mark session cookies Secure on plain HTTP too, when behind a TLS-terminating proxy")
+	fs.StringVar(&c.Auth.URLSigningKeyFile, "url-signing-key", c.Auth.URLSigningKeyFile, "Key file for signing stream and cover URLs (disabled if empty)")
+	fs.DurationVar(&c.Auth.SignedURLTTL, "signed-url-ttl", c.Auth.SignedURLTTL, "How long signed URLs last by default")
+	fs.IntVar(&c.Auth.LockoutAttempts, "lockout-attempts", c.Auth.LockoutAttempts, "Consecutive failed logins that lock an account out (0 to never lock out)")
+	fs.IntVar(&c.Auth.IPLockoutAttempts, "ip-lockout-attempts", c.Auth.IPLockoutAttempts, "Consecutive failed logins that lock a client address out (0 to never lock out)")
+	fs.DurationVar(&c.Auth.LockoutDuration, "lockout-duration", c.Auth.LockoutDuration, "How long lockouts last, and how long failed logins are remembered")
+
+	o := &c.Auth.OIDC
+	fs.StringVar(&o.Issuer, "oidc-issuer", o.Issuer, "OpenID Connect issuer URL; enables single sign-on")
+	fs.StringVar(&o.ClientID, "oidc-client-id", o.ClientID, "OpenID Connect client ID")
+	fs.StringVar(&o.ClientSecret, "oidc-client-secret", o.ClientSecret, "OpenID Connect client secret, empty for a public client (prefer STREAMER_OIDC_CLIENT_SECRET)")
+	fs.StringVar(&o.RedirectURL, "oidc-redirect-url", o.RedirectURL, "Callback URL registered with the provider, ending in /api/auth/oidc/callback")
+	fs.Var(listFlag{&o.Scopes}, "oidc-scopes", "Comma-separated scopes to request")
+	fs.StringVar(&o.Name, "oidc-name", o.Name, "Label of the single sign-on button")
+	fs.StringVar(&o.UsernameClaim, "oidc-username-claim", o.UsernameClaim, "ID token claim used as the username of new accounts")
+	fs.StringVar(&o.RolesClaim, "oidc-roles-claim", o.RolesClaim, "ID token claim holding the groups mapped to roles")
+	fs.Var(mappingFlag{&o.RoleMapping}, "oidc-role-mapping", "Comma-separated group=role pairs, e.g. media-admins=admin,family=viewer")
+	fs.StringVar(&o.DefaultRole, "oidc-default-role", o.DefaultRole, "Role for users matching no mapping, empty to refuse them")
+	fs.BoolVar(&o.AutoProvision, "oidc-auto-provision", o.AutoProvision, "Create accounts for unknown users on their first single sign-on")
+	fs.DurationVar(&o.RefreshInterval, "oidc-refresh-interval", o.RefreshInterval, "How often single sign-on sessions are checked with the provider")
+
+	rl := &c.RateLimit
+	fs.BoolVar(&rl.Enabled, "rate-limit", rl.Enabled, "Limit how often clients may call the auth, upload, listing and stream routes")
+	fs.StringVar(&rl.Store, "rate-limit-store", rl.Store, "Where request counts are kept: memory, or postgres to share limits across instances")
+	fs.Var(limitFlag{&rl.Auth}, "rate-limit-auth", "Limit for logins, registrations and device linking, as requests/window or 0 for none")
+	fs.Var(limitFlag{&rl.Upload}, "rate-limit-upload", "Limit for uploads, as requests/window or 0 for none")
+	fs.Var(limitFlag{&rl.Listing}, "rate-limit-listing", "Limit for listing, searching and looking up videos and genres, as requests/window or 0 for none")
+	fs.Var(limitFlag{&rl.Stream}, "rate-limit-stream", "Limit for starting playback, as requests/window or 0 for none")
+
+	fs.StringVar(&c.Tracing.Exporter, "tracing", c.Tracing.Exporter, "Trace exporter: none, stdout or otlp")
+	fs.StringVar(&c.Tracing.Endpoint, "otlp-endpoint", c.Tracing.Endpoint, "Base URL of the OTLP/HTTP collector")
+	fs.Float64Var(&c.Tracing.SampleRatio, "trace-sample-ratio", c.Tracing.SampleRatio, "Fraction of new traces to record, from 0 to 1")
+
+	d := &c.Database
+	fs.StringVar(&d.Driver, "db", d.Driver, "Storage backend: postgres, sqlite or memory")
+	fs.StringVar(&d.DataDir, "data", d.DataDir, "Data directory for the SQLite database")
+	fs.StringVar(&d.URL, "db-url", d.URL, "PostgreSQL connection URL, overrides the individual -db-* connection flags")
+	fs.StringVar(&d.Host, "db-host", d.Host, "PostgreSQL host")
+	fs.IntVar(&d.Port, "db-port", d.Port, "PostgreSQL port")
+	fs.StringVar(&d.Name, "db-name", d.Name, "PostgreSQL database name")
+	fs.StringVar(&d.User, "db-user", d.User, "PostgreSQL user")
+	fs.StringVar(&d.Password, "db-password", d.Password, "PostgreSQL password (prefer -db-password-file)")
+	fs.StringVar(&d.PasswordFile, "db-password-file", d.PasswordFile, "File containing the PostgreSQL password")
+	fs.StringVar(&d.SSLMode, "db-sslmode", d.SSLMode, "PostgreSQL TLS mode: disable, require, verify-ca or verify-full")
+	fs.StringVar(&d.SSLRootCert, "db-sslrootcert", d.SSLRootCert, "CA certificate for verifying the PostgreSQL server")
+	fs.StringVar(&d.SSLCert, "db-sslcert", d.SSLCert, "Client certificate for PostgreSQL")
+	fs.StringVar(&d.SSLKey, "db-sslkey", d.SSLKey, "Client key for PostgreSQL")
+	fs.IntVar(&d.MaxOpenConns, "db-max-open-conns", d.MaxOpenConns, "Maximum open database connections")
+	fs.IntVar(&d.MaxIdleConns, "db-max-idle-conns", d.MaxIdleConns, "Maximum idle database connections")
+	fs.DurationVar(&d.ConnMaxLifetime, "db-conn-max-lifetime", d.ConnMaxLifetime, "Maximum lifetime of a database connection")
+	fs.IntVar(&d.ConnectRetries, "db-connect-retries", d.ConnectRetries, "Retries for the initial database connection")
+	fs.DurationVar(&d.ConnectBackoff, "db-connect-backoff", d.ConnectBackoff, "Initial wait between connection retries, doubled each time")
+}
+
+// Validate checks the configuration for values the server can't start with
+// and reports all of them at once.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Port > 0 && c.Port <= 65535, "port: %d is not a valid port", c.Port)
+	check(c.VideoDir != "", "video_dir: must not be empty")
+	check(c.CoverImageDir != "", "cover_dir: must not be empty")
+	check(c.MaxUploadSize > 0, "max_upload_mb: must be positive")
+	for _, l := range c.Listeners {
+		addr, err := ParseListenAddress(l.Address)
+		check(err == nil, "listeners.address: %v", err)
+		check(l.Routes == "public" || l.Routes == "admin" || l.Routes == "all", "listeners.routes: %q must be public, admin or all", l.Routes)
+		check(!addr.TLS || c.TLS.Enabled(), "listeners.address: %q needs tls.cert_file and tls.key_file", l.Address)
+		if l.SocketMode != "" {
+			_, err := strconv.ParseUint(l.SocketMode, 8, 32)
+			check(err == nil && addr.Network == "unix", "listeners.socket_mode: %q must be an octal mode on a unix listener", l.SocketMode)
+		}
+	}
+	for _, proxy := range c.TrustedProxies {
+		_, err := ParseIPPrefix(proxy)
+		check(err == nil, "trusted_proxies: %v", err)
+	}
+	check(c.ShutdownTimeout >= 0, "shutdown_timeout: must not be negative")
+	for _, origin := range c.CORSOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		check(err == nil && u.Scheme != "" && u.Host != "" && u.Path == "", "cors_origins: %q is not an origin like https://example.com", origin)
+	}
+
+	t := &c.TLS
+	check((t.CertFile == "") == (t.KeyFile == ""), "tls: cert_file and key_file must be set together")
+	check(t.RedirectPort == 0 || t.Enabled(), "tls.redirect_port: requires TLS to be enabled")
+	check(t.RedirectPort >= 0 && t.RedirectPort <= 65535, "tls.redirect_port: %d is not a valid port", t.RedirectPort)
+	check(t.RedirectPort == 0 || t.RedirectPort != c.Port, "tls.redirect_port: must differ from port")
+	switch t.ClientAuth {
+	case "none":
+	case "optional", "require":
+		check(t.Enabled(), "tls.client_auth: requires TLS to be enabled")
+		check(t.ClientCAFile != "", "tls.client_auth: %s requires client_ca_file", t.ClientAuth)
+	default:
+		check(false, "tls.client_auth: unknown mode %q", t.ClientAuth)
+	}
+
+	l := &c.Log
+	check(logLevels[l.Level], "log.level: unknown level %q", l.Level)
+	check(l.Format == "text" || l.Format == "json", "log.format: %q must be text or json", l.Format)
+	check(l.AccessLogMaxMB > 0, "log.access_log_max_mb: must be positive")
+	check(l.AccessLogMaxBackups >= 0, "log.access_log_max_backups: must not be negative")
+
+	check(c.Auth.SessionTTL > 0, "auth.session_ttl: must be positive")
+	check(c.Auth.InviteTTL > 0, "auth.invite_ttl: must be positive")
+	check(c.Auth.SignedURLTTL > 0 && c.Auth.SignedURLTTL <= 7*24*time.Hour, "auth.signed_url_ttl: must be positive and at most 168h")
+	check(c.Auth.LockoutAttempts >= 0, "auth.lockout_attempts: must not be negative")
+	check(c.Auth.IPLockoutAttempts >= 0, "auth.ip_lockout_attempts: must not be negative")
+	check(c.Auth.LockoutDuration >= time.Minute, "auth.lockout_duration: must be at least 1m")
+	if o := &c.Auth.OIDC; o.Enabled() {
+		u, err := url.Parse(o.Issuer)
+		check(err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "", "auth.oidc.issuer: %q is not an http(s) URL", o.Issuer)
+		check(o.ClientID != "", "auth.oidc.client_id: must not be empty")
+		u, err = url.Parse(o.RedirectURL)
+		check(err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "", "auth.oidc.redirect_url: %q is not an http(s) URL", o.RedirectURL)
+		check(slices.Contains(o.Scopes, "openid"), "auth.oidc.scopes: must include openid")
+		check(o.UsernameClaim != "", "auth.oidc.username_claim: must not be empty")
+		check(len(o.RoleMapping) == 0 || o.RolesClaim != "", "auth.oidc.roles_claim: must not be empty with a role_mapping")
+		check(o.RefreshInterval > 0, "auth.oidc.refresh_interval: must be positive")
+	}
+
+	rl := &c.RateLimit
+	check(rl.Store == "memory" || rl.Store == "postgres", "rate_limit.store: %q must be memory or postgres", rl.Store)
+	check(rl.Store != "postgres" || c.Database.Driver == "postgres", "rate_limit.store: postgres requires the postgres database driver")
+	limits := []struct {
+		name  string
+		limit Limit
+	}{{"auth", rl.Auth}, {"upload", rl.Upload}, {"listing", rl.Listing}, {"stream", rl.Stream}}
+	for _, l := range limits {
+		check(l.limit.Requests >= 0, "rate_limit.%s.requests: must not be negative", l.name)
+		check(l.limit.Requests == 0 || l.limit.Window >= time.Second, "rate_limit.%s.window: must be at least 1s", l.name)
+	}
+
+	tr := &c.Tracing
+	switch tr.Exporter {
+	case "none", "stdout":
+	case "otlp":
+		u, err := url.Parse(tr.Endpoint)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "tracing.endpoint: %q is not an http(s) URL", tr.Endpoint)
+	default:
+		check(false, "tracing.exporter: unknown exporter %q", tr.Exporter)
+	}
+	check(tr.SampleRatio >= 0 && tr.SampleRatio <= 1, "tracing.sample_ratio: %v must be between 0 and 1", tr.SampleRatio)
+	check(tr.ServiceName != "", "tracing.service_name: must not be empty")
+
+	d := &c.Database
+	switch d.Driver {
+	case "postgres":
+		if d.URL == "" {
+			check(d.Host != "", "database.host: must not be empty")
+			check(d.Port > 0 && d.Port <= 65535, "database.port: %d is not a valid port", d.Port)
+			check(d.Name != "", "database.name: must not be empty")
+			check(sslModes[d.SSLMode], "database.sslmode: unsupported mode %q", d.SSLMode)
+			check(d.Password == "" || d.PasswordFile == "", "database: password and password_file are mutually exclusive")
+		} else {
+			_, err := url.Parse(d.URL)
+			check(err == nil, "database.url: %v", err)
+		}
+		check(d.MaxOpenConns >= 0, "database.max_open_conns: must not be negative")
+		check(d.MaxIdleConns >= 0, "database.max_idle_conns: must not be negative")
+		check(d.ConnMaxLifetime >= 0, "database.conn_max_lifetime: must not be negative")
+		check(d.ConnectRetries >= 0, "database.connect_retries: must not be negative")
+		check(d.ConnectBackoff > 0, "database.connect_backoff: must be positive")
+	case "sqlite":
+		check(d.DataDir != "", "database.data_dir: must not be empty")
+	case "memory":
+	default:
+		check(false, "database.driver: unknown driver %q", d.Driver)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+const redacted = "[redacted]"
+
+// Redacted returns a copy of the configuration with secrets masked, safe to
+// print or log.
+func (c *Config) Redacted() *Config {
+	r := *c
+	if r.Database.Password != "" {
+		r.Database.Password = redacted
+	}
+	r.Database.URL = redactDSN(r.Database.URL)
+	if r.AdminToken != "" {
+		r.AdminToken = redacted
+	}
+	if r.Auth.OIDC.ClientSecret != "" {
+		r.Auth.OIDC.ClientSecret = redacted
+	}
+	return &r
+}
+
+// redactDSN masks the password in a postgres:// URL. Key/value DSNs and
+// anything unparsable are masked completely if they mention a password.
+func redactDSN(dsn string) string {
+	u, err := url.Parse(dsn)
+	if err != nil || u.Scheme == "" {
+		if strings.Contains(dsn, "password") {
+			return redacted
+		}
+		return dsn
+	}
+	q := u.Query()
+	if q.Has("password") {
+		q.Set("password", redacted)
+		u.RawQuery = q.Encode()
+	}
+	return u.Redacted()
+}
+
+// WriteTOML writes the configuration in config file format.
+func (c *Config) WriteTOML(w io.Writer) error {
+	return toml.NewEncoder(w).Encode(c)
+}
+
+// listFlag is a flag.Value for comma-separated lists.
+type listFlag struct {
+	list *[]string
+}
+
+func (f listFlag) String() string {
+	if f.list == nil {
+		return ""
+	}
+	return strings.Join(*f.list, ",")
+}
+
+func (f listFlag) Set(v string) error {
+	*f.list = splitList(v)
+	return nil
+}
+
+// limitFlag is a flag.Value for a Limit written as requests/window.
+type limitFlag struct {
+	limit *Limit
+}
+
+func (f limitFlag) String() string {
+	if f.limit == nil {
+		return ""
+	}
+	return f.limit.String()
+}
+
+func (f limitFlag) Set(v string) error {
+	limit, err := ParseLimit(v)
+	if err != nil {
+		return err
+	}
+	*f.limit = limit
+	return nil
+}
+
+// mappingFlag is a flag.Value for comma-separated key=value pairs.
+type mappingFlag struct {
+	m *map[string]string
+}
+
+func (f mappingFlag) String() string {
+	if f.m == nil {
+		return ""
+	}
+	items := make([]string, 0, len(*f.m))
+	for k, v := range *f.m {
+		items = append(items, k+"="+v)
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+func (f mappingFlag) Set(v string) error {
+	m, err := parseMapping(v)
+	if err != nil {
+		return err
+	}
+	*f.m = m
+	return nil
+}
+
+func parseMapping(v string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, item := range splitList(v) {
+		key, value, ok := strings.Cut(item, "=")
+		if !ok || key == "" || value == "" {
+			return nil, fmt.Errorf("%q is not a key=value pair", item)
+		}
+		m[key] = value
+	}
+	return m, nil
+}
+
+// listenersFlag is a flag.Value for a comma-separated list of
+// [routes=]address listeners; routes default to public.
+type listenersFlag struct {
+	list *[]ListenerConfig
+}
+
+func (f listenersFlag) String() string {
+	if f.list == nil {
+		return ""
+	}
+	items := make([]string, len(*f.list))
+	for i, l := range *f.list {
+		items[i] = l.Routes + "=" + l.Address
+	}
+	return strings.Join(items, ",")
+}
+
+func (f listenersFlag) Set(v string) error {
+	*f.list = parseListeners(v)
+	return nil
+}
+
+func parseListeners(v string) []ListenerConfig {
+	var listeners []ListenerConfig
+	for _, item := range splitList(v) {
+		l := ListenerConfig{Routes: "public", Address: item}
+		if routes, addr, ok := strings.Cut(item, "="); ok {
+			l.Routes, l.Address = routes, addr
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners
+}
+
+// ParseIPPrefix parses a CIDR range or a single IP address, which is treated
+// as a range of one.
+func ParseIPPrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid CIDR range %q", s)
+		}
+		return p.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid IP address %q", s)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
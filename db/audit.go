@@ -0,0 +1,133 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AuditEvent records who did, or tried to do, what.
+type AuditEvent struct {
+	ID        int       `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	// UserID is zero for anonymous requests and deleted users.
+	UserID    int    `json:"user_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	Action    string `json:"action"`
+	Target    string `json:"target,omitempty"`
+	Outcome   string `json:"outcome"`
+	ClientIP  string `json:"client_ip,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+// AuditFilter selects audit events. Zero fields match everything.
+type AuditFilter struct {
+	UserID  int
+	Action  string
+	Outcome string
+	// BeforeID returns only events older than this one, for paging.
+	BeforeID int
+	Limit    int
+}
+
+func (f AuditFilter) match(e AuditEvent) bool {
+	return (f.UserID == 0 || e.UserID == f.UserID) &&
+		(f.Action == "" || e.Action == f.Action) &&
+		(f.Outcome == "" || e.Outcome == f.Outcome) &&
+		(f.BeforeID == 0 || e.ID < f.BeforeID)
+}
+
+func (s *SQLStore) RecordAuditEvent(ctx context.Context, e *AuditEvent) error {
+	defer s.startQuery(ctx, "record_audit_event")()
+
+	var userID interface{}
+	if e.UserID != 0 {
+		userID = e.UserID
+	}
+	query := `
+		INSERT INTO audit_log (created_at, user_id, username, action, target, outcome, client_ip, request_id, detail)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id
+	`
+	return s.db.QueryRowContext(ctx, s.dialect.Rebind(query),
+		e.CreatedAt.UTC(), userID, e.Username, e.Action, e.Target, e.Outcome, e.ClientIP, e.RequestID, e.Detail,
+	).Scan(&e.ID)
+}
+
+// ListAuditEvents returns the matching events, newest first.
+func (s *SQLStore) ListAuditEvents(ctx context.Context, f AuditFilter) ([]AuditEvent, error) {
+	defer s.startQuery(ctx, "list_audit_events")()
+
+	var where []string
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, strings.Replace(cond, "?", "$"+strconv.Itoa(len(args)), 1))
+	}
+	if f.UserID != 0 {
+		add("user_id = ?", f.UserID)
+	}
+	if f.Action != "" {
+		add("action = ?", f.Action)
+	}
+	if f.Outcome != "" {
+		add("outcome = ?", f.Outcome)
+	}
+	if f.BeforeID != 0 {
+		add("id < ?", f.BeforeID)
+	}
+	query := `SELECT id, created_at, user_id, username, action, target, outcome, client_ip, request_id, detail FROM audit_log`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	query += ` ORDER BY id DESC`
+	if f.Limit > 0 {
+		args = append(args, f.Limit)
+		query += ` LIMIT $` + strconv.Itoa(len(args))
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.dialect.Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []AuditEvent
+	for rows.Next() {
+		var e AuditEvent
+		var userID sql.NullInt64
+		if err := rows.Scan(&e.ID, &e.CreatedAt, &userID, &e.Username, &e.Action, &e.Target,
+			&e.Outcome, &e.ClientIP, &e.RequestID, &e.Detail); err != nil {
+			return nil, err
+		}
+		e.UserID = int(userID.Int64)
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (s *MemoryStore) RecordAuditEvent(_ context.Context, e *AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.ID = s.newID()
+	s.audit = append(s.audit, *e)
+	return nil
+}
+
+func (s *MemoryStore) ListAuditEvents(_ context.Context, f AuditFilter) ([]AuditEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var events []AuditEvent
+	for i := len(s.audit) - 1; i >= 0; i-- {
+		if f.Limit > 0 && len(events) == f.Limit {
+			break
+		}
+		if f.match(s.audit[i]) {
+			events = append(events, s.audit[i])
+		}
+	}
+	return events, nil
+}
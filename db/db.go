@@ -1,20 +1,16 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"log"
+	"log/slog"
 	"time"
 
-	_ "github.com/lib/pq"
-)
+	"DevMaan707/streamer/config"
 
-var (
-	DB_HOST     = "localhost"
-	DB_PORT     = 5432
-	DB_NAME     = "streamflix"
-	DB_USER     = "xyz"
-	DB_PASSWORD = "xyz"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 )
 
 type Video struct {
@@ -30,6 +26,38 @@ type Video struct {
 	Duration    int       `json:"duration,omitempty"`
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
+
+	// OwnerID is the user who uploaded the video, 0 for videos uploaded
+	// before owners were recorded.
+	OwnerID int `json:"owner_id,omitempty"`
+	// Visibility is one of the Visibility constants. GroupID is the group
+	// a video with VisibilityGroup is shared with.
+	Visibility string `json:"visibility"`
+	GroupID    int    `json:"group_id,omitempty"`
+}
+
+// Who can see a video besides its owner and admins.
+const (
+	// VisibilityPrivate videos are seen by nobody else.
+	VisibilityPrivate = "private"
+	// VisibilityUnlisted videos can be watched by anyone who knows their
+	// ID, but aren't listed or found by search.
+	VisibilityUnlisted = "unlisted"
+	// VisibilityGroup videos are seen by the members of the video's group.
+	VisibilityGroup = "group"
+	// VisibilityPublic videos are seen by everyone.
+	VisibilityPublic = "public"
+)
+
+// Visibilities lists every visibility, most restrictive first.
+var Visibilities = []string{VisibilityPrivate, VisibilityUnlisted, VisibilityGroup, VisibilityPublic}
+
+// VideoAccess is who a listing is for. Listings return public videos, the
+// user's own and those shared with the user's groups, or with All every
+// video.
+type VideoAccess struct {
+	UserID int
+	All    bool
 }
 
 type Genre struct {
@@ -39,248 +67,107 @@ type Genre struct {
 
 var DB *sql.DB
 
-func Initialize() error {
-	connStr := fmt.Sprintf("host=%s port=%d dbname=%s user=%s password=%s sslmode=disable",
-		DB_HOST, DB_PORT, DB_NAME, DB_USER, DB_PASSWORD)
+const maxConnectBackoff = 30 * time.Second
 
-	var err error
-	DB, err = sql.Open("postgres", connStr)
-	if err != nil {
-		return fmt.Errorf("failed to connect to database: %w", err)
-	}
-
-	DB.SetMaxOpenConns(25)
-	DB.SetMaxIdleConns(5)
-	DB.SetConnMaxLifetime(5 * time.Minute)
-
-	if err = DB.Ping(); err != nil {
-		return fmt.Errorf("failed to ping database: %w", err)
-	}
+// ActiveDialect is the dialect of the connection opened into DB.
+var ActiveDialect = Postgres
 
-	log.Println("Connected to PostgreSQL database")
-	return nil
+// defaultGenres mirrors the genres seeded by the initial migration.
+var defaultGenres = []string{
+	"Action", "Comedy", "Drama", "Documentary",
+	"Horror", "Thriller", "Sci-Fi", "Animation",
 }
-func EnsureTablesExist() error {
-	log.Println("Checking and creating database tables if they don't exist...")
-	_, err := DB.Exec(`
-        CREATE TABLE IF NOT EXISTS videos (
-            id SERIAL PRIMARY KEY,
-            filename VARCHAR(255) NOT NULL,
-            title VARCHAR(255) NOT NULL,
-            description TEXT,
-            genre VARCHAR(100),
-            release_year INTEGER,
-            cover_image_path VARCHAR(255),
-            file_path VARCHAR(255) NOT NULL,
-            file_size BIGINT NOT NULL,
-            duration INTEGER,
-            created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
-            updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
-        )
-    `)
-	if err != nil {
-		return fmt.Errorf("failed to create videos table: %w", err)
-	}
 
-	_, err = DB.Exec(`
-        CREATE TABLE IF NOT EXISTS genres (
-            id SERIAL PRIMARY KEY,
-            name VARCHAR(100) NOT NULL UNIQUE
-        )
-    `)
+// Initialize connects to PostgreSQL. The first connection is retried with
+// exponential backoff so the server can start alongside its database.
+func Initialize(cfg config.DatabaseConfig) error {
+	connStr, err := cfg.DSN()
 	if err != nil {
-		return fmt.Errorf("failed to create genres table: %w", err)
+		return err
 	}
-	var count int
-	err = DB.QueryRow("SELECT COUNT(*) FROM genres").Scan(&count)
+
+	DB, err = sql.Open("postgres", connStr)
 	if err != nil {
-		return fmt.Errorf("failed to check genres count: %w", err)
+		return fmt.Errorf("failed to connect to database: %w", err)
 	}
 
-	if count == 0 {
-		log.Println("Adding default genres...")
-		defaultGenres := []string{
-			"Action", "Comedy", "Drama", "Documentary",
-			"Horror", "Thriller", "Sci-Fi", "Animation",
-		}
+	DB.SetMaxOpenConns(cfg.MaxOpenConns)
+	DB.SetMaxIdleConns(cfg.MaxIdleConns)
+	DB.SetConnMaxLifetime(cfg.ConnMaxLifetime)
 
-		for _, genre := range defaultGenres {
-			_, err = DB.Exec("INSERT INTO genres (name) VALUES ($1) ON CONFLICT (name) DO NOTHING", genre)
-			if err != nil {
-				log.Printf("Warning: Failed to insert genre %s: %v", genre, err)
-			}
+	backoff := cfg.ConnectBackoff
+	for attempt := 0; ; attempt++ {
+		err = DB.Ping()
+		if err == nil {
+			break
+		}
+		if attempt >= cfg.ConnectRetries {
+			return fmt.Errorf("failed to ping database: %w", err)
+		}
+		slog.Warn("Database not reachable, retrying", "error", err, "backoff", backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxConnectBackoff {
+			backoff = maxConnectBackoff
 		}
 	}
 
-	log.Println("Database tables verified")
-	return nil
-}
-func TestConnection() error {
-	if err := DB.Ping(); err != nil {
-		return fmt.Errorf("failed to ping database: %w", err)
-	}
-	var count int
-	err := DB.QueryRow("SELECT COUNT(*) FROM videos").Scan(&count)
-	if err != nil {
-		return fmt.Errorf("failed to query database: %w", err)
-	}
-
-	log.Printf("Successfully connected to database, videos table has %d records", count)
+	ActiveDialect = Postgres
+	slog.Info("Connected to PostgreSQL database")
 	return nil
 }
 
-func GetAllVideos() ([]Video, error) {
-	log.Println("Attempting to query all videos from database...")
+// InitializeSQLite opens (creating if needed) the SQLite database at path.
+// SQLite allows a single writer, so the pool is limited to one connection,
+// transactions take the write lock up front and the busy timeout covers
+// access from other processes.
+func InitializeSQLite(path string) error {
+	connStr := fmt.Sprintf("file:%s?_foreign_keys=on&_busy_timeout=5000&_journal_mode=WAL&_txlock=immediate", path)
 
-	query := `
-        SELECT id, filename, title, description, genre, release_year, cover_image_path,
-        file_path, file_size, duration, created_at, updated_at
-        FROM videos
-        ORDER BY created_at DESC
-    `
-
-	rows, err := DB.Query(query)
+	var err error
+	DB, err = sql.Open("sqlite3", connStr)
 	if err != nil {
-		log.Printf("Database query error: %v", err)
-		return nil, err
+		return fmt.Errorf("failed to open database: %w", err)
 	}
-	defer rows.Close()
 
-	log.Println("Successfully queried videos table")
-
-	var videos []Video
-	for rows.Next() {
-		var v Video
-		var releaseYear, duration sql.NullInt32
-		var description, genre, coverImage sql.NullString
-		var createdAt, updatedAt time.Time
-
-		if err := rows.Scan(
-			&v.ID, &v.Filename, &v.Title, &description, &genre, &releaseYear, &coverImage,
-			&v.FilePath, &v.FileSize, &duration, &createdAt, &updatedAt,
-		); err != nil {
-			log.Printf("Error scanning row: %v", err)
-			return nil, err
-		}
-		v.Description = description.String
-		v.Genre = genre.String
-		v.ReleaseYear = int(releaseYear.Int32)
-		v.CoverImage = coverImage.String
-		v.Duration = int(duration.Int32)
-		v.CreatedAt = createdAt
-		v.UpdatedAt = updatedAt
-
-		videos = append(videos, v)
-	}
+	DB.SetMaxOpenConns(1)
 
-	if err := rows.Err(); err != nil {
-		log.Printf("Error iterating rows: %v", err)
-		return nil, err
+	if err = DB.Ping(); err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
 	}
 
-	log.Printf("Found %d videos in database", len(videos))
-	return videos, nil
+	ActiveDialect = SQLite
+	slog.Info("Opened SQLite database", "path", path)
+	return nil
 }
-func GetVideosByGenre(genre string) ([]Video, error) {
-	query := `
-		SELECT id, filename, title, description, genre, release_year, cover_image_path,
-		file_path, file_size, duration, created_at, updated_at
-		FROM videos
-		WHERE genre = $1
-		ORDER BY created_at DESC
-	`
-	rows, err := DB.Query(query, genre)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var videos []Video
-	for rows.Next() {
-		var v Video
-		var releaseYear, duration sql.NullInt32
-		var description, genre, coverImage sql.NullString
-		var createdAt, updatedAt time.Time
 
-		if err := rows.Scan(
-			&v.ID, &v.Filename, &v.Title, &description, &genre, &releaseYear, &coverImage,
-			&v.FilePath, &v.FileSize, &duration, &createdAt, &updatedAt,
-		); err != nil {
-			return nil, err
-		}
-
-		v.Description = description.String
-		v.Genre = genre.String
-		v.ReleaseYear = int(releaseYear.Int32)
-		v.CoverImage = coverImage.String
-		v.Duration = int(duration.Int32)
-		v.CreatedAt = createdAt
-		v.UpdatedAt = updatedAt
-
-		videos = append(videos, v)
+// Close closes the connection pool, if one was opened.
+func Close() error {
+	if DB == nil {
+		return nil
 	}
-
-	if err := rows.Err(); err != nil {
-		return nil, err
-	}
-
-	return videos, nil
+	return DB.Close()
 }
-func GetAllGenres() ([]Genre, error) {
-	query := `SELECT id, name FROM genres ORDER BY name`
-	rows, err := DB.Query(query)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
 
-	var genres []Genre
-	for rows.Next() {
-		var g Genre
-		if err := rows.Scan(&g.ID, &g.Name); err != nil {
-			return nil, err
-		}
-		genres = append(genres, g)
+// Ping checks that the database is reachable. It succeeds trivially when
+// no database is open, as with the memory backend.
+func Ping(ctx context.Context) error {
+	if DB == nil {
+		return nil
 	}
-
-	if err := rows.Err(); err != nil {
-		return nil, err
-	}
-
-	return genres, nil
+	return DB.PingContext(ctx)
 }
 
-func InsertVideo(video *Video) error {
-	query := `
-		INSERT INTO videos
-		(filename, title, description, genre, release_year, cover_image_path, file_path, file_size, duration)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
-		RETURNING id, created_at, updated_at
-	`
-
-	var releaseYear, duration interface{}
-	if video.ReleaseYear > 0 {
-		releaseYear = video.ReleaseYear
-	} else {
-		releaseYear = nil
+func TestConnection() error {
+	if err := DB.Ping(); err != nil {
+		return fmt.Errorf("failed to ping database: %w", err)
 	}
-
-	if video.Duration > 0 {
-		duration = video.Duration
-	} else {
-		duration = nil
+	var count int
+	err := DB.QueryRow("SELECT COUNT(*) FROM videos").Scan(&count)
+	if err != nil {
+		return fmt.Errorf("failed to query database: %w", err)
 	}
 
-	return DB.QueryRow(
-		query,
-		video.Filename,
-		video.Title,
-		video.Description,
-		video.Genre,
-		releaseYear,
-		video.CoverImage,
-		video.FilePath,
-		video.FileSize,
-		duration,
-	).Scan(&video.ID, &video.CreatedAt, &video.UpdatedAt)
+	slog.Info("Database connection verified", "videos", count)
+	return nil
 }
@@ -0,0 +1,235 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Device code statuses.
+const (
+	DeviceCodePending  = "pending"
+	DeviceCodeApproved = "approved"
+	DeviceCodeDenied   = "denied"
+)
+
+// DeviceCode is a pending device authorization: a device showing UserCode
+// polls with its device code until a logged-in user approves or denies
+// it. Only a hash of the device code is stored.
+type DeviceCode struct {
+	ID             int
+	DeviceCodeHash string
+	UserCode       string
+	ClientName     string
+	Scopes         []string
+	ClientIP       string
+	CreatedAt      time.Time
+	ExpiresAt      time.Time
+	// Interval is the minimum number of seconds between polls.
+	Interval     int
+	LastPolledAt *time.Time
+	Status       string
+	// UserID is the user who approved or denied the code.
+	UserID int
+}
+
+const deviceCodeColumns = `id, device_code_hash, user_code, client_name, scopes, client_ip, created_at, expires_at, poll_interval, last_polled_at, status, user_id`
+
+func scanDeviceCode(row interface{ Scan(...interface{}) error }) (*DeviceCode, error) {
+	var dc DeviceCode
+	var scopes string
+	var lastPolled sql.NullTime
+	var userID sql.NullInt64
+	err := row.Scan(&dc.ID, &dc.DeviceCodeHash, &dc.UserCode, &dc.ClientName, &scopes, &dc.ClientIP,
+		&dc.CreatedAt, &dc.ExpiresAt, &dc.Interval, &lastPolled, &dc.Status, &userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	dc.Scopes = strings.Split(scopes, ",")
+	if lastPolled.Valid {
+		dc.LastPolledAt = &lastPolled.Time
+	}
+	dc.UserID = int(userID.Int64)
+	return &dc, nil
+}
+
+func (s *SQLStore) CreateDeviceCode(ctx context.Context, dc *DeviceCode) error {
+	defer s.startQuery(ctx, "create_device_code")()
+
+	query := `
+		INSERT INTO device_codes (device_code_hash, user_code, client_name, scopes, client_ip, created_at, expires_at, poll_interval, status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id
+	`
+	err := s.db.QueryRowContext(ctx, s.dialect.Rebind(query),
+		dc.DeviceCodeHash, dc.UserCode, dc.ClientName, strings.Join(dc.Scopes, ","), dc.ClientIP,
+		dc.CreatedAt.UTC(), dc.ExpiresAt.UTC(), dc.Interval, dc.Status,
+	).Scan(&dc.ID)
+	if isUniqueViolation(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+func (s *SQLStore) CountPendingDeviceCodes(ctx context.Context, clientIP string, now time.Time) (int, error) {
+	defer s.startQuery(ctx, "count_pending_device_codes")()
+
+	query := `SELECT COUNT(*) FROM device_codes WHERE client_ip = $1 AND status = $2 AND expires_at > $3`
+	var count int
+	err := s.db.QueryRowContext(ctx, s.dialect.Rebind(query), clientIP, DeviceCodePending, now.UTC()).Scan(&count)
+	return count, err
+}
+
+func (s *SQLStore) GetDeviceCode(ctx context.Context, deviceCodeHash string) (*DeviceCode, error) {
+	defer s.startQuery(ctx, "get_device_code")()
+
+	query := `SELECT ` + deviceCodeColumns + ` FROM device_codes WHERE device_code_hash = $1`
+	return scanDeviceCode(s.db.QueryRowContext(ctx, s.dialect.Rebind(query), deviceCodeHash))
+}
+
+func (s *SQLStore) GetPendingDeviceCode(ctx context.Context, userCode string, now time.Time) (*DeviceCode, error) {
+	defer s.startQuery(ctx, "get_pending_device_code")()
+
+	query := `SELECT ` + deviceCodeColumns + ` FROM device_codes WHERE user_code = $1 AND status = $2 AND expires_at > $3`
+	return scanDeviceCode(s.db.QueryRowContext(ctx, s.dialect.Rebind(query), userCode, DeviceCodePending, now.UTC()))
+}
+
+func (s *SQLStore) ResolveDeviceCode(ctx context.Context, id, userID int, status string) error {
+	defer s.startQuery(ctx, "resolve_device_code")()
+
+	query := `UPDATE device_codes SET status = $1, user_id = $2 WHERE id = $3 AND status = $4`
+	return expectRow(s.db.ExecContext(ctx, s.dialect.Rebind(query), status, userID, id, DeviceCodePending))
+}
+
+func (s *SQLStore) UpdateDeviceCodePoll(ctx context.Context, id int, polledAt time.Time, interval int) error {
+	defer s.startQuery(ctx, "update_device_code_poll")()
+
+	query := `UPDATE device_codes SET last_polled_at = $1, poll_interval = $2 WHERE id = $3`
+	_, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), polledAt.UTC(), interval, id)
+	return err
+}
+
+func (s *SQLStore) DeleteDeviceCode(ctx context.Context, id int) error {
+	defer s.startQuery(ctx, "delete_device_code")()
+
+	query := `DELETE FROM device_codes WHERE id = $1`
+	return expectRow(s.db.ExecContext(ctx, s.dialect.Rebind(query), id))
+}
+
+func (s *SQLStore) DeleteExpiredDeviceCodes(ctx context.Context, now time.Time) error {
+	defer s.startQuery(ctx, "delete_expired_device_codes")()
+
+	query := `DELETE FROM device_codes WHERE expires_at <= $1`
+	_, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), now.UTC())
+	return err
+}
+
+func (s *MemoryStore) CreateDeviceCode(_ context.Context, dc *DeviceCode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.deviceCodes {
+		if existing.UserCode == dc.UserCode || existing.DeviceCodeHash == dc.DeviceCodeHash {
+			return ErrConflict
+		}
+	}
+	dc.ID = s.newID()
+	s.deviceCodes = append(s.deviceCodes, *dc)
+	return nil
+}
+
+func (s *MemoryStore) CountPendingDeviceCodes(_ context.Context, clientIP string, now time.Time) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	count := 0
+	for _, dc := range s.deviceCodes {
+		if dc.ClientIP == clientIP && dc.Status == DeviceCodePending && dc.ExpiresAt.After(now) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// findDeviceCode returns a copy of the first device code matching match.
+func (s *MemoryStore) findDeviceCode(match func(DeviceCode) bool) (*DeviceCode, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, dc := range s.deviceCodes {
+		if match(dc) {
+			return &dc, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryStore) GetDeviceCode(_ context.Context, deviceCodeHash string) (*DeviceCode, error) {
+	return s.findDeviceCode(func(dc DeviceCode) bool { return dc.DeviceCodeHash == deviceCodeHash })
+}
+
+func (s *MemoryStore) GetPendingDeviceCode(_ context.Context, userCode string, now time.Time) (*DeviceCode, error) {
+	return s.findDeviceCode(func(dc DeviceCode) bool {
+		return dc.UserCode == userCode && dc.Status == DeviceCodePending && dc.ExpiresAt.After(now)
+	})
+}
+
+// updateDeviceCode applies change to the device code with the given ID if
+// it matches cond.
+func (s *MemoryStore) updateDeviceCode(id int, cond func(DeviceCode) bool, change func(*DeviceCode)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.deviceCodes {
+		if s.deviceCodes[i].ID == id && cond(s.deviceCodes[i]) {
+			change(&s.deviceCodes[i])
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *MemoryStore) ResolveDeviceCode(_ context.Context, id, userID int, status string) error {
+	return s.updateDeviceCode(id,
+		func(dc DeviceCode) bool { return dc.Status == DeviceCodePending },
+		func(dc *DeviceCode) { dc.Status, dc.UserID = status, userID })
+}
+
+func (s *MemoryStore) UpdateDeviceCodePoll(_ context.Context, id int, polledAt time.Time, interval int) error {
+	err := s.updateDeviceCode(id,
+		func(DeviceCode) bool { return true },
+		func(dc *DeviceCode) { dc.LastPolledAt, dc.Interval = &polledAt, interval })
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// deleteDeviceCodes removes the device codes matching drop and reports how
+// many there were.
+func (s *MemoryStore) deleteDeviceCodes(drop func(DeviceCode) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.deviceCodes[:0]
+	for _, dc := range s.deviceCodes {
+		if !drop(dc) {
+			kept = append(kept, dc)
+		}
+	}
+	deleted := len(s.deviceCodes) - len(kept)
+	s.deviceCodes = kept
+	return deleted
+}
+
+func (s *MemoryStore) DeleteDeviceCode(_ context.Context, id int) error {
+	if s.deleteDeviceCodes(func(dc DeviceCode) bool { return dc.ID == id }) == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeleteExpiredDeviceCodes(_ context.Context, now time.Time) error {
+	s.deleteDeviceCodes(func(dc DeviceCode) bool { return !dc.ExpiresAt.After(now) })
+	return nil
+}
@@ -0,0 +1,39 @@
+package db
+
+import (
+	"regexp"
+)
+
+// Dialect captures the differences between the SQL backends. Queries are
+// written with PostgreSQL-style $N placeholders and rebound per dialect;
+// schema differences live in the per-dialect migration directories.
+type Dialect struct {
+	Name string
+	// CaseInsensitiveLike is the operator used for case-insensitive
+	// substring matching.
+	CaseInsensitiveLike string
+}
+
+var (
+	Postgres = Dialect{
+		Name:                "postgres",
+		CaseInsensitiveLike: "ILIKE",
+	}
+
+	SQLite = Dialect{
+		Name: "sqlite",
+		// LIKE is already case-insensitive for ASCII in SQLite.
+		CaseInsensitiveLike: "LIKE",
+	}
+)
+
+var placeholderRe = regexp.MustCompile(`\$(\d+)`)
+
+// Rebind rewrites $N placeholders into the form the dialect's driver
+// expects. SQLite accepts ?N with the same numbering.
+func (d Dialect) Rebind(query string) string {
+	if d.Name == Postgres.Name {
+		return query
+	}
+	return placeholderRe.ReplaceAllString(query, "?$1")
+}
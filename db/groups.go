@@ -0,0 +1,241 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"time"
+)
+
+// Group is a set of users that videos can be shared with.
+type Group struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	// Members are the usernames of the group's members, sorted.
+	Members []string `json:"members"`
+}
+
+// ListGroups returns the groups, sorted by name, with their members.
+func (s *SQLStore) ListGroups(ctx context.Context, userID int) ([]Group, error) {
+	defer s.startQuery(ctx, "list_groups")()
+
+	query := `
+		SELECT g.id, g.name, g.created_at, u.username
+		FROM user_groups g
+		LEFT JOIN group_members m ON m.group_id = g.id
+		LEFT JOIN users u ON u.id = m.user_id
+		WHERE $1 = 0 OR g.id IN (SELECT group_id FROM group_members WHERE user_id = $1)
+		ORDER BY g.name, u.username
+	`
+	rows, err := s.db.QueryContext(ctx, s.dialect.Rebind(query), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []Group{}
+	for rows.Next() {
+		var g Group
+		var member sql.NullString
+		if err := rows.Scan(&g.ID, &g.Name, &g.CreatedAt, &member); err != nil {
+			return nil, err
+		}
+		if n := len(groups); n == 0 || groups[n-1].ID != g.ID {
+			g.Members = []string{}
+			groups = append(groups, g)
+		}
+		if member.Valid {
+			last := &groups[len(groups)-1]
+			last.Members = append(last.Members, member.String)
+		}
+	}
+	return groups, rows.Err()
+}
+
+// GetGroup returns a group without its members.
+func (s *SQLStore) GetGroup(ctx context.Context, id int) (*Group, error) {
+	defer s.startQuery(ctx, "get_group")()
+
+	var g Group
+	query := `SELECT id, name, created_at FROM user_groups WHERE id = $1`
+	err := s.db.QueryRowContext(ctx, s.dialect.Rebind(query), id).Scan(&g.ID, &g.Name, &g.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+func (s *SQLStore) CreateGroup(ctx context.Context, g *Group) error {
+	defer s.startQuery(ctx, "create_group")()
+
+	query := `INSERT INTO user_groups (name, created_at) VALUES ($1, $2) RETURNING id`
+	err := s.db.QueryRowContext(ctx, s.dialect.Rebind(query), g.Name, g.CreatedAt.UTC()).Scan(&g.ID)
+	if isUniqueViolation(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+// DeleteGroup deletes a group. Videos shared with it are then only seen by
+// their owners.
+func (s *SQLStore) DeleteGroup(ctx context.Context, id int) error {
+	defer s.startQuery(ctx, "delete_group")()
+
+	query := `DELETE FROM user_groups WHERE id = $1`
+	return expectRow(s.db.ExecContext(ctx, s.dialect.Rebind(query), id))
+}
+
+func (s *SQLStore) AddGroupMember(ctx context.Context, groupID, userID int) error {
+	defer s.startQuery(ctx, "add_group_member")()
+
+	query := `INSERT INTO group_members (group_id, user_id) VALUES ($1, $2)`
+	_, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), groupID, userID)
+	if isUniqueViolation(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *SQLStore) RemoveGroupMember(ctx context.Context, groupID, userID int) error {
+	defer s.startQuery(ctx, "remove_group_member")()
+
+	query := `DELETE FROM group_members WHERE group_id = $1 AND user_id = $2`
+	return expectRow(s.db.ExecContext(ctx, s.dialect.Rebind(query), groupID, userID))
+}
+
+func (s *SQLStore) IsGroupMember(ctx context.Context, groupID, userID int) (bool, error) {
+	defer s.startQuery(ctx, "is_group_member")()
+
+	var count int
+	query := `SELECT COUNT(*) FROM group_members WHERE group_id = $1 AND user_id = $2`
+	err := s.db.QueryRowContext(ctx, s.dialect.Rebind(query), groupID, userID).Scan(&count)
+	return count > 0, err
+}
+
+type memoryGroupMember struct {
+	groupID, userID int
+}
+
+func (s *MemoryStore) ListGroups(_ context.Context, userID int) ([]Group, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	groups := []Group{}
+	for _, g := range s.groups {
+		if userID != 0 && !s.inGroup(g.ID, userID) {
+			continue
+		}
+		g.Members = []string{}
+		for _, m := range s.groupMembers {
+			if m.groupID != g.ID {
+				continue
+			}
+			for _, u := range s.users {
+				if u.ID == m.userID {
+					g.Members = append(g.Members, u.Username)
+				}
+			}
+		}
+		sort.Strings(g.Members)
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	return groups, nil
+}
+
+func (s *MemoryStore) GetGroup(_ context.Context, id int) (*Group, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, g := range s.groups {
+		if g.ID == id {
+			return &g, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryStore) CreateGroup(_ context.Context, g *Group) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.groups {
+		if existing.Name == g.Name {
+			return ErrConflict
+		}
+	}
+	g.ID = s.newID()
+	s.groups = append(s.groups, Group{ID: g.ID, Name: g.Name, CreatedAt: g.CreatedAt})
+	return nil
+}
+
+func (s *MemoryStore) DeleteGroup(_ context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, g := range s.groups {
+		if g.ID != id {
+			continue
+		}
+		s.groups = append(s.groups[:i], s.groups[i+1:]...)
+		members := s.groupMembers[:0]
+		for _, m := range s.groupMembers {
+			if m.groupID != id {
+				members = append(members, m)
+			}
+		}
+		s.groupMembers = members
+		for i := range s.videos {
+			if s.videos[i].GroupID == id {
+				s.videos[i].GroupID = 0
+			}
+		}
+		for userID, p := range s.preferences {
+			if p.GroupID == id {
+				p.GroupID = 0
+				s.preferences[userID] = p
+			}
+		}
+		return nil
+	}
+	return ErrNotFound
+}
+
+func (s *MemoryStore) AddGroupMember(_ context.Context, groupID, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.inGroup(groupID, userID) {
+		s.groupMembers = append(s.groupMembers, memoryGroupMember{groupID: groupID, userID: userID})
+	}
+	return nil
+}
+
+func (s *MemoryStore) RemoveGroupMember(_ context.Context, groupID, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, m := range s.groupMembers {
+		if m.groupID == groupID && m.userID == userID {
+			s.groupMembers = append(s.groupMembers[:i], s.groupMembers[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *MemoryStore) IsGroupMember(_ context.Context, groupID, userID int) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.inGroup(groupID, userID), nil
+}
+
+// inGroup reports whether the user is a member of the group. The caller
+// must hold s.mu.
+func (s *MemoryStore) inGroup(groupID, userID int) bool {
+	for _, m := range s.groupMembers {
+		if m.groupID == groupID && m.userID == userID {
+			return true
+		}
+	}
+	return false
+}
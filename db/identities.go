@@ -0,0 +1,111 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// Identity links an account to a user at an OpenID Connect provider,
+// identified by the issuer and the subject claim.
+type Identity struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"-"`
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"subject"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (s *SQLStore) GetUserByIdentity(ctx context.Context, issuer, subject string) (*User, error) {
+	defer s.startQuery(ctx, "get_user_by_identity")()
+
+	query := `
+		SELECT u.id, u.username, u.password_hash, u.role, u.created_at, u.updated_at
+		FROM user_identities i JOIN users u ON u.id = i.user_id
+		WHERE i.issuer = $1 AND i.subject = $2
+	`
+	return scanUser(s.db.QueryRowContext(ctx, s.dialect.Rebind(query), issuer, subject))
+}
+
+func (s *SQLStore) CreateIdentity(ctx context.Context, ident *Identity) error {
+	defer s.startQuery(ctx, "create_identity")()
+
+	return s.insertIdentity(ctx, s.db, ident)
+}
+
+func (s *SQLStore) insertIdentity(ctx context.Context, q queryRower, ident *Identity) error {
+	query := `
+		INSERT INTO user_identities (user_id, issuer, subject, created_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`
+	err := q.QueryRowContext(ctx, s.dialect.Rebind(query),
+		ident.UserID, ident.Issuer, ident.Subject, ident.CreatedAt.UTC(),
+	).Scan(&ident.ID)
+	if isUniqueViolation(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+func (s *SQLStore) CreateUserWithIdentity(ctx context.Context, u *User, ident *Identity) error {
+	defer s.startQuery(ctx, "create_user_with_identity")()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.insertUser(ctx, tx, u); err != nil {
+		return err
+	}
+	ident.UserID = u.ID
+	if err := s.insertIdentity(ctx, tx, ident); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *MemoryStore) GetUserByIdentity(_ context.Context, issuer, subject string) (*User, error) {
+	s.mu.RLock()
+	userID := 0
+	for _, ident := range s.identities {
+		if ident.Issuer == issuer && ident.Subject == subject {
+			userID = ident.UserID
+		}
+	}
+	s.mu.RUnlock()
+	return s.findUser(func(u User) bool { return u.ID == userID })
+}
+
+func (s *MemoryStore) CreateIdentity(_ context.Context, ident *Identity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.insertIdentity(ident)
+}
+
+func (s *MemoryStore) insertIdentity(ident *Identity) error {
+	for _, existing := range s.identities {
+		if existing.Issuer == ident.Issuer && existing.Subject == ident.Subject {
+			return ErrConflict
+		}
+	}
+	ident.ID = s.newID()
+	s.identities = append(s.identities, *ident)
+	return nil
+}
+
+func (s *MemoryStore) CreateUserWithIdentity(_ context.Context, u *User, ident *Identity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.identities {
+		if existing.Issuer == ident.Issuer && existing.Subject == ident.Subject {
+			return ErrConflict
+		}
+	}
+	if err := s.insertUser(u); err != nil {
+		return err
+	}
+	ident.UserID = u.ID
+	return s.insertIdentity(ident)
+}
@@ -0,0 +1,243 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// LoginAttempt is a failed login to an existing account.
+type LoginAttempt struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"-"`
+	ClientIP  string    `json:"client_ip"`
+	UserAgent string    `json:"user_agent"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (s *SQLStore) CreateLoginAttempt(ctx context.Context, a *LoginAttempt) error {
+	defer s.startQuery(ctx, "create_login_attempt")()
+
+	query := `
+		INSERT INTO login_attempts (user_id, client_ip, user_agent, created_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`
+	return s.db.QueryRowContext(ctx, s.dialect.Rebind(query), a.UserID, a.ClientIP, a.UserAgent, a.CreatedAt.UTC()).Scan(&a.ID)
+}
+
+// ListLoginAttempts returns the user's failed logins since the given time,
+// newest first.
+func (s *SQLStore) ListLoginAttempts(ctx context.Context, userID int, since time.Time) ([]LoginAttempt, error) {
+	defer s.startQuery(ctx, "list_login_attempts")()
+
+	query := `
+		SELECT id, user_id, client_ip, user_agent, created_at
+		FROM login_attempts
+		WHERE user_id = $1 AND created_at >= $2
+		ORDER BY created_at DESC, id DESC
+	`
+	rows, err := s.db.QueryContext(ctx, s.dialect.Rebind(query), userID, since.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := []LoginAttempt{}
+	for rows.Next() {
+		var a LoginAttempt
+		if err := rows.Scan(&a.ID, &a.UserID, &a.ClientIP, &a.UserAgent, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+// maxReserveRetries is how often ReserveLoginAttempt reads the failures
+// again after another attempt changed them.
+const maxReserveRetries = 5
+
+// ReserveLoginAttempt counts an attempt against subject as a failure if
+// allow agrees. The count is only changed if it is still what allow was
+// shown, and read again otherwise.
+func (s *SQLStore) ReserveLoginAttempt(ctx context.Context, subject string, now, since time.Time, allow func(failures int, last time.Time) bool) (int, bool, error) {
+	defer s.startQuery(ctx, "reserve_login_attempt")()
+
+	for range maxReserveRetries {
+		var stored int
+		var last time.Time
+		query := `SELECT failures, last_failed_at FROM login_failures WHERE subject = $1`
+		err := s.db.QueryRowContext(ctx, s.dialect.Rebind(query), subject).Scan(&stored, &last)
+		found := err == nil
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return 0, false, err
+		}
+		failures := stored
+		expired := found && last.Before(since)
+		if !found || expired {
+			failures, last = 0, time.Time{}
+		}
+		if !allow(failures, last) {
+			return failures, false, nil
+		}
+
+		var res sql.Result
+		switch {
+		case !found:
+			query = `INSERT INTO login_failures (subject, failures, last_failed_at) VALUES ($1, 1, $2) ON CONFLICT (subject) DO NOTHING`
+			res, err = s.db.ExecContext(ctx, s.dialect.Rebind(query), subject, now.UTC())
+		case expired:
+			query = `UPDATE login_failures SET failures = 1, last_failed_at = $2 WHERE subject = $1 AND failures = $3 AND last_failed_at < $4`
+			res, err = s.db.ExecContext(ctx, s.dialect.Rebind(query), subject, now.UTC(), stored, since.UTC())
+		default:
+			query = `UPDATE login_failures SET failures = failures + 1, last_failed_at = $2 WHERE subject = $1 AND failures = $3 AND last_failed_at >= $4`
+			res, err = s.db.ExecContext(ctx, s.dialect.Rebind(query), subject, now.UTC(), stored, since.UTC())
+		}
+		if err := expectRow(res, err); err == nil {
+			return failures, true, nil
+		} else if !errors.Is(err, ErrNotFound) {
+			return 0, false, err
+		}
+	}
+	return 0, false, fmt.Errorf("failures of %s kept changing", subject)
+}
+
+func (s *SQLStore) ReleaseLoginAttempt(ctx context.Context, subject string) error {
+	defer s.startQuery(ctx, "release_login_attempt")()
+
+	query := `UPDATE login_failures SET failures = failures - 1 WHERE subject = $1 AND failures > 0`
+	_, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), subject)
+	return err
+}
+
+// GetLoginFailures returns the consecutive failures of subject and the
+// time of the last, or no failures if the last was before since.
+func (s *SQLStore) GetLoginFailures(ctx context.Context, subject string, since time.Time) (int, time.Time, error) {
+	defer s.startQuery(ctx, "get_login_failures")()
+
+	var failures int
+	var last time.Time
+	query := `SELECT failures, last_failed_at FROM login_failures WHERE subject = $1 AND last_failed_at >= $2`
+	err := s.db.QueryRowContext(ctx, s.dialect.Rebind(query), subject, since.UTC()).Scan(&failures, &last)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, time.Time{}, nil
+	}
+	return failures, last, err
+}
+
+// ClearLoginFailures forgets the failures of subject. It returns
+// ErrNotFound if there were none since the given time.
+func (s *SQLStore) ClearLoginFailures(ctx context.Context, subject string, since time.Time) error {
+	defer s.startQuery(ctx, "clear_login_failures")()
+
+	query := `DELETE FROM login_failures WHERE subject = $1 AND last_failed_at >= $2`
+	return expectRow(s.db.ExecContext(ctx, s.dialect.Rebind(query), subject, since.UTC()))
+}
+
+// DeleteLoginAttemptsBefore deletes failed logins and failure counts older
+// than before.
+func (s *SQLStore) DeleteLoginAttemptsBefore(ctx context.Context, before time.Time) error {
+	defer s.startQuery(ctx, "delete_login_attempts")()
+
+	if _, err := s.db.ExecContext(ctx, s.dialect.Rebind(`DELETE FROM login_attempts WHERE created_at < $1`), before.UTC()); err != nil {
+		return err
+	}
+	_, err := s.db.ExecContext(ctx, s.dialect.Rebind(`DELETE FROM login_failures WHERE last_failed_at < $1`), before.UTC())
+	return err
+}
+
+type memoryLoginFailures struct {
+	failures   int
+	lastFailed time.Time
+}
+
+func (s *MemoryStore) CreateLoginAttempt(_ context.Context, a *LoginAttempt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a.ID = s.newID()
+	s.loginAttempts = append(s.loginAttempts, *a)
+	return nil
+}
+
+func (s *MemoryStore) ListLoginAttempts(_ context.Context, userID int, since time.Time) ([]LoginAttempt, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	attempts := []LoginAttempt{}
+	for _, a := range s.loginAttempts {
+		if a.UserID == userID && !a.CreatedAt.Before(since) {
+			attempts = append(attempts, a)
+		}
+	}
+	sort.Slice(attempts, func(i, j int) bool { return attempts[i].ID > attempts[j].ID })
+	return attempts, nil
+}
+
+func (s *MemoryStore) ReserveLoginAttempt(_ context.Context, subject string, now, since time.Time, allow func(failures int, last time.Time) bool) (int, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.loginFailures == nil {
+		s.loginFailures = make(map[string]memoryLoginFailures)
+	}
+	f := s.loginFailures[subject]
+	if f.lastFailed.Before(since) {
+		f = memoryLoginFailures{}
+	}
+	if !allow(f.failures, f.lastFailed) {
+		return f.failures, false, nil
+	}
+	s.loginFailures[subject] = memoryLoginFailures{failures: f.failures + 1, lastFailed: now}
+	return f.failures, true, nil
+}
+
+func (s *MemoryStore) ReleaseLoginAttempt(_ context.Context, subject string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, ok := s.loginFailures[subject]; ok && f.failures > 0 {
+		f.failures--
+		s.loginFailures[subject] = f
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetLoginFailures(_ context.Context, subject string, since time.Time) (int, time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	f, ok := s.loginFailures[subject]
+	if !ok || f.lastFailed.Before(since) {
+		return 0, time.Time{}, nil
+	}
+	return f.failures, f.lastFailed, nil
+}
+
+func (s *MemoryStore) ClearLoginFailures(_ context.Context, subject string, since time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.loginFailures[subject]
+	if !ok || f.lastFailed.Before(since) {
+		return ErrNotFound
+	}
+	delete(s.loginFailures, subject)
+	return nil
+}
+
+func (s *MemoryStore) DeleteLoginAttemptsBefore(_ context.Context, before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attempts := s.loginAttempts[:0]
+	for _, a := range s.loginAttempts {
+		if !a.CreatedAt.Before(before) {
+			attempts = append(attempts, a)
+		}
+	}
+	s.loginAttempts = attempts
+	for subject, f := range s.loginFailures {
+		if f.lastFailed.Before(before) {
+			delete(s.loginFailures, subject)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package db
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestSQLite(t *testing.T) *SQLStore {
+	t.Helper()
+	if err := InitializeSQLite(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatalf("InitializeSQLite: %v", err)
+	}
+	t.Cleanup(func() { Close() })
+	if _, err := MigrateUp(); err != nil {
+		t.Fatalf("MigrateUp: %v", err)
+	}
+	return NewSQLiteStore(DB)
+}
+
+func TestReserveLoginAttempt(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range map[string]LoginRepository{
+		"sqlite": openTestSQLite(t),
+		"memory": NewMemoryStore(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			now := time.Now().UTC().Truncate(time.Second)
+			since := now.Add(-time.Hour)
+			allowAll := func(int, time.Time) bool { return true }
+
+			for want := range 2 {
+				failures, ok, err := store.ReserveLoginAttempt(ctx, "account:alice", now, since, allowAll)
+				if err != nil || !ok || failures != want {
+					t.Fatalf("reservation %d: got %d, %v, %v; want %d, true, nil", want+1, failures, ok, err, want)
+				}
+			}
+
+			var seen int
+			var seenLast time.Time
+			failures, ok, err := store.ReserveLoginAttempt(ctx, "account:alice", now, since, func(failures int, last time.Time) bool {
+				seen, seenLast = failures, last
+				return false
+			})
+			if err != nil || ok || failures != 2 {
+				t.Fatalf("refused reservation: got %d, %v, %v; want 2, false, nil", failures, ok, err)
+			}
+			if seen != 2 || !seenLast.Equal(now) {
+				t.Errorf("allow was shown %d failures at %v, want 2 at %v", seen, seenLast, now)
+			}
+
+			if err := store.ReleaseLoginAttempt(ctx, "account:alice"); err != nil {
+				t.Fatalf("ReleaseLoginAttempt: %v", err)
+			}
+			if failures, _, err := store.GetLoginFailures(ctx, "account:alice", since); err != nil || failures != 1 {
+				t.Errorf("after release: got %d failures, %v; want 1", failures, err)
+			}
+
+			// Failures before since are forgotten.
+			later := now.Add(2 * time.Hour)
+			failures, ok, err = store.ReserveLoginAttempt(ctx, "account:alice", later, later.Add(-time.Hour), allowAll)
+			if err != nil || !ok || failures != 0 {
+				t.Fatalf("reservation after expiry: got %d, %v, %v; want 0, true, nil", failures, ok, err)
+			}
+			if failures, _, err := store.GetLoginFailures(ctx, "account:alice", later.Add(-time.Hour)); err != nil || failures != 1 {
+				t.Errorf("after expiry: got %d failures, %v; want 1", failures, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,445 @@
+package db
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore is an in-memory Store. It behaves like SQLStore, including
+// the default genres, but keeps everything in process memory; it is meant
+// for tests and throwaway instances.
+type MemoryStore struct {
+	mu           sync.RWMutex
+	videos       []Video
+	genres       []Genre
+	users        []User
+	sessions     []Session
+	invites      []memoryInvite
+	audit        []AuditEvent
+	apiTokens    []APIToken
+	identities   []Identity
+	deviceCodes  []DeviceCode
+	shares       []Share
+	groups       []Group
+	groupMembers []memoryGroupMember
+	preferences  map[int]Preferences
+	nextVideoID  int
+	nextID       int
+
+	// loginAttempts and loginFailures track failed logins.
+	loginAttempts []LoginAttempt
+	loginFailures map[string]memoryLoginFailures
+}
+
+type memoryInvite struct {
+	Invite
+	used bool
+}
+
+func NewMemoryStore() *MemoryStore {
+	s := &MemoryStore{nextVideoID: 1, nextID: 1}
+	for i, name := range defaultGenres {
+		s.genres = append(s.genres, Genre{ID: i + 1, Name: name})
+	}
+	return s
+}
+
+func (s *MemoryStore) GetAllVideos(_ context.Context, access VideoAccess) ([]Video, error) {
+	return s.filterVideos(func(v Video) bool { return s.listed(v, access) }), nil
+}
+
+func (s *MemoryStore) GetVideosByGenre(_ context.Context, genre string, access VideoAccess) ([]Video, error) {
+	return s.filterVideos(func(v Video) bool { return v.Genre == genre && s.listed(v, access) }), nil
+}
+
+func (s *MemoryStore) SearchVideos(_ context.Context, term string, access VideoAccess) ([]Video, error) {
+	term = strings.ToLower(term)
+	return s.filterVideos(func(v Video) bool {
+		return (strings.Contains(strings.ToLower(v.Title), term) ||
+			strings.Contains(strings.ToLower(v.Description), term)) && s.listed(v, access)
+	}), nil
+}
+
+// listed reports whether a listing for access shows v, like
+// listedCondition. The caller must hold s.mu.
+func (s *MemoryStore) listed(v Video, access VideoAccess) bool {
+	return access.All || v.Visibility == VisibilityPublic || v.OwnerID == access.UserID ||
+		(v.Visibility == VisibilityGroup && s.inGroup(v.GroupID, access.UserID))
+}
+
+func (s *MemoryStore) InsertVideo(_ context.Context, video *Video) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, v := range s.videos {
+		if v.FilePath == video.FilePath {
+			return ErrConflict
+		}
+	}
+	now := time.Now()
+	video.ID = s.nextVideoID
+	video.CreatedAt = now
+	video.UpdatedAt = now
+	s.nextVideoID++
+	s.videos = append(s.videos, *video)
+	return nil
+}
+
+func (s *MemoryStore) GetVideo(_ context.Context, id int) (*Video, error) {
+	return s.findVideo(func(v Video) bool { return v.ID == id })
+}
+
+func (s *MemoryStore) GetVideoByFile(_ context.Context, filePath string) (*Video, error) {
+	return s.findVideo(func(v Video) bool { return v.FilePath == filePath })
+}
+
+func (s *MemoryStore) GetVideoByCover(_ context.Context, coverImage string) (*Video, error) {
+	return s.findVideo(func(v Video) bool { return v.CoverImage == coverImage })
+}
+
+// findVideo returns the oldest matching video.
+func (s *MemoryStore) findVideo(match func(Video) bool) (*Video, error) {
+	videos := s.filterVideos(match)
+	if len(videos) == 0 {
+		return nil, ErrNotFound
+	}
+	return &videos[len(videos)-1], nil
+}
+
+func (s *MemoryStore) SetVideoVisibility(_ context.Context, id int, visibility string, groupID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if visibility != VisibilityGroup {
+		groupID = 0
+	}
+	for i := range s.videos {
+		v := &s.videos[i]
+		if v.ID == id {
+			v.Visibility = visibility
+			v.GroupID = groupID
+			v.UpdatedAt = time.Now()
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *MemoryStore) UpdateVideo(_ context.Context, video *Video) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.videos {
+		v := &s.videos[i]
+		if v.ID == video.ID {
+			v.Title = video.Title
+			v.Description = video.Description
+			v.Genre = video.Genre
+			v.ReleaseYear = video.ReleaseYear
+			v.UpdatedAt = time.Now()
+			video.UpdatedAt = v.UpdatedAt
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *MemoryStore) DeleteVideo(_ context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, v := range s.videos {
+		if v.ID == id {
+			s.videos = append(s.videos[:i], s.videos[i+1:]...)
+			shares := s.shares[:0]
+			for _, sh := range s.shares {
+				if sh.VideoID != id {
+					shares = append(shares, sh)
+				}
+			}
+			s.shares = shares
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *MemoryStore) CreateGenre(_ context.Context, genre *Genre) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	maxID := 0
+	for _, g := range s.genres {
+		if g.Name == genre.Name {
+			return ErrConflict
+		}
+		maxID = max(maxID, g.ID)
+	}
+	genre.ID = maxID + 1
+	s.genres = append(s.genres, *genre)
+	return nil
+}
+
+func (s *MemoryStore) DeleteGenre(_ context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, g := range s.genres {
+		if g.ID == id {
+			s.genres = append(s.genres[:i], s.genres[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *MemoryStore) GetAllGenres(context.Context) ([]Genre, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	genres := make([]Genre, len(s.genres))
+	copy(genres, s.genres)
+	sort.Slice(genres, func(i, j int) bool { return genres[i].Name < genres[j].Name })
+	return genres, nil
+}
+
+// filterVideos returns copies of the matching videos, newest first.
+func (s *MemoryStore) filterVideos(match func(Video) bool) []Video {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var videos []Video
+	for _, v := range s.videos {
+		if match(v) {
+			videos = append(videos, v)
+		}
+	}
+	sort.SliceStable(videos, func(i, j int) bool {
+		if videos[i].CreatedAt.Equal(videos[j].CreatedAt) {
+			return videos[i].ID > videos[j].ID
+		}
+		return videos[i].CreatedAt.After(videos[j].CreatedAt)
+	})
+	return videos
+}
+
+func (s *MemoryStore) newID() int {
+	id := s.nextID
+	s.nextID++
+	return id
+}
+
+func (s *MemoryStore) CountUsers(context.Context) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.users), nil
+}
+
+func (s *MemoryStore) CreateUser(_ context.Context, u *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.insertUser(u)
+}
+
+func (s *MemoryStore) insertUser(u *User) error {
+	for _, existing := range s.users {
+		if existing.Username == u.Username {
+			return ErrConflict
+		}
+	}
+	now := time.Now()
+	u.ID = s.newID()
+	u.CreatedAt = now
+	u.UpdatedAt = now
+	s.users = append(s.users, *u)
+	return nil
+}
+
+func (s *MemoryStore) findUser(match func(User) bool) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, u := range s.users {
+		if match(u) {
+			return &u, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryStore) GetUserByID(_ context.Context, id int) (*User, error) {
+	return s.findUser(func(u User) bool { return u.ID == id })
+}
+
+func (s *MemoryStore) GetUserByUsername(_ context.Context, username string) (*User, error) {
+	return s.findUser(func(u User) bool { return u.Username == username })
+}
+
+func (s *MemoryStore) ListUsers(context.Context) ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	users := make([]User, len(s.users))
+	copy(users, s.users)
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users, nil
+}
+
+// updateUser applies change to the user with the given ID.
+func (s *MemoryStore) updateUser(userID int, change func(*User)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.users {
+		if s.users[i].ID == userID {
+			change(&s.users[i])
+			s.users[i].UpdatedAt = time.Now()
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *MemoryStore) SetUserRole(_ context.Context, userID int, role string) error {
+	return s.updateUser(userID, func(u *User) { u.Role = role })
+}
+
+func (s *MemoryStore) GetUserPreferences(ctx context.Context, userID int) (*Preferences, error) {
+	if _, err := s.GetUserByID(ctx, userID); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.preferences[userID]
+	if !ok {
+		p = Preferences{Visibility: VisibilityPublic}
+	}
+	return &p, nil
+}
+
+func (s *MemoryStore) SetUserPreferences(_ context.Context, userID int, p Preferences) error {
+	return s.updateUser(userID, func(u *User) {
+		if s.preferences == nil {
+			s.preferences = make(map[int]Preferences)
+		}
+		s.preferences[u.ID] = p
+	})
+}
+
+func (s *MemoryStore) UpdatePassword(_ context.Context, userID int, hash string) error {
+	return s.updateUser(userID, func(u *User) { u.PasswordHash = hash })
+}
+
+func (s *MemoryStore) CreateSession(_ context.Context, sess *Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess.ID = s.newID()
+	s.sessions = append(s.sessions, *sess)
+	return nil
+}
+
+func (s *MemoryStore) GetSession(_ context.Context, tokenHash string, now time.Time) (*Session, *User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, sess := range s.sessions {
+		if sess.TokenHash != tokenHash || !sess.ExpiresAt.After(now) {
+			continue
+		}
+		for _, u := range s.users {
+			if u.ID == sess.UserID {
+				return &sess, &u, nil
+			}
+		}
+	}
+	return nil, nil, ErrNotFound
+}
+
+func (s *MemoryStore) TouchSession(_ context.Context, id int, lastSeen time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.sessions {
+		if s.sessions[i].ID == id {
+			s.sessions[i].LastSeenAt = lastSeen
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) UpdateSessionRefresh(_ context.Context, id int, refreshToken string, refreshAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.sessions {
+		if s.sessions[i].ID == id {
+			s.sessions[i].RefreshToken = refreshToken
+			s.sessions[i].RefreshAt = &refreshAt
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *MemoryStore) ListSessions(_ context.Context, userID int, now time.Time) ([]Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var sessions []Session
+	for _, sess := range s.sessions {
+		if sess.UserID == userID && sess.ExpiresAt.After(now) {
+			sessions = append(sessions, sess)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt) })
+	return sessions, nil
+}
+
+// deleteSessions removes the sessions matching drop and reports how many
+// there were.
+func (s *MemoryStore) deleteSessions(drop func(Session) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.sessions[:0]
+	for _, sess := range s.sessions {
+		if !drop(sess) {
+			kept = append(kept, sess)
+		}
+	}
+	deleted := len(s.sessions) - len(kept)
+	s.sessions = kept
+	return deleted
+}
+
+func (s *MemoryStore) DeleteSession(_ context.Context, userID, id int) error {
+	if s.deleteSessions(func(sess Session) bool { return sess.ID == id && sess.UserID == userID }) == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeleteUserSessions(_ context.Context, userID, keepID int) error {
+	s.deleteSessions(func(sess Session) bool { return sess.UserID == userID && sess.ID != keepID })
+	return nil
+}
+
+func (s *MemoryStore) DeleteExpiredSessions(_ context.Context, now time.Time) (int64, error) {
+	return int64(s.deleteSessions(func(sess Session) bool { return !sess.ExpiresAt.After(now) })), nil
+}
+
+func (s *MemoryStore) CreateInvite(_ context.Context, inv *Invite) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inv.ID = s.newID()
+	s.invites = append(s.invites, memoryInvite{Invite: *inv})
+	return nil
+}
+
+func (s *MemoryStore) RedeemInvite(_ context.Context, tokenHash string, now time.Time, u *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.invites {
+		inv := &s.invites[i]
+		if inv.TokenHash != tokenHash || inv.used || !inv.ExpiresAt.After(now) {
+			continue
+		}
+		u.Role = inv.Role
+		if err := s.insertUser(u); err != nil {
+			return err
+		}
+		inv.used = true
+		return nil
+	}
+	return ErrNotFound
+}
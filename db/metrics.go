@@ -0,0 +1,58 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"time"
+
+	"DevMaan707/streamer/metrics"
+	"DevMaan707/streamer/tracing"
+)
+
+var queryDuration = metrics.Default.Histogram("starflix_db_query_duration_seconds",
+	"Time taken by database queries, reading the results included, by query.",
+	[]float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}, "query")
+
+// startQuery starts timing the named query and a span for it; call the
+// returned function when the query is done.
+func (s *SQLStore) startQuery(ctx context.Context, name string) func() {
+	start := time.Now()
+	_, span := tracing.StartKind(ctx, "db."+name, tracing.KindClient,
+		slog.String("db.system", s.dialect.Name),
+		slog.String("db.operation", name))
+	return func() {
+		queryDuration.With(name).Observe(time.Since(start).Seconds())
+		span.End()
+	}
+}
+
+// The connection pool statistics are read from DB on every scrape and are
+// all zero while no database is open.
+func init() {
+	pool := func(get func(sql.DBStats) float64) func() float64 {
+		return func() float64 {
+			if DB == nil {
+				return 0
+			}
+			return get(DB.Stats())
+		}
+	}
+	m := metrics.Default
+	m.GaugeFunc("starflix_db_max_open_connections", "Maximum number of open database connections.",
+		pool(func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) }))
+	m.GaugeFunc("starflix_db_connections", "Database connections by state.",
+		pool(func(s sql.DBStats) float64 { return float64(s.InUse) }), "state", "in_use")
+	m.GaugeFunc("starflix_db_connections", "Database connections by state.",
+		pool(func(s sql.DBStats) float64 { return float64(s.Idle) }), "state", "idle")
+	m.CounterFunc("starflix_db_wait_total", "Times a query had to wait for a free connection.",
+		pool(func(s sql.DBStats) float64 { return float64(s.WaitCount) }))
+	m.CounterFunc("starflix_db_wait_seconds_total", "Total time spent waiting for a free connection.",
+		pool(func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }))
+	m.CounterFunc("starflix_db_connections_closed_total", "Connections closed by the pool, by reason.",
+		pool(func(s sql.DBStats) float64 { return float64(s.MaxIdleClosed) }), "reason", "max_idle")
+	m.CounterFunc("starflix_db_connections_closed_total", "Connections closed by the pool, by reason.",
+		pool(func(s sql.DBStats) float64 { return float64(s.MaxIdleTimeClosed) }), "reason", "max_idle_time")
+	m.CounterFunc("starflix_db_connections_closed_total", "Connections closed by the pool, by reason.",
+		pool(func(s sql.DBStats) float64 { return float64(s.MaxLifetimeClosed) }), "reason", "max_lifetime")
+}
@@ -0,0 +1,308 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+// migrationLockID is the PostgreSQL advisory lock key held while migrating,
+// so that instances starting at the same time don't race.
+const migrationLockID = 0x5354524d
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationState struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Migrations returns the embedded migrations for the dialect, ordered by
+// version. Files are named NNNN_name.up.sql and NNNN_name.down.sql.
+func Migrations(d Dialect) ([]Migration, error) {
+	dir := path.Join("migrations", d.Name)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %w", err)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		name := entry.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+		base := strings.TrimSuffix(name, "."+direction+".sql")
+		prefix, label, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("invalid migration file name %s", name)
+		}
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %s", name)
+		}
+		body, err := migrationFiles.ReadFile(path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: label}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %04d has no up script", m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// MigrateUp applies every pending migration and returns how many ran.
+func MigrateUp() (int, error) {
+	migrations, err := Migrations(ActiveDialect)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	err = withMigrationLock(func(conn *sql.Conn) error {
+		applied, err := appliedVersions(conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			ran, err := runMigration(conn, m, true)
+			if err != nil {
+				return fmt.Errorf("migration %04d_%s failed: %w", m.Version, m.Name, err)
+			}
+			if ran {
+				count++
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
+// MigrateDown rolls back the given number of most recently applied
+// migrations.
+func MigrateDown(steps int) (int, error) {
+	migrations, err := Migrations(ActiveDialect)
+	if err != nil {
+		return 0, err
+	}
+	byVersion := make(map[int]Migration, len(migrations))
+	for _, m := range migrations {
+		byVersion[m.Version] = m
+	}
+
+	count := 0
+	err = withMigrationLock(func(conn *sql.Conn) error {
+		applied, err := appliedVersions(conn)
+		if err != nil {
+			return err
+		}
+		versions := make([]int, 0, len(applied))
+		for v := range applied {
+			versions = append(versions, v)
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+
+		for _, v := range versions {
+			if count == steps {
+				break
+			}
+			m, ok := byVersion[v]
+			if !ok {
+				return fmt.Errorf("applied migration %04d is unknown to this binary", v)
+			}
+			if m.Down == "" {
+				return fmt.Errorf("migration %04d_%s cannot be rolled back", m.Version, m.Name)
+			}
+			if _, err := runMigration(conn, m, false); err != nil {
+				return fmt.Errorf("rollback of %04d_%s failed: %w", m.Version, m.Name, err)
+			}
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// MigrationStatus lists every known migration and when it was applied.
+func MigrationStatus() ([]MigrationState, error) {
+	migrations, err := Migrations(ActiveDialect)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := DB.Conn(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := ensureMigrationsTable(conn); err != nil {
+		return nil, err
+	}
+	applied, err := appliedVersions(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	states := make([]MigrationState, 0, len(migrations))
+	for _, m := range migrations {
+		state := MigrationState{Migration: m}
+		if at, ok := applied[m.Version]; ok {
+			at := at
+			state.AppliedAt = &at
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+// PendingMigrations returns how many migrations have not been applied yet.
+func PendingMigrations() (int, error) {
+	states, err := MigrationStatus()
+	if err != nil {
+		return 0, err
+	}
+	pending := 0
+	for _, s := range states {
+		if s.AppliedAt == nil {
+			pending++
+		}
+	}
+	return pending, nil
+}
+
+func withMigrationLock(fn func(conn *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := DB.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer conn.Close()
+
+	// SQLite serialises writers itself and every migration runs in an
+	// immediate transaction, so only PostgreSQL needs an explicit lock.
+	if ActiveDialect.Name == Postgres.Name {
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+			return fmt.Errorf("failed to acquire migration lock: %w", err)
+		}
+		defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockID)
+	}
+
+	if err := ensureMigrationsTable(conn); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+func ensureMigrationsTable(conn *sql.Conn) error {
+	_, err := conn.ExecContext(context.Background(), `
+        CREATE TABLE IF NOT EXISTS schema_migrations (
+            version INTEGER PRIMARY KEY,
+            name VARCHAR(255) NOT NULL,
+            applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        )
+    `)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+	return nil
+}
+
+func appliedVersions(conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(context.Background(), "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// runMigration applies (up) or rolls back (down) a migration together with
+// its schema_migrations bookkeeping in one transaction. The applied state is
+// re-checked inside the transaction, so a migration another instance has
+// just run is skipped rather than run twice.
+func runMigration(conn *sql.Conn, m Migration, up bool) (bool, error) {
+	tx, err := conn.BeginTx(context.Background(), nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	err = tx.QueryRow(ActiveDialect.Rebind(
+		"SELECT COUNT(*) FROM schema_migrations WHERE version = $1"), m.Version).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+	if (exists > 0) == up {
+		return false, nil
+	}
+
+	script, record := m.Up, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)"
+	args := []interface{}{m.Version, m.Name}
+	if up {
+		slog.Info("Applying migration", "version", m.Version, "name", m.Name)
+	} else {
+		slog.Info("Rolling back migration", "version", m.Version, "name", m.Name)
+		script, record = m.Down, "DELETE FROM schema_migrations WHERE version = $1"
+		args = args[:1]
+	}
+	if _, err := tx.Exec(script); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(ActiveDialect.Rebind(record), args...); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
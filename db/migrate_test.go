@@ -0,0 +1,76 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestUniqueVideoFilesMigration checks that migration 0011 keeps videos
+// that share a file, and their shares, rather than dropping them.
+func TestUniqueVideoFilesMigration(t *testing.T) {
+	ctx := context.Background()
+	store := openTestSQLite(t)
+	if _, err := MigrateDown(1); err != nil {
+		t.Fatalf("MigrateDown: %v", err)
+	}
+
+	now := time.Now().UTC()
+	user := &User{Username: "alice", Role: "admin", CreatedAt: now, UpdatedAt: now}
+	if err := store.CreateUser(ctx, user); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	var ids []int
+	for _, title := range []string{"Old", "New", "Other"} {
+		path := "movie.mp4"
+		if title == "Other" {
+			path = "other.mp4"
+		}
+		v := &Video{Title: title, Filename: path, FilePath: path, OwnerID: user.ID, Visibility: VisibilityPublic}
+		if err := store.InsertVideo(ctx, v); err != nil {
+			t.Fatalf("InsertVideo %s: %v", title, err)
+		}
+		ids = append(ids, v.ID)
+	}
+	share := &Share{VideoID: ids[0], UserID: user.ID, TokenHash: "hash", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	if err := store.CreateShare(ctx, share); err != nil {
+		t.Fatalf("CreateShare: %v", err)
+	}
+
+	if _, err := MigrateUp(); err != nil {
+		t.Fatalf("MigrateUp: %v", err)
+	}
+	paths := func() []string {
+		t.Helper()
+		var paths []string
+		for _, id := range ids {
+			v, err := store.GetVideo(ctx, id)
+			if err != nil {
+				t.Fatalf("GetVideo %d: %v", id, err)
+			}
+			paths = append(paths, v.FilePath)
+		}
+		return paths
+	}
+	got := paths()
+	if want := []string{"movie.mp4#replaced-" + strconv.Itoa(ids[0]), "movie.mp4", "other.mp4"}; !slices.Equal(got, want) {
+		t.Errorf("after migrating up: got paths %q, want %q", got, want)
+	}
+	if shares, err := store.ListShares(ctx, user.ID, ids[0]); err != nil || len(shares) != 1 {
+		t.Errorf("got %d shares of the replaced video, %v; want 1", len(shares), err)
+	}
+	dup := &Video{Title: "Dup", Filename: "movie.mp4", FilePath: "movie.mp4", OwnerID: user.ID, Visibility: VisibilityPublic}
+	if err := store.InsertVideo(ctx, dup); !errors.Is(err, ErrConflict) {
+		t.Errorf("InsertVideo with a used path: got %v, want ErrConflict", err)
+	}
+
+	if _, err := MigrateDown(1); err != nil {
+		t.Fatalf("MigrateDown: %v", err)
+	}
+	if got, want := paths(), []string{"movie.mp4", "movie.mp4", "other.mp4"}; !slices.Equal(got, want) {
+		t.Errorf("after migrating down: got paths %q, want %q", got, want)
+	}
+}
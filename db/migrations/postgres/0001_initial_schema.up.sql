@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS videos (
+    id SERIAL PRIMARY KEY,
+    filename VARCHAR(255) NOT NULL,
+    title VARCHAR(255) NOT NULL,
+    description TEXT,
+    genre VARCHAR(100),
+    release_year INTEGER,
+    cover_image_path VARCHAR(255),
+    file_path VARCHAR(255) NOT NULL,
+    file_size BIGINT NOT NULL,
+    duration INTEGER,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS genres (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL UNIQUE
+);
+
+INSERT INTO genres (name) VALUES
+    ('Action'), ('Comedy'), ('Drama'), ('Documentary'),
+    ('Horror'), ('Thriller'), ('Sci-Fi'), ('Animation')
+ON CONFLICT (name) DO NOTHING;
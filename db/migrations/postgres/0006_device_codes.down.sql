@@ -0,0 +1,3 @@
+ALTER TABLE api_tokens DROP COLUMN device;
+
+DROP TABLE IF EXISTS device_codes;
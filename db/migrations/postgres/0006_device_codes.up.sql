@@ -0,0 +1,21 @@
+-- Pending device authorization requests (RFC 8628). Rows are deleted once
+-- the device has collected its token or after they expire.
+CREATE TABLE IF NOT EXISTS device_codes (
+    id SERIAL PRIMARY KEY,
+    device_code_hash CHAR(64) NOT NULL UNIQUE,
+    user_code CHAR(8) NOT NULL UNIQUE,
+    client_name VARCHAR(100) NOT NULL,
+    scopes VARCHAR(255) NOT NULL,
+    client_ip VARCHAR(45) NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    poll_interval INTEGER NOT NULL,
+    last_polled_at TIMESTAMP WITH TIME ZONE,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS device_codes_client_ip_idx ON device_codes (client_ip);
+
+-- API tokens issued to devices are listed as linked devices.
+ALTER TABLE api_tokens ADD COLUMN device BOOLEAN NOT NULL DEFAULT FALSE;
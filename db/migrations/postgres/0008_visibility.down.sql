@@ -0,0 +1,10 @@
+ALTER TABLE users DROP COLUMN default_group_id;
+ALTER TABLE users DROP COLUMN default_visibility;
+
+DROP INDEX IF EXISTS videos_owner_id_idx;
+ALTER TABLE videos DROP COLUMN group_id;
+ALTER TABLE videos DROP COLUMN visibility;
+ALTER TABLE videos DROP COLUMN owner_id;
+
+DROP TABLE IF EXISTS group_members;
+DROP TABLE IF EXISTS user_groups;
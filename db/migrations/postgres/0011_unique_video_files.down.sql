@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS videos_file_path_key;
+
+UPDATE videos SET file_path = substr(file_path, 1, strpos(file_path, '#replaced-') - 1)
+WHERE strpos(file_path, '#replaced-') > 0;
@@ -0,0 +1,10 @@
+-- Uploads used to overwrite a file of the same name, leaving older videos
+-- pointing at the newest upload's file. The newest video keeps the path;
+-- the older ones are kept too, with the path marked so that it is unique
+-- and shows their own file is gone, for an admin to delete or fix them.
+UPDATE videos SET file_path = file_path || '#replaced-' || id
+WHERE EXISTS (
+    SELECT 1 FROM videos newer WHERE newer.file_path = videos.file_path AND newer.id > videos.id
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS videos_file_path_key ON videos (file_path);
@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS audit_log;
+
+ALTER TABLE invites DROP COLUMN role;
+
+ALTER TABLE users ADD COLUMN is_admin BOOLEAN NOT NULL DEFAULT FALSE;
+UPDATE users SET is_admin = (role = 'admin');
+ALTER TABLE users DROP COLUMN role;
@@ -0,0 +1,22 @@
+-- Existing non-admin accounts could upload before roles existed, so they
+-- keep that ability.
+ALTER TABLE users ADD COLUMN role VARCHAR(16) NOT NULL DEFAULT 'viewer';
+UPDATE users SET role = CASE WHEN is_admin THEN 'admin' ELSE 'uploader' END;
+ALTER TABLE users DROP COLUMN is_admin;
+
+ALTER TABLE invites ADD COLUMN role VARCHAR(16) NOT NULL DEFAULT 'viewer';
+
+CREATE TABLE IF NOT EXISTS audit_log (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at TIMESTAMP NOT NULL,
+    user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    username VARCHAR(64) NOT NULL DEFAULT '',
+    action VARCHAR(64) NOT NULL,
+    target VARCHAR(255) NOT NULL DEFAULT '',
+    outcome VARCHAR(16) NOT NULL,
+    client_ip VARCHAR(45) NOT NULL DEFAULT '',
+    request_id VARCHAR(64) NOT NULL DEFAULT '',
+    detail TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_created_at_idx ON audit_log (created_at);
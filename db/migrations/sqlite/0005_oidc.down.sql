@@ -0,0 +1,4 @@
+ALTER TABLE sessions DROP COLUMN refresh_at;
+ALTER TABLE sessions DROP COLUMN refresh_token;
+
+DROP TABLE IF EXISTS user_identities;
@@ -0,0 +1,16 @@
+-- Links accounts to identities at an OpenID Connect provider.
+CREATE TABLE IF NOT EXISTS user_identities (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    issuer VARCHAR(255) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    UNIQUE (issuer, subject)
+);
+
+CREATE INDEX IF NOT EXISTS user_identities_user_id_idx ON user_identities (user_id);
+
+-- Single sign-on sessions keep the provider's refresh token and are
+-- checked with the provider again at refresh_at.
+ALTER TABLE sessions ADD COLUMN refresh_token TEXT NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN refresh_at TIMESTAMP;
@@ -0,0 +1,16 @@
+-- Links that let people without an account watch one video. Only a hash
+-- of the share token is stored, like for sessions and API tokens.
+CREATE TABLE IF NOT EXISTS shares (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    video_id INTEGER NOT NULL REFERENCES videos(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    password_hash TEXT NOT NULL DEFAULT '',
+    max_plays INTEGER NOT NULL DEFAULT 0,
+    plays INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    last_played_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS shares_user_id_idx ON shares (user_id);
@@ -0,0 +1,25 @@
+-- Groups let a video be shared with some accounts rather than everyone.
+CREATE TABLE IF NOT EXISTS user_groups (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name VARCHAR(64) NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS group_members (
+    group_id INTEGER NOT NULL REFERENCES user_groups(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    PRIMARY KEY (group_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS group_members_user_id_idx ON group_members (user_id);
+
+-- Videos uploaded before visibility existed stay visible to everyone and
+-- have no owner.
+ALTER TABLE videos ADD COLUMN owner_id INTEGER REFERENCES users(id) ON DELETE SET NULL;
+ALTER TABLE videos ADD COLUMN visibility VARCHAR(16) NOT NULL DEFAULT 'public';
+ALTER TABLE videos ADD COLUMN group_id INTEGER REFERENCES user_groups(id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS videos_owner_id_idx ON videos (owner_id);
+
+ALTER TABLE users ADD COLUMN default_visibility VARCHAR(16) NOT NULL DEFAULT 'public';
+ALTER TABLE users ADD COLUMN default_group_id INTEGER REFERENCES user_groups(id) ON DELETE SET NULL;
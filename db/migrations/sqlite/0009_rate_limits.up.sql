@@ -0,0 +1,12 @@
+-- Request counts for rate limiting, when instances share their limits
+-- through the database. Each row counts one client's requests to one class
+-- of routes in one fixed window.
+CREATE TABLE IF NOT EXISTS rate_limits (
+    bucket VARCHAR(255) NOT NULL,
+    window_start TIMESTAMP NOT NULL,
+    hits INTEGER NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (bucket, window_start)
+);
+
+CREATE INDEX IF NOT EXISTS rate_limits_expires_at_idx ON rate_limits (expires_at);
@@ -0,0 +1,20 @@
+-- Failed logins to existing accounts, kept for a while so their users can
+-- see them.
+CREATE TABLE IF NOT EXISTS login_attempts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    client_ip VARCHAR(45) NOT NULL DEFAULT '',
+    user_agent VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS login_attempts_user_id_idx ON login_attempts (user_id, created_at);
+CREATE INDEX IF NOT EXISTS login_attempts_created_at_idx ON login_attempts (created_at);
+
+-- Consecutive failed logins per username ("account:<name>") and per client
+-- IP ("ip:<address>"), which slow down and lock out further attempts.
+CREATE TABLE IF NOT EXISTS login_failures (
+    subject VARCHAR(255) PRIMARY KEY,
+    failures INTEGER NOT NULL,
+    last_failed_at TIMESTAMP NOT NULL
+);
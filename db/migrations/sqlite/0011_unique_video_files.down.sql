@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS videos_file_path_key;
+
+UPDATE videos SET file_path = substr(file_path, 1, instr(file_path, '#replaced-') - 1)
+WHERE instr(file_path, '#replaced-') > 0;
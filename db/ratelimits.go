@@ -0,0 +1,29 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// HitRateLimit counts a request against bucket in the window starting at
+// windowStart and returns the number of requests counted in it so far.
+func (s *SQLStore) HitRateLimit(ctx context.Context, bucket string, windowStart, expiresAt time.Time) (int, error) {
+	defer s.startQuery(ctx, "hit_rate_limit")()
+
+	query := `
+		INSERT INTO rate_limits (bucket, window_start, hits, expires_at) VALUES ($1, $2, 1, $3)
+		ON CONFLICT (bucket, window_start) DO UPDATE SET hits = rate_limits.hits + 1
+		RETURNING hits
+	`
+	var hits int
+	err := s.db.QueryRowContext(ctx, s.dialect.Rebind(query), bucket, windowStart.UTC(), expiresAt.UTC()).Scan(&hits)
+	return hits, err
+}
+
+func (s *SQLStore) DeleteExpiredRateLimits(ctx context.Context, now time.Time) error {
+	defer s.startQuery(ctx, "delete_expired_rate_limits")()
+
+	query := `DELETE FROM rate_limits WHERE expires_at < $1`
+	_, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), now.UTC())
+	return err
+}
@@ -0,0 +1,181 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when the requested record doesn't exist.
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned when a record clashes with an existing one,
+	// such as a taken username.
+	ErrConflict = errors.New("already exists")
+)
+
+// VideoRepository is the storage the services use for video metadata. The
+// context carries cancellation and the current trace span. Listings only
+// return the videos access may see; single lookups return any video and
+// leave checking access to the caller.
+type VideoRepository interface {
+	GetAllVideos(ctx context.Context, access VideoAccess) ([]Video, error)
+	GetVideo(ctx context.Context, id int) (*Video, error)
+	GetVideoByFile(ctx context.Context, filePath string) (*Video, error)
+	GetVideoByCover(ctx context.Context, coverImage string) (*Video, error)
+	GetVideosByGenre(ctx context.Context, genre string, access VideoAccess) ([]Video, error)
+	SearchVideos(ctx context.Context, term string, access VideoAccess) ([]Video, error)
+	// InsertVideo returns ErrConflict if another video is stored in the
+	// same file.
+	InsertVideo(ctx context.Context, video *Video) error
+	// UpdateVideo saves the title, description, genre and release year.
+	UpdateVideo(ctx context.Context, video *Video) error
+	SetVideoVisibility(ctx context.Context, id int, visibility string, groupID int) error
+	DeleteVideo(ctx context.Context, id int) error
+}
+
+// GenreRepository is the storage the services use for genres.
+type GenreRepository interface {
+	GetAllGenres(ctx context.Context) ([]Genre, error)
+	// CreateGenre returns ErrConflict if the name is taken.
+	CreateGenre(ctx context.Context, genre *Genre) error
+	DeleteGenre(ctx context.Context, id int) error
+}
+
+// UserRepository stores accounts, their login sessions, API tokens, single
+// sign-on identities, invites and pending device authorizations.
+// Lookups that find nothing return ErrNotFound.
+type UserRepository interface {
+	CountUsers(ctx context.Context) (int, error)
+	// CreateUser returns ErrConflict if the username is taken.
+	CreateUser(ctx context.Context, u *User) error
+	GetUserByID(ctx context.Context, id int) (*User, error)
+	GetUserByUsername(ctx context.Context, username string) (*User, error)
+	ListUsers(ctx context.Context) ([]User, error)
+	UpdatePassword(ctx context.Context, userID int, hash string) error
+	SetUserRole(ctx context.Context, userID int, role string) error
+	GetUserPreferences(ctx context.Context, userID int) (*Preferences, error)
+	SetUserPreferences(ctx context.Context, userID int, p Preferences) error
+
+	CreateSession(ctx context.Context, s *Session) error
+	GetSession(ctx context.Context, tokenHash string, now time.Time) (*Session, *User, error)
+	TouchSession(ctx context.Context, id int, lastSeen time.Time) error
+	UpdateSessionRefresh(ctx context.Context, id int, refreshToken string, refreshAt time.Time) error
+	ListSessions(ctx context.Context, userID int, now time.Time) ([]Session, error)
+	DeleteSession(ctx context.Context, userID, id int) error
+	DeleteUserSessions(ctx context.Context, userID, keepID int) error
+	DeleteExpiredSessions(ctx context.Context, now time.Time) (int64, error)
+
+	CreateAPIToken(ctx context.Context, t *APIToken) error
+	GetAPIToken(ctx context.Context, tokenHash string, now time.Time) (*APIToken, *User, error)
+	TouchAPIToken(ctx context.Context, id int, lastUsed time.Time) error
+	ListAPITokens(ctx context.Context, userID int) ([]APIToken, error)
+	DeleteAPIToken(ctx context.Context, userID, id int) error
+
+	GetUserByIdentity(ctx context.Context, issuer, subject string) (*User, error)
+	// CreateIdentity returns ErrConflict if the identity is linked
+	// already.
+	CreateIdentity(ctx context.Context, ident *Identity) error
+	// CreateUserWithIdentity creates u linked to ident in one
+	// transaction, returning ErrConflict if the username is taken.
+	CreateUserWithIdentity(ctx context.Context, u *User, ident *Identity) error
+
+	// CreateDeviceCode returns ErrConflict if the user code is taken.
+	CreateDeviceCode(ctx context.Context, dc *DeviceCode) error
+	CountPendingDeviceCodes(ctx context.Context, clientIP string, now time.Time) (int, error)
+	GetDeviceCode(ctx context.Context, deviceCodeHash string) (*DeviceCode, error)
+	// GetPendingDeviceCode finds an unexpired code awaiting approval by its
+	// user code.
+	GetPendingDeviceCode(ctx context.Context, userCode string, now time.Time) (*DeviceCode, error)
+	// ResolveDeviceCode approves or denies a pending code for the user,
+	// returning ErrNotFound if it isn't pending anymore.
+	ResolveDeviceCode(ctx context.Context, id, userID int, status string) error
+	UpdateDeviceCodePoll(ctx context.Context, id int, polledAt time.Time, interval int) error
+	DeleteDeviceCode(ctx context.Context, id int) error
+	DeleteExpiredDeviceCodes(ctx context.Context, now time.Time) error
+
+	CreateInvite(ctx context.Context, inv *Invite) error
+	// RedeemInvite returns ErrNotFound for unknown, used or expired
+	// invites and ErrConflict if the username is taken.
+	RedeemInvite(ctx context.Context, tokenHash string, now time.Time, u *User) error
+}
+
+// AuditRepository stores the audit trail.
+type AuditRepository interface {
+	RecordAuditEvent(ctx context.Context, e *AuditEvent) error
+	ListAuditEvents(ctx context.Context, f AuditFilter) ([]AuditEvent, error)
+}
+
+// ShareRepository stores share links. Lookups that find nothing return
+// ErrNotFound.
+type ShareRepository interface {
+	CreateShare(ctx context.Context, sh *Share) error
+	GetShare(ctx context.Context, tokenHash string, now time.Time) (*Share, error)
+	ListShares(ctx context.Context, userID, videoID int) ([]Share, error)
+	RecordSharePlay(ctx context.Context, id int, now time.Time) error
+	DeleteShare(ctx context.Context, userID, id int) error
+}
+
+// GroupRepository stores the groups videos can be shared with. Lookups
+// that find nothing return ErrNotFound.
+type GroupRepository interface {
+	// ListGroups returns the groups the user is a member of or, with a
+	// userID of 0, every group, with their members.
+	ListGroups(ctx context.Context, userID int) ([]Group, error)
+	GetGroup(ctx context.Context, id int) (*Group, error)
+	// CreateGroup returns ErrConflict if the name is taken.
+	CreateGroup(ctx context.Context, g *Group) error
+	DeleteGroup(ctx context.Context, id int) error
+	// AddGroupMember does nothing if the user is a member already.
+	AddGroupMember(ctx context.Context, groupID, userID int) error
+	RemoveGroupMember(ctx context.Context, groupID, userID int) error
+	IsGroupMember(ctx context.Context, groupID, userID int) (bool, error)
+}
+
+// LoginRepository tracks failed logins, to slow down and lock out password
+// guessing and to show users the attempts on their accounts. Failures are
+// counted per subject, an account or a client address.
+type LoginRepository interface {
+	CreateLoginAttempt(ctx context.Context, a *LoginAttempt) error
+	ListLoginAttempts(ctx context.Context, userID int, since time.Time) ([]LoginAttempt, error)
+	// ReserveLoginAttempt counts an attempt as a failure if allow agrees,
+	// given the subject's consecutive failures since the given time and
+	// the time of the last. Checking and counting are atomic, so attempts
+	// running at the same time can't all pass the check. It returns the
+	// failures before the attempt and whether it was counted.
+	ReserveLoginAttempt(ctx context.Context, subject string, now, since time.Time, allow func(failures int, last time.Time) bool) (int, bool, error)
+	// ReleaseLoginAttempt takes back an attempt counted by
+	// ReserveLoginAttempt.
+	ReleaseLoginAttempt(ctx context.Context, subject string) error
+	GetLoginFailures(ctx context.Context, subject string, since time.Time) (int, time.Time, error)
+	// ClearLoginFailures returns ErrNotFound if the subject has no
+	// failures since the given time.
+	ClearLoginFailures(ctx context.Context, subject string, since time.Time) error
+	DeleteLoginAttemptsBefore(ctx context.Context, before time.Time) error
+}
+
+// RateLimitRepository counts requests in fixed windows, so that server
+// instances sharing a database share their rate limits. Only SQLStore
+// provides it.
+type RateLimitRepository interface {
+	HitRateLimit(ctx context.Context, bucket string, windowStart, expiresAt time.Time) (int, error)
+	DeleteExpiredRateLimits(ctx context.Context, now time.Time) error
+}
+
+// Store is a backend providing every repository.
+type Store interface {
+	VideoRepository
+	GenreRepository
+	UserRepository
+	AuditRepository
+	ShareRepository
+	GroupRepository
+	LoginRepository
+}
+
+var (
+	_ Store = (*SQLStore)(nil)
+	_ Store = (*MemoryStore)(nil)
+
+	_ RateLimitRepository = (*SQLStore)(nil)
+)
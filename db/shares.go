@@ -0,0 +1,187 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"time"
+)
+
+// Share lets people without an account watch one video through a link.
+// MaxPlays of 0 means unlimited plays.
+type Share struct {
+	ID           int        `json:"id"`
+	VideoID      int        `json:"video_id"`
+	VideoTitle   string     `json:"video_title"`
+	UserID       int        `json:"-"`
+	TokenHash    string     `json:"-"`
+	PasswordHash string     `json:"-"`
+	MaxPlays     int        `json:"max_plays"`
+	Plays        int        `json:"plays"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ExpiresAt    time.Time  `json:"expires_at"`
+	LastPlayedAt *time.Time `json:"last_played_at"`
+}
+
+const shareColumns = `sh.id, sh.video_id, v.title, sh.user_id, sh.token_hash, sh.password_hash, sh.max_plays, sh.plays, sh.created_at, sh.expires_at, sh.last_played_at`
+
+func scanShare(row interface{ Scan(...interface{}) error }) (*Share, error) {
+	var sh Share
+	var lastPlayed sql.NullTime
+	err := row.Scan(&sh.ID, &sh.VideoID, &sh.VideoTitle, &sh.UserID, &sh.TokenHash, &sh.PasswordHash,
+		&sh.MaxPlays, &sh.Plays, &sh.CreatedAt, &sh.ExpiresAt, &lastPlayed)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if lastPlayed.Valid {
+		sh.LastPlayedAt = &lastPlayed.Time
+	}
+	return &sh, nil
+}
+
+func (s *SQLStore) CreateShare(ctx context.Context, sh *Share) error {
+	defer s.startQuery(ctx, "create_share")()
+
+	query := `
+		INSERT INTO shares (video_id, user_id, token_hash, password_hash, max_plays, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`
+	return s.db.QueryRowContext(ctx, s.dialect.Rebind(query),
+		sh.VideoID, sh.UserID, sh.TokenHash, sh.PasswordHash, sh.MaxPlays, sh.CreatedAt.UTC(), sh.ExpiresAt.UTC(),
+	).Scan(&sh.ID)
+}
+
+// GetShare returns the unexpired share with the given token hash.
+func (s *SQLStore) GetShare(ctx context.Context, tokenHash string, now time.Time) (*Share, error) {
+	defer s.startQuery(ctx, "get_share")()
+
+	query := `
+		SELECT ` + shareColumns + `
+		FROM shares sh JOIN videos v ON v.id = sh.video_id
+		WHERE sh.token_hash = $1 AND sh.expires_at > $2
+	`
+	return scanShare(s.db.QueryRowContext(ctx, s.dialect.Rebind(query), tokenHash, now.UTC()))
+}
+
+// ListShares returns the user's shares, expired ones included, newest
+// first. A videoID of 0 lists the shares of every video.
+func (s *SQLStore) ListShares(ctx context.Context, userID, videoID int) ([]Share, error) {
+	defer s.startQuery(ctx, "list_shares")()
+
+	query := `
+		SELECT ` + shareColumns + `
+		FROM shares sh JOIN videos v ON v.id = sh.video_id
+		WHERE sh.user_id = $1 AND ($2 = 0 OR sh.video_id = $2)
+		ORDER BY sh.id DESC
+	`
+	rows, err := s.db.QueryContext(ctx, s.dialect.Rebind(query), userID, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var shares []Share
+	for rows.Next() {
+		sh, err := scanShare(rows)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, *sh)
+	}
+	return shares, rows.Err()
+}
+
+// RecordSharePlay counts a play of a share. It returns ErrNotFound if the
+// share has expired, been revoked or used up its plays.
+func (s *SQLStore) RecordSharePlay(ctx context.Context, id int, now time.Time) error {
+	defer s.startQuery(ctx, "record_share_play")()
+
+	query := `
+		UPDATE shares SET plays = plays + 1, last_played_at = $2
+		WHERE id = $1 AND expires_at > $2 AND (max_plays = 0 OR plays < max_plays)
+	`
+	return expectRow(s.db.ExecContext(ctx, s.dialect.Rebind(query), id, now.UTC()))
+}
+
+// DeleteShare revokes one of the user's shares.
+func (s *SQLStore) DeleteShare(ctx context.Context, userID, id int) error {
+	defer s.startQuery(ctx, "delete_share")()
+
+	query := `DELETE FROM shares WHERE id = $1 AND user_id = $2`
+	return expectRow(s.db.ExecContext(ctx, s.dialect.Rebind(query), id, userID))
+}
+
+func (s *MemoryStore) CreateShare(_ context.Context, sh *Share) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sh.ID = s.newID()
+	s.shares = append(s.shares, *sh)
+	return nil
+}
+
+// shareWithTitle fills in the title of the shared video. The caller must
+// hold s.mu.
+func (s *MemoryStore) shareWithTitle(sh Share) Share {
+	for _, v := range s.videos {
+		if v.ID == sh.VideoID {
+			sh.VideoTitle = v.Title
+		}
+	}
+	return sh
+}
+
+func (s *MemoryStore) GetShare(_ context.Context, tokenHash string, now time.Time) (*Share, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, sh := range s.shares {
+		if sh.TokenHash == tokenHash && sh.ExpiresAt.After(now) {
+			sh = s.shareWithTitle(sh)
+			return &sh, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryStore) ListShares(_ context.Context, userID, videoID int) ([]Share, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var shares []Share
+	for _, sh := range s.shares {
+		if sh.UserID == userID && (videoID == 0 || sh.VideoID == videoID) {
+			shares = append(shares, s.shareWithTitle(sh))
+		}
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].ID > shares[j].ID })
+	return shares, nil
+}
+
+func (s *MemoryStore) RecordSharePlay(_ context.Context, id int, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.shares {
+		sh := &s.shares[i]
+		if sh.ID == id && sh.ExpiresAt.After(now) && (sh.MaxPlays == 0 || sh.Plays < sh.MaxPlays) {
+			sh.Plays++
+			sh.LastPlayedAt = &now
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *MemoryStore) DeleteShare(_ context.Context, userID, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, sh := range s.shares {
+		if sh.ID == id && sh.UserID == userID {
+			s.shares = append(s.shares[:i], s.shares[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
@@ -0,0 +1,313 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// SQLStore implements Store on top of a SQL connection pool, using the
+// given dialect for the backend-specific parts.
+type SQLStore struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+func NewPostgresStore(conn *sql.DB) *SQLStore {
+	return &SQLStore{db: conn, dialect: Postgres}
+}
+
+func NewSQLiteStore(conn *sql.DB) *SQLStore {
+	return &SQLStore{db: conn, dialect: SQLite}
+}
+
+const videoColumns = `id, filename, title, description, genre, release_year, cover_image_path,
+        file_path, file_size, duration, created_at, updated_at, owner_id, visibility, group_id`
+
+// listedCondition is the condition for the videos a listing shows for a
+// VideoAccess passed as the parameters $1 (All) and $2 (UserID). Unlisted
+// videos are only listed for their owner.
+const listedCondition = `($1 OR visibility = 'public' OR owner_id = $2
+        OR (visibility = 'group' AND group_id IN (SELECT group_id FROM group_members WHERE user_id = $2)))`
+
+func (s *SQLStore) GetAllVideos(ctx context.Context, access VideoAccess) ([]Video, error) {
+	defer s.startQuery(ctx, "get_all_videos")()
+
+	query := `
+        SELECT ` + videoColumns + `
+        FROM videos
+        WHERE ` + listedCondition + `
+        ORDER BY created_at DESC
+    `
+
+	rows, err := s.db.QueryContext(ctx, s.dialect.Rebind(query), access.All, access.UserID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos, err := scanVideos(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Debug("Queried all videos", "count", len(videos))
+	return videos, nil
+}
+func (s *SQLStore) GetVideosByGenre(ctx context.Context, genre string, access VideoAccess) ([]Video, error) {
+	defer s.startQuery(ctx, "get_videos_by_genre")()
+
+	query := `
+		SELECT ` + videoColumns + `
+		FROM videos
+		WHERE genre = $3 AND ` + listedCondition + `
+		ORDER BY created_at DESC
+	`
+	rows, err := s.db.QueryContext(ctx, s.dialect.Rebind(query), access.All, access.UserID, genre)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanVideos(rows)
+}
+
+// SearchVideos returns the videos whose title or description contains term,
+// ignoring case.
+func (s *SQLStore) SearchVideos(ctx context.Context, term string, access VideoAccess) ([]Video, error) {
+	defer s.startQuery(ctx, "search_videos")()
+
+	query := `
+		SELECT ` + videoColumns + `
+		FROM videos
+		WHERE (title ` + s.dialect.CaseInsensitiveLike + ` $3 ESCAPE '\'
+		OR description ` + s.dialect.CaseInsensitiveLike + ` $3 ESCAPE '\')
+		AND ` + listedCondition + `
+		ORDER BY created_at DESC
+	`
+	rows, err := s.db.QueryContext(ctx, s.dialect.Rebind(query), access.All, access.UserID, "%"+escapeLike(term)+"%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanVideos(rows)
+}
+
+func (s *SQLStore) GetAllGenres(ctx context.Context) ([]Genre, error) {
+	defer s.startQuery(ctx, "get_all_genres")()
+
+	query := `SELECT id, name FROM genres ORDER BY name`
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var genres []Genre
+	for rows.Next() {
+		var g Genre
+		if err := rows.Scan(&g.ID, &g.Name); err != nil {
+			return nil, err
+		}
+		genres = append(genres, g)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return genres, nil
+}
+
+func (s *SQLStore) InsertVideo(ctx context.Context, video *Video) error {
+	defer s.startQuery(ctx, "insert_video")()
+
+	query := `
+		INSERT INTO videos
+		(filename, title, description, genre, release_year, cover_image_path, file_path, file_size, duration,
+		owner_id, visibility, group_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		RETURNING id, created_at, updated_at
+	`
+
+	var releaseYear, duration interface{}
+	if video.ReleaseYear > 0 {
+		releaseYear = video.ReleaseYear
+	} else {
+		releaseYear = nil
+	}
+
+	if video.Duration > 0 {
+		duration = video.Duration
+	} else {
+		duration = nil
+	}
+
+	err := s.db.QueryRowContext(ctx,
+		s.dialect.Rebind(query),
+		video.Filename,
+		video.Title,
+		video.Description,
+		video.Genre,
+		releaseYear,
+		video.CoverImage,
+		video.FilePath,
+		video.FileSize,
+		duration,
+		nullID(video.OwnerID),
+		video.Visibility,
+		nullID(video.GroupID),
+	).Scan(&video.ID, &video.CreatedAt, &video.UpdatedAt)
+	if isUniqueViolation(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+func (s *SQLStore) GetVideo(ctx context.Context, id int) (*Video, error) {
+	defer s.startQuery(ctx, "get_video")()
+
+	return s.getVideo(ctx, `id = $1`, id)
+}
+
+// GetVideoByFile returns the video stored in the given file.
+func (s *SQLStore) GetVideoByFile(ctx context.Context, filePath string) (*Video, error) {
+	defer s.startQuery(ctx, "get_video_by_file")()
+
+	return s.getVideo(ctx, `file_path = $1`, filePath)
+}
+
+// GetVideoByCover returns the video with the given cover image.
+func (s *SQLStore) GetVideoByCover(ctx context.Context, coverImage string) (*Video, error) {
+	defer s.startQuery(ctx, "get_video_by_cover")()
+
+	return s.getVideo(ctx, `cover_image_path = $1`, coverImage)
+}
+
+// getVideo returns the first video matching condition, which takes arg as
+// $1.
+func (s *SQLStore) getVideo(ctx context.Context, condition string, arg interface{}) (*Video, error) {
+	query := `SELECT ` + videoColumns + ` FROM videos WHERE ` + condition + ` ORDER BY id LIMIT 1`
+	rows, err := s.db.QueryContext(ctx, s.dialect.Rebind(query), arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos, err := scanVideos(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(videos) == 0 {
+		return nil, ErrNotFound
+	}
+	return &videos[0], nil
+}
+
+func (s *SQLStore) UpdateVideo(ctx context.Context, video *Video) error {
+	defer s.startQuery(ctx, "update_video")()
+
+	var releaseYear interface{}
+	if video.ReleaseYear > 0 {
+		releaseYear = video.ReleaseYear
+	}
+	video.UpdatedAt = time.Now().UTC()
+	query := `
+		UPDATE videos
+		SET title = $1, description = $2, genre = $3, release_year = $4, updated_at = $5
+		WHERE id = $6
+	`
+	return expectRow(s.db.ExecContext(ctx, s.dialect.Rebind(query),
+		video.Title, video.Description, video.Genre, releaseYear, video.UpdatedAt, video.ID))
+}
+
+// SetVideoVisibility changes who can see a video. groupID is ignored
+// unless visibility is VisibilityGroup.
+func (s *SQLStore) SetVideoVisibility(ctx context.Context, id int, visibility string, groupID int) error {
+	defer s.startQuery(ctx, "set_video_visibility")()
+
+	if visibility != VisibilityGroup {
+		groupID = 0
+	}
+	query := `UPDATE videos SET visibility = $1, group_id = $2, updated_at = $3 WHERE id = $4`
+	return expectRow(s.db.ExecContext(ctx, s.dialect.Rebind(query),
+		visibility, nullID(groupID), time.Now().UTC(), id))
+}
+
+func (s *SQLStore) DeleteVideo(ctx context.Context, id int) error {
+	defer s.startQuery(ctx, "delete_video")()
+
+	query := `DELETE FROM videos WHERE id = $1`
+	return expectRow(s.db.ExecContext(ctx, s.dialect.Rebind(query), id))
+}
+
+func (s *SQLStore) CreateGenre(ctx context.Context, genre *Genre) error {
+	defer s.startQuery(ctx, "create_genre")()
+
+	query := `INSERT INTO genres (name) VALUES ($1) RETURNING id`
+	err := s.db.QueryRowContext(ctx, s.dialect.Rebind(query), genre.Name).Scan(&genre.ID)
+	if isUniqueViolation(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+func (s *SQLStore) DeleteGenre(ctx context.Context, id int) error {
+	defer s.startQuery(ctx, "delete_genre")()
+
+	query := `DELETE FROM genres WHERE id = $1`
+	return expectRow(s.db.ExecContext(ctx, s.dialect.Rebind(query), id))
+}
+
+func scanVideos(rows *sql.Rows) ([]Video, error) {
+	var videos []Video
+	for rows.Next() {
+		var v Video
+		var releaseYear, duration, ownerID, groupID sql.NullInt32
+		var description, genre, coverImage sql.NullString
+		var createdAt, updatedAt time.Time
+
+		if err := rows.Scan(
+			&v.ID, &v.Filename, &v.Title, &description, &genre, &releaseYear, &coverImage,
+			&v.FilePath, &v.FileSize, &duration, &createdAt, &updatedAt,
+			&ownerID, &v.Visibility, &groupID,
+		); err != nil {
+			return nil, err
+		}
+
+		v.Description = description.String
+		v.Genre = genre.String
+		v.ReleaseYear = int(releaseYear.Int32)
+		v.CoverImage = coverImage.String
+		v.Duration = int(duration.Int32)
+		v.OwnerID = int(ownerID.Int32)
+		v.GroupID = int(groupID.Int32)
+		v.CreatedAt = createdAt
+		v.UpdatedAt = updatedAt
+
+		videos = append(videos, v)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return videos, nil
+}
+
+// nullID stores an ID of 0, meaning none, as NULL.
+func nullID(id int) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
@@ -0,0 +1,176 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// APIToken is a personal access token for scripts. Like sessions, only a
+// hash of the token is stored.
+type APIToken struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"-"`
+	Name       string     `json:"name"`
+	TokenHash  string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	// Device marks tokens issued through the device authorization flow,
+	// which are listed as linked devices.
+	Device bool `json:"device"`
+}
+
+const apiTokenColumns = `t.id, t.user_id, t.name, t.token_hash, t.scopes, t.created_at, t.expires_at, t.last_used_at, t.device`
+
+func scanAPIToken(row interface{ Scan(...interface{}) error }, extra ...interface{}) (*APIToken, error) {
+	var t APIToken
+	var scopes string
+	var lastUsed sql.NullTime
+	dest := append([]interface{}{&t.ID, &t.UserID, &t.Name, &t.TokenHash, &scopes, &t.CreatedAt, &t.ExpiresAt, &lastUsed, &t.Device}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	t.Scopes = strings.Split(scopes, ",")
+	if lastUsed.Valid {
+		t.LastUsedAt = &lastUsed.Time
+	}
+	return &t, nil
+}
+
+func (s *SQLStore) CreateAPIToken(ctx context.Context, t *APIToken) error {
+	defer s.startQuery(ctx, "create_api_token")()
+
+	query := `
+		INSERT INTO api_tokens (user_id, name, token_hash, scopes, created_at, expires_at, device)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`
+	return s.db.QueryRowContext(ctx, s.dialect.Rebind(query),
+		t.UserID, t.Name, t.TokenHash, strings.Join(t.Scopes, ","), t.CreatedAt.UTC(), t.ExpiresAt.UTC(), t.Device,
+	).Scan(&t.ID)
+}
+
+// GetAPIToken returns the unexpired token with the given hash and its user.
+func (s *SQLStore) GetAPIToken(ctx context.Context, tokenHash string, now time.Time) (*APIToken, *User, error) {
+	defer s.startQuery(ctx, "get_api_token")()
+
+	query := `
+		SELECT ` + apiTokenColumns + `, u.id, u.username, u.password_hash, u.role, u.created_at, u.updated_at
+		FROM api_tokens t JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = $1 AND t.expires_at > $2
+	`
+	var u User
+	t, err := scanAPIToken(s.db.QueryRowContext(ctx, s.dialect.Rebind(query), tokenHash, now.UTC()),
+		&u.ID, &u.Username, &u.PasswordHash, &u.Role, &u.CreatedAt, &u.UpdatedAt)
+	if err != nil {
+		return nil, nil, err
+	}
+	return t, &u, nil
+}
+
+func (s *SQLStore) TouchAPIToken(ctx context.Context, id int, lastUsed time.Time) error {
+	defer s.startQuery(ctx, "touch_api_token")()
+
+	query := `UPDATE api_tokens SET last_used_at = $1 WHERE id = $2`
+	_, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), lastUsed.UTC(), id)
+	return err
+}
+
+// ListAPITokens returns the user's tokens, expired ones included, newest
+// first.
+func (s *SQLStore) ListAPITokens(ctx context.Context, userID int) ([]APIToken, error) {
+	defer s.startQuery(ctx, "list_api_tokens")()
+
+	query := `SELECT ` + apiTokenColumns + ` FROM api_tokens t WHERE t.user_id = $1 ORDER BY t.id DESC`
+	rows, err := s.db.QueryContext(ctx, s.dialect.Rebind(query), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []APIToken
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, *t)
+	}
+	return tokens, rows.Err()
+}
+
+// DeleteAPIToken revokes one of the user's tokens.
+func (s *SQLStore) DeleteAPIToken(ctx context.Context, userID, id int) error {
+	defer s.startQuery(ctx, "delete_api_token")()
+
+	query := `DELETE FROM api_tokens WHERE id = $1 AND user_id = $2`
+	return expectRow(s.db.ExecContext(ctx, s.dialect.Rebind(query), id, userID))
+}
+
+func (s *MemoryStore) CreateAPIToken(_ context.Context, t *APIToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t.ID = s.newID()
+	s.apiTokens = append(s.apiTokens, *t)
+	return nil
+}
+
+func (s *MemoryStore) GetAPIToken(_ context.Context, tokenHash string, now time.Time) (*APIToken, *User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, t := range s.apiTokens {
+		if t.TokenHash != tokenHash || !t.ExpiresAt.After(now) {
+			continue
+		}
+		for _, u := range s.users {
+			if u.ID == t.UserID {
+				return &t, &u, nil
+			}
+		}
+	}
+	return nil, nil, ErrNotFound
+}
+
+func (s *MemoryStore) TouchAPIToken(_ context.Context, id int, lastUsed time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.apiTokens {
+		if s.apiTokens[i].ID == id {
+			s.apiTokens[i].LastUsedAt = &lastUsed
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) ListAPITokens(_ context.Context, userID int) ([]APIToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var tokens []APIToken
+	for _, t := range s.apiTokens {
+		if t.UserID == userID {
+			tokens = append(tokens, t)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].ID > tokens[j].ID })
+	return tokens, nil
+}
+
+func (s *MemoryStore) DeleteAPIToken(_ context.Context, userID, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, t := range s.apiTokens {
+		if t.ID == id && t.UserID == userID {
+			s.apiTokens = append(s.apiTokens[:i], s.apiTokens[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
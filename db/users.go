@@ -0,0 +1,379 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+type User struct {
+	ID           int    `json:"id"`
+	Username     string `json:"username"`
+	PasswordHash string `json:"-"`
+	// Role is one of the roles defined by the auth package.
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Session is a login. Only a hash of its token is stored, so a leaked
+// database can't be used to take over sessions.
+type Session struct {
+	ID         int       `json:"id"`
+	UserID     int       `json:"-"`
+	TokenHash  string    `json:"-"`
+	UserAgent  string    `json:"user_agent"`
+	ClientIP   string    `json:"client_ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	// RefreshToken and RefreshAt are set for single sign-on sessions,
+	// which are checked with the identity provider again at RefreshAt.
+	RefreshToken string     `json:"-"`
+	RefreshAt    *time.Time `json:"-"`
+}
+
+// Preferences are a user's defaults for new uploads.
+type Preferences struct {
+	// Visibility is given to the user's uploads, and GroupID to those
+	// with VisibilityGroup.
+	Visibility string `json:"default_visibility"`
+	GroupID    int    `json:"default_group_id,omitempty"`
+}
+
+// Invite lets someone create their own account once before it expires.
+type Invite struct {
+	ID        int    `json:"id"`
+	TokenHash string `json:"-"`
+	CreatedBy int    `json:"created_by"`
+	// Role is given to the account created with the invite.
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// isUniqueViolation reports whether err is a unique constraint violation in
+// either backend.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505"
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+	}
+	return false
+}
+
+const userColumns = `id, username, password_hash, role, created_at, updated_at`
+
+func scanUser(row interface{ Scan(...interface{}) error }) (*User, error) {
+	var u User
+	err := row.Scan(&u.ID, &u.Username, &u.PasswordHash, &u.Role, &u.CreatedAt, &u.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (s *SQLStore) CountUsers(ctx context.Context) (int, error) {
+	defer s.startQuery(ctx, "count_users")()
+
+	var count int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM users`).Scan(&count)
+	return count, err
+}
+
+func (s *SQLStore) CreateUser(ctx context.Context, u *User) error {
+	defer s.startQuery(ctx, "create_user")()
+
+	return s.insertUser(ctx, s.db, u)
+}
+
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func (s *SQLStore) insertUser(ctx context.Context, q queryRower, u *User) error {
+	query := `
+		INSERT INTO users (username, password_hash, role, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $4)
+		RETURNING id, created_at, updated_at
+	`
+	now := time.Now().UTC()
+	err := q.QueryRowContext(ctx, s.dialect.Rebind(query), u.Username, u.PasswordHash, u.Role, now).
+		Scan(&u.ID, &u.CreatedAt, &u.UpdatedAt)
+	if isUniqueViolation(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+func (s *SQLStore) GetUserByID(ctx context.Context, id int) (*User, error) {
+	defer s.startQuery(ctx, "get_user_by_id")()
+
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = $1`
+	return scanUser(s.db.QueryRowContext(ctx, s.dialect.Rebind(query), id))
+}
+
+func (s *SQLStore) GetUserByUsername(ctx context.Context, username string) (*User, error) {
+	defer s.startQuery(ctx, "get_user_by_username")()
+
+	query := `SELECT ` + userColumns + ` FROM users WHERE username = $1`
+	return scanUser(s.db.QueryRowContext(ctx, s.dialect.Rebind(query), username))
+}
+
+func (s *SQLStore) ListUsers(ctx context.Context) ([]User, error) {
+	defer s.startQuery(ctx, "list_users")()
+
+	rows, err := s.db.QueryContext(ctx, `SELECT `+userColumns+` FROM users ORDER BY username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, *u)
+	}
+	return users, rows.Err()
+}
+
+func (s *SQLStore) SetUserRole(ctx context.Context, userID int, role string) error {
+	defer s.startQuery(ctx, "set_user_role")()
+
+	query := `UPDATE users SET role = $1, updated_at = $2 WHERE id = $3`
+	return expectRow(s.db.ExecContext(ctx, s.dialect.Rebind(query), role, time.Now().UTC(), userID))
+}
+
+func (s *SQLStore) GetUserPreferences(ctx context.Context, userID int) (*Preferences, error) {
+	defer s.startQuery(ctx, "get_user_preferences")()
+
+	var p Preferences
+	var groupID sql.NullInt32
+	query := `SELECT default_visibility, default_group_id FROM users WHERE id = $1`
+	err := s.db.QueryRowContext(ctx, s.dialect.Rebind(query), userID).Scan(&p.Visibility, &groupID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.GroupID = int(groupID.Int32)
+	return &p, nil
+}
+
+func (s *SQLStore) SetUserPreferences(ctx context.Context, userID int, p Preferences) error {
+	defer s.startQuery(ctx, "set_user_preferences")()
+
+	query := `UPDATE users SET default_visibility = $1, default_group_id = $2, updated_at = $3 WHERE id = $4`
+	return expectRow(s.db.ExecContext(ctx, s.dialect.Rebind(query),
+		p.Visibility, nullID(p.GroupID), time.Now().UTC(), userID))
+}
+
+func (s *SQLStore) UpdatePassword(ctx context.Context, userID int, hash string) error {
+	defer s.startQuery(ctx, "update_password")()
+
+	query := `UPDATE users SET password_hash = $1, updated_at = $2 WHERE id = $3`
+	return expectRow(s.db.ExecContext(ctx, s.dialect.Rebind(query), hash, time.Now().UTC(), userID))
+}
+
+// expectRow turns an update or delete that matched nothing into ErrNotFound.
+func expectRow(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLStore) CreateSession(ctx context.Context, sess *Session) error {
+	defer s.startQuery(ctx, "create_session")()
+
+	query := `
+		INSERT INTO sessions (user_id, token_hash, user_agent, client_ip, created_at, last_seen_at, expires_at, refresh_token, refresh_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id
+	`
+	return s.db.QueryRowContext(ctx, s.dialect.Rebind(query),
+		sess.UserID, sess.TokenHash, sess.UserAgent, sess.ClientIP,
+		sess.CreatedAt.UTC(), sess.LastSeenAt.UTC(), sess.ExpiresAt.UTC(),
+		sess.RefreshToken, utcOrNil(sess.RefreshAt),
+	).Scan(&sess.ID)
+}
+
+// utcOrNil converts an optional time for storage.
+func utcOrNil(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UTC()
+}
+
+const sessionColumns = `s.id, s.user_id, s.token_hash, s.user_agent, s.client_ip, s.created_at, s.last_seen_at, s.expires_at, s.refresh_token, s.refresh_at`
+
+func scanSession(row interface{ Scan(...interface{}) error }, extra ...interface{}) (*Session, error) {
+	var sess Session
+	var refreshAt sql.NullTime
+	dest := append([]interface{}{&sess.ID, &sess.UserID, &sess.TokenHash, &sess.UserAgent, &sess.ClientIP,
+		&sess.CreatedAt, &sess.LastSeenAt, &sess.ExpiresAt, &sess.RefreshToken, &refreshAt}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if refreshAt.Valid {
+		sess.RefreshAt = &refreshAt.Time
+	}
+	return &sess, nil
+}
+
+// GetSession returns the unexpired session with the given token hash and
+// its user.
+func (s *SQLStore) GetSession(ctx context.Context, tokenHash string, now time.Time) (*Session, *User, error) {
+	defer s.startQuery(ctx, "get_session")()
+
+	query := `
+		SELECT ` + sessionColumns + `, u.id, u.username, u.password_hash, u.role, u.created_at, u.updated_at
+		FROM sessions s JOIN users u ON u.id = s.user_id
+		WHERE s.token_hash = $1 AND s.expires_at > $2
+	`
+	var u User
+	sess, err := scanSession(s.db.QueryRowContext(ctx, s.dialect.Rebind(query), tokenHash, now.UTC()),
+		&u.ID, &u.Username, &u.PasswordHash, &u.Role, &u.CreatedAt, &u.UpdatedAt)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sess, &u, nil
+}
+
+func (s *SQLStore) TouchSession(ctx context.Context, id int, lastSeen time.Time) error {
+	defer s.startQuery(ctx, "touch_session")()
+
+	query := `UPDATE sessions SET last_seen_at = $1 WHERE id = $2`
+	_, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), lastSeen.UTC(), id)
+	return err
+}
+
+func (s *SQLStore) UpdateSessionRefresh(ctx context.Context, id int, refreshToken string, refreshAt time.Time) error {
+	defer s.startQuery(ctx, "update_session_refresh")()
+
+	query := `UPDATE sessions SET refresh_token = $1, refresh_at = $2 WHERE id = $3`
+	return expectRow(s.db.ExecContext(ctx, s.dialect.Rebind(query), refreshToken, refreshAt.UTC(), id))
+}
+
+func (s *SQLStore) ListSessions(ctx context.Context, userID int, now time.Time) ([]Session, error) {
+	defer s.startQuery(ctx, "list_sessions")()
+
+	query := `
+		SELECT ` + sessionColumns + ` FROM sessions s
+		WHERE s.user_id = $1 AND s.expires_at > $2
+		ORDER BY s.last_seen_at DESC
+	`
+	rows, err := s.db.QueryContext(ctx, s.dialect.Rebind(query), userID, now.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		sess, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, *sess)
+	}
+	return sessions, rows.Err()
+}
+
+// DeleteSession revokes one of the user's sessions.
+func (s *SQLStore) DeleteSession(ctx context.Context, userID, id int) error {
+	defer s.startQuery(ctx, "delete_session")()
+
+	query := `DELETE FROM sessions WHERE id = $1 AND user_id = $2`
+	return expectRow(s.db.ExecContext(ctx, s.dialect.Rebind(query), id, userID))
+}
+
+// DeleteUserSessions revokes all of the user's sessions except keepID.
+func (s *SQLStore) DeleteUserSessions(ctx context.Context, userID, keepID int) error {
+	defer s.startQuery(ctx, "delete_user_sessions")()
+
+	query := `DELETE FROM sessions WHERE user_id = $1 AND id <> $2`
+	_, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), userID, keepID)
+	return err
+}
+
+func (s *SQLStore) DeleteExpiredSessions(ctx context.Context, now time.Time) (int64, error) {
+	defer s.startQuery(ctx, "delete_expired_sessions")()
+
+	query := `DELETE FROM sessions WHERE expires_at <= $1`
+	res, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *SQLStore) CreateInvite(ctx context.Context, inv *Invite) error {
+	defer s.startQuery(ctx, "create_invite")()
+
+	query := `
+		INSERT INTO invites (token_hash, created_by, role, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`
+	return s.db.QueryRowContext(ctx, s.dialect.Rebind(query),
+		inv.TokenHash, inv.CreatedBy, inv.Role, inv.CreatedAt.UTC(), inv.ExpiresAt.UTC(),
+	).Scan(&inv.ID)
+}
+
+// RedeemInvite creates u, with the invite's role, from the invite identified
+// by tokenHash, provided the invite is unused and unexpired, and marks it
+// used. Both happen in one transaction, so an invite can't be redeemed twice.
+func (s *SQLStore) RedeemInvite(ctx context.Context, tokenHash string, now time.Time, u *User) error {
+	defer s.startQuery(ctx, "redeem_invite")()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var inviteID int
+	query := `SELECT id, role FROM invites WHERE token_hash = $1 AND used_at IS NULL AND expires_at > $2`
+	err = tx.QueryRowContext(ctx, s.dialect.Rebind(query), tokenHash, now.UTC()).Scan(&inviteID, &u.Role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.insertUser(ctx, tx, u); err != nil {
+		return err
+	}
+	query = `UPDATE invites SET used_at = $1, used_by = $2 WHERE id = $3`
+	if _, err := tx.ExecContext(ctx, s.dialect.Rebind(query), now.UTC(), u.ID, inviteID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -2,4 +2,11 @@ module DevMaan707/streamer
 
 go 1.23.0
 
-require github.com/lib/pq v1.10.9
+require (
+	github.com/BurntSushi/toml v1.5.0
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.24
+	golang.org/x/crypto v0.31.0
+)
+
+require golang.org/x/sys v0.28.0 // indirect
@@ -0,0 +1,69 @@
+// Package logging configures the process-wide slog logger.
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+
+	"DevMaan707/streamer/config"
+	"DevMaan707/streamer/tracing"
+	"DevMaan707/streamer/utils"
+)
+
+// level is shared by every handler Setup creates, so SetLevel takes effect
+// without replacing the logger.
+var level = new(slog.LevelVar)
+
+// Setup installs the default slog logger, writing to stderr in the
+// configured format. Output from the standard log package is routed
+// through it as well.
+func Setup(cfg config.LogConfig) {
+	slog.SetDefault(slog.New(newHandler(os.Stderr, cfg)))
+}
+
+func newHandler(w io.Writer, cfg config.LogConfig) slog.Handler {
+	SetLevel(cfg.Level)
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	if cfg.Format == "json" {
+		h = slog.NewJSONHandler(w, opts)
+	} else {
+		h = slog.NewTextHandler(w, opts)
+	}
+	return contextHandler{h}
+}
+
+// SetLevel changes the minimum level of the default logger. Unknown levels
+// are ignored; the configuration is validated before it gets here.
+func SetLevel(name string) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(name)); err == nil {
+		level.Set(l)
+	}
+}
+
+// contextHandler adds the request ID and trace context from the context to
+// every record logged with one of the *Context functions.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := utils.RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := tracing.SpanFromContext(ctx).Context(); sc.Valid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID.String()), slog.String("span_id", sc.SpanID.String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
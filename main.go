@@ -1,15 +1,23 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	"DevMaan707/streamer/config"
 	"DevMaan707/streamer/db"
+	"DevMaan707/streamer/logging"
 	"DevMaan707/streamer/server"
+	"DevMaan707/streamer/tracing"
+	"DevMaan707/streamer/vault"
 )
 
 func expandPath(path string) string {
@@ -19,70 +27,199 @@ func expandPath(path string) string {
 
 	home, err := os.UserHomeDir()
 	if err != nil {
-		log.Printf("Warning: could not expand home directory: %v", err)
+		slog.Warn("Could not expand home directory", "path", path, "error", err)
 		return path
 	}
 
 	return filepath.Join(home, path[1:])
 }
 
+// fatal logs msg with its attributes as an error and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// loadConfig loads the configuration and resolves its paths, so that
+// configurations loaded at different times compare equal.
+func loadConfig(fs *flag.FlagSet, args []string) (*config.Config, error) {
+	cfg, err := config.Load(fs, args)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.VideoDir, err = filepath.Abs(expandPath(cfg.VideoDir))
+	if err != nil {
+		return nil, fmt.Errorf("error resolving video directory path: %w", err)
+	}
+	cfg.CoverImageDir, err = filepath.Abs(expandPath(cfg.CoverImageDir))
+	if err != nil {
+		return nil, fmt.Errorf("error resolving cover images directory path: %w", err)
+	}
+	cfg.Database.DataDir = expandPath(cfg.Database.DataDir)
+	cfg.TLS.CertFile = expandPath(cfg.TLS.CertFile)
+	cfg.TLS.KeyFile = expandPath(cfg.TLS.KeyFile)
+	cfg.TLS.ClientCAFile = expandPath(cfg.TLS.ClientCAFile)
+	if cfg.EncryptionKeyFile != "" {
+		cfg.EncryptionKeyFile = expandPath(cfg.EncryptionKeyFile)
+	}
+	if cfg.Auth.URLSigningKeyFile != "" {
+		cfg.Auth.URLSigningKeyFile = expandPath(cfg.Auth.URLSigningKeyFile)
+	}
+	cfg.Log.AccessLog = expandPath(cfg.Log.AccessLog)
+	return cfg, nil
+}
+
+// connectDatabase opens the configured SQL backend into db.DB. It reports
+// false for the memory backend, which has no database.
+func connectDatabase(cfg *config.Config) (bool, error) {
+	switch cfg.Database.Driver {
+	case "memory":
+		return false, nil
+	case "sqlite":
+		dataDir := cfg.Database.DataDir
+		if err := os.MkdirAll(dataDir, 0755); err != nil {
+			return false, fmt.Errorf("failed to create data directory: %w", err)
+		}
+		return true, db.InitializeSQLite(filepath.Join(dataDir, "starflix.db"))
+	case "postgres":
+		return true, db.Initialize(cfg.Database)
+	default:
+		return false, fmt.Errorf("unknown database driver %q", cfg.Database.Driver)
+	}
+}
+
+// openStore connects to the configured storage backend and brings its
+// schema up to date.
+func openStore(cfg *config.Config) (db.Store, error) {
+	connected, err := connectDatabase(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if !connected {
+		slog.Warn("Using in-memory storage, nothing will be persisted")
+		return db.NewMemoryStore(), nil
+	}
+
+	applied, err := db.MigrateUp()
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+	if applied > 0 {
+		slog.Info("Applied database migrations", "count", applied)
+	}
+	if err := db.TestConnection(); err != nil {
+		slog.Warn("Database connection test failed, some features may not work properly", "error", err)
+	}
+
+	if cfg.Database.Driver == "sqlite" {
+		return db.NewSQLiteStore(db.DB), nil
+	}
+	return db.NewPostgresStore(db.DB), nil
+}
+
 func main() {
-	cfg := config.NewConfig()
-	flag.IntVar(&cfg.Port, "port", 5101, "Port to serve on")
-	flag.StringVar(&cfg.VideoDir, "videos", "./videos", "Directory containing video files")
-	flag.StringVar(&cfg.CoverImageDir, "covers", "./covers", "Directory for video cover images")
-	flag.IntVar(&cfg.MaxUploadSize, "max-upload", 1024, "Maximum upload size in MB")
-	flag.Parse()
-	cfg.VideoDir = expandPath(cfg.VideoDir)
-	cfg.CoverImageDir = expandPath(cfg.CoverImageDir)
-	absPath, err := filepath.Abs(cfg.VideoDir)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "rotate-key":
+			runRotateKey(os.Args[2:])
+			return
+		case "rotate-signing-key":
+			runRotateSigningKey(os.Args[2:])
+			return
+		case "migrate":
+			runMigrate(os.Args[2:])
+			return
+		case "user":
+			runUser(os.Args[2:])
+			return
+		}
+	}
+
+	printConfig := flag.Bool("print-config", false, "Print the effective configuration with secrets redacted and exit")
+	cfg, err := loadConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		fatal("Configuration error", "error", err)
+	}
+	if *printConfig {
+		if err := cfg.Redacted().WriteTOML(os.Stdout); err != nil {
+			fatal("Failed to print configuration", "error", err)
+		}
+		return
+	}
+	logging.Setup(cfg.Log)
+	shutdownTracing, err := tracing.Setup(cfg.Tracing)
 	if err != nil {
-		log.Fatalf("Error resolving video directory path: %v", err)
+		fatal("Failed to set up tracing", "error", err)
 	}
 
-	cfg.VideoDir = absPath
+	absPath := cfg.VideoDir
 	if _, err := os.Stat(absPath); os.IsNotExist(err) {
-		log.Printf("Video directory does not exist, creating: %s", absPath)
+		slog.Info("Video directory does not exist, creating it", "path", absPath)
 		if err := os.MkdirAll(absPath, 0755); err != nil {
-			log.Fatalf("Failed to create video directory: %v", err)
+			fatal("Failed to create video directory", "error", err)
 		}
 	} else if err != nil {
-		log.Fatalf("Error accessing video directory: %v", err)
-	}
-	absPathCovers, err := filepath.Abs(cfg.CoverImageDir)
-	if err != nil {
-		log.Fatalf("Error resolving cover images directory path: %v", err)
+		fatal("Error accessing video directory", "error", err)
 	}
-
-	cfg.CoverImageDir = absPathCovers
+	absPathCovers := cfg.CoverImageDir
 	if _, err := os.Stat(absPathCovers); os.IsNotExist(err) {
-		log.Printf("Cover images directory does not exist, creating: %s", absPathCovers)
+		slog.Info("Cover images directory does not exist, creating it", "path", absPathCovers)
 		if err := os.MkdirAll(absPathCovers, 0755); err != nil {
-			log.Fatalf("Failed to create cover images directory: %v", err)
+			fatal("Failed to create cover images directory", "error", err)
 		}
 	}
-	if err := db.Initialize(); err != nil {
-		log.Fatalf("Database initialization failed: %v", err)
+	if cfg.EncryptionKeyFile != "" {
+		if _, err := os.Stat(cfg.EncryptionKeyFile); os.IsNotExist(err) {
+			slog.Info("Encryption key file does not exist, creating it", "path", cfg.EncryptionKeyFile)
+			if err := vault.CreateKeyFile(cfg.EncryptionKeyFile); err != nil {
+				fatal("Failed to create encryption key file", "error", err)
+			}
+		}
 	}
-	if err := db.TestConnection(); err != nil {
-		log.Printf("WARNING: Database connection test failed: %v", err)
-		log.Println("The application will continue, but some features may not work properly")
+	if cfg.Auth.URLSigningKeyFile != "" {
+		if _, err := os.Stat(cfg.Auth.URLSigningKeyFile); os.IsNotExist(err) {
+			slog.Info("URL signing key file does not exist, creating it", "path", cfg.Auth.URLSigningKeyFile)
+			if err := vault.CreateKeyFile(cfg.Auth.URLSigningKeyFile); err != nil {
+				fatal("Failed to create URL signing key file", "error", err)
+			}
+		}
 	}
-	if err := db.EnsureTablesExist(); err != nil {
-		log.Printf("WARNING: Failed to verify database tables: %v", err)
+	store, err := openStore(cfg)
+	if err != nil {
+		fatal("Database initialization failed", "error", err)
 	}
 
-	srv, err := server.NewServer(cfg)
+	srv, err := server.NewServer(cfg, store)
 	if err != nil {
-		log.Fatalf("Failed to create server: %v", err)
+		fatal("Failed to create server", "error", err)
 	}
 
-	fmt.Printf("Starting StreamFlix video platform on http://localhost:%d\n", cfg.Port)
-	fmt.Printf("Serving videos from: %s\n", absPath)
-	fmt.Printf("Storing cover images in: %s\n", absPathCovers)
-	fmt.Printf("Maximum upload size: %d MB\n", cfg.MaxUploadSize)
+	slog.Info("Starting StreamFlix video platform",
+		"video_dir", absPath,
+		"cover_dir", absPathCovers,
+		"max_upload_mb", cfg.MaxUploadSize,
+		"encryption_key_file", cfg.EncryptionKeyFile)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	if err := srv.Start(); err != nil {
-		log.Fatalf("Server error: %v", err)
+	go srv.ReloadOnSignal(ctx, func() (*config.Config, error) {
+		fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		fs.Bool("print-config", false, "")
+		return loadConfig(fs, os.Args[1:])
+	})
+
+	if err := srv.Run(ctx); err != nil {
+		fatal("Server error", "error", err)
+	}
+	if err := db.Close(); err != nil {
+		slog.Error("Failed to close database", "error", err)
+	}
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(flushCtx); err != nil {
+		slog.Warn("Failed to flush traces", "error", err)
 	}
 }
@@ -0,0 +1,315 @@
+// Package metrics is a small Prometheus client: counters, gauges and
+// histograms with labels, exposed in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Default is the registry the server exposes on /metrics.
+var Default = NewRegistry()
+
+// DefaultBuckets suit latencies in seconds, from 5ms to 10s.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds metric families and writes them out in registration order.
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+	byName   map[string]*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{byName: make(map[string]*family)}
+}
+
+type family struct {
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+	funcs  []funcSeries
+}
+
+type series struct {
+	labelValues []string
+	value       atomicFloat
+	// Histograms only: the count per bucket (not cumulative) and in total.
+	bucketCounts []atomic.Uint64
+	count        atomic.Uint64
+}
+
+type funcSeries struct {
+	labelValues []string
+	fn          func() float64
+}
+
+// register returns the family called name, creating it on first use.
+// Registering the same name with a different type or labels is a
+// programming error and panics.
+func (r *Registry) register(name, help, typ string, labels []string, buckets []float64) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if f, ok := r.byName[name]; ok {
+		if f.typ != typ || strings.Join(f.labels, ",") != strings.Join(labels, ",") {
+			panic(fmt.Sprintf("metrics: %s registered twice with different types or labels", name))
+		}
+		return f
+	}
+	f := &family{
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	r.families = append(r.families, f)
+	r.byName[name] = f
+	return f
+}
+
+func (f *family) with(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), values...)}
+		if f.typ == "histogram" {
+			s.bucketCounts = make([]atomic.Uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct{ f *family }
+
+// Counter is a value that only goes up.
+type Counter struct{ s *series }
+
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{r.register(name, help, "counter", labels, nil)}
+}
+
+// With returns the counter for the given label values, in the order the
+// labels were registered.
+func (v *CounterVec) With(values ...string) *Counter {
+	return &Counter{v.f.with(values)}
+}
+
+func (c *Counter) Inc() { c.s.value.add(1) }
+
+// Add increases the counter by delta, which must not be negative.
+func (c *Counter) Add(delta float64) { c.s.value.add(delta) }
+
+// GaugeVec is a gauge partitioned by labels.
+type GaugeVec struct{ f *family }
+
+// Gauge is a value that can go up and down.
+type Gauge struct{ s *series }
+
+func (r *Registry) Gauge(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{r.register(name, help, "gauge", labels, nil)}
+}
+
+func (v *GaugeVec) With(values ...string) *Gauge {
+	return &Gauge{v.f.with(values)}
+}
+
+func (g *Gauge) Set(value float64) { g.s.value.set(value) }
+func (g *Gauge) Add(delta float64) { g.s.value.add(delta) }
+func (g *Gauge) Inc()              { g.s.value.add(1) }
+func (g *Gauge) Dec()              { g.s.value.add(-1) }
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct{ f *family }
+
+// Histogram counts observations into buckets.
+type Histogram struct {
+	s       *series
+	buckets []float64
+}
+
+// Histogram registers a histogram with the given upper bucket bounds, in
+// increasing order; the +Inf bucket is implied.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{r.register(name, help, "histogram", labels, buckets)}
+}
+
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return &Histogram{s: v.f.with(values), buckets: v.f.buckets}
+}
+
+func (h *Histogram) Observe(value float64) {
+	i := sort.SearchFloat64s(h.buckets, value)
+	if i < len(h.buckets) {
+		h.s.bucketCounts[i].Add(1)
+	}
+	h.s.count.Add(1)
+	h.s.value.add(value)
+}
+
+// GaugeFunc registers a gauge whose value is read from fn at scrape time.
+// labelPairs are alternating label names and values; several calls with the
+// same name and label names add series to one family.
+func (r *Registry) GaugeFunc(name, help string, fn func() float64, labelPairs ...string) {
+	r.registerFunc(name, help, "gauge", fn, labelPairs)
+}
+
+// CounterFunc is like GaugeFunc for a value that only goes up.
+func (r *Registry) CounterFunc(name, help string, fn func() float64, labelPairs ...string) {
+	r.registerFunc(name, help, "counter", fn, labelPairs)
+}
+
+func (r *Registry) registerFunc(name, help, typ string, fn func() float64, labelPairs []string) {
+	var labels, values []string
+	for i := 0; i+1 < len(labelPairs); i += 2 {
+		labels = append(labels, labelPairs[i])
+		values = append(values, labelPairs[i+1])
+	}
+	f := r.register(name, help, typ, labels, nil)
+	f.mu.Lock()
+	f.funcs = append(f.funcs, funcSeries{labelValues: values, fn: fn})
+	f.mu.Unlock()
+}
+
+// WriteText writes every metric in the Prometheus text exposition format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	families := append([]*family(nil), r.families...)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(bw)
+	}
+	return bw.Flush()
+}
+
+func (f *family) write(w *bufio.Writer) {
+	f.mu.Lock()
+	series := make([]*series, 0, len(f.series))
+	for _, s := range f.series {
+		series = append(series, s)
+	}
+	funcs := append([]funcSeries(nil), f.funcs...)
+	f.mu.Unlock()
+	if len(series) == 0 && len(funcs) == 0 {
+		return
+	}
+	sort.Slice(series, func(i, j int) bool {
+		return strings.Join(series[i].labelValues, "\xff") < strings.Join(series[j].labelValues, "\xff")
+	})
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.typ)
+	for _, fs := range funcs {
+		writeSample(w, f.name, f.labels, fs.labelValues, "", "", fs.fn())
+	}
+	for _, s := range series {
+		if f.typ != "histogram" {
+			writeSample(w, f.name, f.labels, s.labelValues, "", "", s.value.load())
+			continue
+		}
+		var cumulative uint64
+		for i, bound := range f.buckets {
+			cumulative += s.bucketCounts[i].Load()
+			writeSample(w, f.name+"_bucket", f.labels, s.labelValues, "le", formatFloat(bound), float64(cumulative))
+		}
+		count := s.count.Load()
+		writeSample(w, f.name+"_bucket", f.labels, s.labelValues, "le", "+Inf", float64(count))
+		writeSample(w, f.name+"_sum", f.labels, s.labelValues, "", "", s.value.load())
+		writeSample(w, f.name+"_count", f.labels, s.labelValues, "", "", float64(count))
+	}
+}
+
+func writeSample(w *bufio.Writer, name string, labels, values []string, extraLabel, extraValue string, value float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraLabel != "" {
+		w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", l, escapeLabel(values[i]))
+		}
+		if extraLabel != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", extraLabel, extraValue)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+// Handler serves the registry's metrics.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteText(w)
+	})
+}
+
+// atomicFloat is a float64 updated with compare-and-swap.
+type atomicFloat struct {
+	bits atomic.Uint64
+}
+
+func (a *atomicFloat) load() float64 {
+	return math.Float64frombits(a.bits.Load())
+}
+
+func (a *atomicFloat) set(v float64) {
+	a.bits.Store(math.Float64bits(v))
+}
+
+func (a *atomicFloat) add(delta float64) {
+	for {
+		old := a.bits.Load()
+		next := math.Float64bits(math.Float64frombits(old) + delta)
+		if a.bits.CompareAndSwap(old, next) {
+			return
+		}
+	}
+}
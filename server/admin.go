@@ -0,0 +1,18 @@
+package server
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// registerAdminRoutes adds the operator endpoints. They are only served on
+// listeners with the admin (or all) route set, which would typically bind to
+// localhost.
+func (s *Server) registerAdminRoutes(mux *http.ServeMux) {
+	mux.Handle("/metrics", s.metricsHandler())
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
@@ -0,0 +1,588 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"DevMaan707/streamer/auth"
+	"DevMaan707/streamer/config"
+	"DevMaan707/streamer/db"
+	"DevMaan707/streamer/services"
+	"DevMaan707/streamer/vault"
+)
+
+// testAPI is a server on a MemoryStore, mounted on an httptest.Server.
+type testAPI struct {
+	srv   *Server
+	store *db.MemoryStore
+	ts    *httptest.Server
+}
+
+func newTestConfig(t *testing.T) *config.Config {
+	t.Helper()
+	cfg := config.NewConfig()
+	cfg.VideoDir = t.TempDir()
+	cfg.CoverImageDir = t.TempDir()
+	cfg.Database.Driver = "memory"
+	cfg.RateLimit.Enabled = false
+	return cfg
+}
+
+func newTestAPI(t *testing.T) *testAPI {
+	t.Helper()
+	return newTestAPIWithConfig(t, newTestConfig(t))
+}
+
+func newTestAPIWithConfig(t *testing.T, cfg *config.Config) *testAPI {
+	t.Helper()
+	return startTestAPI(t, httptest.NewUnstartedServer(nil), cfg)
+}
+
+// startTestAPI starts ts with a server for cfg. Creating ts first gives
+// its URL, for settings that need it.
+func startTestAPI(t *testing.T, ts *httptest.Server, cfg *config.Config) *testAPI {
+	t.Helper()
+	t.Cleanup(ts.Close)
+	store := db.NewMemoryStore()
+	srv, err := NewServer(cfg, store)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	handler, err := srv.Handler()
+	if err != nil {
+		t.Fatalf("Handler: %v", err)
+	}
+	ts.Config.Handler = handler
+	ts.Start()
+	return &testAPI{srv: srv, store: store, ts: ts}
+}
+
+func testPassword(username string) string {
+	return "correct horse " + username
+}
+
+// client returns a client without a session.
+func (a *testAPI) client(t *testing.T) *testClient {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{t: t, base: a.ts.URL, http: &http.Client{Jar: jar}}
+}
+
+// user creates an account with the given role and returns a client logged
+// in to it.
+func (a *testAPI) user(t *testing.T, username string, role auth.Role) *testClient {
+	t.Helper()
+	if _, err := a.srv.authSvc.CreateUser(context.Background(), username, testPassword(username), role); err != nil {
+		t.Fatalf("CreateUser %s: %v", username, err)
+	}
+	c := a.client(t)
+	if status := c.json(http.MethodPost, "/api/auth/login", map[string]string{
+		"username": username, "password": testPassword(username),
+	}, nil); status != http.StatusOK {
+		t.Fatalf("login as %s: got %d", username, status)
+	}
+	return c
+}
+
+type testClient struct {
+	t    *testing.T
+	base string
+	http *http.Client
+}
+
+func (c *testClient) do(req *http.Request) (int, []byte) {
+	c.t.Helper()
+	resp, err := c.http.Do(req)
+	if err != nil {
+		c.t.Fatalf("%s %s: %v", req.Method, req.URL.Path, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatalf("%s %s: reading body: %v", req.Method, req.URL.Path, err)
+	}
+	return resp.StatusCode, body
+}
+
+func (c *testClient) request(method, path string, body io.Reader) *http.Request {
+	c.t.Helper()
+	req, err := http.NewRequest(method, c.base+path, body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return req
+}
+
+// json sends in, if not nil, as the JSON body and decodes a successful
+// response into out, if not nil. It returns the status code.
+func (c *testClient) json(method, path string, in, out interface{}) int {
+	c.t.Helper()
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		body = bytes.NewReader(b)
+	}
+	req := c.request(method, path, body)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	status, respBody := c.do(req)
+	if out != nil && status < 300 {
+		if err := json.Unmarshal(respBody, out); err != nil {
+			c.t.Fatalf("%s %s: decoding %q: %v", method, path, respBody, err)
+		}
+	}
+	return status
+}
+
+// get returns the status and body of a GET request, with extra headers
+// given as name, value pairs.
+func (c *testClient) get(path string, headers ...string) (int, []byte) {
+	c.t.Helper()
+	req := c.request(http.MethodGet, path, nil)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	return c.do(req)
+}
+
+// upload uploads content as a video called filename with the given form
+// fields and returns the status and the stored file's name.
+func (c *testClient) upload(filename string, content []byte, fields map[string]string) (int, string) {
+	c.t.Helper()
+	status, body := c.do(c.uploadRequest(filename, content, fields))
+	var resp uploadTestResponse
+	json.Unmarshal(body, &resp)
+	return status, resp.File
+}
+
+// uploadRequest returns the request upload sends.
+func (c *testClient) uploadRequest(filename string, content []byte, fields map[string]string) *http.Request {
+	c.t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for name, value := range fields {
+		mw.WriteField(name, value)
+	}
+	fw, err := mw.CreateFormFile("file", filename)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	fw.Write(content)
+	mw.Close()
+
+	req := c.request(http.MethodPost, "/api/upload", &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+type uploadTestResponse struct {
+	Success bool   `json:"success"`
+	File    string `json:"file"`
+}
+
+// videos returns the videos the client's user sees in the listing.
+func (c *testClient) videos() []db.Video {
+	c.t.Helper()
+	var videos []db.Video
+	if status := c.json(http.MethodGet, "/api/videos", nil, &videos); status != http.StatusOK {
+		c.t.Fatalf("GET /api/videos: got %d", status)
+	}
+	return videos
+}
+
+// video returns the listed video stored in file.
+func (c *testClient) video(file string) db.Video {
+	c.t.Helper()
+	for _, v := range c.videos() {
+		if v.FilePath == file {
+			return v
+		}
+	}
+	c.t.Fatalf("video %s isn't listed", file)
+	return db.Video{}
+}
+
+func TestAPIRequiresLogin(t *testing.T) {
+	api := newTestAPI(t)
+	c := api.client(t)
+
+	for _, path := range []string{"/api/videos", "/api/genres", "/api/auth/me", "/videos/movie.mp4"} {
+		if status, _ := c.get(path); status != http.StatusUnauthorized {
+			t.Errorf("GET %s without a session: got %d, want 401", path, status)
+		}
+	}
+	if status := c.json(http.MethodPost, "/api/auth/login", map[string]string{
+		"username": "nobody", "password": "wrong password",
+	}, nil); status != http.StatusUnauthorized {
+		t.Errorf("login with a wrong password: got %d, want 401", status)
+	}
+}
+
+func TestAPILoginAndLogout(t *testing.T) {
+	api := newTestAPI(t)
+	c := api.user(t, "alice", auth.RoleViewer)
+
+	var me struct {
+		User db.User `json:"user"`
+	}
+	if status := c.json(http.MethodGet, "/api/auth/me", nil, &me); status != http.StatusOK {
+		t.Fatalf("GET /api/auth/me: got %d", status)
+	}
+	if me.User.Username != "alice" || me.User.Role != string(auth.RoleViewer) {
+		t.Errorf("got %+v, want alice the viewer", me.User)
+	}
+	var genres []db.Genre
+	if status := c.json(http.MethodGet, "/api/genres", nil, &genres); status != http.StatusOK || len(genres) == 0 {
+		t.Errorf("GET /api/genres: got %d and %d genres, want the default genres", status, len(genres))
+	}
+
+	if status := c.json(http.MethodPost, "/api/auth/logout", nil, nil); status != http.StatusNoContent && status != http.StatusOK {
+		t.Fatalf("logout: got %d", status)
+	}
+	if status, _ := c.get("/api/auth/me"); status != http.StatusUnauthorized {
+		t.Errorf("GET /api/auth/me after logging out: got %d, want 401", status)
+	}
+}
+
+func TestAPIUploadAndStream(t *testing.T) {
+	api := newTestAPI(t)
+	uploader := api.user(t, "bob", auth.RoleUploader)
+	viewer := api.user(t, "carol", auth.RoleViewer)
+	content := []byte("0123456789abcdef")
+
+	if status, _ := viewer.upload("movie.mp4", content, nil); status != http.StatusForbidden {
+		t.Errorf("upload by a viewer: got %d, want 403", status)
+	}
+	if status, _ := uploader.upload("notes.txt", content, nil); status != http.StatusBadRequest {
+		t.Errorf("upload of a text file: got %d, want 400", status)
+	}
+
+	status, file := uploader.upload("movie.mp4", content, map[string]string{"title": "Movie", "genre": "Drama"})
+	if status != http.StatusOK || file != "movie.mp4" {
+		t.Fatalf("upload: got %d and %q, want 200 and movie.mp4", status, file)
+	}
+	v := viewer.video(file)
+	if v.Title != "Movie" || v.Genre != "Drama" || v.Visibility != db.VisibilityPublic {
+		t.Errorf("got video %+v, want the public Drama Movie", v)
+	}
+
+	var byGenre []db.Video
+	if status := viewer.json(http.MethodGet, "/api/videos/genre/Drama", nil, &byGenre); status != http.StatusOK || len(byGenre) != 1 {
+		t.Errorf("GET /api/videos/genre/Drama: got %d and %d videos, want 1", status, len(byGenre))
+	}
+	var found []db.Video
+	if status := viewer.json(http.MethodGet, "/api/videos/search?q=movie", nil, &found); status != http.StatusOK || len(found) != 1 {
+		t.Errorf("search: got %d and %d videos, want 1", status, len(found))
+	}
+
+	status, body := viewer.get("/videos/" + file)
+	if status != http.StatusOK || !bytes.Equal(body, content) {
+		t.Errorf("stream: got %d and %q", status, body)
+	}
+	status, body = viewer.get("/videos/"+file, "Range", "bytes=4-7")
+	if status != http.StatusPartialContent || string(body) != "4567" {
+		t.Errorf("range request: got %d and %q, want 206 and 4567", status, body)
+	}
+	if status, _ := viewer.get("/videos/missing.mp4"); status != http.StatusNotFound {
+		t.Errorf("stream of a missing file: got %d, want 404", status)
+	}
+}
+
+// TestAPIUploadKeepsExistingFiles checks that an upload with the name of an
+// existing file gets a name of its own rather than replacing the file.
+func TestAPIUploadKeepsExistingFiles(t *testing.T) {
+	api := newTestAPI(t)
+	admin := api.user(t, "alice", auth.RoleAdmin)
+	bob := api.user(t, "bob", auth.RoleUploader)
+
+	status, first := admin.upload("sample.mp4", []byte("admin's video"), map[string]string{"visibility": db.VisibilityPrivate})
+	if status != http.StatusOK {
+		t.Fatalf("first upload: got %d", status)
+	}
+	status, second := bob.upload("sample.mp4", []byte("bob's video"), map[string]string{"visibility": db.VisibilityPublic})
+	if status != http.StatusOK {
+		t.Fatalf("second upload: got %d", status)
+	}
+	if first != "sample.mp4" || second != "sample-1.mp4" {
+		t.Errorf("got files %q and %q, want sample.mp4 and sample-1.mp4", first, second)
+	}
+
+	if _, body := admin.get("/videos/" + first); string(body) != "admin's video" {
+		t.Errorf("admin's stream: got %q", body)
+	}
+	if status, body := bob.get("/videos/" + second); status != http.StatusOK || string(body) != "bob's video" {
+		t.Errorf("bob's stream: got %d and %q", status, body)
+	}
+	if status, _ := bob.get("/videos/" + first); status != http.StatusNotFound {
+		t.Errorf("bob streaming the admin's private video: got %d, want 404", status)
+	}
+}
+
+func TestAPIVisibility(t *testing.T) {
+	api := newTestAPI(t)
+	owner := api.user(t, "bob", auth.RoleUploader)
+	other := api.user(t, "carol", auth.RoleViewer)
+	admin := api.user(t, "alice", auth.RoleAdmin)
+
+	_, file := owner.upload("private.mp4", []byte("secret"), map[string]string{"visibility": db.VisibilityPrivate})
+	v := owner.video(file)
+	if v.Visibility != db.VisibilityPrivate {
+		t.Fatalf("got visibility %q, want private", v.Visibility)
+	}
+	if len(other.videos()) != 0 {
+		t.Error("a private video is listed for another user")
+	}
+	path := fmt.Sprintf("/api/videos/%d", v.ID)
+	if status, _ := other.get(path); status != http.StatusNotFound {
+		t.Errorf("GET %s by another user: got %d, want 404", path, status)
+	}
+	if status, _ := other.get("/videos/" + file); status != http.StatusNotFound {
+		t.Errorf("stream by another user: got %d, want 404", status)
+	}
+	if status, _ := admin.get(path); status != http.StatusOK {
+		t.Errorf("GET %s by an admin: got %d, want 200", path, status)
+	}
+
+	if status := other.json(http.MethodPut, path+"/visibility", map[string]string{"visibility": db.VisibilityPublic}, nil); status != http.StatusForbidden {
+		t.Errorf("visibility change by a viewer: got %d, want 403", status)
+	}
+	if status := owner.json(http.MethodPut, path+"/visibility", map[string]string{"visibility": db.VisibilityUnlisted}, nil); status != http.StatusOK {
+		t.Fatalf("visibility change by the owner: got %d", status)
+	}
+	if len(other.videos()) != 0 {
+		t.Error("an unlisted video is listed for another user")
+	}
+	if status, body := other.get("/videos/" + file); status != http.StatusOK || string(body) != "secret" {
+		t.Errorf("stream of an unlisted video: got %d and %q", status, body)
+	}
+}
+
+func TestAPIEditAndDelete(t *testing.T) {
+	api := newTestAPI(t)
+	owner := api.user(t, "bob", auth.RoleEditor)
+	editor := api.user(t, "carol", auth.RoleEditor)
+	viewer := api.user(t, "dave", auth.RoleViewer)
+	uploader := api.user(t, "erin", auth.RoleUploader)
+	admin := api.user(t, "alice", auth.RoleAdmin)
+
+	_, file := owner.upload("public.mp4", []byte("video"), nil)
+	path := fmt.Sprintf("/api/videos/%d", owner.video(file).ID)
+	update := map[string]interface{}{"title": "Renamed", "genre": "Comedy", "release_year": 2020}
+
+	if status := viewer.json(http.MethodPut, path, update, nil); status != http.StatusForbidden {
+		t.Errorf("edit by a viewer: got %d, want 403", status)
+	}
+	if status := uploader.json(http.MethodPut, path, update, nil); status != http.StatusForbidden {
+		t.Errorf("edit by an uploader: got %d, want 403", status)
+	}
+	if status := uploader.json(http.MethodDelete, path, nil, nil); status != http.StatusForbidden {
+		t.Errorf("delete by an uploader: got %d, want 403", status)
+	}
+	if status := editor.json(http.MethodPut, path, map[string]interface{}{"title": "By editor"}, nil); status != http.StatusOK {
+		t.Errorf("edit of another user's video by an editor: got %d, want 200", status)
+	}
+	if status := editor.json(http.MethodPut, path+"/visibility",
+		map[string]string{"visibility": db.VisibilityPrivate}, nil); status != http.StatusForbidden {
+		t.Errorf("visibility change of another user's video by an editor: got %d, want 403", status)
+	}
+	// An editor may only act on videos they can see.
+	_, private := owner.upload("private.mp4", []byte("secret"), map[string]string{"visibility": db.VisibilityPrivate})
+	privatePath := fmt.Sprintf("/api/videos/%d", owner.video(private).ID)
+	if status := editor.json(http.MethodDelete, privatePath, nil, nil); status != http.StatusNotFound {
+		t.Errorf("delete of a video the editor can't see: got %d, want 404", status)
+	}
+	if status := owner.json(http.MethodPut, path, map[string]interface{}{"title": " "}, nil); status != http.StatusBadRequest {
+		t.Errorf("edit without a title: got %d, want 400", status)
+	}
+
+	var updated db.Video
+	if status := owner.json(http.MethodPut, path, update, &updated); status != http.StatusOK {
+		t.Fatalf("edit by the owner: got %d", status)
+	}
+	if updated.Title != "Renamed" || updated.Genre != "Comedy" || updated.ReleaseYear != 2020 {
+		t.Errorf("got %+v after editing", updated)
+	}
+	if status := admin.json(http.MethodPut, path, map[string]interface{}{"title": "By admin"}, nil); status != http.StatusOK {
+		t.Errorf("edit by an admin: got %d, want 200", status)
+	}
+
+	if status := owner.json(http.MethodDelete, path, nil, nil); status != http.StatusNoContent {
+		t.Fatalf("delete by the owner: got %d", status)
+	}
+	if status, _ := owner.get(path); status != http.StatusNotFound {
+		t.Errorf("GET after deleting: got %d, want 404", status)
+	}
+	if status, _ := admin.get("/videos/" + file); status != http.StatusNotFound {
+		t.Errorf("stream after deleting: got %d, want 404", status)
+	}
+	if status := editor.json(http.MethodDelete, privatePath, nil, nil); status != http.StatusNotFound {
+		t.Errorf("delete of a video the editor can't see: got %d, want 404", status)
+	}
+	_, other := owner.upload("other.mp4", []byte("other"), nil)
+	if status := editor.json(http.MethodDelete, fmt.Sprintf("/api/videos/%d", owner.video(other).ID), nil, nil); status != http.StatusNoContent {
+		t.Errorf("delete of another user's video by an editor: got %d, want 204", status)
+	}
+}
+
+func TestAPIShares(t *testing.T) {
+	api := newTestAPI(t)
+	owner := api.user(t, "bob", auth.RoleUploader)
+	other := api.user(t, "carol", auth.RoleUploader)
+
+	_, file := owner.upload("family.mp4", []byte("family video"), map[string]string{"visibility": db.VisibilityPrivate})
+	id := owner.video(file).ID
+	// Make it visible to carol, who still mustn't share it.
+	if status := owner.json(http.MethodPut, fmt.Sprintf("/api/videos/%d/visibility", id),
+		map[string]string{"visibility": db.VisibilityUnlisted}, nil); status != http.StatusOK {
+		t.Fatalf("visibility change: got %d", status)
+	}
+	sharesPath := fmt.Sprintf("/api/videos/%d/shares", id)
+	if status := other.json(http.MethodPost, sharesPath, map[string]interface{}{}, nil); status != http.StatusForbidden {
+		t.Errorf("share by another user: got %d, want 403", status)
+	}
+
+	var share struct {
+		Token string `json:"token"`
+		URL   string `json:"url"`
+	}
+	if status := owner.json(http.MethodPost, sharesPath, map[string]interface{}{"max_plays": 1}, &share); status != http.StatusCreated {
+		t.Fatalf("share by the owner: got %d", status)
+	}
+	if share.Token == "" || !strings.HasSuffix(share.URL, "/s/"+share.Token) {
+		t.Errorf("got share %+v", share)
+	}
+
+	video := "/api/shared/" + share.Token + "/video"
+	anonymous := api.client(t)
+	// Seeking needs a counted play, probes don't.
+	if status, _ := anonymous.get(video, "Range", "bytes=1-"); status != http.StatusForbidden {
+		t.Errorf("range request without a play: got %d, want 403", status)
+	}
+	if status, body := anonymous.get(video, "Range", "bytes=0-1"); status != http.StatusPartialContent || string(body) != "fa" {
+		t.Errorf("probe: got %d and %q, want 206 and fa", status, body)
+	}
+
+	player := api.client(t)
+	status, body := player.get(video, "Range", "bytes=0-")
+	if status != http.StatusPartialContent || string(body) != "family video" {
+		t.Errorf("shared stream: got %d and %q", status, body)
+	}
+	var shares []db.Share
+	owner.json(http.MethodGet, sharesPath, nil, &shares)
+	if len(shares) != 1 || shares[0].Plays != 1 {
+		t.Errorf("got shares %+v, want one played once", shares)
+	}
+	if status, body := player.get(video, "Range", "bytes=7-"); status != http.StatusPartialContent || string(body) != "video" {
+		t.Errorf("seeking in a counted play: got %d and %q, want 206 and video", status, body)
+	}
+
+	// Once the plays are used up, only the counted play goes on.
+	for _, rng := range []string{"", "bytes=0-", "bytes=0-1", "bytes=1-", "bytes=0-1,2-"} {
+		if status, _ := anonymous.get(video, "Range", rng); status != http.StatusGone {
+			t.Errorf("stream with Range %q after the plays are used up: got %d, want 410", rng, status)
+		}
+	}
+	if status, _ := player.get(video, "Range", "bytes=7-"); status != http.StatusPartialContent {
+		t.Errorf("seeking in the last counted play: got %d, want 206", status)
+	}
+	if status, _ := player.get(video); status != http.StatusGone {
+		t.Errorf("a share limited to one play was played twice: got %d, want 410", status)
+	}
+	owner.json(http.MethodGet, sharesPath, nil, &shares)
+	if len(shares) != 1 || shares[0].Plays != 1 {
+		t.Errorf("got shares %+v, want one played once", shares)
+	}
+	if status, _ := anonymous.get("/api/shared/not-a-token/video"); status != http.StatusNotFound {
+		t.Errorf("stream of an unknown share: got %d, want 404", status)
+	}
+}
+
+func TestAPIAdminOnly(t *testing.T) {
+	api := newTestAPI(t)
+	editor := api.user(t, "carol", auth.RoleEditor)
+	admin := api.user(t, "alice", auth.RoleAdmin)
+
+	for _, path := range []string{"/api/users", "/api/admin/audit", "/api/admin/status"} {
+		if status, _ := editor.get(path); status != http.StatusForbidden {
+			t.Errorf("GET %s by an editor: got %d, want 403", path, status)
+		}
+		if status, _ := admin.get(path); status != http.StatusOK {
+			t.Errorf("GET %s by an admin: got %d, want 200", path, status)
+		}
+	}
+
+	var users []db.User
+	admin.json(http.MethodGet, "/api/users", nil, &users)
+	var carol int
+	for _, u := range users {
+		if u.Username == "carol" {
+			carol = u.ID
+		}
+	}
+	path := fmt.Sprintf("/api/users/%d/role", carol)
+	if status := admin.json(http.MethodPut, path, map[string]string{"role": string(auth.RoleViewer)}, nil); status != http.StatusOK {
+		t.Fatalf("role change: got %d", status)
+	}
+	if status, _ := editor.upload("movie.mp4", []byte("video"), nil); status != http.StatusForbidden {
+		t.Errorf("upload after demotion to viewer: got %d, want 403", status)
+	}
+}
+
+func TestAPISignedURLs(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.Auth.URLSigningKeyFile = filepath.Join(t.TempDir(), "url-keys")
+	if err := vault.CreateKeyFile(cfg.Auth.URLSigningKeyFile); err != nil {
+		t.Fatalf("CreateKeyFile: %v", err)
+	}
+	api := newTestAPIWithConfig(t, cfg)
+	owner := api.user(t, "bob", auth.RoleUploader)
+	other := api.user(t, "carol", auth.RoleAdmin)
+	anonymous := api.client(t)
+
+	_, file := owner.upload("private.mp4", []byte("private video"), map[string]string{"visibility": db.VisibilityPrivate})
+	var urls services.SignedVideoURLs
+	if status := owner.json(http.MethodPost, fmt.Sprintf("/api/videos/%d/signed-url", owner.video(file).ID), nil, &urls); status != http.StatusOK {
+		t.Fatalf("signing: got %d", status)
+	}
+	signed, err := url.Parse(urls.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, body := anonymous.get(signed.RequestURI()); status != http.StatusOK || string(body) != "private video" {
+		t.Errorf("signed URL: got %d %q", status, body)
+	}
+
+	// The user a signed URL runs as is covered by the signature.
+	q := signed.Query()
+	q.Set("uid", strconv.Itoa(other.me().ID))
+	if status, _ := anonymous.get(signed.Path + "?" + q.Encode()); status != http.StatusForbidden {
+		t.Errorf("signed URL naming another user: got %d, want 403", status)
+	}
+	q = signed.Query()
+	q.Set("sig", "forged")
+	if status, _ := anonymous.get(signed.Path + "?" + q.Encode()); status != http.StatusForbidden {
+		t.Errorf("forged signature: got %d, want 403", status)
+	}
+	if status, _ := anonymous.get("/videos/" + file + "?uid=1&sig=forged"); status != http.StatusForbidden {
+		t.Errorf("made-up signed URL: got %d, want 403", status)
+	}
+}
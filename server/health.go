@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"DevMaan707/streamer/db"
+)
+
+// readinessTimeout bounds each readiness check, so a hanging database
+// makes the probe fail instead of time out.
+const readinessTimeout = 2 * time.Second
+
+// registerHealthRoutes adds the liveness and readiness probes, which are
+// served on every listener.
+func (s *Server) registerHealthRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("/readyz", s.readyHandler)
+}
+
+type readiness struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// readyHandler reports whether the server can do its job: the database is
+// reachable with its schema up to date, and uploads can be stored. It
+// answers 503 if any check fails.
+func (s *Server) readyHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	result := readiness{Status: "ready", Checks: make(map[string]string)}
+	check := func(name string, err error) {
+		if err != nil {
+			result.Status = "unavailable"
+			result.Checks[name] = err.Error()
+			return
+		}
+		result.Checks[name] = "ok"
+	}
+
+	if db.DB != nil {
+		err := db.Ping(ctx)
+		check("database", err)
+		if err == nil {
+			check("migrations", migrationsCurrent())
+		}
+	}
+	check("storage", s.uploadSvc.CheckStorage())
+
+	status := http.StatusOK
+	if result.Status != "ready" {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, result)
+}
+
+func migrationsCurrent() error {
+	pending, err := db.PendingMigrations()
+	if err != nil {
+		return err
+	}
+	if pending > 0 {
+		return fmt.Errorf("%d migrations pending", pending)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"DevMaan707/streamer/config"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket
+// activation.
+const listenFDsStart = 3
+
+// systemdListeners returns the sockets passed by systemd socket activation,
+// keyed by their FileDescriptorName and by their index. The LISTEN_*
+// variables are cleared so child processes don't inherit them.
+func systemdListeners() (map[string]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	listeners := make(map[string]net.Listener, count)
+	for i := 0; i < count; i++ {
+		fd := listenFDsStart + i
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("systemd-socket-%d", i))
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to use systemd socket %d: %w", i, err)
+		}
+		listeners[strconv.Itoa(i)] = ln
+		if i < len(names) && names[i] != "" {
+			listeners[names[i]] = ln
+		}
+	}
+	return listeners, nil
+}
+
+// openListener opens the socket for a listener configuration. Sockets
+// inherited from systemd are looked up in inherited.
+func openListener(lc config.ListenerConfig, inherited map[string]net.Listener) (net.Listener, config.ListenAddress, error) {
+	addr, err := config.ParseListenAddress(lc.Address)
+	if err != nil {
+		return nil, addr, err
+	}
+
+	switch addr.Network {
+	case "systemd":
+		ln, ok := inherited[addr.Address]
+		if !ok {
+			return nil, addr, fmt.Errorf("no socket named %q was passed by systemd", addr.Address)
+		}
+		return ln, addr, nil
+	case "unix":
+		// A socket file left behind by an unclean exit would make the
+		// listen fail.
+		if info, err := os.Stat(addr.Address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(addr.Address)
+		}
+		ln, err := net.Listen("unix", addr.Address)
+		if err != nil {
+			return nil, addr, err
+		}
+		mode := uint64(0660)
+		if lc.SocketMode != "" {
+			mode, _ = strconv.ParseUint(lc.SocketMode, 8, 32)
+		}
+		if err := os.Chmod(addr.Address, os.FileMode(mode)); err != nil {
+			ln.Close()
+			return nil, addr, fmt.Errorf("failed to set socket permissions: %w", err)
+		}
+		return ln, addr, nil
+	default:
+		ln, err := net.Listen("tcp", addr.Address)
+		return ln, addr, err
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"DevMaan707/streamer/metrics"
+)
+
+var (
+	httpRequests = metrics.Default.Counter("starflix_http_requests_total",
+		"HTTP requests by route pattern, method and status code.", "route", "method", "status")
+	httpDuration = metrics.Default.Histogram("starflix_http_request_duration_seconds",
+		"Time to serve HTTP requests, streams included, by route pattern and method.",
+		metrics.DefaultBuckets, "route", "method")
+	storageBytes = metrics.Default.Gauge("starflix_storage_bytes",
+		"Total size of the files in the video and cover directories.", "dir")
+	storageFiles = metrics.Default.Gauge("starflix_storage_files",
+		"Number of files in the video and cover directories.", "dir")
+)
+
+// MetricsMiddleware counts and times requests. It labels them with the
+// ServeMux pattern that matched, which keeps the number of series bounded;
+// the mux records the pattern on the request passed down to it, so this
+// middleware must not replace the request.
+func MetricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		lw := &loggingResponseWriter{
+			ResponseWriter: w,
+			statusCode:     http.StatusOK,
+		}
+		next.ServeHTTP(lw, r)
+
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		method := r.Method
+		switch method {
+		case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+			http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		default:
+			method = "OTHER"
+		}
+		httpRequests.With(route, method, strconv.Itoa(lw.statusCode)).Inc()
+		httpDuration.With(route, method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// storageScanInterval limits how often the storage directories are walked
+// for /metrics, as a large library takes a while to scan.
+const storageScanInterval = time.Minute
+
+// storageCollector updates the storage gauges before a scrape.
+type storageCollector struct {
+	dirs map[string]func() string
+
+	mu       sync.Mutex
+	lastScan time.Time
+}
+
+func (c *storageCollector) update() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.lastScan) < storageScanInterval {
+		return
+	}
+	c.lastScan = time.Now()
+	for name, dir := range c.dirs {
+		size, files := dirUsage(dir())
+		storageBytes.With(name).Set(float64(size))
+		storageFiles.With(name).Set(float64(files))
+	}
+}
+
+// dirUsage sums the sizes of the regular files below dir, skipping
+// anything it can't read.
+func dirUsage(dir string) (size int64, files int) {
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+			files++
+		}
+		return nil
+	})
+	return size, files
+}
+
+// metricsHandler serves the default registry, refreshing the storage
+// gauges first.
+func (s *Server) metricsHandler() http.Handler {
+	storage := &storageCollector{dirs: map[string]func() string{
+		"videos": func() string { return s.Config().VideoDir },
+		"covers": func() string { return s.Config().CoverImageDir },
+	}}
+	registry := metrics.Default.Handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		storage.update()
+		registry.ServeHTTP(w, r)
+	})
+}
@@ -1,18 +1,27 @@
 package server
 
 import (
-	"log"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
+
+	"DevMaan707/streamer/tracing"
+	"DevMaan707/streamer/utils"
 )
 
 func CloudflareMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Transfer-Encoding", "chunked")
 		w.Header().Set("X-Content-Type-Options", "nosniff")
-		log.Printf("CF-RAY: %s", r.Header.Get("CF-RAY"))
-		log.Printf("CF-Connecting-IP: %s", r.Header.Get("CF-Connecting-IP"))
-		log.Printf("Content-Length: %s", r.Header.Get("Content-Length"))
+		slog.DebugContext(r.Context(), "Request headers",
+			"cf_ray", r.Header.Get("CF-RAY"),
+			"content_length", r.Header.Get("Content-Length"))
 
 		next.ServeHTTP(w, r)
 	})
@@ -21,47 +30,179 @@ func ErrorLoggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if err := recover(); err != nil {
-				log.Printf("Panic in request handler: %v", err)
+				slog.ErrorContext(r.Context(), "Panic in request handler", "panic", err)
 				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			}
 		}()
 		next.ServeHTTP(w, r)
 	})
 }
-func CORSMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
 
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
+// CORSMiddleware allows cross-origin requests from the origins returned by
+// allowedOrigins, which is consulted on every request so the list can be
+// reloaded at runtime.
+func CORSMiddleware(allowedOrigins func() []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			for _, allowed := range allowedOrigins() {
+				if allowed == "*" {
+					w.Header().Set("Access-Control-Allow-Origin", "*")
+					break
+				}
+				if origin != "" && strings.EqualFold(origin, allowed) {
+					w.Header().Set("Access-Control-Allow-Origin", origin)
+					w.Header().Add("Vary", "Origin")
+					break
+				}
+			}
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 
-		next.ServeHTTP(w, r)
-	})
+			if r.Method == http.MethodOptions {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
 }
 
-func LoggingMiddleware(next http.Handler) http.Handler {
+// LoggingMiddleware logs every request once it has completed and, if
+// accessLog is not nil, also writes it there in Combined Log Format.
+func LoggingMiddleware(accessLog io.Writer) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			lw := &loggingResponseWriter{
+				ResponseWriter: w,
+				statusCode:     http.StatusOK,
+			}
+			next.ServeHTTP(lw, r)
+			duration := time.Since(start)
+			slog.InfoContext(r.Context(), "Request",
+				"client_ip", utils.ClientIP(r.Context()),
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", lw.statusCode,
+				"bytes", lw.bytes,
+				"duration", duration)
+			if accessLog != nil {
+				writeAccessLog(accessLog, r, lw, start)
+			}
+		})
+	}
+}
+
+// writeAccessLog writes one line in the Combined Log Format used by Apache
+// and nginx, so existing log analysers can read it.
+func writeAccessLog(w io.Writer, r *http.Request, lw *loggingResponseWriter, start time.Time) {
+	size := "-"
+	if lw.bytes > 0 {
+		size = strconv.FormatInt(lw.bytes, 10)
+	}
+	fmt.Fprintf(w, "%s - - [%s] %s %d %s %s %s\n",
+		utils.ClientIP(r.Context()),
+		start.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(r.Method+" "+r.RequestURI+" "+r.Proto),
+		lw.statusCode,
+		size,
+		quoteOrDash(r.Referer()),
+		quoteOrDash(r.UserAgent()))
+}
+
+func quoteOrDash(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return strconv.Quote(s)
+}
+
+// RequestIDMiddleware gives every request an ID, taken from the
+// X-Request-ID header when the client or a proxy sent a usable one and
+// generated otherwise. The ID is echoed in the response and stored in the
+// request context, where it is added to every log line.
+func RequestIDMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		lw := &loggingResponseWriter{
-			ResponseWriter: w,
-			statusCode:     http.StatusOK,
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
 		}
-		next.ServeHTTP(lw, r)
-		duration := time.Since(start)
-		log.Printf("%s %s %d %s", r.Method, r.URL.Path, lw.statusCode, duration)
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(utils.WithRequestID(r.Context(), id)))
 	})
 }
 
+// validRequestID accepts IDs of up to 128 characters from a conservative
+// set, so a propagated ID can't inject anything into the logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
 type loggingResponseWriter struct {
 	http.ResponseWriter
 	statusCode int
+	bytes      int64
 }
 
 func (lw *loggingResponseWriter) WriteHeader(code int) {
 	lw.statusCode = code
 	lw.ResponseWriter.WriteHeader(code)
 }
+
+func (lw *loggingResponseWriter) Write(p []byte) (int, error) {
+	n, err := lw.ResponseWriter.Write(p)
+	lw.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (lw *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return lw.ResponseWriter
+}
+
+// TracingMiddleware starts a server span for every request, continuing the
+// caller's trace when the request carries a W3C traceparent header.
+func TracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := tracing.Extract(r.Context(), r.Header)
+		ctx, span := tracing.StartKind(ctx, r.Method, tracing.KindServer,
+			slog.String("http.request.method", r.Method),
+			slog.String("url.path", r.URL.Path),
+			slog.String("client.address", utils.ClientIP(ctx)),
+			slog.String("user_agent.original", r.UserAgent()))
+		defer span.End()
+
+		lw := &loggingResponseWriter{
+			ResponseWriter: w,
+			statusCode:     http.StatusOK,
+		}
+		// The mux records the matched pattern on this request.
+		r = r.WithContext(ctx)
+		next.ServeHTTP(lw, r)
+
+		if r.Pattern != "" {
+			span.SetName(r.Method + " " + r.Pattern)
+			span.SetAttributes(slog.String("http.route", r.Pattern))
+		}
+		span.SetAttributes(slog.Int("http.response.status_code", lw.statusCode))
+		if lw.statusCode >= 500 {
+			span.RecordError(fmt.Errorf("%d %s", lw.statusCode, http.StatusText(lw.statusCode)))
+		}
+	})
+}
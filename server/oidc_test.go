@@ -0,0 +1,429 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"DevMaan707/streamer/auth"
+	"DevMaan707/streamer/config"
+	"DevMaan707/streamer/db"
+)
+
+const (
+	testClientID     = "streamer"
+	testClientSecret = "client secret"
+)
+
+// testIdP is an OpenID Connect identity provider on an httptest.Server. Its
+// authorization endpoint logs in the user given to setUser without asking.
+type testIdP struct {
+	*httptest.Server
+	t   *testing.T
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	user  auth.Claims
+	nonce string // replaces the nonce in ID tokens if set
+	codes map[string]authRequest
+}
+
+// authRequest is what the IdP remembers about a code it issued.
+type authRequest struct {
+	redirectURI string
+	nonce       string
+	challenge   string
+	claims      auth.Claims
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &testIdP{t: t, key: key, codes: make(map[string]authRequest)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("/jwks", idp.jwks)
+	mux.HandleFunc("/authorize", idp.authorize)
+	mux.HandleFunc("/token", idp.token)
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+// setUser makes the IdP log in a user with the given claims from now on.
+func (idp *testIdP) setUser(claims auth.Claims) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.user = claims
+}
+
+func (idp *testIdP) setNonce(nonce string) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.nonce = nonce
+}
+
+func (idp *testIdP) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 idp.URL,
+		"authorization_endpoint": idp.URL + "/authorize",
+		"token_endpoint":         idp.URL + "/token",
+		"jwks_uri":               idp.URL + "/jwks",
+	})
+}
+
+func (idp *testIdP) jwks(w http.ResponseWriter, r *http.Request) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": "test-key",
+		"use": "sig",
+		"n":   b64(idp.key.N.Bytes()),
+		"e":   b64(big.NewInt(int64(idp.key.E)).Bytes()),
+	}}})
+}
+
+func (idp *testIdP) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != testClientID || q.Get("response_type") != "code" ||
+		q.Get("code_challenge_method") != "S256" || !strings.Contains(q.Get("scope"), "openid") {
+		idp.t.Errorf("IdP got authorization request %v", q)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	code, err := auth.NewToken()
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	idp.mu.Lock()
+	idp.codes[code] = authRequest{
+		redirectURI: q.Get("redirect_uri"),
+		nonce:       q.Get("nonce"),
+		challenge:   q.Get("code_challenge"),
+		claims:      idp.user,
+	}
+	idp.mu.Unlock()
+
+	callback, _ := url.Parse(q.Get("redirect_uri"))
+	callback.RawQuery = url.Values{"code": {code}, "state": {q.Get("state")}}.Encode()
+	http.Redirect(w, r, callback.String(), http.StatusFound)
+}
+
+func (idp *testIdP) token(w http.ResponseWriter, r *http.Request) {
+	invalidGrant := func(reason string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": reason})
+	}
+	id, secret, _ := r.BasicAuth()
+	if id != testClientID || secret != url.QueryEscape(testClientSecret) {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+		return
+	}
+	if r.PostFormValue("grant_type") != "authorization_code" {
+		invalidGrant("unsupported grant")
+		return
+	}
+	code := r.PostFormValue("code")
+	idp.mu.Lock()
+	req, ok := idp.codes[code]
+	delete(idp.codes, code)
+	nonce := idp.nonce
+	idp.mu.Unlock()
+	if !ok {
+		invalidGrant("unknown code")
+		return
+	}
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != req.challenge {
+		invalidGrant("code verifier doesn't match")
+		return
+	}
+	if r.PostFormValue("redirect_uri") != req.redirectURI {
+		invalidGrant("redirect_uri doesn't match")
+		return
+	}
+
+	if nonce == "" {
+		nonce = req.nonce
+	}
+	now := time.Now()
+	claims := map[string]any{
+		"iss":   idp.URL,
+		"aud":   testClientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+		"nonce": nonce,
+	}
+	for name, value := range req.claims {
+		claims[name] = value
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token":  "access-" + code,
+		"token_type":    "Bearer",
+		"id_token":      idp.sign(claims),
+		"refresh_token": "refresh-" + code,
+	})
+}
+
+// sign returns claims as an RS256 JWT.
+func (idp *testIdP) sign(claims map[string]any) string {
+	b64 := base64.RawURLEncoding.EncodeToString
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test-key", "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	signed := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	return signed + "." + b64(sig)
+}
+
+// newOIDCTestAPI starts a server that uses idp for single sign-on.
+func newOIDCTestAPI(t *testing.T, idp *testIdP, configure func(*config.OIDCConfig)) *testAPI {
+	t.Helper()
+	ts := httptest.NewUnstartedServer(nil)
+	cfg := newTestConfig(t)
+	o := &cfg.Auth.OIDC
+	o.Issuer = idp.URL
+	o.ClientID = testClientID
+	o.ClientSecret = testClientSecret
+	o.RedirectURL = "http://" + ts.Listener.Addr().String() + "/api/auth/oidc/callback"
+	if configure != nil {
+		configure(o)
+	}
+	return startTestAPI(t, ts, cfg)
+}
+
+// follow sends the browser to path on the server and follows redirects,
+// through the IdP and back, until it is sent to a page of the app. It
+// returns that page's URL.
+func (c *testClient) follow(path string) *url.URL {
+	c.t.Helper()
+	var page *url.URL
+	client := *c.http
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if req.URL.Path == "/" || req.URL.Path == "/login.html" {
+			page = req.URL
+			return http.ErrUseLastResponse
+		}
+		return nil
+	}
+	resp, err := client.Get(c.base + path)
+	if err != nil {
+		c.t.Fatalf("GET %s: %v", path, err)
+	}
+	resp.Body.Close()
+	if page == nil {
+		c.t.Fatalf("GET %s ended at %s with %s instead of a page of the app", path, resp.Request.URL, resp.Status)
+	}
+	return page
+}
+
+// step sends the browser to rawURL without following redirects and
+// returns where it is redirected to.
+func (c *testClient) step(rawURL string) *url.URL {
+	c.t.Helper()
+	client := *c.http
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.Get(rawURL)
+	if err != nil {
+		c.t.Fatalf("GET %s: %v", rawURL, err)
+	}
+	resp.Body.Close()
+	location, err := resp.Location()
+	if err != nil {
+		c.t.Fatalf("GET %s: got %s without a redirect", rawURL, resp.Status)
+	}
+	return location
+}
+
+// me returns the logged-in user, or nil without a session.
+func (c *testClient) me() *db.User {
+	c.t.Helper()
+	var me struct {
+		User *db.User `json:"user"`
+	}
+	if status := c.json(http.MethodGet, "/api/auth/me", nil, &me); status != http.StatusOK {
+		return nil
+	}
+	return me.User
+}
+
+func loginError(page *url.URL) string {
+	if page.Path != "/login.html" {
+		return ""
+	}
+	return page.Query().Get("error")
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := newTestIdP(t)
+	api := newOIDCTestAPI(t, idp, func(o *config.OIDCConfig) {
+		o.AutoProvision = true
+		o.RoleMapping = map[string]string{"streamer-editors": "editor", "streamer-admins": "admin"}
+	})
+
+	idp.setUser(auth.Claims{"sub": "u-1", "preferred_username": "Erin", "groups": []string{"staff", "streamer-editors"}})
+	c := api.client(t)
+	if page := c.follow("/api/auth/oidc/login"); page.Path != "/" {
+		t.Fatalf("login ended at %s, error %q", page, loginError(page))
+	}
+	me := c.me()
+	if me == nil || me.Username != "erin" || me.Role != string(auth.RoleEditor) {
+		t.Fatalf("got user %+v, want erin the editor", me)
+	}
+
+	// Roles follow the IdP on every login.
+	idp.setUser(auth.Claims{"sub": "u-1", "preferred_username": "Erin", "groups": []string{"streamer-admins"}})
+	c = api.client(t)
+	if page := c.follow("/api/auth/oidc/login"); page.Path != "/" {
+		t.Fatalf("second login ended at %s, error %q", page, loginError(page))
+	}
+	if me := c.me(); me == nil || me.Username != "erin" || me.Role != string(auth.RoleAdmin) {
+		t.Errorf("got user %+v after the second login, want erin the admin", me)
+	}
+
+	// A user of the same name who isn't linked gets no access to erin.
+	idp.setUser(auth.Claims{"sub": "u-2", "preferred_username": "erin"})
+	c = api.client(t)
+	if page := c.follow("/api/auth/oidc/login"); !strings.Contains(loginError(page), "exists already") {
+		t.Errorf("login as another erin ended at %s, want a conflict", page)
+	}
+	if c.me() != nil {
+		t.Error("a refused login started a session")
+	}
+}
+
+func TestOIDCStateAndNonce(t *testing.T) {
+	idp := newTestIdP(t)
+	api := newOIDCTestAPI(t, idp, func(o *config.OIDCConfig) { o.AutoProvision = true })
+	idp.setUser(auth.Claims{"sub": "u-1", "preferred_username": "erin"})
+
+	// begin starts a login and returns the callback URL the IdP sends the
+	// browser back to.
+	begin := func(c *testClient) *url.URL {
+		t.Helper()
+		authorize := c.step(c.base + "/api/auth/oidc/login")
+		if !strings.HasPrefix(authorize.String(), idp.URL+"/authorize?") {
+			t.Fatalf("login redirected to %s, want the IdP", authorize)
+		}
+		return c.step(authorize.String())
+	}
+
+	t.Run("state mismatch", func(t *testing.T) {
+		c := api.client(t)
+		callback := begin(c)
+		q := callback.Query()
+		q.Set("state", "forged")
+		callback.RawQuery = q.Encode()
+		if page := c.step(callback.String()); !strings.Contains(loginError(page), "login expired") {
+			t.Errorf("callback with another state ended at %s", page)
+		}
+		if c.me() != nil {
+			t.Error("a callback with another state started a session")
+		}
+	})
+
+	t.Run("other browser", func(t *testing.T) {
+		callback := begin(api.client(t))
+		// The callback reaches a browser that didn't start the login, as
+		// in login CSRF.
+		c := api.client(t)
+		if page := c.step(callback.String()); !strings.Contains(loginError(page), "login expired") {
+			t.Errorf("callback in another browser ended at %s", page)
+		}
+		if c.me() != nil {
+			t.Error("a callback in another browser started a session")
+		}
+	})
+
+	t.Run("nonce mismatch", func(t *testing.T) {
+		idp.setNonce("replayed")
+		defer idp.setNonce("")
+		c := api.client(t)
+		if page := c.follow("/api/auth/oidc/login"); loginError(page) == "" {
+			t.Errorf("login with an ID token for another nonce ended at %s", page)
+		}
+		if c.me() != nil {
+			t.Error("an ID token for another nonce started a session")
+		}
+	})
+
+	t.Run("replayed callback", func(t *testing.T) {
+		c := api.client(t)
+		callback := begin(c)
+		if page := c.step(callback.String()); page.Path != "/" {
+			t.Fatalf("callback ended at %s, error %q", page, loginError(page))
+		}
+		if c.me() == nil {
+			t.Fatal("no session after logging in")
+		}
+		// The login state is used up, and so is the code.
+		if page := c.step(callback.String()); loginError(page) == "" {
+			t.Errorf("replayed callback ended at %s", page)
+		}
+	})
+}
+
+func TestOIDCLinking(t *testing.T) {
+	idp := newTestIdP(t)
+	api := newOIDCTestAPI(t, idp, nil)
+	idp.setUser(auth.Claims{"sub": "u-1", "preferred_username": "frank"})
+
+	// Without auto-provisioning, an unlinked account can't log in.
+	c := api.client(t)
+	if page := c.follow("/api/auth/oidc/login"); !strings.Contains(loginError(page), "no account is linked") {
+		t.Errorf("login of an unlinked account ended at %s", page)
+	}
+	if status, _ := c.get("/api/auth/oidc/login?link=1"); status != http.StatusUnauthorized {
+		t.Errorf("linking without a session: got %d, want 401", status)
+	}
+
+	frank := api.user(t, "frank", auth.RoleUploader)
+	if page := frank.follow("/api/auth/oidc/login?link=1"); page.Path != "/" {
+		t.Fatalf("linking ended at %s, error %q", page, loginError(page))
+	}
+	c = api.client(t)
+	if page := c.follow("/api/auth/oidc/login"); page.Path != "/" {
+		t.Fatalf("login after linking ended at %s, error %q", page, loginError(page))
+	}
+	if me := c.me(); me == nil || me.Username != "frank" || me.Role != string(auth.RoleUploader) {
+		t.Errorf("got user %+v, want frank the uploader", me)
+	}
+
+	// One provider account can't be linked to two accounts.
+	grace := api.user(t, "grace", auth.RoleViewer)
+	if page := grace.follow("/api/auth/oidc/login?link=1"); !strings.Contains(loginError(page), "linked to an account already") {
+		t.Errorf("linking a linked account ended at %s", page)
+	}
+	user, err := api.store.GetUserByIdentity(context.Background(), idp.URL, "u-1")
+	if err != nil || user.Username != "frank" {
+		t.Errorf("identity is linked to %+v, %v; want frank", user, err)
+	}
+	if _, err := api.store.GetUserByIdentity(context.Background(), idp.URL, "u-2"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("GetUserByIdentity of an unknown subject: got %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+
+	"DevMaan707/streamer/config"
+	"DevMaan707/streamer/utils"
+)
+
+// proxyTrust decides which peers are trusted reverse proxies and resolves
+// the real client address from their forwarding headers.
+type proxyTrust struct {
+	prefixes []netip.Prefix
+}
+
+func newProxyTrust(cfg *config.Config) (*proxyTrust, error) {
+	t := &proxyTrust{}
+	for _, proxy := range cfg.TrustedProxies {
+		p, err := config.ParseIPPrefix(proxy)
+		if err != nil {
+			return nil, err
+		}
+		t.prefixes = append(t.prefixes, p)
+	}
+	if cfg.TrustedProxiesFile != "" {
+		prefixes, err := readPrefixFile(cfg.TrustedProxiesFile)
+		if err != nil {
+			return nil, err
+		}
+		t.prefixes = append(t.prefixes, prefixes...)
+	}
+	return t, nil
+}
+
+func readPrefixFile(path string) ([]netip.Prefix, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open trusted proxies file: %w", err)
+	}
+	defer f.Close()
+
+	var prefixes []netip.Prefix
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p, err := config.ParseIPPrefix(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, lineNo, err)
+		}
+		prefixes = append(prefixes, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read trusted proxies file: %w", err)
+	}
+	return prefixes, nil
+}
+
+func (t *proxyTrust) trusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range t.prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client that made r. Forwarding
+// headers are only consulted when the direct peer is a trusted proxy, in
+// this order: CF-Connecting-IP, X-Forwarded-For, Forwarded. Peers on a unix
+// socket are local proxies and always trusted.
+func (t *proxyTrust) clientIP(r *http.Request) string {
+	peer, ok := parseHostAddr(r.RemoteAddr)
+	if ok && !t.trusted(peer) {
+		return peer.String()
+	}
+
+	if ip, ok := parseHostAddr(r.Header.Get("CF-Connecting-IP")); ok {
+		return ip.String()
+	}
+	if hops := r.Header.Values("X-Forwarded-For"); len(hops) > 0 {
+		if ip, ok := t.firstUntrusted(splitHeaderList(hops, parseHostAddr)); ok {
+			return ip.String()
+		}
+	}
+	if forwarded := r.Header.Values("Forwarded"); len(forwarded) > 0 {
+		if ip, ok := t.firstUntrusted(splitHeaderList(forwarded, parseForwardedFor)); ok {
+			return ip.String()
+		}
+	}
+
+	if ok {
+		return peer.String()
+	}
+	return r.RemoteAddr
+}
+
+// firstUntrusted walks a forwarding chain from the closest hop backwards and
+// returns the first address that is not a trusted proxy. Everything before
+// that hop could have been forged by the client.
+func (t *proxyTrust) firstUntrusted(chain []netip.Addr) (netip.Addr, bool) {
+	for i := len(chain) - 1; i >= 0; i-- {
+		if !t.trusted(chain[i]) {
+			return chain[i], true
+		}
+	}
+	if len(chain) > 0 {
+		return chain[0], true
+	}
+	return netip.Addr{}, false
+}
+
+// splitHeaderList parses the comma-separated elements of a header that may
+// appear several times. Elements that can't be parsed end the chain, since
+// nothing before them can be attributed reliably.
+func splitHeaderList(values []string, parse func(string) (netip.Addr, bool)) []netip.Addr {
+	var chain []netip.Addr
+	for _, v := range values {
+		for _, elem := range strings.Split(v, ",") {
+			addr, ok := parse(strings.TrimSpace(elem))
+			if !ok {
+				chain = nil
+				continue
+			}
+			chain = append(chain, addr)
+		}
+	}
+	return chain
+}
+
+// parseForwardedFor extracts the for= address of one Forwarded element
+// (RFC 7239), e.g. for="[2001:db8::1]:4711";proto=https.
+func parseForwardedFor(elem string) (netip.Addr, bool) {
+	for _, pair := range strings.Split(elem, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || !strings.EqualFold(key, "for") {
+			continue
+		}
+		return parseHostAddr(strings.Trim(value, `"`))
+	}
+	return netip.Addr{}, false
+}
+
+// parseHostAddr parses an IP address with an optional port, with or
+// without IPv6 brackets.
+func parseHostAddr(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return netip.Addr{}, false
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	addr, err := netip.ParseAddr(strings.Trim(s, "[]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// ClientIPMiddleware resolves the client address through the trusted
+// proxies returned by trust and stores it in the request context, where
+// utils.ClientIP finds it.
+func ClientIPMiddleware(trust func() *proxyTrust) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := trust().clientIP(r)
+			next.ServeHTTP(w, r.WithContext(utils.WithClientIP(r.Context(), ip)))
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"DevMaan707/streamer/api"
+	"DevMaan707/streamer/config"
+	"DevMaan707/streamer/db"
+	"DevMaan707/streamer/metrics"
+	"DevMaan707/streamer/services"
+	"DevMaan707/streamer/utils"
+)
+
+var rateLimited = metrics.Default.Counter("starflix_rate_limited_total",
+	"Requests refused by the rate limiter, by route class.", "class")
+
+// The classes of routes that are rate limited, each with its own limit.
+const (
+	rateClassAuth    = "auth"
+	rateClassUpload  = "upload"
+	rateClassListing = "listing"
+	rateClassStream  = "stream"
+)
+
+// rateLimitClass returns the class of routes r belongs to, or "" if r
+// isn't rate limited. Device token polls aren't limited here, as the
+// device flow makes devices slow down itself.
+func rateLimitClass(r *http.Request) string {
+	path := r.URL.Path
+	switch {
+	case path == "/api/auth/login", path == "/api/auth/register",
+		strings.HasPrefix(path, "/api/auth/oidc/"), path == "/api/device/code":
+		return rateClassAuth
+	case path == "/api/upload":
+		return rateClassUpload
+	case strings.HasPrefix(path, "/api/shared/"):
+		_, action, _ := strings.Cut(strings.TrimPrefix(path, "/api/shared/"), "/")
+		if action == "unlock" {
+			return rateClassAuth
+		}
+		if action == "video" && services.StartsPlay(r) {
+			return rateClassStream
+		}
+	case strings.HasPrefix(path, "/videos/"):
+		if services.StartsPlay(r) {
+			return rateClassStream
+		}
+	case r.Method == http.MethodGet && (path == "/api/videos" || strings.HasPrefix(path, "/api/videos/") || path == "/api/genres"):
+		return rateClassListing
+	}
+	return ""
+}
+
+func classLimit(cfg *config.RateLimitConfig, class string) config.Limit {
+	switch class {
+	case rateClassAuth:
+		return cfg.Auth
+	case rateClassUpload:
+		return cfg.Upload
+	case rateClassListing:
+		return cfg.Listing
+	case rateClassStream:
+		return cfg.Stream
+	}
+	return config.Limit{}
+}
+
+// rateSweepInterval is how often expired request counts are deleted.
+const rateSweepInterval = time.Minute
+
+// rateLimiter counts requests in fixed windows, in memory or in the
+// database.
+type rateLimiter struct {
+	counter db.RateLimitRepository
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+func newRateLimiter(counter db.RateLimitRepository) *rateLimiter {
+	return &rateLimiter{counter: counter, lastSweep: time.Now()}
+}
+
+// hit counts a request against bucket and returns how many requests the
+// bucket has made in the current window, and when the window ends.
+func (l *rateLimiter) hit(ctx context.Context, bucket string, window time.Duration, now time.Time) (int, time.Time, error) {
+	l.mu.Lock()
+	sweep := now.Sub(l.lastSweep) >= rateSweepInterval
+	if sweep {
+		l.lastSweep = now
+	}
+	l.mu.Unlock()
+	if sweep {
+		if err := l.counter.DeleteExpiredRateLimits(ctx, now); err != nil {
+			slog.WarnContext(ctx, "Failed to delete expired rate limits", "error", err)
+		}
+	}
+
+	start := now.Truncate(window)
+	end := start.Add(window)
+	hits, err := l.counter.HitRateLimit(ctx, bucket, start, end)
+	return hits, end, err
+}
+
+// RateLimitMiddleware limits how often each client may call the routes of
+// each class, using the limits cfg returns so they can be reloaded.
+// Clients sending valid credentials are counted by account and others by
+// IP address; the request is passed on authenticated, so RequireAuth
+// doesn't look the credentials up again. Limited responses carry
+// RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers, and
+// requests over the limit are refused with 429 and Retry-After. If the
+// counts can't be read, requests are let through.
+func RateLimitMiddleware(limiter *rateLimiter, authSvc *services.AuthService, cfg func() *config.RateLimitConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rl := cfg()
+			class := rateLimitClass(r)
+			limit := classLimit(rl, class)
+			if !rl.Enabled || limit.Requests == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			key := "ip:" + utils.ClientIP(r.Context())
+			if authed, err := api.Authenticate(authSvc, r); err == nil {
+				r = authed
+				key = "user:" + strconv.Itoa(services.CurrentUser(r.Context()).ID)
+			}
+
+			now := time.Now()
+			hits, reset, err := limiter.hit(r.Context(), class+":"+key, limit.Window, now)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Failed to count request for rate limiting", "error", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+			resetSeconds := strconv.Itoa(int(math.Ceil(reset.Sub(now).Seconds())))
+			h := w.Header()
+			h.Set("RateLimit-Limit", strconv.Itoa(limit.Requests))
+			h.Set("RateLimit-Remaining", strconv.Itoa(max(limit.Requests-hits, 0)))
+			h.Set("RateLimit-Reset", resetSeconds)
+			h.Set("RateLimit-Policy", strconv.Itoa(limit.Requests)+";w="+strconv.Itoa(int(limit.Window.Seconds())))
+			if hits > limit.Requests {
+				rateLimited.With(class).Inc()
+				slog.WarnContext(r.Context(), "Rate limit exceeded", "class", class, "client", key)
+				h.Set("Retry-After", resetSeconds)
+				api.WriteError(w, http.StatusTooManyRequests, "Too many requests, try again later")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// memoryRateCounter keeps request counts for a single instance.
+type memoryRateCounter struct {
+	mu     sync.Mutex
+	counts map[memoryRateWindow]memoryRateCount
+}
+
+type memoryRateWindow struct {
+	bucket string
+	start  int64
+}
+
+type memoryRateCount struct {
+	hits      int
+	expiresAt time.Time
+}
+
+func newMemoryRateCounter() *memoryRateCounter {
+	return &memoryRateCounter{counts: make(map[memoryRateWindow]memoryRateCount)}
+}
+
+func (c *memoryRateCounter) HitRateLimit(_ context.Context, bucket string, windowStart, expiresAt time.Time) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := memoryRateWindow{bucket: bucket, start: windowStart.UnixNano()}
+	count := c.counts[w]
+	count.hits++
+	count.expiresAt = expiresAt
+	c.counts[w] = count
+	return count.hits, nil
+}
+
+func (c *memoryRateCounter) DeleteExpiredRateLimits(_ context.Context, now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for w, count := range c.counts {
+		if count.expiresAt.Before(now) {
+			delete(c.counts, w)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+
+	"DevMaan707/streamer/config"
+	"DevMaan707/streamer/logging"
+)
+
+// restartOnly lists the settings that are read once at startup. A reload
+// that changes any of them is rejected as a whole.
+var restartOnly = []struct {
+	name string
+	get  func(c *config.Config) interface{}
+}{
+	{"port", func(c *config.Config) interface{} { return c.Port }},
+	{"video_dir", func(c *config.Config) interface{} { return c.VideoDir }},
+	{"cover_dir", func(c *config.Config) interface{} { return c.CoverImageDir }},
+	{"listeners", func(c *config.Config) interface{} { return c.EffectiveListeners() }},
+	{"tls", func(c *config.Config) interface{} { return c.TLS }},
+	{"encryption_key_file", func(c *config.Config) interface{} { return c.EncryptionKeyFile }},
+	{"database", func(c *config.Config) interface{} { return c.Database }},
+	{"auth", func(c *config.Config) interface{} { return c.Auth }},
+	{"rate_limit.store", func(c *config.Config) interface{} { return c.RateLimit.Store }},
+	{"tracing", func(c *config.Config) interface{} { return c.Tracing }},
+	{"log.format", func(c *config.Config) interface{} { return c.Log.Format }},
+	{"log.access_log", func(c *config.Config) interface{} {
+		return [3]interface{}{c.Log.AccessLog, c.Log.AccessLogMaxMB, c.Log.AccessLogMaxBackups}
+	}},
+}
+
+// Reload swaps in a new configuration. Only the reloadable settings
+// (upload limit, CORS origins, rate limits) take effect, and the
+// encryption and URL signing keys are re-read; requests already in
+// flight, including active streams, keep running untouched. Renewed TLS
+// certificates need no reload; they are picked up from disk automatically.
+func (s *Server) Reload(next *config.Config) error {
+	current := s.Config()
+	var changed []string
+	for _, setting := range restartOnly {
+		if !reflect.DeepEqual(setting.get(current), setting.get(next)) {
+			changed = append(changed, setting.name)
+		}
+	}
+	if len(changed) > 0 {
+		return fmt.Errorf("changing %v requires a restart", changed)
+	}
+
+	trust, err := newProxyTrust(next)
+	if err != nil {
+		return fmt.Errorf("failed to load trusted proxies: %w", err)
+	}
+
+	// Both key files are read before either is used, so a bad one leaves
+	// the other's keys unchanged too.
+	swapURLKeys, swapKeyring := func() {}, func() {}
+	if s.urlKeys != nil {
+		// Picks up a key added by rotate-signing-key, so new URLs are
+		// signed with it.
+		if swapURLKeys, err = s.urlKeys.Stage(); err != nil {
+			return fmt.Errorf("failed to reload URL signing keys: %w", err)
+		}
+	}
+	if s.keyring != nil {
+		// Picks up a key added by rotate-key: new uploads are encrypted
+		// with it, and existing files re-encrypted in the background.
+		if swapKeyring, err = s.keyring.Stage(); err != nil {
+			return fmt.Errorf("failed to reload encryption keys: %w", err)
+		}
+	}
+	swapURLKeys()
+	swapKeyring()
+	if s.keyring != nil {
+		s.reencryptor.Wake()
+	}
+
+	s.uploadSvc.SetMaxUploadSize(next.MaxUploadSizeBytes())
+	s.trust.Store(trust)
+	logging.SetLevel(next.Log.Level)
+	s.cfg.Store(next)
+	return nil
+}
+
+// ReloadOnSignal reloads the configuration with load every time the process
+// receives SIGHUP, until ctx is cancelled. It blocks, so run it in its own
+// goroutine.
+func (s *Server) ReloadOnSignal(ctx context.Context, load func() (*config.Config, error)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+		slog.Info("Received SIGHUP, reloading configuration")
+		next, err := load()
+		if err != nil {
+			slog.Error("Configuration reload failed, keeping current settings", "error", err)
+			continue
+		}
+		if err := s.Reload(next); err != nil {
+			slog.Error("Configuration reload rejected, keeping current settings", "error", err)
+			continue
+		}
+		slog.Info("Configuration reloaded",
+			"max_upload_mb", next.MaxUploadSize,
+			"cors_origins", next.CORSOrigins,
+			"log_level", next.Log.Level)
+	}
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"DevMaan707/streamer/db"
+	"DevMaan707/streamer/vault"
+)
+
+// TestReloadKeepsKeysOnError checks that a bad encryption key file leaves
+// the URL signing keys unchanged too, though they are read first.
+func TestReloadKeepsKeysOnError(t *testing.T) {
+	cfg := newTestConfig(t)
+	dir := t.TempDir()
+	cfg.EncryptionKeyFile = filepath.Join(dir, "keys")
+	cfg.Auth.URLSigningKeyFile = filepath.Join(dir, "url-keys")
+	for _, path := range []string{cfg.EncryptionKeyFile, cfg.Auth.URLSigningKeyFile} {
+		if err := vault.CreateKeyFile(path); err != nil {
+			t.Fatalf("CreateKeyFile: %v", err)
+		}
+	}
+	srv, err := NewServer(cfg, db.NewMemoryStore())
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	// What rotate-signing-key does, from another process.
+	urlKeys, err := vault.LoadKeyring(cfg.Auth.URLSigningKeyFile)
+	if err != nil {
+		t.Fatalf("LoadKeyring: %v", err)
+	}
+	rotated, err := urlKeys.Rotate()
+	if err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	if err := os.WriteFile(cfg.EncryptionKeyFile, []byte("not a key\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := srv.Reload(cfg); err == nil {
+		t.Fatal("Reload succeeded with a bad encryption key file")
+	}
+	if id := srv.urlKeys.ActiveID(); id == rotated {
+		t.Errorf("URL signing key %d was swapped in by a failed reload", id)
+	}
+
+	if err := vault.CreateKeyFile(cfg.EncryptionKeyFile + ".new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(cfg.EncryptionKeyFile+".new", cfg.EncryptionKeyFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Reload(cfg); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if id := srv.urlKeys.ActiveID(); id != rotated {
+		t.Errorf("got URL signing key %d after reloading, want %d", id, rotated)
+	}
+}
@@ -1,60 +1,374 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"embed"
 	"fmt"
+	"io"
 	"io/fs"
+	"log/slog"
+	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"DevMaan707/streamer/api"
+	"DevMaan707/streamer/auth"
 	"DevMaan707/streamer/config"
+	"DevMaan707/streamer/db"
+	"DevMaan707/streamer/logging"
 	"DevMaan707/streamer/services"
+	"DevMaan707/streamer/vault"
 )
 
 //go:embed static/*
 var staticFiles embed.FS
 
 type Server struct {
-	cfg       *config.Config
+	// cfg is swapped atomically on reload; read it through Config.
+	cfg       atomic.Pointer[config.Config]
+	trust     atomic.Pointer[proxyTrust]
 	videoSvc  *services.VideoService
 	uploadSvc *services.UploadService
+	shareSvc  *services.ShareService
+	groupSvc  *services.GroupService
+	authSvc   *services.AuthService
+	// oidcSvc is nil unless single sign-on is configured.
+	oidcSvc *services.OIDCService
+	// keyring and reencryptor are nil unless encryption at rest is
+	// enabled.
+	keyring     *vault.Keyring
+	reencryptor *vault.Reencryptor
+	// urlKeys is nil unless signed URLs are enabled.
+	urlKeys *vault.Keyring
+	limiter *rateLimiter
+	// accessLog is nil unless an access log file is configured.
+	accessLog io.WriteCloser
+	started   time.Time
 }
 
-func NewServer(cfg *config.Config) (*Server, error) {
-	videoSvc, err := services.NewVideoService(cfg.VideoDir, cfg.CoverImageDir)
+// NewServer wires the services on top of the given store. Passing a
+// db.MemoryStore runs the whole API without a database. If there are no
+// user accounts yet an initial admin is created.
+func NewServer(cfg *config.Config, store db.Store) (*Server, error) {
+	var keyring *vault.Keyring
+	if cfg.EncryptionKeyFile != "" {
+		var err error
+		keyring, err = vault.LoadKeyring(cfg.EncryptionKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load encryption keys: %w", err)
+		}
+	}
+
+	var urlKeys *vault.Keyring
+	var signer *auth.URLSigner
+	if cfg.Auth.URLSigningKeyFile != "" {
+		var err error
+		urlKeys, err = vault.LoadKeyring(cfg.Auth.URLSigningKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load URL signing keys: %w", err)
+		}
+		signer = auth.NewURLSigner(urlKeys)
+	}
+
+	trust, err := newProxyTrust(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load trusted proxies: %w", err)
+	}
+
+	var counter db.RateLimitRepository = newMemoryRateCounter()
+	if cfg.RateLimit.Store == "postgres" {
+		repo, ok := store.(db.RateLimitRepository)
+		if !ok {
+			return nil, fmt.Errorf("rate limits can only be shared through a database store")
+		}
+		counter = repo
+	}
+
+	groupSvc := services.NewGroupService(store, store)
+	videoSvc, err := services.NewVideoService(store, store, groupSvc, cfg.VideoDir, cfg.CoverImageDir, keyring, signer, cfg.Auth.SignedURLTTL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create video service: %w", err)
 	}
 
-	uploadSvc := services.NewUploadService(cfg.VideoDir, cfg.CoverImageDir, cfg.MaxUploadSizeBytes())
+	uploadSvc := services.NewUploadService(store, groupSvc, cfg.VideoDir, cfg.CoverImageDir, cfg.MaxUploadSizeBytes(), keyring)
+
+	authSvc := services.NewAuthService(store, store, store, cfg.Auth.SessionTTL, cfg.Auth.InviteTTL, services.LockoutPolicy{
+		Attempts:   cfg.Auth.LockoutAttempts,
+		IPAttempts: cfg.Auth.IPLockoutAttempts,
+		Duration:   cfg.Auth.LockoutDuration,
+	})
+	if err := authSvc.EnsureInitialAdmin(context.Background()); err != nil {
+		return nil, err
+	}
 
-	return &Server{
-		cfg:       cfg,
+	var oidcSvc *services.OIDCService
+	if cfg.Auth.OIDC.Enabled() {
+		if oidcSvc, err = services.NewOIDCService(authSvc, cfg.Auth.OIDC); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &Server{
 		videoSvc:  videoSvc,
 		uploadSvc: uploadSvc,
-	}, nil
+		shareSvc:  services.NewShareService(store, videoSvc),
+		groupSvc:  groupSvc,
+		authSvc:   authSvc,
+		oidcSvc:   oidcSvc,
+		keyring:   keyring,
+		urlKeys:   urlKeys,
+		limiter:   newRateLimiter(counter),
+		started:   time.Now(),
+	}
+	if keyring != nil {
+		s.reencryptor = vault.NewReencryptor(keyring, cfg.VideoDir, cfg.CoverImageDir)
+	}
+	if cfg.Log.AccessLog != "" {
+		accessLog, err := logging.OpenRotatingFile(cfg.Log.AccessLog, int64(cfg.Log.AccessLogMaxMB)<<20, cfg.Log.AccessLogMaxBackups)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open access log: %w", err)
+		}
+		s.accessLog = accessLog
+	}
+	s.cfg.Store(cfg)
+	s.trust.Store(trust)
+	return s, nil
+}
+
+// Config returns the configuration currently in effect.
+func (s *Server) Config() *config.Config {
+	return s.cfg.Load()
 }
 
-func (s *Server) Start() error {
+// Handler returns the public HTTP handler, routes and middleware included,
+// so it can also be mounted on an httptest.Server.
+func (s *Server) Handler() (http.Handler, error) {
+	return s.RoutesHandler("public")
+}
+
+// RoutesHandler returns the handler for a listener route set: "public" for
+// the site and API, "admin" for the operator endpoints, or "all".
+func (s *Server) RoutesHandler(routes string) (http.Handler, error) {
 	mux := http.NewServeMux()
-	api.RegisterRoutes(mux, s.videoSvc, s.uploadSvc)
-	staticFS, err := fs.Sub(staticFiles, "static")
-	if err != nil {
-		return fmt.Errorf("failed to load static files: %w", err)
+	if routes == "public" || routes == "all" {
+		api.RegisterRoutes(mux, s.videoSvc, s.uploadSvc, s.shareSvc, s.groupSvc, s.authSvc, s.oidcSvc, s.Config().Auth.SecureCookies)
+		staticFS, err := fs.Sub(staticFiles, "static")
+		if err != nil {
+			return nil, fmt.Errorf("failed to load static files: %w", err)
+		}
+		mux.Handle("/", http.FileServer(http.FS(staticFS)))
+		mux.HandleFunc("/link", func(w http.ResponseWriter, r *http.Request) {
+			http.ServeFileFS(w, r, staticFS, "link.html")
+		})
+		mux.HandleFunc("/s/", func(w http.ResponseWriter, r *http.Request) {
+			http.ServeFileFS(w, r, staticFS, "share.html")
+		})
+		mux.HandleFunc("/api/admin/status", s.requireAdmin(s.statusHandler))
+	}
+	if routes == "admin" || routes == "all" {
+		s.registerAdminRoutes(mux)
 	}
-	mux.Handle("/", http.FileServer(http.FS(staticFS)))
+	s.registerHealthRoutes(mux)
 	handler := CloudflareMiddleware(mux)
 	handler = ErrorLoggingMiddleware(handler)
-	handler = LoggingMiddleware(handler)
-	handler = CORSMiddleware(handler)
-	server := &http.Server{
-		Addr:         fmt.Sprintf(":%d", s.cfg.Port),
-		Handler:      handler,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 30 * time.Minute,
-		IdleTimeout:  120 * time.Second,
+	handler = MetricsMiddleware(handler)
+	var accessLog io.Writer
+	if s.accessLog != nil {
+		accessLog = s.accessLog
 	}
+	handler = RateLimitMiddleware(s.limiter, s.authSvc, func() *config.RateLimitConfig { return &s.Config().RateLimit })(handler)
+	handler = LoggingMiddleware(accessLog)(handler)
+	handler = TracingMiddleware(handler)
+	handler = ClientIPMiddleware(s.trust.Load)(handler)
+	handler = RequestIDMiddleware(handler)
+	handler = CORSMiddleware(func() []string { return s.Config().CORSOrigins })(handler)
+	return handler, nil
+}
+
+// listener is one socket the server accepts connections on, with the
+// handler serving it and, for HTTPS, its TLS configuration.
+type listener struct {
+	ln      net.Listener
+	handler http.Handler
+	tls     *tls.Config
+}
 
-	return server.ListenAndServe()
+// Run opens the configured listeners, plus the HTTP-to-HTTPS redirect port
+// when set, and serves until ctx is cancelled, then shuts down gracefully;
+// see Serve.
+func (s *Server) Run(ctx context.Context) error {
+	cfg := s.Config()
+	inherited, err := systemdListeners()
+	if err != nil {
+		return err
+	}
+
+	var tlsCfg *tls.Config
+	if cfg.TLS.Enabled() {
+		if tlsCfg, err = newTLSConfig(cfg.TLS); err != nil {
+			return err
+		}
+	}
+
+	var listeners []listener
+	closeAll := func() {
+		for _, l := range listeners {
+			l.ln.Close()
+		}
+	}
+	for _, lc := range cfg.EffectiveListeners() {
+		handler, err := s.RoutesHandler(lc.Routes)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		ln, addr, err := openListener(lc, inherited)
+		if err != nil {
+			closeAll()
+			return fmt.Errorf("failed to listen on %s: %w", lc.Address, err)
+		}
+		l := listener{ln: ln, handler: handler}
+		if addr.TLS {
+			l.tls = tlsCfg
+		}
+		listeners = append(listeners, l)
+		slog.Info("Listening", "address", lc.Address, "routes", lc.Routes)
+	}
+
+	if cfg.TLS.RedirectPort != 0 {
+		ln, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.TLS.RedirectPort))
+		if err != nil {
+			closeAll()
+			return err
+		}
+		listeners = append(listeners, listener{ln: ln, handler: httpsRedirectHandler(cfg.Port)})
+	}
+
+	return s.serve(ctx, listeners)
+}
+
+// Serve serves plain HTTP on ln until ctx is cancelled. It then stops
+// accepting connections and lets in-flight requests, streams and uploads
+// included, finish for up to the configured shutdown timeout. Requests still
+// running after that have their contexts cancelled, which makes uploads
+// remove their partial files, and their connections closed.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	handler, err := s.Handler()
+	if err != nil {
+		ln.Close()
+		return err
+	}
+	return s.serve(ctx, []listener{{ln: ln, handler: handler}})
+}
+
+func (s *Server) serve(ctx context.Context, listeners []listener) error {
+	// Re-encryption stops when shutdown begins, and serve waits for it so
+	// no temporary files are left behind.
+	reencryptCtx, stopReencrypting := context.WithCancel(ctx)
+	defer stopReencrypting()
+	reencrypted := make(chan struct{})
+	if s.reencryptor != nil {
+		// Finishes re-encrypting files left on older keys, e.g. by a
+		// rotation while the server was stopped.
+		go func() {
+			defer close(reencrypted)
+			s.reencryptor.Run(reencryptCtx)
+		}()
+	} else {
+		close(reencrypted)
+	}
+
+	var inflight sync.WaitGroup
+	requestCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
+	servers := make([]*http.Server, len(listeners))
+	serveErr := make(chan error, len(listeners))
+	for i, l := range listeners {
+		handler := l.handler
+		servers[i] = &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				inflight.Add(1)
+				defer inflight.Done()
+				handler.ServeHTTP(w, r)
+			}),
+			TLSConfig:    l.tls,
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 30 * time.Minute,
+			IdleTimeout:  120 * time.Second,
+			BaseContext:  func(net.Listener) context.Context { return requestCtx },
+			ErrorLog:     slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+		}
+		go func(srv *http.Server, l listener) {
+			if l.tls != nil {
+				// The certificate comes from TLSConfig.GetCertificate.
+				serveErr <- srv.ServeTLS(l.ln, "", "")
+			} else {
+				serveErr <- srv.Serve(l.ln)
+			}
+		}(servers[i], l)
+	}
+
+	var runErr error
+	select {
+	case runErr = <-serveErr:
+	case <-ctx.Done():
+	}
+
+	stopReencrypting()
+	timeout := s.Config().ShutdownTimeout
+	slog.Info("Shutting down, waiting for in-flight requests", "timeout", timeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var timedOut atomic.Bool
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				timedOut.Store(true)
+			}
+		}(srv)
+	}
+	wg.Wait()
+
+	if timedOut.Load() {
+		slog.Warn("Shutdown timeout reached, cancelling remaining requests")
+		cancelRequests()
+		for _, srv := range servers {
+			srv.Close()
+		}
+		if !waitTimeout(&inflight, cleanupGracePeriod) {
+			slog.Warn("Some requests did not finish cleaning up")
+		}
+	}
+	<-reencrypted
+	if s.accessLog != nil {
+		s.accessLog.Close()
+	}
+	slog.Info("Server stopped")
+	return runErr
+}
+
+// cleanupGracePeriod is how long cancelled requests get to clean up after
+// the shutdown timeout has passed.
+const cleanupGracePeriod = 5 * time.Second
+
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
 }
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"DevMaan707/streamer/auth"
+	"DevMaan707/streamer/db"
+	"DevMaan707/streamer/vault"
+)
+
+// startServing runs s.serve with handler on a new local listener and
+// returns the listener's URL, a function that cancels the server's context
+// and a channel serve's result is sent on.
+func startServing(t *testing.T, s *Server, handler http.Handler) (string, context.CancelFunc, <-chan error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	done := make(chan error, 1)
+	go func() { done <- s.serve(ctx, []listener{{ln: ln, handler: handler}}) }()
+	return "http://" + ln.Addr().String(), cancel, done
+}
+
+func waitServe(t *testing.T, done <-chan error, timeout time.Duration) {
+	t.Helper()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("serve: %v", err)
+		}
+	case <-time.After(timeout):
+		t.Fatalf("serve didn't return within %v", timeout)
+	}
+}
+
+func TestShutdownDrainsInflightRequests(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.ShutdownTimeout = 5 * time.Second
+	api := newTestAPIWithConfig(t, cfg)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	cancelled := make(chan bool, 1)
+	url, stop, done := startServing(t, api.srv, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		cancelled <- r.Context().Err() != nil
+		io.WriteString(w, "finished")
+	}))
+
+	type result struct {
+		body []byte
+		err  error
+	}
+	res := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			res <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		res <- result{body, err}
+	}()
+
+	<-started
+	stop()
+	// Shutdown waits for the request instead of returning.
+	select {
+	case <-done:
+		t.Fatal("serve returned while a request was in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := http.Get(url); err == nil {
+		t.Error("a new connection was accepted while shutting down")
+	}
+
+	close(release)
+	waitServe(t, done, time.Second)
+	if r := <-res; r.err != nil || string(r.body) != "finished" {
+		t.Errorf("in-flight request: got %q, %v; want it to finish", r.body, r.err)
+	}
+	if <-cancelled {
+		t.Error("the in-flight request's context was cancelled before the timeout")
+	}
+}
+
+func TestShutdownTimeoutCancelsRequests(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.ShutdownTimeout = 100 * time.Millisecond
+	api := newTestAPIWithConfig(t, cfg)
+
+	started := make(chan struct{})
+	cleanedUp := make(chan struct{})
+	url, stop, done := startServing(t, api.srv, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		// Like a stream that would run for a long time.
+		<-r.Context().Done()
+		close(cleanedUp)
+	}))
+
+	go func() {
+		if resp, err := http.Get(url); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+	begin := time.Now()
+	stop()
+	waitServe(t, done, cleanupGracePeriod)
+	select {
+	case <-cleanedUp:
+	default:
+		t.Fatal("the request's context wasn't cancelled at the shutdown timeout")
+	}
+	if elapsed := time.Since(begin); elapsed < cfg.ShutdownTimeout {
+		t.Errorf("serve returned after %v, before the shutdown timeout", elapsed)
+	}
+}
+
+// TestShutdownRemovesCancelledUploads checks that an upload still running
+// at the shutdown timeout leaves no files and no video behind.
+func TestShutdownRemovesCancelledUploads(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.ShutdownTimeout = 100 * time.Millisecond
+	api := newTestAPIWithConfig(t, cfg)
+	// Logs in; the cookie is sent to the serving listener too, as cookies
+	// don't depend on the port.
+	c := api.user(t, "bob", auth.RoleUploader)
+
+	handler, err := api.srv.Handler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan struct{})
+	url, stop, done := startServing(t, api.srv, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Receive the whole upload, then hold it back until the shutdown
+		// timeout cancels the request, so the upload is written while it
+		// is being cancelled.
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("reading the upload: %v", err)
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		close(received)
+		<-r.Context().Done()
+		handler.ServeHTTP(w, r)
+	}))
+	c.base = url
+
+	go c.http.Do(c.uploadRequest("movie.mp4", bytes.Repeat([]byte("frame"), 1<<16), nil))
+	<-received
+	stop()
+	waitServe(t, done, cleanupGracePeriod)
+
+	for _, dir := range []string{cfg.VideoDir, cfg.CoverImageDir} {
+		if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+			t.Errorf("%s: got %d files after a cancelled upload, want none", dir, len(entries))
+		}
+	}
+	if _, err := api.store.GetVideoByFile(context.Background(), "movie.mp4"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("GetVideoByFile after a cancelled upload: got %v, want ErrNotFound", err)
+	}
+}
+
+// TestShutdownStopsReencryption checks that serve doesn't return while a
+// file is being re-encrypted, and that the file is left as it was.
+func TestShutdownStopsReencryption(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.EncryptionKeyFile = filepath.Join(t.TempDir(), "keys")
+	if err := vault.CreateKeyFile(cfg.EncryptionKeyFile); err != nil {
+		t.Fatalf("CreateKeyFile: %v", err)
+	}
+	k, err := vault.LoadKeyring(cfg.EncryptionKeyFile)
+	if err != nil {
+		t.Fatalf("LoadKeyring: %v", err)
+	}
+	content := bytes.Repeat([]byte("frame"), 8<<20)
+	path := filepath.Join(cfg.VideoDir, "movie.mp4")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := k.NewWriter(f)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	if _, err := w.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := k.Rotate(); err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+
+	api := newTestAPIWithConfig(t, cfg)
+	_, stop, done := startServing(t, api.srv, http.NotFoundHandler())
+	deadline := time.Now().Add(5 * time.Second)
+	for p := api.srv.reencryptor.Progress(); !p.Running && p.FinishedAt == nil; p = api.srv.reencryptor.Progress() {
+		if time.Now().After(deadline) {
+			t.Fatal("re-encryption didn't start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	stop()
+	waitServe(t, done, cleanupGracePeriod)
+
+	if p := api.srv.reencryptor.Progress(); p.Running {
+		t.Errorf("re-encryption still running after serve returned: %+v", p)
+	}
+	if entries, _ := os.ReadDir(cfg.VideoDir); len(entries) != 1 {
+		t.Errorf("got %d files, want the video; temporary files were left behind", len(entries))
+	}
+	f, err = os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := api.srv.keyring.NewReader(f)
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("got %d bytes, %v; want the video unchanged", len(got), err)
+	}
+}
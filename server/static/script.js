@@ -18,6 +18,7 @@ document.addEventListener("DOMContentLoaded", function () {
   const genreNav = document.getElementById("genre-nav");
   const uploadForm = document.getElementById("upload-form");
   const fileInput = document.getElementById("file-input");
+  const logoutButton = document.getElementById("logout-button");
   const coverInput = document.getElementById("cover-input");
   const selectedFile = document.getElementById("selected-file");
   const selectedCover = document.getElementById("selected-cover");
@@ -28,6 +29,9 @@ document.addEventListener("DOMContentLoaded", function () {
   const dropArea = document.getElementById("drop-area");
   const coverUploadArea = document.getElementById("cover-upload-area");
   const genreSelect = document.getElementById("genre");
+  const visibilitySelect = document.getElementById("visibility");
+  const groupField = document.getElementById("group-field");
+  const groupSelect = document.getElementById("group_id");
   const movieModal = document.getElementById("movie-modal");
   const modalTitle = document.getElementById("modal-title");
   const modalPoster = document.getElementById("modal-poster");
@@ -54,6 +58,7 @@ document.addEventListener("DOMContentLoaded", function () {
     uploadPage.classList.add("active");
     videosPage.classList.remove("active");
     loadGenres();
+    loadGroups();
   });
   function formatFileSize(bytes) {
     if (bytes === 0) return "0 B";
@@ -94,9 +99,28 @@ document.addEventListener("DOMContentLoaded", function () {
     const colorIndex = hash % colors.length;
     return `data:image/svg+xml,%3Csvg xmlns='http://www.w3.org/2000/svg' width='100' height='100' viewBox='0 0 100 100'%3E%3Crect width='100' height='100' fill='${encodeURIComponent(colors[colorIndex])}'/%3E%3C/svg%3E`;
   }
+  function redirectToLogin() {
+    window.location.href = "/login.html";
+  }
+  logoutButton.addEventListener("click", () => {
+    fetch("/api/auth/logout", { method: "POST" }).finally(redirectToLogin);
+  });
+  function loadCurrentUser() {
+    fetch("/api/auth/me")
+      .then((response) => (response.ok ? response.json() : null))
+      .then((me) => {
+        if (me && me.user.role === "viewer") {
+          uploadTab.classList.add("hidden");
+        }
+      });
+  }
   function loadGenres() {
     fetch("/api/genres")
       .then((response) => {
+        if (response.status === 401) {
+          redirectToLogin();
+          throw new Error("Not logged in");
+        }
         if (!response.ok) throw new Error("Failed to load genres");
         return response.json();
       })
@@ -126,12 +150,31 @@ document.addEventListener("DOMContentLoaded", function () {
         console.error("Error loading genres:", error);
       });
   }
+  function loadGroups() {
+    fetch("/api/groups")
+      .then((response) => (response.ok ? response.json() : []))
+      .then((groups) => {
+        groupSelect.innerHTML = groups
+          .map((g) => `<option value="${g.id}">${g.name}</option>`)
+          .join("");
+      });
+  }
+  visibilitySelect.addEventListener("change", () => {
+    const group = visibilitySelect.value === "group";
+    groupField.classList.toggle("hidden", !group);
+    groupSelect.disabled = !group;
+  });
+  groupSelect.disabled = true;
   function loadVideos() {
     loadingIndicator.classList.remove("hidden");
     videoCategories.innerHTML = "";
 
     fetch("/api/videos")
       .then((response) => {
+        if (response.status === 401) {
+          redirectToLogin();
+          throw new Error("Not logged in");
+        }
         if (!response.ok) {
           throw new Error("Failed to load videos");
         }
@@ -443,17 +486,22 @@ document.addEventListener("DOMContentLoaded", function () {
     xhr.onload = function () {
       progressContainer.classList.add("hidden");
 
+      if (xhr.status === 401) {
+        redirectToLogin();
+        return;
+      }
       if (xhr.status === 200) {
         const response = JSON.parse(xhr.responseText);
         uploadMessage.textContent = response.message;
         uploadMessage.className = "message success";
         uploadForm.reset();
+        visibilitySelect.dispatchEvent(new Event("change"));
         fileInfo.classList.add("hidden");
       } else {
         let errorMessage = "Upload failed";
         try {
           const response = JSON.parse(xhr.responseText);
-          errorMessage = `Upload failed: ${response.message || xhr.statusText}`;
+          errorMessage = `Upload failed: ${response.message || response.error || xhr.statusText}`;
         } catch (e) {
           errorMessage = `Upload failed: ${xhr.statusText}`;
         }
@@ -497,5 +545,6 @@ document.addEventListener("DOMContentLoaded", function () {
       header.classList.remove("scrolled");
     }
   });
+  loadCurrentUser();
   loadVideos();
 });
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"DevMaan707/streamer/api"
+	"DevMaan707/streamer/auth"
+	"DevMaan707/streamer/services"
+	"DevMaan707/streamer/vault"
+)
+
+// Version is the release the binary was built from, set at build time with
+// -ldflags "-X DevMaan707/streamer/server.Version=v1.2.3".
+var Version = "dev"
+
+// requireAdmin only lets requests through that carry the configured admin
+// token as a bearer token, for scripts and monitoring, or that authenticate
+// as a user with the admin role: by session cookie or by an API token with
+// the admin scope. Denials are audited.
+func (s *Server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		target := r.Method + " " + r.URL.Path
+		var ctx context.Context
+		if got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			want := s.Config().AdminToken
+			if want != "" && subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1 {
+				next(w, r)
+				return
+			}
+			if t, user, err := s.authSvc.AuthenticateAPIToken(r.Context(), got); err == nil {
+				ctx = services.WithAPIToken(r.Context(), t, user)
+			} else {
+				s.authSvc.Audit(r.Context(), string(auth.PermAdmin), target, services.AuditDenied, "invalid bearer token")
+			}
+		} else if c, err := r.Cookie(api.SessionCookie); err == nil {
+			if sess, user, err := s.authSvc.Authenticate(r.Context(), c.Value); err == nil {
+				ctx = services.WithSession(r.Context(), sess, user)
+			}
+		}
+		if ctx == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="starflix-admin"`)
+			api.WriteError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		if err := s.authSvc.Authorize(ctx, auth.PermAdmin, target); err != nil {
+			api.WriteError(w, http.StatusForbidden, err.Error())
+			return
+		}
+		next(w, r.WithContext(ctx))
+	}
+}
+
+type buildStatus struct {
+	Version   string `json:"version"`
+	Revision  string `json:"revision,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+type configSummary struct {
+	Listeners     []string `json:"listeners"`
+	TLS           bool     `json:"tls"`
+	Database      string   `json:"database"`
+	MaxUploadMB   int      `json:"max_upload_mb"`
+	Encryption    bool     `json:"encryption"`
+	CORSOrigins   []string `json:"cors_origins"`
+	LogLevel      string   `json:"log_level"`
+	AccessLog     bool     `json:"access_log"`
+	VideoDir      string   `json:"video_dir"`
+	CoverImageDir string   `json:"cover_dir"`
+}
+
+type storageStatus struct {
+	Bytes int64 `json:"bytes"`
+	Files int   `json:"files"`
+}
+
+type serverStatus struct {
+	Build   buildStatus              `json:"build"`
+	Started time.Time                `json:"started"`
+	Uptime  string                   `json:"uptime"`
+	Config  configSummary            `json:"config"`
+	Library services.LibraryStats    `json:"library"`
+	Storage map[string]storageStatus `json:"storage"`
+	// Reencryption is set when encryption at rest is enabled.
+	Reencryption *vault.ReencryptProgress `json:"reencryption,omitempty"`
+}
+
+// statusHandler serves diagnostics for operators: what is running, how it
+// is configured and how much it stores.
+func (s *Server) statusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		api.WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	cfg := s.Config()
+
+	status := serverStatus{
+		Build:   buildStatus{Version: Version, GoVersion: runtime.Version()},
+		Started: s.started,
+		Uptime:  time.Since(s.started).Round(time.Second).String(),
+		Config: configSummary{
+			TLS:           cfg.TLS.Enabled(),
+			Database:      cfg.Database.Driver,
+			MaxUploadMB:   cfg.MaxUploadSize,
+			Encryption:    cfg.EncryptionKeyFile != "",
+			CORSOrigins:   cfg.CORSOrigins,
+			LogLevel:      cfg.Log.Level,
+			AccessLog:     cfg.Log.AccessLog != "",
+			VideoDir:      cfg.VideoDir,
+			CoverImageDir: cfg.CoverImageDir,
+		},
+		Storage: make(map[string]storageStatus),
+	}
+	if s.reencryptor != nil {
+		progress := s.reencryptor.Progress()
+		status.Reencryption = &progress
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				status.Build.Revision = setting.Value
+			}
+		}
+	}
+	for _, l := range cfg.EffectiveListeners() {
+		status.Config.Listeners = append(status.Config.Listeners, l.Routes+"="+l.Address)
+	}
+
+	library, err := s.videoSvc.LibraryStats(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to read library stats", "error", err)
+		api.WriteError(w, http.StatusInternalServerError, "Failed to read library stats")
+		return
+	}
+	status.Library = library
+
+	for name, dir := range map[string]string{"videos": cfg.VideoDir, "covers": cfg.CoverImageDir} {
+		size, files := dirUsage(dir)
+		status.Storage[name] = storageStatus{Bytes: size, Files: files}
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
@@ -0,0 +1,143 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"DevMaan707/streamer/auth"
+	"DevMaan707/streamer/db"
+)
+
+const (
+	// APITokenPrefix starts every API token, so they are recognisable in
+	// scripts and secret scanners.
+	APITokenPrefix = "sfx_"
+	// DefaultAPITokenTTL and MaxAPITokenTTL bound how long tokens last.
+	DefaultAPITokenTTL = 90 * 24 * time.Hour
+	MaxAPITokenTTL     = 365 * 24 * time.Hour
+)
+
+type apiTokenContextKey struct{}
+
+// WithAPIToken returns a copy of ctx carrying the token a request was
+// authenticated with and its owner.
+func WithAPIToken(ctx context.Context, t *db.APIToken, user *db.User) context.Context {
+	ctx = context.WithValue(ctx, apiTokenContextKey{}, t)
+	return context.WithValue(ctx, userContextKey{}, user)
+}
+
+// CurrentAPIToken returns the token stored by WithAPIToken, or nil for
+// requests authenticated with a session.
+func CurrentAPIToken(ctx context.Context) *db.APIToken {
+	t, _ := ctx.Value(apiTokenContextKey{}).(*db.APIToken)
+	return t
+}
+
+// tokenAllows reports whether any of the token's scopes grants p.
+func tokenAllows(t *db.APIToken, p auth.Permission) bool {
+	for _, sc := range t.Scopes {
+		if auth.Scope(sc).Allows(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateAPIToken creates a named token for user limited to scopes, which
+// the user's role must be able to use. A zero ttl means
+// DefaultAPITokenTTL. The token itself is only returned here.
+func (s *AuthService) CreateAPIToken(ctx context.Context, user *db.User, name string, scopes []string, ttl time.Duration) (string, *db.APIToken, error) {
+	return s.createAPIToken(ctx, user, name, scopes, ttl, false)
+}
+
+// createAPIToken creates a token, marked as a linked device's if device is
+// set.
+func (s *AuthService) createAPIToken(ctx context.Context, user *db.User, name string, scopes []string, ttl time.Duration, device bool) (string, *db.APIToken, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 100 {
+		return "", nil, fmt.Errorf("%w: token names are 1-100 characters", ErrInvalidInput)
+	}
+	if len(scopes) == 0 {
+		return "", nil, fmt.Errorf("%w: at least one scope is required", ErrInvalidInput)
+	}
+	seen := make(map[string]bool)
+	var unique []string
+	for _, raw := range scopes {
+		sc, err := auth.ParseScope(raw)
+		if err != nil {
+			return "", nil, fmt.Errorf("%w: %v", ErrInvalidInput, err)
+		}
+		if !sc.UsableBy(auth.Role(user.Role)) {
+			return "", nil, fmt.Errorf("%w: the %s role can't use the %s scope", ErrInvalidInput, user.Role, sc)
+		}
+		if !seen[raw] {
+			seen[raw] = true
+			unique = append(unique, raw)
+		}
+	}
+	if ttl == 0 {
+		ttl = DefaultAPITokenTTL
+	}
+	if ttl < 0 || ttl > MaxAPITokenTTL {
+		return "", nil, fmt.Errorf("%w: tokens can last at most %s", ErrInvalidInput, MaxAPITokenTTL)
+	}
+
+	secret, err := auth.NewToken()
+	if err != nil {
+		return "", nil, err
+	}
+	token := APITokenPrefix + secret
+	now := time.Now().UTC()
+	t := &db.APIToken{
+		UserID:    user.ID,
+		Name:      name,
+		TokenHash: auth.HashToken(token),
+		Scopes:    unique,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+		Device:    device,
+	}
+	if err := s.users.CreateAPIToken(ctx, t); err != nil {
+		return "", nil, fmt.Errorf("failed to create API token: %w", err)
+	}
+	return token, t, nil
+}
+
+// AuthenticateAPIToken resolves an API token to the token record and its
+// owner, recording when it was last used.
+func (s *AuthService) AuthenticateAPIToken(ctx context.Context, token string) (*db.APIToken, *db.User, error) {
+	if !strings.HasPrefix(token, APITokenPrefix) {
+		return nil, nil, ErrUnauthenticated
+	}
+	now := time.Now().UTC()
+	t, user, err := s.users.GetAPIToken(ctx, auth.HashToken(token), now)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, nil, ErrUnauthenticated
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to look up API token: %w", err)
+	}
+	if t.LastUsedAt == nil || now.Sub(*t.LastUsedAt) >= touchInterval {
+		if err := s.users.TouchAPIToken(ctx, t.ID, now); err != nil {
+			slog.WarnContext(ctx, "Failed to update API token", "error", err)
+		} else {
+			t.LastUsedAt = &now
+		}
+	}
+	return t, user, nil
+}
+
+// ListAPITokens returns the user's tokens, expired ones included.
+func (s *AuthService) ListAPITokens(ctx context.Context, userID int) ([]db.APIToken, error) {
+	return s.users.ListAPITokens(ctx, userID)
+}
+
+// RevokeAPIToken deletes one of the user's tokens. It returns
+// db.ErrNotFound if the token doesn't exist or belongs to someone else.
+func (s *AuthService) RevokeAPIToken(ctx context.Context, userID, id int) error {
+	return s.users.DeleteAPIToken(ctx, userID, id)
+}
@@ -0,0 +1,102 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"DevMaan707/streamer/auth"
+	"DevMaan707/streamer/db"
+	"DevMaan707/streamer/utils"
+)
+
+// Audit event outcomes.
+const (
+	AuditSuccess = "success"
+	AuditDenied  = "denied"
+)
+
+// Audit records an event in the audit trail, attributed to the logged-in
+// user, client IP and request ID found in ctx. Failures to record are
+// logged rather than returned, so they never fail the audited operation.
+func (s *AuthService) Audit(ctx context.Context, action, target, outcome, detail string) {
+	e := &db.AuditEvent{
+		CreatedAt: time.Now().UTC(),
+		Action:    action,
+		Target:    truncate(target, 255),
+		Outcome:   outcome,
+		ClientIP:  utils.ClientIP(ctx),
+		RequestID: utils.RequestID(ctx),
+		Detail:    detail,
+	}
+	if user := CurrentUser(ctx); user != nil {
+		e.UserID = user.ID
+		e.Username = user.Username
+	}
+	level := slog.LevelInfo
+	if outcome == AuditDenied {
+		level = slog.LevelWarn
+	}
+	slog.Log(ctx, level, "Audit", "action", action, "target", e.Target, "outcome", outcome, "user", e.Username, "detail", detail)
+	if err := s.audit.RecordAuditEvent(ctx, e); err != nil {
+		slog.ErrorContext(ctx, "Failed to record audit event", "action", action, "error", err)
+	}
+}
+
+// Authorize checks that the logged-in user's role, and the scopes of the
+// API token if the request used one, grant perm for an operation on target. Denials are recorded in the audit trail and return
+// ErrForbidden, or ErrUnauthenticated when nobody is logged in.
+func (s *AuthService) Authorize(ctx context.Context, perm auth.Permission, target string) error {
+	user := CurrentUser(ctx)
+	if user == nil {
+		s.Audit(ctx, string(perm), target, AuditDenied, "not logged in")
+		return ErrUnauthenticated
+	}
+	if !auth.Role(user.Role).Can(perm) {
+		s.Audit(ctx, string(perm), target, AuditDenied, "role "+user.Role)
+		return fmt.Errorf("%w: the %s role may not %s", ErrForbidden, user.Role, perm)
+	}
+	if t := CurrentAPIToken(ctx); t != nil && !tokenAllows(t, perm) {
+		s.Audit(ctx, string(perm), target, AuditDenied, "API token "+t.Name+" lacks the scope")
+		return fmt.Errorf("%w: the API token's scopes don't allow %s", ErrForbidden, perm)
+	}
+	return nil
+}
+
+// ListAuditEvents returns audit events matching f, newest first.
+func (s *AuthService) ListAuditEvents(ctx context.Context, f db.AuditFilter) ([]db.AuditEvent, error) {
+	return s.audit.ListAuditEvents(ctx, f)
+}
+
+// SetRole changes a user's role. The last admin can't be demoted, so the
+// server always keeps someone able to assign roles.
+func (s *AuthService) SetRole(ctx context.Context, userID int, role auth.Role) (*db.User, error) {
+	if _, err := auth.ParseRole(string(role)); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidInput, err)
+	}
+	user, err := s.users.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if auth.Role(user.Role) == auth.RoleAdmin && role != auth.RoleAdmin {
+		users, err := s.users.ListUsers(ctx)
+		if err != nil {
+			return nil, err
+		}
+		admins := 0
+		for _, u := range users {
+			if auth.Role(u.Role) == auth.RoleAdmin {
+				admins++
+			}
+		}
+		if admins <= 1 {
+			return nil, fmt.Errorf("%w: the last admin can't be demoted", ErrInvalidInput)
+		}
+	}
+	if err := s.users.SetUserRole(ctx, userID, string(role)); err != nil {
+		return nil, err
+	}
+	user.Role = string(role)
+	return user, nil
+}
@@ -0,0 +1,418 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"DevMaan707/streamer/auth"
+	"DevMaan707/streamer/db"
+	"DevMaan707/streamer/tracing"
+)
+
+var (
+	// ErrInvalidCredentials is returned by Login for an unknown user or a
+	// wrong password, without saying which.
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	// ErrUnauthenticated is returned for a missing, unknown or expired
+	// session token.
+	ErrUnauthenticated = errors.New("not logged in")
+	// ErrForbidden is returned when the user's role lacks a permission.
+	ErrForbidden = errors.New("forbidden")
+	// ErrInvalidInput wraps validation failures of user-supplied values.
+	ErrInvalidInput = errors.New("invalid input")
+)
+
+// MinPasswordLength is the shortest password accepted for new accounts and
+// password changes.
+const MinPasswordLength = 8
+
+// touchInterval limits how often a session's last-seen time is written.
+const touchInterval = time.Minute
+
+var usernamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{2,63}$`)
+
+// dummyHash is verified against when a login names an unknown user, so the
+// response takes as long as for a wrong password.
+var dummyHash = mustHashPassword("starflix-dummy-password")
+
+// mustHashPassword panics if hashing fails, as an empty dummyHash would
+// make logins of unknown users fail fast and give them away.
+func mustHashPassword(password string) string {
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		panic(fmt.Sprintf("failed to hash dummy password: %v", err))
+	}
+	return hash
+}
+
+type AuthService struct {
+	users      db.UserRepository
+	audit      db.AuditRepository
+	logins     db.LoginRepository
+	sessionTTL time.Duration
+	inviteTTL  time.Duration
+	lockout    LockoutPolicy
+	// oidc is set by NewOIDCService when single sign-on is enabled.
+	oidc *OIDCService
+	// devices limits wrong device code entries.
+	devices deviceLimiter
+}
+
+func NewAuthService(users db.UserRepository, audit db.AuditRepository, logins db.LoginRepository, sessionTTL, inviteTTL time.Duration, lockout LockoutPolicy) *AuthService {
+	return &AuthService{
+		users:      users,
+		audit:      audit,
+		logins:     logins,
+		sessionTTL: sessionTTL,
+		inviteTTL:  inviteTTL,
+		lockout:    lockout,
+	}
+}
+
+// SessionTTL is how long a new session lasts.
+func (s *AuthService) SessionTTL() time.Duration {
+	return s.sessionTTL
+}
+
+type userContextKey struct{}
+
+type sessionContextKey struct{}
+
+// WithSession returns a copy of ctx carrying the logged-in user and their
+// session.
+func WithSession(ctx context.Context, sess *db.Session, user *db.User) context.Context {
+	ctx = context.WithValue(ctx, sessionContextKey{}, sess)
+	return context.WithValue(ctx, userContextKey{}, user)
+}
+
+// CurrentUser returns the user stored by WithSession, or nil.
+func CurrentUser(ctx context.Context) *db.User {
+	u, _ := ctx.Value(userContextKey{}).(*db.User)
+	return u
+}
+
+// CurrentSession returns the session stored by WithSession, or nil.
+func CurrentSession(ctx context.Context) *db.Session {
+	sess, _ := ctx.Value(sessionContextKey{}).(*db.Session)
+	return sess
+}
+
+// EnsureInitialAdmin creates an "admin" account with a random password when
+// there are no users yet, and prints the password once to stderr so the
+// operator can log in and change it. The password is kept out of the log,
+// which may be shipped elsewhere.
+func (s *AuthService) EnsureInitialAdmin(ctx context.Context) error {
+	count, err := s.users.CountUsers(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to count users: %w", err)
+	}
+	if count > 0 {
+		return nil
+	}
+	password, err := auth.NewToken()
+	if err != nil {
+		return err
+	}
+	if _, err := s.CreateUser(ctx, "admin", password, auth.RoleAdmin); err != nil {
+		return fmt.Errorf("failed to create initial admin: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "\nInitial admin account created: username admin, password %s\nChange the password after logging in.\n\n", password)
+	slog.Warn("Created initial admin account, its password is printed to stderr; change it after logging in",
+		"username", "admin")
+	return nil
+}
+
+// Login checks a username and password and starts a session, returning its
+// token. Password hashes in an outdated format are upgraded on the way.
+// Failed logins delay and eventually lock out further attempts on the
+// account and from the client address, following the lockout policy;
+// meanwhile Login returns a LoginDelayError without checking the password.
+func (s *AuthService) Login(ctx context.Context, username, password, userAgent, clientIP string) (string, *db.Session, *db.User, error) {
+	ctx, span := tracing.Start(ctx, "AuthService.Login")
+	defer span.End()
+
+	// Unknown usernames are counted too, so lockouts don't reveal which
+	// accounts exist.
+	name := truncate(normalizeUsername(username), 128)
+	now := time.Now().UTC()
+	reserved, err := s.reserveLoginAttempt(ctx, name, clientIP, now)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	user, err := s.users.GetUserByUsername(ctx, name)
+	if errors.Is(err, db.ErrNotFound) {
+		auth.VerifyPassword(dummyHash, password)
+		s.recordLoginFailure(ctx, reserved, nil, userAgent, clientIP)
+		return "", nil, nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		s.releaseLoginAttempts(ctx, reserved)
+		span.RecordError(err)
+		return "", nil, nil, fmt.Errorf("failed to look up user: %w", err)
+	}
+	if user.PasswordHash == "" {
+		// Single sign-on accounts have no password.
+		auth.VerifyPassword(dummyHash, password)
+		s.recordLoginFailure(ctx, reserved, user, userAgent, clientIP)
+		return "", nil, nil, ErrInvalidCredentials
+	}
+	if err := auth.VerifyPassword(user.PasswordHash, password); err != nil {
+		if errors.Is(err, auth.ErrMismatch) {
+			s.recordLoginFailure(ctx, reserved, user, userAgent, clientIP)
+			return "", nil, nil, ErrInvalidCredentials
+		}
+		s.releaseLoginAttempts(ctx, reserved)
+		span.RecordError(err)
+		return "", nil, nil, fmt.Errorf("failed to verify password: %w", err)
+	}
+	// The account's failures are forgotten; the client address only gets
+	// this attempt back, so logging in to one account doesn't clear the
+	// guesses at others.
+	for _, r := range reserved {
+		if r.subject != accountSubject(name) {
+			s.releaseLoginAttempts(ctx, []reservedLogin{r})
+		}
+	}
+	if err := s.logins.ClearLoginFailures(ctx, accountSubject(name), now.Add(-s.lockout.Duration)); err != nil && !errors.Is(err, db.ErrNotFound) {
+		slog.WarnContext(ctx, "Failed to reset failed logins", "user", user.Username, "error", err)
+	}
+
+	if auth.NeedsRehash(user.PasswordHash) {
+		if hash, err := auth.HashPassword(password); err == nil {
+			if err := s.users.UpdatePassword(ctx, user.ID, hash); err != nil {
+				slog.WarnContext(ctx, "Failed to upgrade password hash", "user", user.Username, "error", err)
+			} else {
+				user.PasswordHash = hash
+			}
+		}
+	}
+
+	if _, err := s.users.DeleteExpiredSessions(ctx, time.Now().UTC()); err != nil {
+		slog.WarnContext(ctx, "Failed to delete expired sessions", "error", err)
+	}
+	if err := s.logins.DeleteLoginAttemptsBefore(ctx, now.Add(-loginAttemptRetention)); err != nil {
+		slog.WarnContext(ctx, "Failed to delete old failed logins", "error", err)
+	}
+
+	sess := &db.Session{UserID: user.ID, UserAgent: userAgent, ClientIP: clientIP}
+	token, err := s.createSession(ctx, sess)
+	if err != nil {
+		span.RecordError(err)
+		return "", nil, nil, err
+	}
+	return token, sess, user, nil
+}
+
+// createSession stores sess, which has its user, client and any single
+// sign-on fields set, with a new token and returns the token.
+func (s *AuthService) createSession(ctx context.Context, sess *db.Session) (string, error) {
+	token, err := auth.NewToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	sess.TokenHash = auth.HashToken(token)
+	sess.UserAgent = truncate(sess.UserAgent, 512)
+	sess.CreatedAt = now
+	sess.LastSeenAt = now
+	sess.ExpiresAt = now.Add(s.sessionTTL)
+	if err := s.users.CreateSession(ctx, sess); err != nil {
+		return "", fmt.Errorf("failed to create session: %w", err)
+	}
+	return token, nil
+}
+
+// Authenticate resolves a session token to its session and user. Single
+// sign-on sessions are checked with the identity provider when due, which
+// may end them.
+func (s *AuthService) Authenticate(ctx context.Context, token string) (*db.Session, *db.User, error) {
+	if token == "" {
+		return nil, nil, ErrUnauthenticated
+	}
+	now := time.Now().UTC()
+	sess, user, err := s.users.GetSession(ctx, auth.HashToken(token), now)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, nil, ErrUnauthenticated
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to look up session: %w", err)
+	}
+	if sess.RefreshAt != nil && !now.Before(*sess.RefreshAt) && s.oidc != nil {
+		if user, err = s.oidc.refresh(ctx, sess, user); err != nil {
+			return nil, nil, err
+		}
+	}
+	if now.Sub(sess.LastSeenAt) >= touchInterval {
+		if err := s.users.TouchSession(ctx, sess.ID, now); err != nil {
+			slog.WarnContext(ctx, "Failed to update session", "error", err)
+		} else {
+			sess.LastSeenAt = now
+		}
+	}
+	return sess, user, nil
+}
+
+// Logout ends the given session.
+func (s *AuthService) Logout(ctx context.Context, sess *db.Session) error {
+	return s.users.DeleteSession(ctx, sess.UserID, sess.ID)
+}
+
+// ListSessions returns the user's active sessions.
+func (s *AuthService) ListSessions(ctx context.Context, userID int) ([]db.Session, error) {
+	return s.users.ListSessions(ctx, userID, time.Now().UTC())
+}
+
+// RevokeSession ends one of the user's sessions. It returns db.ErrNotFound
+// if the session doesn't exist or belongs to someone else.
+func (s *AuthService) RevokeSession(ctx context.Context, userID, sessionID int) error {
+	return s.users.DeleteSession(ctx, userID, sessionID)
+}
+
+// CreateUser adds an account.
+func (s *AuthService) CreateUser(ctx context.Context, username, password string, role auth.Role) (*db.User, error) {
+	user, err := newUser(username, password, role)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.users.CreateUser(ctx, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// SetPassword replaces a user's password without checking the old one and
+// ends all their sessions. It is meant for administrators.
+func (s *AuthService) SetPassword(ctx context.Context, username, password string) error {
+	user, err := s.users.GetUserByUsername(ctx, normalizeUsername(username))
+	if err != nil {
+		return err
+	}
+	if err := validatePassword(password); err != nil {
+		return err
+	}
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	if err := s.users.UpdatePassword(ctx, user.ID, hash); err != nil {
+		return err
+	}
+	return s.users.DeleteUserSessions(ctx, user.ID, 0)
+}
+
+func (s *AuthService) ListUsers(ctx context.Context) ([]db.User, error) {
+	return s.users.ListUsers(ctx)
+}
+
+// ChangePassword replaces the user's password after checking the current
+// one, and ends their other sessions.
+func (s *AuthService) ChangePassword(ctx context.Context, user *db.User, sess *db.Session, current, password string) error {
+	if user.PasswordHash == "" {
+		return fmt.Errorf("%w: this account logs in with single sign-on and has no password", ErrInvalidInput)
+	}
+	if err := auth.VerifyPassword(user.PasswordHash, current); err != nil {
+		if errors.Is(err, auth.ErrMismatch) {
+			return ErrInvalidCredentials
+		}
+		return err
+	}
+	if err := validatePassword(password); err != nil {
+		return err
+	}
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	if err := s.users.UpdatePassword(ctx, user.ID, hash); err != nil {
+		return err
+	}
+	return s.users.DeleteUserSessions(ctx, user.ID, sess.ID)
+}
+
+// CreateInvite returns a one-time registration token for an account with
+// the given role.
+func (s *AuthService) CreateInvite(ctx context.Context, createdBy int, role auth.Role) (string, *db.Invite, error) {
+	if _, err := auth.ParseRole(string(role)); err != nil {
+		return "", nil, fmt.Errorf("%w: %v", ErrInvalidInput, err)
+	}
+	token, err := auth.NewToken()
+	if err != nil {
+		return "", nil, err
+	}
+	now := time.Now().UTC()
+	inv := &db.Invite{
+		TokenHash: auth.HashToken(token),
+		CreatedBy: createdBy,
+		Role:      string(role),
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.inviteTTL),
+	}
+	if err := s.users.CreateInvite(ctx, inv); err != nil {
+		return "", nil, fmt.Errorf("failed to create invite: %w", err)
+	}
+	return token, inv, nil
+}
+
+// Register creates an account with an invite token, with the role the
+// invite was made for. Unknown, used and expired invites all return
+// db.ErrNotFound.
+func (s *AuthService) Register(ctx context.Context, inviteToken, username, password string) (*db.User, error) {
+	user, err := newUser(username, password, auth.RoleViewer)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.users.RedeemInvite(ctx, auth.HashToken(inviteToken), time.Now().UTC(), user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func newUser(username, password string, role auth.Role) (*db.User, error) {
+	if _, err := auth.ParseRole(string(role)); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidInput, err)
+	}
+	username = normalizeUsername(username)
+	if !usernamePattern.MatchString(username) {
+		return nil, fmt.Errorf("%w: usernames are 3-64 letters, digits, dots, dashes or underscores", ErrInvalidInput)
+	}
+	if err := validatePassword(password); err != nil {
+		return nil, err
+	}
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	return &db.User{
+		Username:     username,
+		PasswordHash: hash,
+		Role:         string(role),
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}, nil
+}
+
+func validatePassword(password string) error {
+	if len(password) < MinPasswordLength {
+		return fmt.Errorf("%w: passwords must be at least %d characters", ErrInvalidInput, MinPasswordLength)
+	}
+	return nil
+}
+
+func normalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
@@ -0,0 +1,337 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"DevMaan707/streamer/auth"
+	"DevMaan707/streamer/db"
+)
+
+const (
+	// DeviceCodeTTL is how long a device has to be approved.
+	DeviceCodeTTL = 10 * time.Minute
+	// DevicePollInterval is the initial minimum time between polls; each
+	// poll that comes too early adds deviceSlowDown.
+	DevicePollInterval = 5 * time.Second
+	deviceSlowDown     = 5 * time.Second
+	// DeviceTokenTTL is how long a linked device stays linked.
+	DeviceTokenTTL = MaxAPITokenTTL
+	// maxPendingDeviceCodes limits the codes awaiting approval per client
+	// IP.
+	maxPendingDeviceCodes = 5
+	// maxCodeAttempts limits the wrong user codes a user may enter per
+	// codeAttemptWindow, so codes can't be guessed.
+	maxCodeAttempts   = 10
+	codeAttemptWindow = 10 * time.Minute
+)
+
+// userCodeAlphabet has no vowels, so codes don't spell words, and no
+// characters that are easily confused, as RFC 8628 recommends.
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+// Device authorization errors, named after the RFC 8628 error codes a
+// polling device receives.
+var (
+	ErrAuthorizationPending = errors.New("authorization_pending")
+	ErrSlowDown             = errors.New("slow_down")
+	ErrAccessDenied         = errors.New("access_denied")
+	ErrExpiredToken         = errors.New("expired_token")
+	// ErrRateLimited is returned when a client or user is making too many
+	// attempts.
+	ErrRateLimited = errors.New("too many requests")
+)
+
+// codeAttempts counts a user's wrong user code entries in the current
+// window.
+type codeAttempts struct {
+	count int
+	start time.Time
+}
+
+// deviceLimiter tracks wrong user code entries per user.
+type deviceLimiter struct {
+	mu       sync.Mutex
+	attempts map[int]*codeAttempts
+}
+
+// DeviceAuthorization is what a device shows the user: a short code to
+// enter at the verification page.
+type DeviceAuthorization struct {
+	DeviceCode string
+	UserCode   string
+	ExpiresIn  time.Duration
+	Interval   time.Duration
+}
+
+// StartDeviceAuthorization creates a device code for a device calling
+// itself clientName that asks for scopes, videos:read if none.
+func (s *AuthService) StartDeviceAuthorization(ctx context.Context, clientName string, scopes []string, clientIP string) (*DeviceAuthorization, error) {
+	clientName = strings.TrimSpace(clientName)
+	if clientName == "" || len(clientName) > 100 {
+		return nil, fmt.Errorf("%w: device names are 1-100 characters", ErrInvalidInput)
+	}
+	if len(scopes) == 0 {
+		scopes = []string{string(auth.ScopeVideosRead)}
+	}
+	for _, raw := range scopes {
+		if _, err := auth.ParseScope(raw); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidInput, err)
+		}
+	}
+
+	now := time.Now().UTC()
+	if err := s.users.DeleteExpiredDeviceCodes(ctx, now); err != nil {
+		slog.WarnContext(ctx, "Failed to delete expired device codes", "error", err)
+	}
+	pending, err := s.users.CountPendingDeviceCodes(ctx, clientIP, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count device codes: %w", err)
+	}
+	if pending >= maxPendingDeviceCodes {
+		return nil, fmt.Errorf("%w: finish linking the devices already waiting first", ErrRateLimited)
+	}
+
+	deviceCode, err := auth.NewToken()
+	if err != nil {
+		return nil, err
+	}
+	dc := &db.DeviceCode{
+		DeviceCodeHash: auth.HashToken(deviceCode),
+		ClientName:     clientName,
+		Scopes:         scopes,
+		ClientIP:       clientIP,
+		CreatedAt:      now,
+		ExpiresAt:      now.Add(DeviceCodeTTL),
+		Interval:       int(DevicePollInterval / time.Second),
+		Status:         db.DeviceCodePending,
+	}
+	// User codes are short, so a clash with a pending one is possible if
+	// unlikely; a fresh code is tried then.
+	for attempt := 0; ; attempt++ {
+		if dc.UserCode, err = newUserCode(); err != nil {
+			return nil, err
+		}
+		err = s.users.CreateDeviceCode(ctx, dc)
+		if !errors.Is(err, db.ErrConflict) || attempt == 2 {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create device code: %w", err)
+	}
+	return &DeviceAuthorization{
+		DeviceCode: deviceCode,
+		UserCode:   FormatUserCode(dc.UserCode),
+		ExpiresIn:  DeviceCodeTTL,
+		Interval:   DevicePollInterval,
+	}, nil
+}
+
+// newUserCode returns eight random letters from userCodeAlphabet.
+func newUserCode() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		// 256 isn't a multiple of 20, which skews the choice slightly;
+		// that doesn't matter for codes that live ten minutes.
+		b[i] = userCodeAlphabet[int(b[i])%len(userCodeAlphabet)]
+	}
+	return string(b), nil
+}
+
+// FormatUserCode writes a user code as ABCD-EFGH.
+func FormatUserCode(code string) string {
+	if len(code) != 8 {
+		return code
+	}
+	return code[:4] + "-" + code[4:]
+}
+
+// normalizeUserCode accepts a user code typed in any case, with or without
+// the dash or spaces.
+func normalizeUserCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			r -= 'a' - 'A'
+		}
+		if r >= 'A' && r <= 'Z' {
+			return r
+		}
+		return -1
+	}, code)
+}
+
+// LookupDeviceCode returns the pending device authorization a user code
+// belongs to, so the user can check what they are approving. Wrong codes
+// count towards the user's attempt limit.
+func (s *AuthService) LookupDeviceCode(ctx context.Context, user *db.User, userCode string) (*db.DeviceCode, error) {
+	if !s.devices.allow(user.ID) {
+		s.Audit(ctx, "link_device", "", AuditDenied, "too many wrong codes")
+		return nil, fmt.Errorf("%w: too many wrong codes, try again later", ErrRateLimited)
+	}
+	dc, err := s.users.GetPendingDeviceCode(ctx, normalizeUserCode(userCode), time.Now().UTC())
+	if errors.Is(err, db.ErrNotFound) {
+		s.devices.fail(user.ID)
+		return nil, fmt.Errorf("%w: the code is wrong or has expired", db.ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up device code: %w", err)
+	}
+	return dc, nil
+}
+
+// ResolveDeviceCode approves or denies the device authorization for a user
+// code. Approval fails if the device asks for scopes the user's role can't
+// use.
+func (s *AuthService) ResolveDeviceCode(ctx context.Context, user *db.User, userCode string, approve bool) (*db.DeviceCode, error) {
+	dc, err := s.LookupDeviceCode(ctx, user, userCode)
+	if err != nil {
+		return nil, err
+	}
+	status := db.DeviceCodeDenied
+	if approve {
+		for _, raw := range dc.Scopes {
+			if !auth.Scope(raw).UsableBy(auth.Role(user.Role)) {
+				return nil, fmt.Errorf("%w: the device asks for the %s scope, which the %s role can't use", ErrForbidden, raw, user.Role)
+			}
+		}
+		status = db.DeviceCodeApproved
+	}
+	if err := s.users.ResolveDeviceCode(ctx, dc.ID, user.ID, status); err != nil {
+		return nil, err
+	}
+	dc.Status, dc.UserID = status, user.ID
+	s.Audit(ctx, "link_device", dc.ClientName, AuditSuccess, status)
+	return dc, nil
+}
+
+// PollDeviceToken is called by the device with its device code. Until the
+// code is resolved it returns ErrAuthorizationPending, or ErrSlowDown when
+// polled more often than the interval allows. Once approved it returns a
+// new API token, exactly once.
+func (s *AuthService) PollDeviceToken(ctx context.Context, deviceCode string) (string, *db.APIToken, error) {
+	now := time.Now().UTC()
+	dc, err := s.users.GetDeviceCode(ctx, auth.HashToken(deviceCode))
+	if errors.Is(err, db.ErrNotFound) {
+		return "", nil, fmt.Errorf("%w: unknown device code", ErrInvalidInput)
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to look up device code: %w", err)
+	}
+	if !now.Before(dc.ExpiresAt) {
+		return "", nil, ErrExpiredToken
+	}
+
+	switch dc.Status {
+	case db.DeviceCodeDenied:
+		if err := s.users.DeleteDeviceCode(ctx, dc.ID); err != nil && !errors.Is(err, db.ErrNotFound) {
+			slog.WarnContext(ctx, "Failed to delete device code", "error", err)
+		}
+		return "", nil, ErrAccessDenied
+	case db.DeviceCodeApproved:
+		// Deleting first means concurrent polls can't both collect a
+		// token.
+		if err := s.users.DeleteDeviceCode(ctx, dc.ID); err != nil {
+			if errors.Is(err, db.ErrNotFound) {
+				return "", nil, ErrExpiredToken
+			}
+			return "", nil, fmt.Errorf("failed to delete device code: %w", err)
+		}
+		user, err := s.users.GetUserByID(ctx, dc.UserID)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to look up user: %w", err)
+		}
+		token, t, err := s.createAPIToken(ctx, user, dc.ClientName, dc.Scopes, DeviceTokenTTL, true)
+		if err != nil {
+			return "", nil, err
+		}
+		s.Audit(WithAPIToken(ctx, t, user), "device_linked", t.Name, AuditSuccess, strings.Join(t.Scopes, ","))
+		return token, t, nil
+	}
+
+	interval := dc.Interval
+	tooSoon := dc.LastPolledAt != nil && now.Sub(*dc.LastPolledAt) < time.Duration(interval)*time.Second
+	if tooSoon {
+		interval += int(deviceSlowDown / time.Second)
+	}
+	if err := s.users.UpdateDeviceCodePoll(ctx, dc.ID, now, interval); err != nil {
+		slog.WarnContext(ctx, "Failed to update device code", "error", err)
+	}
+	if tooSoon {
+		return "", nil, ErrSlowDown
+	}
+	return "", nil, ErrAuthorizationPending
+}
+
+// ListDevices returns the user's linked devices, that is the API tokens
+// issued through the device flow.
+func (s *AuthService) ListDevices(ctx context.Context, userID int) ([]db.APIToken, error) {
+	tokens, err := s.users.ListAPITokens(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	devices := []db.APIToken{}
+	for _, t := range tokens {
+		if t.Device {
+			devices = append(devices, t)
+		}
+	}
+	return devices, nil
+}
+
+// UnlinkDevice revokes the token of one of the user's linked devices. It
+// returns db.ErrNotFound for tokens that aren't the user's or weren't
+// issued to a device.
+func (s *AuthService) UnlinkDevice(ctx context.Context, userID, id int) error {
+	devices, err := s.ListDevices(ctx, userID)
+	if err != nil {
+		return err
+	}
+	for _, d := range devices {
+		if d.ID == id {
+			return s.users.DeleteAPIToken(ctx, userID, id)
+		}
+	}
+	return db.ErrNotFound
+}
+
+// allow reports whether the user may try another code.
+func (l *deviceLimiter) allow(userID int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	a, ok := l.attempts[userID]
+	if !ok || time.Since(a.start) >= codeAttemptWindow {
+		return true
+	}
+	return a.count < maxCodeAttempts
+}
+
+// fail counts a wrong code.
+func (l *deviceLimiter) fail(userID int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.attempts == nil {
+		l.attempts = make(map[int]*codeAttempts)
+	}
+	now := time.Now()
+	for id, a := range l.attempts {
+		if now.Sub(a.start) >= codeAttemptWindow {
+			delete(l.attempts, id)
+		}
+	}
+	a, ok := l.attempts[userID]
+	if !ok {
+		a = &codeAttempts{start: now}
+		l.attempts[userID] = a
+	}
+	a.count++
+}
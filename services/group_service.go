@@ -0,0 +1,205 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"DevMaan707/streamer/auth"
+	"DevMaan707/streamer/db"
+)
+
+// GroupService manages the groups videos can be shared with and decides
+// who can see which video.
+type GroupService struct {
+	groups db.GroupRepository
+	users  db.UserRepository
+}
+
+func NewGroupService(groups db.GroupRepository, users db.UserRepository) *GroupService {
+	return &GroupService{groups: groups, users: users}
+}
+
+func isAdmin(user *db.User) bool {
+	return user != nil && auth.Role(user.Role).Can(auth.PermAdmin)
+}
+
+// Access returns what listings show the user: everything for admins.
+func (s *GroupService) Access(user *db.User) db.VideoAccess {
+	if user == nil {
+		return db.VideoAccess{}
+	}
+	return db.VideoAccess{UserID: user.ID, All: isAdmin(user)}
+}
+
+// CanView reports whether the user may watch the video. Unlisted videos can
+// be watched by anyone; they are only left out of listings.
+func (s *GroupService) CanView(ctx context.Context, user *db.User, video *db.Video) (bool, error) {
+	if user == nil {
+		return false, nil
+	}
+	if isAdmin(user) || video.OwnerID == user.ID {
+		return true, nil
+	}
+	switch video.Visibility {
+	case db.VisibilityPublic, db.VisibilityUnlisted:
+		return true, nil
+	case db.VisibilityGroup:
+		ok, err := s.groups.IsGroupMember(ctx, video.GroupID, user.ID)
+		if err != nil {
+			return false, fmt.Errorf("failed to check group membership: %w", err)
+		}
+		return ok, nil
+	}
+	return false, nil
+}
+
+// CheckVisibility validates a visibility the user wants to give a video.
+// Videos can only be shared with groups the user is a member of, unless
+// they are an admin.
+func (s *GroupService) CheckVisibility(ctx context.Context, user *db.User, visibility string, groupID int) error {
+	if !slices.Contains(db.Visibilities, visibility) {
+		return fmt.Errorf("%w: visibility must be one of %s", ErrInvalidInput, strings.Join(db.Visibilities, ", "))
+	}
+	if visibility != db.VisibilityGroup {
+		return nil
+	}
+	if groupID == 0 {
+		return fmt.Errorf("%w: group_id is required for group visibility", ErrInvalidInput)
+	}
+	if _, err := s.groups.GetGroup(ctx, groupID); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return fmt.Errorf("%w: no such group", ErrInvalidInput)
+		}
+		return fmt.Errorf("failed to look up group: %w", err)
+	}
+	if isAdmin(user) {
+		return nil
+	}
+	ok, err := s.groups.IsGroupMember(ctx, groupID, user.ID)
+	if err != nil {
+		return fmt.Errorf("failed to check group membership: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("%w: you aren't a member of that group", ErrInvalidInput)
+	}
+	return nil
+}
+
+// UploadVisibility returns the visibility and group of a new upload by the
+// user: the requested ones, or if visibility is empty the user's
+// preferences. A preferred group the user has since left is no longer
+// allowed, so such uploads become private.
+func (s *GroupService) UploadVisibility(ctx context.Context, user *db.User, visibility string, groupID int) (string, int, error) {
+	if visibility != "" {
+		if err := s.CheckVisibility(ctx, user, visibility, groupID); err != nil {
+			return "", 0, err
+		}
+		return visibility, groupID, nil
+	}
+	prefs, err := s.Preferences(ctx, user)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := s.CheckVisibility(ctx, user, prefs.Visibility, prefs.GroupID); err != nil {
+		if !errors.Is(err, ErrInvalidInput) {
+			return "", 0, err
+		}
+		return db.VisibilityPrivate, 0, nil
+	}
+	return prefs.Visibility, prefs.GroupID, nil
+}
+
+// Preferences returns the user's defaults for new uploads.
+func (s *GroupService) Preferences(ctx context.Context, user *db.User) (*db.Preferences, error) {
+	prefs, err := s.users.GetUserPreferences(ctx, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load preferences: %w", err)
+	}
+	return prefs, nil
+}
+
+// SetPreferences changes the user's defaults for new uploads.
+func (s *GroupService) SetPreferences(ctx context.Context, user *db.User, prefs db.Preferences) error {
+	if err := s.CheckVisibility(ctx, user, prefs.Visibility, prefs.GroupID); err != nil {
+		return err
+	}
+	if prefs.Visibility != db.VisibilityGroup {
+		prefs.GroupID = 0
+	}
+	if err := s.users.SetUserPreferences(ctx, user.ID, prefs); err != nil {
+		return fmt.Errorf("failed to save preferences: %w", err)
+	}
+	return nil
+}
+
+// ListGroups returns every group to admins and the groups they are a
+// member of to everyone else.
+func (s *GroupService) ListGroups(ctx context.Context, user *db.User) ([]db.Group, error) {
+	userID := user.ID
+	if isAdmin(user) {
+		userID = 0
+	}
+	groups, err := s.groups.ListGroups(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list groups: %w", err)
+	}
+	return groups, nil
+}
+
+func (s *GroupService) CreateGroup(ctx context.Context, name string) (*db.Group, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 64 {
+		return nil, fmt.Errorf("%w: group names are 1-64 characters", ErrInvalidInput)
+	}
+	g := &db.Group{Name: name, CreatedAt: time.Now().UTC(), Members: []string{}}
+	if err := s.groups.CreateGroup(ctx, g); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// DeleteGroup deletes a group. Videos shared with it are then only seen by
+// their owners.
+func (s *GroupService) DeleteGroup(ctx context.Context, id int) error {
+	return s.groups.DeleteGroup(ctx, id)
+}
+
+// AddMember adds the named user to a group.
+func (s *GroupService) AddMember(ctx context.Context, groupID int, username string) error {
+	user, err := s.member(ctx, groupID, username)
+	if err != nil {
+		return err
+	}
+	if err := s.groups.AddGroupMember(ctx, groupID, user.ID); err != nil {
+		return fmt.Errorf("failed to add group member: %w", err)
+	}
+	return nil
+}
+
+// RemoveMember removes the named user from a group.
+func (s *GroupService) RemoveMember(ctx context.Context, groupID int, username string) error {
+	user, err := s.member(ctx, groupID, username)
+	if err != nil {
+		return err
+	}
+	return s.groups.RemoveGroupMember(ctx, groupID, user.ID)
+}
+
+// member looks up a group and a user to add to or remove from it.
+func (s *GroupService) member(ctx context.Context, groupID int, username string) (*db.User, error) {
+	if _, err := s.groups.GetGroup(ctx, groupID); err != nil {
+		return nil, err
+	}
+	user, err := s.users.GetUserByUsername(ctx, normalizeUsername(username))
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, fmt.Errorf("%w: no user named %q", ErrInvalidInput, username)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up user: %w", err)
+	}
+	return user, nil
+}
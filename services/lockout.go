@@ -0,0 +1,210 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"DevMaan707/streamer/db"
+)
+
+// LockoutPolicy slows down and stops password guessing. Each failed login
+// makes the next attempt on the same account, and from the same client
+// address, wait a little longer; Attempts consecutive failures on an
+// account, or IPAttempts from an address, lock it out for Duration.
+// Failures are forgotten after Duration without any. Zero attempts turn
+// the delays and lockout off.
+type LockoutPolicy struct {
+	Attempts   int
+	IPAttempts int
+	Duration   time.Duration
+}
+
+// maxLoginDelay caps the delays before an account or address is locked
+// out.
+const maxLoginDelay = 30 * time.Second
+
+// loginAttemptRetention is how long failed logins are shown to users.
+const loginAttemptRetention = 30 * 24 * time.Hour
+
+// delay returns how long after the last of failures consecutive failures
+// the next attempt has to wait, when attempts of them lock out.
+func (p LockoutPolicy) delay(failures, attempts int) time.Duration {
+	switch {
+	case attempts == 0 || failures == 0:
+		return 0
+	case failures >= attempts:
+		return p.Duration
+	case failures > 6:
+		return maxLoginDelay
+	}
+	return min(time.Second<<(failures-1), maxLoginDelay)
+}
+
+// LoginDelayError is returned by Login while an account or client address
+// has to wait before trying again. It wraps ErrRateLimited.
+type LoginDelayError struct {
+	// Wait is how long until the next attempt is allowed.
+	Wait time.Duration
+	// Locked is set when the wait is a lockout rather than a short delay.
+	Locked bool
+}
+
+func (e *LoginDelayError) Error() string {
+	wait := e.Wait.Round(time.Second)
+	if e.Locked {
+		return fmt.Sprintf("%v: too many failed logins, try again in %v", ErrRateLimited, wait)
+	}
+	return fmt.Sprintf("%v: try again in %v", ErrRateLimited, wait)
+}
+
+func (e *LoginDelayError) Unwrap() error {
+	return ErrRateLimited
+}
+
+func accountSubject(username string) string {
+	return "account:" + username
+}
+
+func ipSubject(clientIP string) string {
+	return "ip:" + clientIP
+}
+
+// reservedLogin is a login attempt counted against an account or client
+// address before the password is checked.
+type reservedLogin struct {
+	subject  string
+	attempts int
+	// failures counts the failures including this attempt.
+	failures int
+	// lockAction and lockTarget are audited when the attempt locks the
+	// subject out.
+	lockAction, lockTarget string
+}
+
+// reserveLoginAttempt counts a login attempt as a failed one against the
+// account and the client address before the password is checked, so that
+// guesses sent at the same time are slowed down as much as guesses sent one
+// after the other. If either has to wait, nothing is counted and a
+// LoginDelayError with the longer wait is returned. The attempts are taken
+// back, or the account's failures cleared, once the login succeeds.
+func (s *AuthService) reserveLoginAttempt(ctx context.Context, username, clientIP string, now time.Time) ([]reservedLogin, error) {
+	candidates := []reservedLogin{{
+		subject: accountSubject(username), attempts: s.lockout.Attempts,
+		lockAction: "lock_account", lockTarget: username,
+	}}
+	if clientIP != "" {
+		candidates = append(candidates, reservedLogin{
+			subject: ipSubject(clientIP), attempts: s.lockout.IPAttempts,
+			lockAction: "lock_client", lockTarget: clientIP,
+		})
+	}
+
+	var reserved []reservedLogin
+	var longest *LoginDelayError
+	since := now.Add(-s.lockout.Duration)
+	for _, c := range candidates {
+		if c.attempts == 0 {
+			continue
+		}
+		var delay *LoginDelayError
+		failures, ok, err := s.logins.ReserveLoginAttempt(ctx, c.subject, now, since, func(failures int, last time.Time) bool {
+			wait := last.Add(s.lockout.delay(failures, c.attempts)).Sub(now)
+			delay = &LoginDelayError{Wait: wait, Locked: failures >= c.attempts}
+			return wait <= 0
+		})
+		if err != nil {
+			s.releaseLoginAttempts(ctx, reserved)
+			return nil, fmt.Errorf("failed to count login attempt: %w", err)
+		}
+		if !ok {
+			if longest == nil || delay.Wait > longest.Wait {
+				longest = delay
+			}
+			continue
+		}
+		c.failures = failures + 1
+		reserved = append(reserved, c)
+	}
+	if longest != nil {
+		s.releaseLoginAttempts(ctx, reserved)
+		return nil, longest
+	}
+	return reserved, nil
+}
+
+// releaseLoginAttempts takes back attempts that didn't fail after all.
+func (s *AuthService) releaseLoginAttempts(ctx context.Context, reserved []reservedLogin) {
+	for _, r := range reserved {
+		if err := s.logins.ReleaseLoginAttempt(ctx, r.subject); err != nil {
+			slog.WarnContext(ctx, "Failed to take back login attempt", "error", err)
+		}
+	}
+}
+
+// recordLoginFailure keeps a failed login to an existing account for the
+// user to see. The admins are told through the audit trail when the
+// reserved attempt locks an account or address out.
+func (s *AuthService) recordLoginFailure(ctx context.Context, reserved []reservedLogin, user *db.User, userAgent, clientIP string) {
+	if user != nil {
+		a := &db.LoginAttempt{UserID: user.ID, ClientIP: clientIP, UserAgent: truncate(userAgent, 255), CreatedAt: time.Now().UTC()}
+		if err := s.logins.CreateLoginAttempt(ctx, a); err != nil {
+			slog.WarnContext(ctx, "Failed to record failed login", "error", err)
+		}
+	}
+	for _, r := range reserved {
+		if r.failures == r.attempts {
+			s.Audit(ctx, r.lockAction, r.lockTarget, AuditDenied,
+				fmt.Sprintf("%d failed logins, locked for %v", r.failures, s.lockout.Duration))
+		}
+	}
+}
+
+// UnlockAccount ends a user's lockout and forgets their failed logins. It
+// returns db.ErrNotFound if the account has no recent failures.
+func (s *AuthService) UnlockAccount(ctx context.Context, userID int) (*db.User, error) {
+	user, err := s.users.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	since := time.Now().UTC().Add(-s.lockout.Duration)
+	if err := s.logins.ClearLoginFailures(ctx, accountSubject(user.Username), since); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, fmt.Errorf("%w: %s has no failed logins", db.ErrNotFound, user.Username)
+		}
+		return nil, fmt.Errorf("failed to unlock account: %w", err)
+	}
+	return user, nil
+}
+
+// LoginLock describes the lockout of an account.
+type LoginLock struct {
+	Failures int `json:"failed_logins"`
+	// LockedUntil is set while the account is locked out.
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+}
+
+// LoginLock returns the user's recent consecutive failed logins and
+// whether they are locked out.
+func (s *AuthService) LoginLock(ctx context.Context, user *db.User) (*LoginLock, error) {
+	now := time.Now().UTC()
+	failures, last, err := s.logins.GetLoginFailures(ctx, accountSubject(user.Username), now.Add(-s.lockout.Duration))
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up failed logins: %w", err)
+	}
+	lock := &LoginLock{Failures: failures}
+	if s.lockout.Attempts > 0 && failures >= s.lockout.Attempts {
+		if until := last.Add(s.lockout.Duration); until.After(now) {
+			lock.LockedUntil = &until
+		}
+	}
+	return lock, nil
+}
+
+// LoginAttempts returns the failed logins to the user's account in the
+// last 30 days, newest first.
+func (s *AuthService) LoginAttempts(ctx context.Context, user *db.User) ([]db.LoginAttempt, error) {
+	return s.logins.ListLoginAttempts(ctx, user.ID, time.Now().UTC().Add(-loginAttemptRetention))
+}
@@ -0,0 +1,103 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"DevMaan707/streamer/auth"
+	"DevMaan707/streamer/db"
+)
+
+func newLockoutTestService(t *testing.T, policy LockoutPolicy) (*AuthService, *db.MemoryStore) {
+	t.Helper()
+	store := db.NewMemoryStore()
+	svc := NewAuthService(store, store, store, time.Hour, time.Hour, policy)
+	if _, err := svc.CreateUser(context.Background(), "alice", "correct horse battery", auth.RoleViewer); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	return svc, store
+}
+
+func TestLoginDelaysConcurrentGuesses(t *testing.T) {
+	svc, _ := newLockoutTestService(t, LockoutPolicy{Attempts: 5, IPAttempts: 20, Duration: 15 * time.Minute})
+
+	const guesses = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, guesses)
+	for range guesses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, _, err := svc.Login(context.Background(), "alice", "wrong password", "test", "192.0.2.1")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	var invalid, delayed int
+	for err := range errs {
+		var delay *LoginDelayError
+		switch {
+		case errors.Is(err, ErrInvalidCredentials):
+			invalid++
+		case errors.As(err, &delay):
+			delayed++
+		default:
+			t.Errorf("Login: unexpected error %v", err)
+		}
+	}
+	if invalid != 1 || delayed != guesses-1 {
+		t.Errorf("got %d passwords checked and %d delayed, want 1 and %d", invalid, delayed, guesses-1)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	svc, store := newLockoutTestService(t, LockoutPolicy{Attempts: 3, IPAttempts: 20, Duration: 15 * time.Minute})
+	ctx := context.Background()
+
+	// Two earlier failures whose delays have passed.
+	earlier := time.Now().UTC().Add(-time.Minute)
+	for range 2 {
+		if _, ok, err := store.ReserveLoginAttempt(ctx, accountSubject("alice"), earlier, earlier.Add(-time.Hour),
+			func(int, time.Time) bool { return true }); !ok || err != nil {
+			t.Fatalf("ReserveLoginAttempt: %v, %v", ok, err)
+		}
+	}
+	if _, _, _, err := svc.Login(ctx, "alice", "wrong password", "test", "192.0.2.1"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("third guess: got %v, want ErrInvalidCredentials", err)
+	}
+
+	var delay *LoginDelayError
+	_, _, _, err := svc.Login(ctx, "alice", "correct horse battery", "test", "192.0.2.2")
+	if !errors.As(err, &delay) || !delay.Locked {
+		t.Fatalf("login to a locked account: got %v, want a lockout", err)
+	}
+	if !errors.Is(err, ErrRateLimited) {
+		t.Errorf("lockout error %v doesn't wrap ErrRateLimited", err)
+	}
+
+	user, err := store.GetUserByUsername(ctx, "alice")
+	if err != nil {
+		t.Fatalf("GetUserByUsername: %v", err)
+	}
+	if _, err := svc.UnlockAccount(ctx, user.ID); err != nil {
+		t.Fatalf("UnlockAccount: %v", err)
+	}
+	if _, _, _, err := svc.Login(ctx, "alice", "correct horse battery", "test", "192.0.2.2"); err != nil {
+		t.Fatalf("login after unlocking: %v", err)
+	}
+	if _, err := svc.UnlockAccount(ctx, user.ID); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("unlocking an account without failures: got %v, want db.ErrNotFound", err)
+	}
+	attempts, err := svc.LoginAttempts(ctx, user)
+	if err != nil {
+		t.Fatalf("LoginAttempts: %v", err)
+	}
+	if len(attempts) != 1 || attempts[0].ClientIP != "192.0.2.1" {
+		t.Errorf("got failed logins %+v, want the one from 192.0.2.1", attempts)
+	}
+}
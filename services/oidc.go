@@ -0,0 +1,364 @@
+package services
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"DevMaan707/streamer/auth"
+	"DevMaan707/streamer/config"
+	"DevMaan707/streamer/db"
+	"DevMaan707/streamer/tracing"
+)
+
+// refreshRetry is how long a session keeps working before the next refresh
+// attempt when the identity provider can't be reached.
+const refreshRetry = time.Minute
+
+// OIDCService logs users in through an OpenID Connect identity provider,
+// provisioning accounts and mapping roles from ID token claims, and keeps
+// single sign-on sessions in step with the provider through refresh tokens.
+type OIDCService struct {
+	auth            *AuthService
+	users           db.UserRepository
+	provider        *auth.OIDCProvider
+	name            string
+	usernameClaim   string
+	rolesClaim      string
+	roleMapping     map[string]auth.Role
+	defaultRole     auth.Role
+	autoProvision   bool
+	refreshInterval time.Duration
+
+	// refreshing holds the refreshes in progress by session ID, so
+	// concurrent requests of one session share a single refresh instead of
+	// racing to use a refresh token the provider may rotate.
+	mu         sync.Mutex
+	refreshing map[int]*refreshCall
+}
+
+type refreshCall struct {
+	done chan struct{}
+	user *db.User
+	err  error
+}
+
+// NewOIDCService sets up single sign-on for authSvc, whose Authenticate
+// then refreshes single sign-on sessions when they are due.
+func NewOIDCService(authSvc *AuthService, cfg config.OIDCConfig) (*OIDCService, error) {
+	s := &OIDCService{
+		auth:            authSvc,
+		users:           authSvc.users,
+		provider:        auth.NewOIDCProvider(cfg.Issuer, cfg.ClientID, cfg.ClientSecret, cfg.RedirectURL, cfg.Scopes),
+		name:            cfg.Name,
+		usernameClaim:   cfg.UsernameClaim,
+		rolesClaim:      cfg.RolesClaim,
+		roleMapping:     make(map[string]auth.Role),
+		autoProvision:   cfg.AutoProvision,
+		refreshInterval: cfg.RefreshInterval,
+		refreshing:      make(map[int]*refreshCall),
+	}
+	for value, name := range cfg.RoleMapping {
+		role, err := auth.ParseRole(name)
+		if err != nil {
+			return nil, fmt.Errorf("auth.oidc.role_mapping: %w", err)
+		}
+		s.roleMapping[value] = role
+	}
+	if cfg.DefaultRole != "" {
+		role, err := auth.ParseRole(cfg.DefaultRole)
+		if err != nil {
+			return nil, fmt.Errorf("auth.oidc.default_role: %w", err)
+		}
+		s.defaultRole = role
+	}
+	authSvc.oidc = s
+	return s, nil
+}
+
+// Name is the label of the login button.
+func (s *OIDCService) Name() string {
+	return s.name
+}
+
+// OIDCLogin is what has to be kept, in a cookie, between sending the
+// browser to the identity provider and its return to the callback.
+type OIDCLogin struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	// Link marks a logged-in user linking their provider account rather
+	// than logging in.
+	Link bool `json:"link,omitempty"`
+}
+
+// BeginLogin returns the identity provider URL to redirect to and the
+// login state for the callback.
+func (s *OIDCService) BeginLogin(ctx context.Context, link bool) (string, *OIDCLogin, error) {
+	login := &OIDCLogin{Link: link}
+	for _, dst := range []*string{&login.State, &login.Nonce, &login.Verifier} {
+		token, err := auth.NewPKCEVerifier()
+		if err != nil {
+			return "", nil, err
+		}
+		*dst = token
+	}
+	url, err := s.provider.AuthCodeURL(ctx, login.State, login.Nonce, login.Verifier)
+	if err != nil {
+		return "", nil, err
+	}
+	return url, login, nil
+}
+
+// Exchange completes the authorization code flow for the state and code
+// the identity provider sent back, returning the verified tokens.
+func (s *OIDCService) Exchange(ctx context.Context, login *OIDCLogin, state, code string) (*auth.OIDCTokens, error) {
+	ctx, span := tracing.Start(ctx, "OIDCService.Exchange")
+	defer span.End()
+
+	if login == nil || subtle.ConstantTimeCompare([]byte(login.State), []byte(state)) != 1 {
+		return nil, fmt.Errorf("%w: the login expired or was started in another browser, please try again", ErrInvalidInput)
+	}
+	if code == "" {
+		return nil, fmt.Errorf("%w: the identity provider sent no authorization code", ErrInvalidInput)
+	}
+	tokens, err := s.provider.Exchange(ctx, code, login.Verifier, login.Nonce)
+	if errors.Is(err, auth.ErrTokenRejected) {
+		slog.WarnContext(ctx, "Identity provider rejected the authorization code", "error", err)
+		return nil, fmt.Errorf("%w: the identity provider rejected the login", ErrUnauthenticated)
+	}
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to complete single sign-on: %w", err)
+	}
+	return tokens, nil
+}
+
+// Login starts a session for the user the tokens identify, creating the
+// account first if auto-provisioning is on. Roles are synced from the
+// claims when a role mapping is configured.
+func (s *OIDCService) Login(ctx context.Context, tokens *auth.OIDCTokens, userAgent, clientIP string) (string, *db.Session, *db.User, error) {
+	ctx, span := tracing.Start(ctx, "OIDCService.Login")
+	defer span.End()
+
+	subject := tokens.Claims.String("sub")
+	user, err := s.users.GetUserByIdentity(ctx, s.provider.Issuer(), subject)
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		if user, err = s.provision(ctx, tokens.Claims); err != nil {
+			return "", nil, nil, err
+		}
+	case err != nil:
+		span.RecordError(err)
+		return "", nil, nil, fmt.Errorf("failed to look up identity: %w", err)
+	default:
+		if user, err = s.syncRole(ctx, user, tokens.Claims); err != nil {
+			return "", nil, nil, err
+		}
+	}
+
+	if _, err := s.users.DeleteExpiredSessions(ctx, time.Now().UTC()); err != nil {
+		slog.WarnContext(ctx, "Failed to delete expired sessions", "error", err)
+	}
+	sess := &db.Session{UserID: user.ID, UserAgent: userAgent, ClientIP: clientIP}
+	if tokens.RefreshToken != "" {
+		refreshAt := time.Now().UTC().Add(s.refreshInterval)
+		sess.RefreshToken = tokens.RefreshToken
+		sess.RefreshAt = &refreshAt
+	}
+	token, err := s.auth.createSession(ctx, sess)
+	if err != nil {
+		span.RecordError(err)
+		return "", nil, nil, err
+	}
+	s.auth.Audit(WithSession(ctx, sess, user), "oidc_login", user.Username, AuditSuccess, "subject "+subject)
+	return token, sess, user, nil
+}
+
+// Link connects the provider account the tokens identify to user, so they
+// can log in with single sign-on from then on.
+func (s *OIDCService) Link(ctx context.Context, user *db.User, tokens *auth.OIDCTokens) error {
+	subject := tokens.Claims.String("sub")
+	err := s.users.CreateIdentity(ctx, &db.Identity{
+		UserID:    user.ID,
+		Issuer:    s.provider.Issuer(),
+		Subject:   subject,
+		CreatedAt: time.Now().UTC(),
+	})
+	if errors.Is(err, db.ErrConflict) {
+		return fmt.Errorf("%w: this %s account is linked to an account already", db.ErrConflict, s.name)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to link identity: %w", err)
+	}
+	s.auth.Audit(ctx, "link_identity", user.Username, AuditSuccess, "subject "+subject)
+	return nil
+}
+
+// provision creates an account for a user logging in for the first time.
+func (s *OIDCService) provision(ctx context.Context, claims auth.Claims) (*db.User, error) {
+	if !s.autoProvision {
+		return nil, fmt.Errorf("%w: no account is linked to this %s account; log in with your password and link it first", ErrForbidden, s.name)
+	}
+	role, ok := s.mapRole(claims)
+	if !ok {
+		s.auth.Audit(ctx, "oidc_login", claims.String("sub"), AuditDenied, "no role mapped")
+		return nil, fmt.Errorf("%w: your %s account isn't allowed to use Starflix", ErrForbidden, s.name)
+	}
+	username, err := s.username(claims)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	user := &db.User{Username: username, Role: string(role), CreatedAt: now, UpdatedAt: now}
+	ident := &db.Identity{Issuer: s.provider.Issuer(), Subject: claims.String("sub"), CreatedAt: now}
+	err = s.users.CreateUserWithIdentity(ctx, user, ident)
+	if errors.Is(err, db.ErrConflict) {
+		return nil, fmt.Errorf("%w: an account named %s exists already; log in with its password and link your %s account", db.ErrConflict, username, s.name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to provision user: %w", err)
+	}
+	s.auth.Audit(ctx, "provision_user", user.Username, AuditSuccess, "role "+user.Role)
+	return user, nil
+}
+
+// username derives a username for a new account from the configured claim,
+// falling back to the email address and then the subject.
+func (s *OIDCService) username(claims auth.Claims) (string, error) {
+	for _, claim := range []string{s.usernameClaim, "email", "sub"} {
+		name, _, _ := strings.Cut(claims.String(claim), "@")
+		name = strings.Map(func(r rune) rune {
+			switch {
+			case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+				return r
+			}
+			return '-'
+		}, strings.ToLower(name))
+		name = strings.TrimLeft(name, "._-")
+		name = truncate(name, 64)
+		if usernamePattern.MatchString(name) {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("%w: the identity provider sent no usable username", ErrInvalidInput)
+}
+
+// mapRole returns the most privileged role the claims map to, or the
+// default role. It reports false if the user should be refused.
+func (s *OIDCService) mapRole(claims auth.Claims) (auth.Role, bool) {
+	best := -1
+	for _, value := range claims.Strings(s.rolesClaim) {
+		if role, ok := s.roleMapping[value]; ok {
+			if i := slices.Index(auth.Roles, role); best == -1 || i < best {
+				best = i
+			}
+		}
+	}
+	if best >= 0 {
+		return auth.Roles[best], true
+	}
+	return s.defaultRole, s.defaultRole != ""
+}
+
+// syncRole updates a returning user's role from the claims when roles are
+// managed at the identity provider, refusing users who map to no role.
+func (s *OIDCService) syncRole(ctx context.Context, user *db.User, claims auth.Claims) (*db.User, error) {
+	if len(s.roleMapping) == 0 {
+		return user, nil
+	}
+	role, ok := s.mapRole(claims)
+	if !ok {
+		s.auth.Audit(ctx, "oidc_login", user.Username, AuditDenied, "no role mapped")
+		return nil, fmt.Errorf("%w: your %s account isn't allowed to use Starflix", ErrForbidden, s.name)
+	}
+	if auth.Role(user.Role) == role {
+		return user, nil
+	}
+	updated, err := s.auth.SetRole(ctx, user.ID, role)
+	if err != nil {
+		// Most likely the last admin losing the admin group; keeping the
+		// role beats locking everyone out of administration.
+		slog.WarnContext(ctx, "Failed to update role from identity provider", "user", user.Username, "role", role, "error", err)
+		return user, nil
+	}
+	s.auth.Audit(ctx, "set_role", user.Username, AuditSuccess, "role "+updated.Role+" from identity provider")
+	return updated, nil
+}
+
+// refresh checks a due single sign-on session with the identity provider.
+// A rejected refresh token, or claims that no longer map to a role, end
+// the session; an unreachable provider only postpones the check.
+func (s *OIDCService) refresh(ctx context.Context, sess *db.Session, user *db.User) (*db.User, error) {
+	s.mu.Lock()
+	if call, ok := s.refreshing[sess.ID]; ok {
+		s.mu.Unlock()
+		<-call.done
+		return call.user, call.err
+	}
+	call := &refreshCall{done: make(chan struct{})}
+	s.refreshing[sess.ID] = call
+	s.mu.Unlock()
+
+	call.user, call.err = s.doRefresh(ctx, sess, user)
+
+	s.mu.Lock()
+	delete(s.refreshing, sess.ID)
+	s.mu.Unlock()
+	close(call.done)
+	return call.user, call.err
+}
+
+func (s *OIDCService) doRefresh(ctx context.Context, sess *db.Session, user *db.User) (*db.User, error) {
+	ctx, span := tracing.Start(ctx, "OIDCService.Refresh")
+	defer span.End()
+
+	now := time.Now().UTC()
+	end := func(reason string) (*db.User, error) {
+		if err := s.users.DeleteSession(ctx, sess.UserID, sess.ID); err != nil && !errors.Is(err, db.ErrNotFound) {
+			slog.WarnContext(ctx, "Failed to end session", "error", err)
+		}
+		s.auth.Audit(WithSession(ctx, sess, user), "oidc_refresh", user.Username, AuditDenied, reason)
+		return nil, ErrUnauthenticated
+	}
+
+	tokens, err := s.provider.Refresh(ctx, sess.RefreshToken)
+	if errors.Is(err, auth.ErrTokenRejected) {
+		return end(err.Error())
+	}
+	if err != nil {
+		span.RecordError(err)
+		slog.WarnContext(ctx, "Failed to refresh single sign-on session, retrying later", "user", user.Username, "error", err)
+		if err := s.users.UpdateSessionRefresh(ctx, sess.ID, sess.RefreshToken, now.Add(refreshRetry)); err != nil {
+			slog.WarnContext(ctx, "Failed to update session", "error", err)
+		}
+		return user, nil
+	}
+
+	if tokens.Claims != nil {
+		linked, err := s.users.GetUserByIdentity(ctx, s.provider.Issuer(), tokens.Claims.String("sub"))
+		if errors.Is(err, db.ErrNotFound) || (err == nil && linked.ID != user.ID) {
+			return end("identity no longer linked")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up identity: %w", err)
+		}
+		if user, err = s.syncRole(WithSession(ctx, sess, user), user, tokens.Claims); err != nil {
+			return end("no role mapped")
+		}
+	}
+
+	refreshAt := now.Add(s.refreshInterval)
+	if err := s.users.UpdateSessionRefresh(ctx, sess.ID, tokens.RefreshToken, refreshAt); err != nil {
+		return nil, fmt.Errorf("failed to update session: %w", err)
+	}
+	sess.RefreshToken = tokens.RefreshToken
+	sess.RefreshAt = &refreshAt
+	return user, nil
+}
@@ -0,0 +1,287 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"DevMaan707/streamer/auth"
+	"DevMaan707/streamer/db"
+)
+
+const (
+	// DefaultShareTTL and MaxShareTTL bound how long share links last.
+	DefaultShareTTL = 7 * 24 * time.Hour
+	MaxShareTTL     = 90 * 24 * time.Hour
+	// MinSharePasswordLength is shorter than MinPasswordLength, as share
+	// passwords are passed on by phone and only guard one video.
+	MinSharePasswordLength = 4
+	// playProbeBytes is the size below which a request from the start of
+	// a video is taken as a player probing it rather than a play.
+	playProbeBytes = 1024
+	// SharePlayTTL is how long a counted play of a share lets its player
+	// seek, that is send range requests further into the video.
+	SharePlayTTL = 6 * time.Hour
+)
+
+var (
+	// ErrShareLocked is returned for password-protected shares that haven't
+	// been unlocked.
+	ErrShareLocked = errors.New("this video is password protected")
+	// ErrWrongSharePassword is returned by Unlock for a wrong password.
+	ErrWrongSharePassword = errors.New("wrong password")
+	// ErrSharePlaysUsed is returned once a share has been played as often
+	// as it allows.
+	ErrSharePlaysUsed = errors.New("this link has been played as often as it allows")
+	// ErrSharePlayNotStarted is returned for range requests into a shared
+	// video that don't belong to a counted play.
+	ErrSharePlayNotStarted = errors.New("playback has to start from the beginning of the video")
+)
+
+// ShareService manages share links, which let people without an account
+// watch a single video.
+type ShareService struct {
+	shares db.ShareRepository
+	videos *VideoService
+	// playSecret signs play keys. Plays are short-lived, so a new secret
+	// on every start does no more harm than making players start over.
+	playSecret []byte
+}
+
+func NewShareService(shares db.ShareRepository, videos *VideoService) *ShareService {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(fmt.Sprintf("failed to generate play key secret: %v", err))
+	}
+	return &ShareService{shares: shares, videos: videos, playSecret: secret}
+}
+
+// ShareOptions are the limits of a new share. A zero TTL means
+// DefaultShareTTL, zero MaxPlays unlimited plays and an empty Password no
+// password.
+type ShareOptions struct {
+	TTL      time.Duration
+	MaxPlays int
+	Password string
+}
+
+// CreateShare creates a share link for a video. Only its owner and admins
+// may. The token is only returned here.
+func (s *ShareService) CreateShare(ctx context.Context, user *db.User, videoID int, opts ShareOptions) (string, *db.Share, error) {
+	if opts.TTL == 0 {
+		opts.TTL = DefaultShareTTL
+	}
+	if opts.TTL < 0 || opts.TTL > MaxShareTTL {
+		return "", nil, fmt.Errorf("%w: shares can last at most %s", ErrInvalidInput, MaxShareTTL)
+	}
+	if opts.MaxPlays < 0 {
+		return "", nil, fmt.Errorf("%w: max_plays can't be negative", ErrInvalidInput)
+	}
+	if opts.Password != "" && len(opts.Password) < MinSharePasswordLength {
+		return "", nil, fmt.Errorf("%w: share passwords must be at least %d characters", ErrInvalidInput, MinSharePasswordLength)
+	}
+	video, err := s.videos.ownVideo(ctx, videoID, auth.PermAdmin, "share")
+	if err != nil {
+		return "", nil, err
+	}
+
+	token, err := auth.NewToken()
+	if err != nil {
+		return "", nil, err
+	}
+	now := time.Now().UTC()
+	sh := &db.Share{
+		VideoID:    video.ID,
+		VideoTitle: video.Title,
+		UserID:     user.ID,
+		TokenHash:  auth.HashToken(token),
+		MaxPlays:   opts.MaxPlays,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(opts.TTL),
+	}
+	if opts.Password != "" {
+		if sh.PasswordHash, err = auth.HashPassword(opts.Password); err != nil {
+			return "", nil, fmt.Errorf("failed to hash share password: %w", err)
+		}
+	}
+	if err := s.shares.CreateShare(ctx, sh); err != nil {
+		return "", nil, fmt.Errorf("failed to create share: %w", err)
+	}
+	return token, sh, nil
+}
+
+// ListShares returns the user's shares, of one video or, with a videoID of
+// 0, of all.
+func (s *ShareService) ListShares(ctx context.Context, userID, videoID int) ([]db.Share, error) {
+	return s.shares.ListShares(ctx, userID, videoID)
+}
+
+// RevokeShare deletes one of the user's shares. It returns db.ErrNotFound
+// if the share doesn't exist or belongs to someone else.
+func (s *ShareService) RevokeShare(ctx context.Context, userID, id int) error {
+	return s.shares.DeleteShare(ctx, userID, id)
+}
+
+// OpenShare returns the share a token belongs to, if it is still valid.
+func (s *ShareService) OpenShare(ctx context.Context, token string) (*db.Share, error) {
+	sh, err := s.shares.GetShare(ctx, auth.HashToken(token), time.Now().UTC())
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, fmt.Errorf("%w: this link has expired or been revoked", db.ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up share: %w", err)
+	}
+	return sh, nil
+}
+
+// Video returns the shared video. Share links work whatever the video's
+// visibility, so it isn't checked.
+func (s *ShareService) Video(ctx context.Context, sh *db.Share) (*db.Video, error) {
+	return s.videos.videos.GetVideo(ctx, sh.VideoID)
+}
+
+// Unlock checks the password of a share and returns the key that proves it
+// was entered, to be kept in a cookie.
+func (s *ShareService) Unlock(sh *db.Share, password string) (string, error) {
+	if sh.PasswordHash == "" {
+		return "", nil
+	}
+	if err := auth.VerifyPassword(sh.PasswordHash, password); err != nil {
+		return "", ErrWrongSharePassword
+	}
+	return unlockKey(sh), nil
+}
+
+// Unlocked reports whether key unlocks the share. Shares without a password
+// are always unlocked.
+func (s *ShareService) Unlocked(sh *db.Share, key string) bool {
+	return sh.PasswordHash == "" || hmac.Equal([]byte(key), []byte(unlockKey(sh)))
+}
+
+// unlockKey is derived from the password hash, which never leaves the
+// server, so it can't be made up without the password and nothing needs
+// to be stored for it.
+func unlockKey(sh *db.Share) string {
+	mac := hmac.New(sha256.New, []byte(sh.PasswordHash))
+	mac.Write([]byte(sh.TokenHash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Play checks a stream request of the shared video before StreamShare
+// serves it. A request from the start of the file begins a play, which is
+// counted and returns a play key to keep in a cookie. Range requests
+// further into the file must carry the key of a play that hasn't expired,
+// so players can seek but the video can't be fetched without being
+// counted; only the tiny probes some players send first need neither.
+// Once the share's plays are used up, everything but the requests of a
+// counted play is refused.
+func (s *ShareService) Play(ctx context.Context, r *http.Request, sh *db.Share, playKey string) (string, error) {
+	now := time.Now().UTC()
+	playing := s.validPlayKey(sh, playKey, now)
+	if !playing && sh.MaxPlays > 0 && sh.Plays >= sh.MaxPlays {
+		return "", ErrSharePlaysUsed
+	}
+	switch {
+	case StartsPlay(r):
+		if err := s.shares.RecordSharePlay(ctx, sh.ID, now); err != nil {
+			if errors.Is(err, db.ErrNotFound) {
+				return "", ErrSharePlaysUsed
+			}
+			return "", fmt.Errorf("failed to record share play: %w", err)
+		}
+		slog.InfoContext(ctx, "Shared video played", "share", sh.ID, "video", sh.VideoID, "plays", sh.Plays+1)
+		return s.playKey(sh, now.Add(SharePlayTTL)), nil
+	case playing, probesPlay(r):
+		return "", nil
+	}
+	return "", ErrSharePlayNotStarted
+}
+
+// playKey proves that a play of the share was counted, until expires.
+func (s *ShareService) playKey(sh *db.Share, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return exp + "." + s.playMAC(sh, exp)
+}
+
+func (s *ShareService) validPlayKey(sh *db.Share, key string, now time.Time) bool {
+	exp, mac, ok := strings.Cut(key, ".")
+	if !ok {
+		return false
+	}
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || now.Unix() >= expires {
+		return false
+	}
+	return hmac.Equal([]byte(mac), []byte(s.playMAC(sh, exp)))
+}
+
+func (s *ShareService) playMAC(sh *db.Share, exp string) string {
+	mac := hmac.New(sha256.New, s.playSecret)
+	fmt.Fprintf(mac, "%d:%s", sh.ID, exp)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// StreamShare streams the shared video, once Play has allowed the request.
+func (s *ShareService) StreamShare(w http.ResponseWriter, r *http.Request, sh *db.Share) error {
+	video, err := s.Video(r.Context(), sh)
+	if err != nil {
+		return err
+	}
+	return s.videos.streamFile(w, r, video.FilePath)
+}
+
+// ServeShareCover serves the cover of the shared video.
+func (s *ShareService) ServeShareCover(w http.ResponseWriter, r *http.Request, sh *db.Share) error {
+	video, err := s.Video(r.Context(), sh)
+	if err != nil {
+		return err
+	}
+	if video.CoverImage == "" {
+		return db.ErrNotFound
+	}
+	return s.videos.serveCover(w, r, video.CoverImage)
+}
+
+// StartsPlay reports whether a stream request reads from the start of the
+// file, as players do when playback begins.
+func StartsPlay(r *http.Request) bool {
+	end, ok := fromStart(r)
+	return ok && (end < 0 || end >= playProbeBytes)
+}
+
+// probesPlay reports whether a stream request only reads the first few
+// bytes of the file, as some players do before playback begins.
+func probesPlay(r *http.Request) bool {
+	end, ok := fromStart(r)
+	return ok && end >= 0 && end < playProbeBytes
+}
+
+// fromStart reports whether a request reads a single range from the start
+// of the file, and returns the last byte it asks for, or -1 for all.
+func fromStart(r *http.Request) (int64, bool) {
+	rng := r.Header.Get("Range")
+	if rng == "" {
+		return -1, true
+	}
+	end, ok := strings.CutPrefix(rng, "bytes=0-")
+	if !ok {
+		return 0, false
+	}
+	if end == "" {
+		return -1, true
+	}
+	n, err := strconv.ParseInt(end, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
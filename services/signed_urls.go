@@ -0,0 +1,98 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"DevMaan707/streamer/auth"
+	"DevMaan707/streamer/db"
+	"DevMaan707/streamer/utils"
+)
+
+// MaxSignedURLTTL bounds how long a signed URL can be made to last.
+const MaxSignedURLTTL = 7 * 24 * time.Hour
+
+// SignedVideoURLs are URLs for a video's stream and cover that work
+// without a session or API token, for players that can't send either.
+type SignedVideoURLs struct {
+	URL       string    `json:"url"`
+	CoverURL  string    `json:"cover_url,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// SignVideoURLs signs the stream and cover URLs of a video for user. A zero
+// ttl means the configured default. If ip is set the URLs only work from
+// that address.
+func (s *VideoService) SignVideoURLs(ctx context.Context, id int, user *db.User, ttl time.Duration, ip string) (*SignedVideoURLs, error) {
+	if s.signer == nil {
+		return nil, fmt.Errorf("%w: signed URLs are not enabled on this server", ErrInvalidInput)
+	}
+	if ttl == 0 {
+		ttl = s.signedURLTTL
+	}
+	if ttl < 0 || ttl > MaxSignedURLTTL {
+		return nil, fmt.Errorf("%w: signed URLs can last at most %s", ErrInvalidInput, MaxSignedURLTTL)
+	}
+	video, err := s.GetVideo(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	expires := time.Now().Add(ttl).Truncate(time.Second).UTC()
+	grant := auth.URLGrant{Path: "/videos/" + video.FilePath, UserID: user.ID, IP: ip, Expires: expires}
+	urls := &SignedVideoURLs{URL: s.signer.Sign(grant), ExpiresAt: expires}
+	if video.CoverImage != "" {
+		grant.Path = "/covers/" + video.CoverImage
+		urls.CoverURL = s.signer.Sign(grant)
+	}
+	return urls, nil
+}
+
+// VerifySignedURL verifies the signature of a signed stream or cover
+// request and returns what it grants.
+func (s *VideoService) VerifySignedURL(r *http.Request) (auth.URLGrant, error) {
+	if s.signer == nil {
+		return auth.URLGrant{}, auth.ErrInvalidSignature
+	}
+	return s.signer.Verify(r.URL.Path, r.URL.Query(), utils.ClientIP(r.Context()), time.Now())
+}
+
+// checkSignature verifies the signature of a signed stream or cover
+// request, and that it was signed for the user the request runs as. Other
+// requests were authenticated by a session or API token and pass.
+func (s *VideoService) checkSignature(r *http.Request) error {
+	if !auth.IsSigned(r.URL.Query()) {
+		return nil
+	}
+	grant, err := s.VerifySignedURL(r)
+	if err != nil {
+		return err
+	}
+	if user := CurrentUser(r.Context()); user == nil || user.ID != grant.UserID {
+		return auth.ErrInvalidSignature
+	}
+	return nil
+}
+
+// WithSignedURLUser returns a copy of ctx carrying the user a signed URL
+// was issued to, for requests that have neither a session nor an API
+// token.
+func WithSignedURLUser(ctx context.Context, user *db.User) context.Context {
+	return context.WithValue(ctx, userContextKey{}, user)
+}
+
+// SignedURLUser returns the user a signed URL names, so that their role
+// still decides what the URL may fetch.
+func (s *AuthService) SignedURLUser(ctx context.Context, userID int) (*db.User, error) {
+	user, err := s.users.GetUserByID(ctx, userID)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, ErrUnauthenticated
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up user: %w", err)
+	}
+	return user, nil
+}
@@ -4,21 +4,42 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/fs"
+	"log/slog"
 	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"DevMaan707/streamer/db"
+	"DevMaan707/streamer/metrics"
+	"DevMaan707/streamer/tracing"
 	"DevMaan707/streamer/utils"
+	"DevMaan707/streamer/vault"
+)
+
+var (
+	uploadSize = metrics.Default.Histogram("starflix_upload_size_bytes",
+		"Size of successfully uploaded videos.",
+		[]float64{1 << 20, 10 << 20, 100 << 20, 500 << 20, 1 << 30, 2 << 30, 5 << 30}).With()
+	uploadDuration = metrics.Default.Histogram("starflix_upload_duration_seconds",
+		"Time taken by successful uploads, from the first byte to the stored file.",
+		[]float64{1, 5, 15, 30, 60, 300, 900, 1800, 3600}).With()
+	uploadFailures = metrics.Default.Counter("starflix_upload_failures_total",
+		"Uploads that were rejected or failed.").With()
 )
 
 type UploadService struct {
+	videos        db.VideoRepository
+	groups        *GroupService
 	uploadDir     string
 	coverDir      string
-	maxUploadSize int64
+	maxUploadSize atomic.Int64
+	keyring       *vault.Keyring
 }
 
 type UploadMetadata struct {
@@ -28,13 +49,98 @@ type UploadMetadata struct {
 	ReleaseYear int    `json:"release_year"`
 }
 
-func NewUploadService(uploadDir string, coverDir string, maxUploadSize int64) *UploadService {
-	return &UploadService{
-		uploadDir:     uploadDir,
-		coverDir:      coverDir,
-		maxUploadSize: maxUploadSize,
+func NewUploadService(videos db.VideoRepository, groups *GroupService, uploadDir string, coverDir string, maxUploadSize int64, keyring *vault.Keyring) *UploadService {
+	s := &UploadService{
+		videos:    videos,
+		groups:    groups,
+		uploadDir: uploadDir,
+		coverDir:  coverDir,
+		keyring:   keyring,
+	}
+	s.maxUploadSize.Store(maxUploadSize)
+	return s
+}
+
+// SetMaxUploadSize changes the upload limit for requests that start after
+// the call.
+func (s *UploadService) SetMaxUploadSize(maxUploadSize int64) {
+	s.maxUploadSize.Store(maxUploadSize)
+}
+
+// writeFile copies src into dst, encrypting it when a keyring is configured.
+func (s *UploadService) writeFile(dst io.Writer, src io.Reader) (int64, error) {
+	if s.keyring != nil {
+		w, err := s.keyring.NewWriter(dst)
+		if err != nil {
+			return 0, err
+		}
+		dst = w
+	}
+	return io.Copy(dst, src)
+}
+
+// saveUnique writes src, encrypted when a keyring is configured, to a new
+// file in dir called name, or name with a number added if a file of that
+// name exists already, and returns the name it got. The data goes to a
+// hidden temporary file that is renamed into place once complete, so the
+// re-encryptor never picks up a partly written upload; the name itself is
+// held by an empty file meanwhile.
+func (s *UploadService) saveUnique(dir, name string, src io.Reader) (string, int64, error) {
+	placeholder, name, err := createUnique(dir, name)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create file: %w", err)
+	}
+	placeholder.Close()
+	path := filepath.Join(dir, name)
+
+	tmp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		os.Remove(path)
+		return "", 0, fmt.Errorf("failed to create file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	written, err := s.writeFile(tmp, src)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", 0, fmt.Errorf("failed to save file: %w", err)
+	}
+	return name, written, nil
+}
+
+// createUnique creates a new file in dir called name, or name with a
+// number added if a file of that name exists already, and returns it
+// along with the name it got. Existing files are never overwritten.
+func createUnique(dir, name string) (*os.File, string, error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 0; ; i++ {
+		candidate := name
+		if i > 0 {
+			candidate = fmt.Sprintf("%s-%d%s", base, i, ext)
+		}
+		f, err := os.OpenFile(filepath.Join(dir, candidate), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			return f, candidate, nil
+		}
+		if !errors.Is(err, fs.ErrExist) || i == maxUniqueNames {
+			return nil, "", err
+		}
 	}
 }
+
+// maxUniqueNames is how many numbered names createUnique tries.
+const maxUniqueNames = 1000
+
 func checkDirPermissions(dir string) error {
 	info, err := os.Stat(dir)
 	if err != nil {
@@ -54,47 +160,75 @@ func checkDirPermissions(dir string) error {
 	return nil
 }
 
-func (s *UploadService) HandleUpload(r *http.Request) (string, error) {
-	log.Println("Starting file upload handling")
-	log.Printf("Content-Length: %d", r.ContentLength)
-	log.Printf("Transfer-Encoding: %v", r.TransferEncoding)
-	log.Printf("X-Forwarded-For: %v", r.Header.Get("X-Forwarded-For"))
+// CheckStorage verifies that uploads can be written to the video and cover
+// directories.
+func (s *UploadService) CheckStorage() error {
+	for _, dir := range []string{s.uploadDir, s.coverDir} {
+		if err := checkDirPermissions(dir); err != nil {
+			return fmt.Errorf("%s: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+func (s *UploadService) HandleUpload(r *http.Request) (savedName string, err error) {
+	start := time.Now()
+	ctx, span := tracing.Start(r.Context(), "UploadService.HandleUpload")
+	var size int64
+	defer func() {
+		span.SetAttributes(slog.Int64("upload.size", size))
+		span.RecordError(err)
+		span.End()
+		if err != nil {
+			uploadFailures.Inc()
+			return
+		}
+		uploadSize.Observe(float64(size))
+		uploadDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	slog.DebugContext(ctx, "Starting file upload handling",
+		"content_length", r.ContentLength,
+		"transfer_encoding", r.TransferEncoding,
+		"client_ip", utils.ClientIP(ctx))
 	maxMemory := int64(32 << 20)
 	if err := r.ParseMultipartForm(maxMemory); err != nil {
-		log.Printf("Failed to parse form: %v", err)
 		return "", fmt.Errorf("failed to parse form: %w", err)
 	}
 	file, header, err := r.FormFile("file")
 	if err != nil {
-		log.Printf("Failed to get file: %v", err)
 		return "", fmt.Errorf("failed to get file: %w", err)
 	}
 	defer file.Close()
-	log.Printf("Received file: %s, size: %d bytes", header.Filename, header.Size)
-	if header.Size > s.maxUploadSize {
-		return "", fmt.Errorf("file too large (max %d bytes)", s.maxUploadSize)
+	slog.DebugContext(ctx, "Received file", "filename", header.Filename, "size", header.Size)
+	if maxUploadSize := s.maxUploadSize.Load(); header.Size > maxUploadSize {
+		return "", fmt.Errorf("file too large (max %d bytes)", maxUploadSize)
 	}
 	filename := header.Filename
 	if !utils.IsVideoFile(filename) {
 		return "", errors.New("only video files are allowed")
 	}
-
-	safeName := utils.SafeFilename(header.Filename)
-	filePath := filepath.Join(s.uploadDir, safeName)
-	dst, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	// The visibility form field overrides the uploader's preferred one.
+	user := CurrentUser(ctx)
+	var groupID int
+	if idStr := r.FormValue("group_id"); idStr != "" {
+		if groupID, err = strconv.Atoi(idStr); err != nil {
+			return "", fmt.Errorf("%w: invalid group_id", ErrInvalidInput)
+		}
+	}
+	visibility, groupID, err := s.groups.UploadVisibility(ctx, user, r.FormValue("visibility"), groupID)
 	if err != nil {
-		log.Printf("Failed to create file: %v", err)
-		return "", fmt.Errorf("failed to create file: %w", err)
+		return "", err
 	}
-	defer dst.Close()
-	written, err := io.Copy(dst, file)
+
+	safeName, written, err := s.saveUnique(s.uploadDir, utils.SafeFilename(header.Filename), utils.ContextReader(r.Context(), file))
 	if err != nil {
-		log.Printf("Failed to save file: %v", err)
-		os.Remove(filePath)
-		return "", fmt.Errorf("failed to save file: %w", err)
+		return "", err
 	}
+	filePath := filepath.Join(s.uploadDir, safeName)
 
-	log.Printf("Successfully wrote %d bytes to %s", written, filePath)
+	slog.DebugContext(ctx, "Wrote uploaded file", "path", filePath, "bytes", written)
+	size = written
 	title := r.FormValue("title")
 	if title == "" {
 		title = strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
@@ -111,23 +245,27 @@ func (s *UploadService) HandleUpload(r *http.Request) (string, error) {
 	if err == nil && coverFile != nil {
 		defer coverFile.Close()
 		if utils.IsImageFile(coverHeader.Filename) {
-			coverFilename := "cover_" + utils.SafeFilename(filename) + filepath.Ext(coverHeader.Filename)
-			coverFullPath := filepath.Join(s.coverDir, coverFilename)
-
-			coverDst, err := os.Create(coverFullPath)
+			coverFilename, _, err := s.saveUnique(s.coverDir, "cover_"+safeName+filepath.Ext(coverHeader.Filename), utils.ContextReader(r.Context(), coverFile))
 			if err == nil {
-				defer coverDst.Close()
-				_, err = io.Copy(coverDst, coverFile)
-				if err == nil {
-					coverPath = coverFilename
-				} else {
-					log.Printf("Failed to save cover image: %v", err)
-				}
+				coverPath = coverFilename
 			} else {
-				log.Printf("Failed to create cover image file: %v", err)
+				slog.WarnContext(ctx, "Failed to save cover image", "error", err)
 			}
 		}
 	}
+	// Files are never left behind without a database entry.
+	removeFiles := func() {
+		os.Remove(filePath)
+		if coverPath != "" {
+			os.Remove(filepath.Join(s.coverDir, coverPath))
+		}
+	}
+	if err := r.Context().Err(); err != nil {
+		// The upload was cancelled, e.g. by a shutdown that ran out of
+		// time.
+		removeFiles()
+		return "", fmt.Errorf("upload cancelled: %w", err)
+	}
 	video := &db.Video{
 		Filename:    filepath.Base(safeName),
 		Title:       title,
@@ -137,11 +275,14 @@ func (s *UploadService) HandleUpload(r *http.Request) (string, error) {
 		CoverImage:  coverPath,
 		FilePath:    safeName,
 		FileSize:    header.Size,
+		OwnerID:     user.ID,
+		Visibility:  visibility,
+		GroupID:     groupID,
 	}
 
-	err = db.InsertVideo(video)
-	if err != nil {
-		log.Printf("Warning: Failed to store video metadata: %v", err)
+	if err := s.videos.InsertVideo(ctx, video); err != nil {
+		removeFiles()
+		return "", fmt.Errorf("failed to store video metadata: %w", err)
 	}
 
 	return safeName, nil
@@ -151,17 +292,9 @@ func (s *UploadService) SaveCoverImage(file multipart.File, header *multipart.Fi
 		return "", errors.New("only image files are allowed for covers")
 	}
 	ext := filepath.Ext(header.Filename)
-	safeName := "cover_" + utils.SafeFilename(baseName) + ext
-	filePath := filepath.Join(s.coverDir, safeName)
-	dst, err := os.Create(filePath)
+	safeName, _, err := s.saveUnique(s.coverDir, "cover_"+utils.SafeFilename(baseName)+ext, file)
 	if err != nil {
-		return "", fmt.Errorf("failed to create destination file: %w", err)
+		return "", err
 	}
-	defer dst.Close()
-	_, err = io.Copy(dst, file)
-	if err != nil {
-		return "", fmt.Errorf("failed to save file: %w", err)
-	}
-
 	return safeName, nil
 }
@@ -0,0 +1,94 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"DevMaan707/streamer/vault"
+)
+
+// TestSaveUniqueDuringReencryption checks that the re-encryptor, woken
+// while an upload is being written, leaves the upload alone.
+func TestSaveUniqueDuringReencryption(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	if err := vault.CreateKeyFile(keyFile); err != nil {
+		t.Fatalf("CreateKeyFile: %v", err)
+	}
+	k, err := vault.LoadKeyring(keyFile)
+	if err != nil {
+		t.Fatalf("LoadKeyring: %v", err)
+	}
+	s := &UploadService{keyring: k}
+
+	// A finished upload, so the re-encryptor has something to do.
+	if _, _, err := s.saveUnique(dir, "old.mp4", bytes.NewReader([]byte("old video"))); err != nil {
+		t.Fatalf("saveUnique: %v", err)
+	}
+
+	content := bytes.Repeat([]byte("frame"), 1<<18)
+	half := len(content) / 2
+	pr, pw := io.Pipe()
+	type result struct {
+		name string
+		err  error
+	}
+	saved := make(chan result, 1)
+	go func() {
+		name, _, err := s.saveUnique(dir, "movie.mp4", pr)
+		saved <- result{name, err}
+	}()
+	if _, err := pw.Write(content[:half]); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := k.Rotate()
+	if err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	r := vault.NewReencryptor(k, dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+	deadline := time.Now().Add(5 * time.Second)
+	for p := r.Progress(); p.KeyID != id || p.FinishedAt == nil; p = r.Progress() {
+		if time.Now().After(deadline) {
+			t.Fatalf("re-encryption didn't finish: %+v", p)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if p := r.Progress(); p.Files != 1 || p.Done != 1 {
+		t.Errorf("got progress %+v, want only the finished upload re-encrypted", p)
+	}
+
+	if _, err := pw.Write(content[half:]); err != nil {
+		t.Fatal(err)
+	}
+	pw.Close()
+	res := <-saved
+	if res.err != nil || res.name != "movie.mp4" {
+		t.Fatalf("saveUnique: got %q, %v", res.name, res.err)
+	}
+
+	f, err := os.Open(filepath.Join(dir, res.name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	vr, err := k.NewReader(f)
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	got, err := io.ReadAll(vr)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("got %d bytes, %v; want the whole upload", len(got), err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("got %d files, want the two uploads; temporary files were left behind", len(entries))
+	}
+}
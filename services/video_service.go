@@ -1,8 +1,11 @@
 package services
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -10,35 +13,65 @@ import (
 	"strings"
 	"time"
 
+	"DevMaan707/streamer/auth"
 	"DevMaan707/streamer/db"
+	"DevMaan707/streamer/metrics"
+	"DevMaan707/streamer/tracing"
 	"DevMaan707/streamer/utils"
+	"DevMaan707/streamer/vault"
+)
+
+var (
+	activeStreams = metrics.Default.Gauge("starflix_active_streams",
+		"Video streams currently being served.").With()
+	streamedBytes = metrics.Default.Counter("starflix_streamed_bytes_total",
+		"Bytes of video sent to clients, by video file.", "video")
 )
 
 type VideoService struct {
+	videos     db.VideoRepository
+	genres     db.GenreRepository
+	groups     *GroupService
 	videoDir   string
 	coverDir   string
+	keyring    *vault.Keyring
 	lastUpdate time.Time
+	// signer is nil when signed URLs are disabled.
+	signer       *auth.URLSigner
+	signedURLTTL time.Duration
 }
 
-func NewVideoService(videoDir string, coverDir string) (*VideoService, error) {
+func NewVideoService(videos db.VideoRepository, genres db.GenreRepository, groups *GroupService, videoDir string, coverDir string, keyring *vault.Keyring, signer *auth.URLSigner, signedURLTTL time.Duration) (*VideoService, error) {
 	svc := &VideoService{
-		videoDir: videoDir,
-		coverDir: coverDir,
+		videos:       videos,
+		genres:       genres,
+		groups:       groups,
+		videoDir:     videoDir,
+		coverDir:     coverDir,
+		keyring:      keyring,
+		signer:       signer,
+		signedURLTTL: signedURLTTL,
 	}
 
 	return svc, nil
 }
 
-func (s *VideoService) ListVideos() ([]db.Video, error) {
-	videos, err := db.GetAllVideos()
+func (s *VideoService) ListVideos(ctx context.Context) ([]db.Video, error) {
+	ctx, span := tracing.Start(ctx, "VideoService.ListVideos")
+	defer span.End()
+
+	videos, err := s.videos.GetAllVideos(ctx, s.groups.Access(CurrentUser(ctx)))
 	if err != nil {
 		return nil, fmt.Errorf("failed to retrieve videos: %w", err)
 	}
 
 	return videos, nil
 }
-func (s *VideoService) ListVideosByGenre(genre string) ([]db.Video, error) {
-	videos, err := db.GetVideosByGenre(genre)
+func (s *VideoService) ListVideosByGenre(ctx context.Context, genre string) ([]db.Video, error) {
+	ctx, span := tracing.Start(ctx, "VideoService.ListVideosByGenre", slog.String("genre", genre))
+	defer span.End()
+
+	videos, err := s.videos.GetVideosByGenre(ctx, genre, s.groups.Access(CurrentUser(ctx)))
 	if err != nil {
 		return nil, fmt.Errorf("failed to retrieve videos: %w", err)
 	}
@@ -46,15 +79,99 @@ func (s *VideoService) ListVideosByGenre(genre string) ([]db.Video, error) {
 	return videos, nil
 }
 
-func (s *VideoService) GetGenres() ([]db.Genre, error) {
-	genres, err := db.GetAllGenres()
+func (s *VideoService) SearchVideos(ctx context.Context, term string) ([]db.Video, error) {
+	ctx, span := tracing.Start(ctx, "VideoService.SearchVideos")
+	defer span.End()
+
+	videos, err := s.videos.SearchVideos(ctx, term, s.groups.Access(CurrentUser(ctx)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to search videos: %w", err)
+	}
+
+	return videos, nil
+}
+
+func (s *VideoService) GetGenres(ctx context.Context) ([]db.Genre, error) {
+	ctx, span := tracing.Start(ctx, "VideoService.GetGenres")
+	defer span.End()
+
+	genres, err := s.genres.GetAllGenres(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to retrieve genres: %w", err)
 	}
 
 	return genres, nil
 }
+
+// LibraryStats summarises the video library.
+type LibraryStats struct {
+	Videos    int   `json:"videos"`
+	Genres    int   `json:"genres"`
+	TotalSize int64 `json:"total_size"`
+}
+
+func (s *VideoService) LibraryStats(ctx context.Context) (LibraryStats, error) {
+	ctx, span := tracing.Start(ctx, "VideoService.LibraryStats")
+	defer span.End()
+
+	videos, err := s.videos.GetAllVideos(ctx, db.VideoAccess{All: true})
+	if err != nil {
+		return LibraryStats{}, fmt.Errorf("failed to retrieve videos: %w", err)
+	}
+	genres, err := s.genres.GetAllGenres(ctx)
+	if err != nil {
+		return LibraryStats{}, fmt.Errorf("failed to retrieve genres: %w", err)
+	}
+	stats := LibraryStats{Videos: len(videos), Genres: len(genres)}
+	for _, v := range videos {
+		stats.TotalSize += v.FileSize
+	}
+	return stats, nil
+}
+
+// StreamVideo streams the video stored in the file at path, if the user
+// may watch it.
 func (s *VideoService) StreamVideo(w http.ResponseWriter, r *http.Request, path string) error {
+	ctx, span := tracing.Start(r.Context(), "VideoService.StreamVideo", slog.String("video", path))
+	defer span.End()
+
+	if err := s.checkSignature(r); err != nil {
+		return err
+	}
+	if err := s.checkFileAccess(ctx, s.videos.GetVideoByFile, path, false); err != nil {
+		return err
+	}
+	return s.streamFile(w, r, path)
+}
+
+// checkFileAccess checks that the current user may see the video a stream
+// or cover file belongs to, looked up with lookup. Files that belong to no
+// video are served to everyone if public is set, as the default covers
+// are, and otherwise only to admins; a video file without a database entry
+// may be what's left of a failed private upload.
+func (s *VideoService) checkFileAccess(ctx context.Context, lookup func(context.Context, string) (*db.Video, error), path string, public bool) error {
+	video, err := lookup(ctx, filepath.ToSlash(filepath.Clean(path)))
+	if errors.Is(err, db.ErrNotFound) {
+		if public || isAdmin(CurrentUser(ctx)) {
+			return nil
+		}
+		return utils.ErrNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to look up video: %w", err)
+	}
+	ok, err := s.groups.CanView(ctx, CurrentUser(ctx), video)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return utils.ErrNotFound
+	}
+	return nil
+}
+
+// streamFile streams a video file without checking access.
+func (s *VideoService) streamFile(w http.ResponseWriter, r *http.Request, path string) error {
 	fullPath := filepath.Join(s.videoDir, filepath.Clean(path))
 	if !strings.HasPrefix(fullPath, s.videoDir) {
 		return utils.ErrInvalidPath
@@ -67,10 +184,13 @@ func (s *VideoService) StreamVideo(w http.ResponseWriter, r *http.Request, path
 		return err
 	}
 	defer file.Close()
-	fileInfo, err := file.Stat()
+	content, fileSize, err := s.openContent(file)
 	if err != nil {
 		return err
 	}
+	activeStreams.Inc()
+	defer activeStreams.Dec()
+	out := &countingWriter{w: w, counter: streamedBytes.With(filepath.Base(fullPath))}
 	contentType := utils.GetContentType(fullPath)
 	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"%s\"", filepath.Base(fullPath)))
 	w.Header().Set("Content-Type", contentType)
@@ -81,7 +201,6 @@ func (s *VideoService) StreamVideo(w http.ResponseWriter, r *http.Request, path
 		w.Header().Set("Expires", "0")
 	}
 
-	fileSize := fileInfo.Size()
 	rangeHeader := r.Header.Get("Range")
 	if rangeHeader != "" {
 		ranges, err := utils.ParseRangeHeader(rangeHeader, fileSize)
@@ -94,28 +213,74 @@ func (s *VideoService) StreamVideo(w http.ResponseWriter, r *http.Request, path
 			w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
 			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, fileSize))
 			w.WriteHeader(http.StatusPartialContent)
-			if _, err := file.Seek(start, 0); err != nil {
+			if _, err := content.Seek(start, 0); err != nil {
 				return err
 			}
-			_, err = utils.CopyN(w, file, end-start+1)
+			_, err = utils.CopyN(out, utils.ContextReader(r.Context(), content), end-start+1)
 			return err
 		}
 	}
 	w.Header().Set("Content-Length", strconv.FormatInt(fileSize, 10))
-	_, err = io.Copy(w, file)
+	_, err = io.Copy(out, utils.ContextReader(r.Context(), content))
 	return err
 }
 
+// countingWriter adds the bytes written through it to a counter as they go,
+// so long streams show up in the metrics while they are running.
+type countingWriter struct {
+	w       io.Writer
+	counter *metrics.Counter
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.counter.Add(float64(n))
+	return n, err
+}
+
+// openContent returns a reader over the plaintext of file and its size,
+// decrypting transparently when the file was stored encrypted.
+func (s *VideoService) openContent(file *os.File) (io.ReadSeeker, int64, error) {
+	if vault.IsEncrypted(file) {
+		if s.keyring == nil {
+			return nil, 0, errors.New("file is encrypted but no encryption key is configured")
+		}
+		r, err := s.keyring.NewReader(file)
+		if err != nil {
+			return nil, 0, err
+		}
+		return r, r.Size(), nil
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	return file, fileInfo.Size(), nil
+}
+
 func (s *VideoService) GetCoverImagePath(coverFilename string) string {
 	if coverFilename == "" {
 		return ""
 	}
 	return filepath.Join(s.coverDir, coverFilename)
 }
+
+// ServeCoverImage serves a cover image, if the user may see its video.
 func (s *VideoService) ServeCoverImage(w http.ResponseWriter, r *http.Request, filename string) error {
 	if filename == "" {
 		return utils.ErrNotFound
 	}
+	if err := s.checkSignature(r); err != nil {
+		return err
+	}
+	if err := s.checkFileAccess(r.Context(), s.videos.GetVideoByCover, filename, true); err != nil {
+		return err
+	}
+	return s.serveCover(w, r, filename)
+}
+
+// serveCover serves a cover image without checking access.
+func (s *VideoService) serveCover(w http.ResponseWriter, r *http.Request, filename string) error {
 	fullPath := filepath.Join(s.coverDir, filepath.Clean(filename))
 	if !strings.HasPrefix(fullPath, s.coverDir) {
 		return utils.ErrInvalidPath
@@ -133,6 +298,167 @@ func (s *VideoService) ServeCoverImage(w http.ResponseWriter, r *http.Request, f
 	}
 
 	w.Header().Set("Content-Type", contentType)
-	http.ServeFile(w, r, fullPath)
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if !vault.IsEncrypted(file) {
+		http.ServeFile(w, r, fullPath)
+		return nil
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	content, _, err := s.openContent(file)
+	if err != nil {
+		return err
+	}
+	http.ServeContent(w, r, filepath.Base(fullPath), fileInfo.ModTime(), content)
 	return nil
 }
+
+// GetVideo returns a video the current user may see. Videos they may not
+// see are reported as not found, so their existence isn't revealed.
+func (s *VideoService) GetVideo(ctx context.Context, id int) (*db.Video, error) {
+	ctx, span := tracing.Start(ctx, "VideoService.GetVideo", slog.Int("video.id", id))
+	defer span.End()
+
+	video, err := s.videos.GetVideo(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := s.groups.CanView(ctx, CurrentUser(ctx), video)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, db.ErrNotFound
+	}
+	return video, nil
+}
+
+// ownVideo returns a video the current user owns, or any video they may
+// see if their role grants perm on every video. Others get ErrForbidden,
+// explained by what they can't do.
+func (s *VideoService) ownVideo(ctx context.Context, id int, perm auth.Permission, action string) (*db.Video, error) {
+	video, err := s.GetVideo(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	user := CurrentUser(ctx)
+	if video.OwnerID != user.ID && !auth.Role(user.Role).Can(perm) {
+		return nil, fmt.Errorf("%w: only the owner can %s a video", ErrForbidden, action)
+	}
+	return video, nil
+}
+
+// SetVisibility changes who can see a video. Only its owner and admins
+// may.
+func (s *VideoService) SetVisibility(ctx context.Context, id int, visibility string, groupID int) (*db.Video, error) {
+	ctx, span := tracing.Start(ctx, "VideoService.SetVisibility", slog.Int("video.id", id))
+	defer span.End()
+
+	video, err := s.ownVideo(ctx, id, auth.PermAdmin, "change who sees")
+	if err != nil {
+		return nil, err
+	}
+	user := CurrentUser(ctx)
+	if err := s.groups.CheckVisibility(ctx, user, visibility, groupID); err != nil {
+		return nil, err
+	}
+	if err := s.videos.SetVideoVisibility(ctx, id, visibility, groupID); err != nil {
+		return nil, fmt.Errorf("failed to change visibility: %w", err)
+	}
+	video.Visibility = visibility
+	video.GroupID = 0
+	if visibility == db.VisibilityGroup {
+		video.GroupID = groupID
+	}
+	return video, nil
+}
+
+// VideoUpdate is the editable metadata of a video.
+type VideoUpdate struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Genre       string `json:"genre"`
+	ReleaseYear int    `json:"release_year"`
+}
+
+// UpdateVideo replaces a video's metadata and returns the updated video.
+// Its owner and users allowed to edit may, on any video they can see.
+func (s *VideoService) UpdateVideo(ctx context.Context, id int, update VideoUpdate) (*db.Video, error) {
+	ctx, span := tracing.Start(ctx, "VideoService.UpdateVideo", slog.Int("video.id", id))
+	defer span.End()
+
+	update.Title = strings.TrimSpace(update.Title)
+	if update.Title == "" {
+		return nil, fmt.Errorf("%w: title is required", ErrInvalidInput)
+	}
+	if update.ReleaseYear < 0 {
+		return nil, fmt.Errorf("%w: invalid release year", ErrInvalidInput)
+	}
+	video, err := s.ownVideo(ctx, id, auth.PermEdit, "edit")
+	if err != nil {
+		return nil, err
+	}
+	video.Title = update.Title
+	video.Description = update.Description
+	video.Genre = update.Genre
+	video.ReleaseYear = update.ReleaseYear
+	if err := s.videos.UpdateVideo(ctx, video); err != nil {
+		return nil, fmt.Errorf("failed to update video: %w", err)
+	}
+	return video, nil
+}
+
+// DeleteVideo removes a video from the library along with its video and
+// cover files, returning what was deleted. Its owner and users allowed to
+// delete may, on any video they can see.
+func (s *VideoService) DeleteVideo(ctx context.Context, id int) (*db.Video, error) {
+	ctx, span := tracing.Start(ctx, "VideoService.DeleteVideo", slog.Int("video.id", id))
+	defer span.End()
+
+	video, err := s.ownVideo(ctx, id, auth.PermDelete, "delete")
+	if err != nil {
+		return nil, err
+	}
+	if err := s.videos.DeleteVideo(ctx, id); err != nil {
+		return nil, fmt.Errorf("failed to delete video: %w", err)
+	}
+	files := []string{filepath.Join(s.videoDir, filepath.Clean("/"+video.FilePath))}
+	if video.CoverImage != "" {
+		files = append(files, filepath.Join(s.coverDir, filepath.Clean("/"+video.CoverImage)))
+	}
+	for _, path := range files {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			slog.WarnContext(ctx, "Failed to remove file of deleted video", "path", path, "error", err)
+		}
+	}
+	return video, nil
+}
+
+func (s *VideoService) CreateGenre(ctx context.Context, name string) (*db.Genre, error) {
+	ctx, span := tracing.Start(ctx, "VideoService.CreateGenre")
+	defer span.End()
+
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 100 {
+		return nil, fmt.Errorf("%w: genre names are 1-100 characters", ErrInvalidInput)
+	}
+	genre := &db.Genre{Name: name}
+	if err := s.genres.CreateGenre(ctx, genre); err != nil {
+		return nil, err
+	}
+	return genre, nil
+}
+
+// DeleteGenre removes a genre. Videos keep the genre name they were given.
+func (s *VideoService) DeleteGenre(ctx context.Context, id int) error {
+	ctx, span := tracing.Start(ctx, "VideoService.DeleteGenre")
+	defer span.End()
+
+	return s.genres.DeleteGenre(ctx, id)
+}
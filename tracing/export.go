@@ -0,0 +1,278 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"DevMaan707/streamer/config"
+)
+
+const (
+	// queueSize bounds the spans waiting for export; more are dropped
+	// rather than slowing down requests.
+	queueSize     = 2048
+	maxBatchSize  = 512
+	batchInterval = 5 * time.Second
+	exportTimeout = 10 * time.Second
+)
+
+// exporter sends finished spans somewhere.
+type exporter interface {
+	exportSpans(ctx context.Context, spans []*Span) error
+}
+
+// tracer batches finished spans for its exporter. The zero tracer, used
+// until Setup is called, samples and exports nothing.
+type tracer struct {
+	exporter exporter
+	ratio    float64
+
+	mu      sync.RWMutex
+	closed  bool
+	queue   chan *Span
+	done    chan struct{}
+	dropped atomic.Int64
+}
+
+var active atomic.Pointer[tracer]
+
+func init() {
+	active.Store(&tracer{})
+}
+
+// Setup starts exporting spans as configured and returns a function that
+// flushes the remaining spans on shutdown.
+func Setup(cfg config.TracingConfig) (shutdown func(context.Context) error, err error) {
+	var exp exporter
+	switch cfg.Exporter {
+	case "none":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exp = &stdoutExporter{w: os.Stdout}
+	case "otlp":
+		exp = &otlpExporter{
+			url:         strings.TrimRight(cfg.Endpoint, "/") + "/v1/traces",
+			serviceName: cfg.ServiceName,
+			client:      &http.Client{Timeout: exportTimeout},
+		}
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", cfg.Exporter)
+	}
+
+	t := &tracer{
+		exporter: exp,
+		ratio:    cfg.SampleRatio,
+		queue:    make(chan *Span, queueSize),
+		done:     make(chan struct{}),
+	}
+	go t.run()
+	active.Store(t)
+	return t.shutdown, nil
+}
+
+func (t *tracer) export(s *Span) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.queue <- s:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+func (t *tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(batchInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+		defer cancel()
+		if err := t.exporter.exportSpans(ctx, batch); err != nil {
+			slog.Warn("Failed to export spans", "spans", len(batch), "error", err)
+		}
+		if dropped := t.dropped.Swap(0); dropped > 0 {
+			slog.Warn("Dropped spans, export queue full", "spans", dropped)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case s, ok := <-t.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) >= maxBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (t *tracer) shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.queue)
+	}
+	t.mu.Unlock()
+	active.Store(&tracer{})
+
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// spanData is a snapshot of a finished span, as encoded by the exporters.
+type spanData struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         SpanKind        `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       *otlpSpanStatus `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+type otlpSpanStatus struct {
+	// Code 2 is STATUS_CODE_ERROR.
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func (s *Span) data() spanData {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := spanData{
+		TraceID: s.sc.TraceID.String(),
+		SpanID:  s.sc.SpanID.String(),
+		Name:    s.name,
+		Kind:    s.kind,
+		Start:   strconv.FormatInt(s.start.UnixNano(), 10),
+		End:     strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+	if s.parent != (SpanID{}) {
+		d.ParentSpanID = s.parent.String()
+	}
+	for _, a := range s.attrs {
+		d.Attributes = append(d.Attributes, otlpAttribute{Key: a.Key, Value: otlpValue(a.Value)})
+	}
+	if s.errorMsg != "" {
+		d.Status = &otlpSpanStatus{Code: 2, Message: s.errorMsg}
+	}
+	return d
+}
+
+// otlpValue converts an attribute value to the OTLP JSON AnyValue form, in
+// which 64-bit integers are strings.
+func otlpValue(v slog.Value) map[string]any {
+	switch v.Kind() {
+	case slog.KindBool:
+		return map[string]any{"boolValue": v.Bool()}
+	case slog.KindInt64:
+		return map[string]any{"intValue": strconv.FormatInt(v.Int64(), 10)}
+	case slog.KindUint64:
+		return map[string]any{"intValue": strconv.FormatUint(v.Uint64(), 10)}
+	case slog.KindFloat64:
+		return map[string]any{"doubleValue": v.Float64()}
+	default:
+		return map[string]any{"stringValue": v.String()}
+	}
+}
+
+// stdoutExporter writes every span as a line of JSON, for development.
+type stdoutExporter struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+func (e *stdoutExporter) exportSpans(_ context.Context, spans []*Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	enc := json.NewEncoder(e.w)
+	for _, s := range spans {
+		if err := enc.Encode(s.data()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// otlpExporter posts spans to an OpenTelemetry collector using OTLP over
+// HTTP with JSON encoding.
+type otlpExporter struct {
+	url         string
+	serviceName string
+	client      *http.Client
+}
+
+func (e *otlpExporter) exportSpans(ctx context.Context, spans []*Span) error {
+	data := make([]spanData, len(spans))
+	for i, s := range spans {
+		data[i] = s.data()
+	}
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": []otlpAttribute{
+					{Key: "service.name", Value: map[string]any{"stringValue": e.serviceName}},
+				},
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "DevMaan707/streamer"},
+				"spans": data,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"DevMaan707/streamer/config"
+)
+
+// collectorRequest is the part of an OTLP/HTTP JSON export request the
+// tests look at.
+type collectorRequest struct {
+	ResourceSpans []struct {
+		Resource struct {
+			Attributes []otlpAttribute `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []struct {
+			Scope struct {
+				Name string `json:"name"`
+			} `json:"scope"`
+			Spans []spanData `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+// collector is an httptest OTLP/HTTP collector that keeps the requests it
+// receives.
+type collector struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []collectorRequest
+	status   int
+}
+
+func newCollector(t *testing.T) *collector {
+	t.Helper()
+	c := &collector{status: http.StatusOK}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" {
+			t.Errorf("collector got %s %s, want POST /v1/traces", r.Method, r.URL.Path)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("collector got Content-Type %q, want application/json", ct)
+		}
+		var req collectorRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("collector: decoding request: %v", err)
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.requests = append(c.requests, req)
+		w.WriteHeader(c.status)
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+// spans returns the spans received so far and the service.name they were
+// reported for.
+func (c *collector) spans(t *testing.T) (string, []spanData) {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var service string
+	var spans []spanData
+	for _, req := range c.requests {
+		for _, rs := range req.ResourceSpans {
+			for _, a := range rs.Resource.Attributes {
+				if a.Key == "service.name" {
+					service, _ = a.Value["stringValue"].(string)
+				}
+			}
+			for _, ss := range rs.ScopeSpans {
+				if ss.Scope.Name != "DevMaan707/streamer" {
+					t.Errorf("got scope %q", ss.Scope.Name)
+				}
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}
+	return service, spans
+}
+
+func attribute(span spanData, key string) map[string]any {
+	for _, a := range span.Attributes {
+		if a.Key == key {
+			return a.Value
+		}
+	}
+	return nil
+}
+
+func TestOTLPExport(t *testing.T) {
+	c := newCollector(t)
+	shutdown, err := Setup(config.TracingConfig{
+		Exporter:    "otlp",
+		Endpoint:    c.URL + "/",
+		SampleRatio: 1,
+		ServiceName: "streamer-test",
+	})
+	if err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+
+	before := time.Now()
+	ctx, parent := StartKind(context.Background(), "GET /api/videos", KindServer,
+		slog.Int("http.status_code", 200))
+	_, child := Start(ctx, "VideoService.ListVideos", slog.Bool("cached", false))
+	child.SetAttributes(slog.String("video.genre", "Drama"), slog.Float64("ratio", 0.5))
+	child.RecordError(errors.New("database is locked"))
+	child.End()
+	parent.End()
+	parent.End()
+
+	// Shutdown flushes the batch without waiting for the interval.
+	sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdown(sctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	service, spans := c.spans(t)
+	if service != "streamer-test" {
+		t.Errorf("got service.name %q, want streamer-test", service)
+	}
+	if len(spans) != 2 {
+		t.Fatalf("collector got %d spans, want 2: %+v", len(spans), spans)
+	}
+	byName := map[string]spanData{}
+	for _, s := range spans {
+		byName[s.Name] = s
+	}
+	p, ch := byName["GET /api/videos"], byName["VideoService.ListVideos"]
+
+	if p.TraceID != parent.Context().TraceID.String() || p.SpanID != parent.Context().SpanID.String() {
+		t.Errorf("parent span has IDs %s/%s, want %s/%s", p.TraceID, p.SpanID,
+			parent.Context().TraceID, parent.Context().SpanID)
+	}
+	if p.ParentSpanID != "" || p.Kind != KindServer || p.Status != nil {
+		t.Errorf("got parent span %+v", p)
+	}
+	if ch.TraceID != p.TraceID || ch.ParentSpanID != p.SpanID || ch.Kind != KindInternal {
+		t.Errorf("child span %+v isn't a child of %s in trace %s", ch, p.SpanID, p.TraceID)
+	}
+	if ch.Status == nil || ch.Status.Code != 2 || ch.Status.Message != "database is locked" {
+		t.Errorf("got child status %+v, want an error status", ch.Status)
+	}
+
+	// 64-bit integers are strings in OTLP JSON.
+	if v := attribute(p, "http.status_code"); v["intValue"] != "200" {
+		t.Errorf("got http.status_code %v, want intValue \"200\"", v)
+	}
+	if v := attribute(ch, "cached"); v["boolValue"] != false {
+		t.Errorf("got cached %v, want boolValue false", v)
+	}
+	if v := attribute(ch, "video.genre"); v["stringValue"] != "Drama" {
+		t.Errorf("got video.genre %v, want stringValue Drama", v)
+	}
+	if v := attribute(ch, "ratio"); v["doubleValue"] != 0.5 {
+		t.Errorf("got ratio %v, want doubleValue 0.5", v)
+	}
+
+	for _, s := range spans {
+		start, err1 := strconv.ParseInt(s.Start, 10, 64)
+		end, err2 := strconv.ParseInt(s.End, 10, 64)
+		if err1 != nil || err2 != nil || start < before.UnixNano() || end < start {
+			t.Errorf("%s: got times %s to %s, want nanoseconds after %d", s.Name, s.Start, s.End, before.UnixNano())
+		}
+	}
+
+	// Spans ended after shutdown go nowhere.
+	_, late := Start(context.Background(), "late")
+	late.End()
+	if _, spans := c.spans(t); len(spans) != 2 {
+		t.Errorf("got %d spans after shutdown, want 2", len(spans))
+	}
+}
+
+func TestOTLPExportFailure(t *testing.T) {
+	c := newCollector(t)
+	c.status = http.StatusServiceUnavailable
+	e := &otlpExporter{url: c.URL + "/v1/traces", serviceName: "streamer-test", client: c.Client()}
+
+	tr := &tracer{exporter: e, ratio: 1}
+	span := &Span{name: "span", kind: KindInternal, start: time.Now(), end: time.Now(), tracer: tr}
+	if err := e.exportSpans(context.Background(), []*Span{span}); err == nil {
+		t.Error("exportSpans succeeded although the collector answered 503")
+	}
+	if _, spans := c.spans(t); len(spans) != 1 || spans[0].Name != "span" {
+		t.Errorf("collector got %+v, want the span", spans)
+	}
+}
@@ -0,0 +1,191 @@
+// Package tracing records OpenTelemetry-style spans, propagates them with
+// W3C Trace Context headers and exports them to stdout or an OTLP/HTTP
+// collector.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type (
+	TraceID [16]byte
+	SpanID  [8]byte
+)
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// SpanContext identifies a span across process boundaries.
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Sampled    bool
+	TraceState string
+}
+
+// Valid reports whether sc identifies a span at all.
+func (sc SpanContext) Valid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// SpanKind is the role of a span, numbered as in OTLP.
+type SpanKind int
+
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+// Span is one timed operation. Spans that are not sampled still carry
+// their context, so sampling decisions propagate, but record nothing.
+// All methods are safe on a nil *Span.
+type Span struct {
+	sc       SpanContext
+	parent   SpanID
+	name     string
+	kind     SpanKind
+	start    time.Time
+	end      time.Time
+	tracer   *tracer
+	mu       sync.Mutex
+	attrs    []slog.Attr
+	errorMsg string
+	ended    bool
+}
+
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+func (s *Span) recording() bool {
+	return s != nil && s.tracer != nil
+}
+
+// SetName replaces the span name, e.g. once the route of a request is known.
+func (s *Span) SetName(name string) {
+	if !s.recording() {
+		return
+	}
+	s.mu.Lock()
+	s.name = name
+	s.mu.Unlock()
+}
+
+func (s *Span) SetAttributes(attrs ...slog.Attr) {
+	if !s.recording() {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, attrs...)
+	s.mu.Unlock()
+}
+
+// RecordError marks the span as failed with err. A nil err is ignored.
+func (s *Span) RecordError(err error) {
+	if err == nil || !s.recording() {
+		return
+	}
+	s.mu.Lock()
+	s.errorMsg = err.Error()
+	s.mu.Unlock()
+}
+
+// End finishes the span and hands it to the exporter. Calls after the first
+// have no effect.
+func (s *Span) End() {
+	if !s.recording() {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+	s.tracer.export(s)
+}
+
+type spanKey struct{}
+
+// ContextWithSpan returns a context carrying span as the current span.
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// SpanFromContext returns the current span, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+type remoteKey struct{}
+
+// contextWithRemote records a parent span received from another process.
+func contextWithRemote(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// parentContext returns the context of the current span, or of a remote
+// parent if there is no local one.
+func parentContext(ctx context.Context) SpanContext {
+	if span := SpanFromContext(ctx); span != nil {
+		return span.sc
+	}
+	sc, _ := ctx.Value(remoteKey{}).(SpanContext)
+	return sc
+}
+
+// Start begins an internal span as a child of the current span in ctx.
+func Start(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, *Span) {
+	return StartKind(ctx, name, KindInternal, attrs...)
+}
+
+// StartKind begins a span of the given kind. Without a parent, a new trace
+// is started and sampled according to the configured ratio; with one, the
+// parent's sampling decision is kept.
+func StartKind(ctx context.Context, name string, kind SpanKind, attrs ...slog.Attr) (context.Context, *Span) {
+	parent := parentContext(ctx)
+	span := &Span{name: name, kind: kind, start: time.Now(), attrs: attrs}
+	if parent.Valid() {
+		span.sc.TraceID = parent.TraceID
+		span.sc.Sampled = parent.Sampled
+		span.sc.TraceState = parent.TraceState
+		span.parent = parent.SpanID
+	} else {
+		rand.Read(span.sc.TraceID[:])
+		span.sc.Sampled = active.Load().sample(span.sc.TraceID)
+	}
+	rand.Read(span.sc.SpanID[:])
+	if span.sc.Sampled {
+		span.tracer = active.Load()
+		if span.tracer.exporter == nil {
+			span.tracer = nil
+		}
+	}
+	return ContextWithSpan(ctx, span), span
+}
+
+// sample decides on a new trace from the bits of its ID, so the same trace
+// gets the same decision wherever it is made.
+func (t *tracer) sample(id TraceID) bool {
+	if t.ratio >= 1 {
+		return true
+	}
+	if t.ratio <= 0 {
+		return false
+	}
+	x := binary.BigEndian.Uint64(id[8:16]) >> 1
+	return x < uint64(t.ratio*(1<<63))
+}
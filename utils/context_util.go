@@ -0,0 +1,24 @@
+package utils
+
+import (
+	"context"
+	"io"
+)
+
+// ContextReader returns a reader that fails with the context's error once
+// ctx is done, so long copies stop promptly on cancellation.
+func ContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, r: r}
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
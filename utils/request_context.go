@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"context"
+)
+
+type contextKey int
+
+const (
+	clientIPKey contextKey = iota
+	requestIDKey
+)
+
+// WithClientIP returns a context carrying the resolved client IP address.
+func WithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPKey, ip)
+}
+
+// ClientIP returns the client IP address resolved by the server's proxy
+// handling, or "" if none was recorded.
+func ClientIP(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey).(string)
+	return ip
+}
+
+// WithRequestID returns a context carrying the ID of the current request.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns the request ID stored in ctx, or "" outside a request.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
@@ -0,0 +1,191 @@
+package vault
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const keySize = 32
+
+var ErrUnknownKey = errors.New("unknown encryption key")
+
+// Keyring holds the master keys read from the key file. Each line of the
+// file is "<id> <hex key>"; the last key listed is the active one used for
+// new files, older keys are kept so existing files stay readable.
+type Keyring struct {
+	path   string
+	mu     sync.RWMutex
+	keys   map[uint32][]byte
+	active uint32
+}
+
+func LoadKeyring(path string) (*Keyring, error) {
+	k := &Keyring{path: path}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// CreateKeyFile writes a new key file with a single freshly generated key.
+// It refuses to overwrite an existing file.
+func CreateKeyFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create key file: %w", err)
+	}
+	defer f.Close()
+	key, err := newKey()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "1 %s\n", hex.EncodeToString(key))
+	return err
+}
+
+// Reload re-reads the key file. On error the keys in use are kept.
+func (k *Keyring) Reload() error {
+	swap, err := k.Stage()
+	if err != nil {
+		return err
+	}
+	swap()
+	return nil
+}
+
+// Stage re-reads the key file without using the keys yet; they replace the
+// keys in use when the returned function is called. It lets several
+// keyrings be reloaded together, with none changed unless all files read.
+func (k *Keyring) Stage() (func(), error) {
+	f, err := os.Open(k.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open key file: %w", err)
+	}
+	defer f.Close()
+
+	keys := make(map[uint32][]byte)
+	var active uint32
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("key file line %d: expected \"<id> <hex key>\"", lineNo)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil || id == 0 {
+			return nil, fmt.Errorf("key file line %d: invalid key id", lineNo)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil || len(key) != keySize {
+			return nil, fmt.Errorf("key file line %d: key must be %d hex-encoded bytes", lineNo, keySize)
+		}
+		keys[uint32(id)] = key
+		active = uint32(id)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("key file contains no keys")
+	}
+
+	return func() {
+		k.mu.Lock()
+		k.keys = keys
+		k.active = active
+		k.mu.Unlock()
+	}, nil
+}
+
+// Rotate appends a new key to the key file and makes it the active key.
+func (k *Keyring) Rotate() (uint32, error) {
+	key, err := newKey()
+	if err != nil {
+		return 0, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	var next uint32
+	for id := range k.keys {
+		if id > next {
+			next = id
+		}
+	}
+	next++
+
+	f, err := os.OpenFile(k.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open key file: %w", err)
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "%d %s\n", next, hex.EncodeToString(key)); err != nil {
+		return 0, fmt.Errorf("failed to write key file: %w", err)
+	}
+
+	k.keys[next] = key
+	k.active = next
+	return next, nil
+}
+
+func (k *Keyring) ActiveID() uint32 {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.active
+}
+
+// ActiveKey returns the active key and its id, for keyrings used to sign
+// rather than encrypt.
+func (k *Keyring) ActiveKey() (uint32, []byte) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.active, k.keys[k.active]
+}
+
+// Key returns the key with the given id, reloading the key file once if it
+// isn't known.
+func (k *Keyring) Key(id uint32) ([]byte, error) {
+	return k.lookup(id)
+}
+
+// lookup returns the master key with the given id. A miss triggers one
+// reload of the key file so that keys added by a rotation in another
+// process are picked up without a restart.
+func (k *Keyring) lookup(id uint32) ([]byte, error) {
+	k.mu.RLock()
+	key, ok := k.keys[id]
+	k.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if key, ok := k.keys[id]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: %d", ErrUnknownKey, id)
+}
+
+func newKey() ([]byte, error) {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,241 @@
+package vault
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"DevMaan707/streamer/utils"
+)
+
+// Reencryptor rewrites the encrypted files in a set of directories that are
+// not using the active key, in the background and one file at a time, while
+// they keep being served. Files already using the active key are skipped,
+// so a run that was interrupted, e.g. by a restart, resumes where it
+// stopped.
+type Reencryptor struct {
+	keyring *Keyring
+	dirs    []string
+	wake    chan struct{}
+
+	mu       sync.Mutex
+	progress ReencryptProgress
+}
+
+// ReencryptProgress reports how far the latest re-encryption has got.
+type ReencryptProgress struct {
+	// KeyID is the key files are being re-encrypted with.
+	KeyID   uint32 `json:"key_id"`
+	Running bool   `json:"running"`
+	// Files is how many files were found using older keys, and Done and
+	// Failed how many of them have been re-encrypted or couldn't be.
+	Files      int        `json:"files"`
+	Done       int        `json:"done"`
+	Failed     int        `json:"failed"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	LastError  string     `json:"last_error,omitempty"`
+}
+
+func NewReencryptor(keyring *Keyring, dirs ...string) *Reencryptor {
+	return &Reencryptor{keyring: keyring, dirs: dirs, wake: make(chan struct{}, 1)}
+}
+
+// Run re-encrypts the files using older keys, then does so again every
+// time Wake is called, until ctx is cancelled. It blocks, so run it in its
+// own goroutine; once it returns, the file it was working on has been left
+// as it was and its temporary file removed.
+func (r *Reencryptor) Run(ctx context.Context) {
+	for {
+		r.reencrypt(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.wake:
+		}
+	}
+}
+
+// Wake makes Run look for files using older keys again, e.g. after the key
+// file was reloaded with a new active key.
+func (r *Reencryptor) Wake() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Progress returns how far the latest re-encryption has got.
+func (r *Reencryptor) Progress() ReencryptProgress {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.progress
+}
+
+func (r *Reencryptor) update(fn func(p *ReencryptProgress)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn(&r.progress)
+}
+
+func (r *Reencryptor) reencrypt(ctx context.Context) {
+	keyID := r.keyring.ActiveID()
+	var files []string
+	for _, dir := range r.dirs {
+		stale, err := r.keyring.staleFiles(dir)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to look for files to re-encrypt", "dir", dir, "error", err)
+			continue
+		}
+		files = append(files, stale...)
+	}
+	if len(files) == 0 {
+		return
+	}
+
+	started := time.Now()
+	r.update(func(p *ReencryptProgress) {
+		*p = ReencryptProgress{KeyID: keyID, Running: true, Files: len(files), StartedAt: &started}
+	})
+	slog.InfoContext(ctx, "Re-encrypting files with the active key", "key_id", keyID, "files", len(files))
+	for _, path := range files {
+		if ctx.Err() != nil {
+			break
+		}
+		done, err := r.keyring.reencryptFile(ctx, path)
+		if err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "Failed to re-encrypt file", "path", path, "error", err)
+		} else if done {
+			slog.DebugContext(ctx, "Re-encrypted file", "path", path)
+		}
+		r.update(func(p *ReencryptProgress) {
+			switch {
+			case err != nil && ctx.Err() == nil:
+				p.Failed++
+				p.LastError = fmt.Sprintf("%s: %v", filepath.Base(path), err)
+			case err == nil:
+				p.Done++
+			}
+		})
+	}
+
+	finished := time.Now()
+	p := r.Progress()
+	if ctx.Err() != nil {
+		slog.InfoContext(ctx, "Re-encryption interrupted, it resumes at the next start", "done", p.Done, "files", p.Files)
+	} else {
+		slog.InfoContext(ctx, "Re-encryption finished", "key_id", keyID, "done", p.Done, "failed", p.Failed,
+			"duration", finished.Sub(started).Round(time.Second))
+	}
+	r.update(func(p *ReencryptProgress) {
+		p.Running = false
+		p.FinishedAt = &finished
+	})
+}
+
+// staleFiles returns the encrypted files in dir that are not using the
+// active key. Hidden files, such as the temporary files uploads and
+// re-encryption write to, are left alone.
+func (k *Keyring) staleFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory: %w", err)
+	}
+	active := k.ActiveID()
+	var files []string
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		id, ok, err := fileKeyID(path)
+		if err != nil {
+			slog.Warn("Failed to read file to re-encrypt", "path", path, "error", err)
+			continue
+		}
+		if ok && id != active {
+			files = append(files, path)
+		}
+	}
+	return files, nil
+}
+
+// fileKeyID returns the id of the key the file at path is encrypted with,
+// and false if it isn't encrypted.
+func fileKeyID(path string) (uint32, bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+	if !IsEncrypted(f) {
+		return 0, false, nil
+	}
+	id, err := readKeyID(f)
+	return id, err == nil, err
+}
+
+// reencryptFile rewrites the file at path with the active key, unless it
+// uses the active key already. The file is written to a temporary file and
+// renamed into place, so readers that already have the old file open are
+// unaffected.
+func (k *Keyring) reencryptFile(ctx context.Context, path string) (bool, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Deleted since it was found.
+			return false, nil
+		}
+		return false, err
+	}
+	defer src.Close()
+	if !IsEncrypted(src) {
+		return false, nil
+	}
+	r, err := k.NewReader(src)
+	if err != nil {
+		return false, err
+	}
+	if r.KeyID() == k.ActiveID() {
+		return false, nil
+	}
+
+	info, err := src.Stat()
+	if err != nil {
+		return false, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".reencrypt-*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	w, err := k.NewWriter(tmp)
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(w, utils.ContextReader(ctx, r)); err != nil {
+		return false, err
+	}
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		// Deleted while it was being re-encrypted; don't bring it back.
+		return false, nil
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,154 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeEncrypted(t *testing.T, k *Keyring, path string, content []byte) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w, err := k.NewWriter(f)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	if _, err := w.Write(content); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readEncrypted(t *testing.T, k *Keyring, path string) (uint32, []byte) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := k.NewReader(f)
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	content, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r.KeyID(), content
+}
+
+func TestReencryptor(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "keys")
+	if err := CreateKeyFile(keyFile); err != nil {
+		t.Fatalf("CreateKeyFile: %v", err)
+	}
+	k, err := LoadKeyring(keyFile)
+	if err != nil {
+		t.Fatalf("LoadKeyring: %v", err)
+	}
+	videos := filepath.Join(dir, "videos")
+	if err := os.Mkdir(videos, 0755); err != nil {
+		t.Fatal(err)
+	}
+	content := bytes.Repeat([]byte("frame"), 10000)
+	for _, name := range []string{"a.mp4", "b.mp4"} {
+		writeEncrypted(t, k, filepath.Join(videos, name), content)
+	}
+	if err := os.WriteFile(filepath.Join(videos, "plain.mp4"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := k.Rotate()
+	if err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	// A file written after the rotation already uses the new key.
+	writeEncrypted(t, k, filepath.Join(videos, "c.mp4"), content)
+
+	r := NewReencryptor(k, videos)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for p := r.Progress(); p.FinishedAt == nil; p = r.Progress() {
+		if time.Now().After(deadline) {
+			t.Fatalf("re-encryption didn't finish: %+v", p)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	p := r.Progress()
+	if p.KeyID != id || p.Files != 2 || p.Done != 2 || p.Failed != 0 || p.Running {
+		t.Errorf("got progress %+v, want 2 of 2 files done with key %d", p, id)
+	}
+	for _, name := range []string{"a.mp4", "b.mp4", "c.mp4"} {
+		keyID, got := readEncrypted(t, k, filepath.Join(videos, name))
+		if keyID != id || !bytes.Equal(got, content) {
+			t.Errorf("%s: got key %d and %d bytes, want key %d and the original content", name, keyID, len(got), id)
+		}
+	}
+	if got, _ := os.ReadFile(filepath.Join(videos, "plain.mp4")); !bytes.Equal(got, content) {
+		t.Error("unencrypted file was changed")
+	}
+
+	// A new rotation is picked up when woken.
+	next, err := k.Rotate()
+	if err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	r.Wake()
+	deadline = time.Now().Add(5 * time.Second)
+	for p := r.Progress(); p.KeyID != next || p.Running; p = r.Progress() {
+		if time.Now().After(deadline) {
+			t.Fatalf("re-encryption after the second rotation didn't finish: %+v", p)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if p := r.Progress(); p.Files != 3 || p.Done != 3 {
+		t.Errorf("got progress %+v after the second rotation, want 3 of 3 files done", p)
+	}
+}
+
+func TestReencryptFileResumes(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "keys")
+	if err := CreateKeyFile(keyFile); err != nil {
+		t.Fatalf("CreateKeyFile: %v", err)
+	}
+	k, err := LoadKeyring(keyFile)
+	if err != nil {
+		t.Fatalf("LoadKeyring: %v", err)
+	}
+	path := filepath.Join(dir, "a.mp4")
+	writeEncrypted(t, k, path, []byte("content"))
+	if _, err := k.Rotate(); err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+
+	// A cancelled run leaves the file as it was.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if done, err := k.reencryptFile(ctx, path); done || err == nil {
+		t.Fatalf("cancelled reencryptFile: got %v, %v; want an error", done, err)
+	}
+	if stale, err := k.staleFiles(dir); err != nil || len(stale) != 1 {
+		t.Fatalf("staleFiles after cancelling: got %v, %v; want the file", stale, err)
+	}
+	if done, err := k.reencryptFile(context.Background(), path); !done || err != nil {
+		t.Fatalf("reencryptFile: got %v, %v", done, err)
+	}
+	if stale, err := k.staleFiles(dir); err != nil || len(stale) != 0 {
+		t.Errorf("staleFiles after re-encrypting: got %v, %v; want none", stale, err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("got %d files, want the key file and the video; temporary files were left behind", len(entries))
+	}
+}